@@ -15,7 +15,7 @@ func main() {
 
 	var g run.Group
 	g.Add(func() error {
-		return cmd.Execute()
+		return cmd.ExecuteContext(ctx)
 	}, func(err error) {
 		cancel()
 	})
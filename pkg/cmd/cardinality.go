@@ -0,0 +1,380 @@
+package cmd
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/observatorium/api/client"
+	"github.com/observatorium/api/client/parameters"
+	"github.com/observatorium/obsctl/pkg/fetcher"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// cardinalityCurrentWindow is the window at the end of the range in which label values count as current.
+	cardinalityCurrentWindow = 5 * time.Minute
+	// cardinalityConcurrency is the number of label values requests made at once.
+	cardinalityConcurrency  = 8
+	defaultCardinalityMatch = `{__name__=~".+"}`
+)
+
+// cardinalityEntry is a metric name and the number of its series.
+type cardinalityEntry struct {
+	name  string
+	count int
+}
+
+// labelCardinality is the number of values of a label over the whole range and at its end.
+type labelCardinality struct {
+	name    string
+	values  int
+	current int
+}
+
+// churn returns how many times more values the label had over the range than at its end. Labels whose values
+// come and go, like pod names, have a high churn.
+func (l labelCardinality) churn() float64 {
+	if l.current == 0 {
+		return float64(l.values)
+	}
+
+	return float64(l.values) / float64(l.current)
+}
+
+// tsdbHeadStats are the head block statistics of the TSDB status endpoint.
+type tsdbHeadStats struct {
+	NumSeries     int `json:"numSeries"`
+	NumLabelPairs int `json:"numLabelPairs"`
+	ChunkCount    int `json:"chunkCount"`
+}
+
+// cardinalityReport is the cardinality of the series of a tenant.
+type cardinalityReport struct {
+	series  int
+	metrics []cardinalityEntry
+	labels  []labelCardinality
+	// head is nil if the TSDB status isn't available.
+	head *tsdbHeadStats
+}
+
+// seriesPerMetric returns the number of series of every metric name, highest first.
+func seriesPerMetric(series []model.LabelSet) []cardinalityEntry {
+	counts := map[string]int{}
+	for _, s := range series {
+		counts[string(s[model.MetricNameLabel])]++
+	}
+
+	res := make([]cardinalityEntry, 0, len(counts))
+	for name, count := range counts {
+		res = append(res, cardinalityEntry{name: name, count: count})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].count != res[j].count {
+			return res[i].count > res[j].count
+		}
+		return res[i].name < res[j].name
+	})
+
+	return res
+}
+
+// sortLabelsByValues sorts labels by their number of values, highest first.
+func sortLabelsByValues(labels []labelCardinality) {
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].values != labels[j].values {
+			return labels[i].values > labels[j].values
+		}
+		return labels[i].name < labels[j].name
+	})
+}
+
+// highChurnLabels returns the labels with a churn of at least the threshold, highest first.
+func highChurnLabels(labels []labelCardinality, threshold float64) []labelCardinality {
+	var res []labelCardinality
+	for _, l := range labels {
+		if l.churn() >= threshold {
+			res = append(res, l)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].churn() > res[j].churn() })
+
+	return res
+}
+
+// fetchCardinality builds a cardinality report of the series matching the matchers between start and end.
+func fetchCardinality(ctx context.Context, f *client.ClientWithResponses, tenant parameters.Tenant, matchers []string, start, end string) (*cardinalityReport, error) {
+	seriesResp, err := f.GetSeriesWithResponse(ctx, tenant, &client.GetSeriesParams{
+		Match: matchers,
+		Start: (*parameters.StartTS)(&start),
+		End:   (*parameters.EndTS)(&end),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting series: %w", err)
+	}
+	if err := checkStatus(seriesResp.Body, seriesResp.StatusCode()); err != nil {
+		return nil, fmt.Errorf("getting series: %w", err)
+	}
+
+	var series struct {
+		Data []model.LabelSet `json:"data"`
+	}
+	if err := json.Unmarshal(seriesResp.Body, &series); err != nil {
+		return nil, fmt.Errorf("parsing series: %w", err)
+	}
+
+	match := parameters.OptionalSeriesMatcher(matchers)
+	labelsResp, err := f.GetLabelsWithResponse(ctx, tenant, &client.GetLabelsParams{
+		Match: &match,
+		Start: (*parameters.StartTS)(&start),
+		End:   (*parameters.EndTS)(&end),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting labels: %w", err)
+	}
+	names, err := decodeStrings(labelsResp.Body, labelsResp.StatusCode())
+	if err != nil {
+		return nil, fmt.Errorf("getting labels: %w", err)
+	}
+
+	e, err := parseTime(end)
+	if err != nil {
+		return nil, err
+	}
+	currentStart := formatTime(e.Add(-cardinalityCurrentWindow))
+
+	// The number of values of a label over the range and at its end are compared to find labels with a high churn.
+	labels := make([]labelCardinality, len(names))
+	var (
+		wg       sync.WaitGroup
+		mtx      sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, cardinalityConcurrency)
+	)
+	countValues := func(name, start string) (int, error) {
+		resp, err := f.GetLabelValuesWithResponse(ctx, tenant, name, &client.GetLabelValuesParams{
+			Match: &match,
+			Start: (*parameters.StartTS)(&start),
+			End:   (*parameters.EndTS)(&end),
+		})
+		if err != nil {
+			return 0, err
+		}
+		values, err := decodeStrings(resp.Body, resp.StatusCode())
+		return len(values), err
+	}
+	for i, name := range names {
+		labels[i].name = name
+
+		wg.Add(1)
+		go func(l *labelCardinality) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			var err error
+			if l.values, err = countValues(l.name, start); err == nil {
+				l.current, err = countValues(l.name, currentStart)
+			}
+			if err != nil {
+				mtx.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("getting values of label %s: %w", l.name, err)
+				}
+				mtx.Unlock()
+			}
+		}(&labels[i])
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	sortLabelsByValues(labels)
+
+	return &cardinalityReport{
+		series:  len(series.Data),
+		metrics: seriesPerMetric(series.Data),
+		labels:  labels,
+		head:    fetchTSDBHeadStats(ctx, f, tenant),
+	}, nil
+}
+
+// fetchTSDBHeadStats returns the head statistics of the TSDB status endpoint, or nil if it isn't available,
+// which is the case when the tenant is read through a Thanos Querier.
+func fetchTSDBHeadStats(ctx context.Context, f *client.ClientWithResponses, tenant parameters.Tenant) *tsdbHeadStats {
+	resp, body, err := fetcher.Get(ctx, f, "/api/metrics/v1/"+string(tenant)+"/api/v1/status/tsdb", nil)
+	if err == nil {
+		err = checkStatus(body, resp.StatusCode)
+	}
+	if err != nil {
+		level.Debug(logger).Log("msg", "TSDB status not available", "err", err)
+		return nil
+	}
+
+	var status struct {
+		Data struct {
+			HeadStats *tsdbHeadStats `json:"headStats"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		level.Debug(logger).Log("msg", "parsing TSDB status", "err", err)
+		return nil
+	}
+
+	return status.Data.HeadStats
+}
+
+// decodeStrings decodes the data of a labels or label values response.
+func decodeStrings(body []byte, statusCode int) ([]string, error) {
+	if err := checkStatus(body, statusCode); err != nil {
+		return nil, err
+	}
+
+	var res struct {
+		Data []string `json:"data"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, fmt.Errorf("parsing response: %w", err)
+	}
+
+	return res.Data, nil
+}
+
+// topN returns how many of length elements to show for a top n, which is all of them if n is not positive.
+func topN(length, n int) int {
+	if n <= 0 || n > length {
+		return length
+	}
+
+	return n
+}
+
+// printCardinalityTable writes the report as tables of the top metrics, top labels and labels with a high churn.
+func printCardinalityTable(w io.Writer, r *cardinalityReport, top int, churnThreshold float64) error {
+	fmt.Fprintf(w, "Series: %d\n", r.series)
+	if r.head != nil {
+		fmt.Fprintf(w, "TSDB head: %d series, %d label pairs, %d chunks\n", r.head.NumSeries, r.head.NumLabelPairs, r.head.ChunkCount)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nMETRIC\tSERIES\tSHARE")
+	for _, m := range r.metrics[:topN(len(r.metrics), top)] {
+		fmt.Fprintf(tw, "%s\t%d\t%.1f%%\n", m.name, m.count, float64(m.count)/float64(r.series)*100)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(tw, "\nLABEL\tVALUES")
+	for _, l := range r.labels[:topN(len(r.labels), top)] {
+		fmt.Fprintf(tw, "%s\t%d\n", l.name, l.values)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	churn := highChurnLabels(r.labels, churnThreshold)
+	if len(churn) == 0 {
+		_, err := fmt.Fprintf(w, "\nNo labels with a churn of at least %g.\n", churnThreshold)
+		return err
+	}
+
+	fmt.Fprintf(tw, "\nHIGH CHURN LABEL\tVALUES\tCURRENT VALUES\tCHURN\n")
+	for _, l := range churn[:topN(len(churn), top)] {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\n", l.name, l.values, l.current, l.churn())
+	}
+
+	return tw.Flush()
+}
+
+// printCardinalityCSV writes the same rows as printCardinalityTable as CSV, with the kind of row in the first column.
+func printCardinalityCSV(w io.Writer, r *cardinalityReport, top int, churnThreshold float64) error {
+	cw := csv.NewWriter(w)
+	rows := [][]string{{"kind", "name", "count", "current", "churn"}}
+	if r.head != nil {
+		rows = append(rows, []string{"head", "series", strconv.Itoa(r.head.NumSeries), "", ""})
+	}
+	rows = append(rows, []string{"total", "series", strconv.Itoa(r.series), "", ""})
+	for _, m := range r.metrics[:topN(len(r.metrics), top)] {
+		rows = append(rows, []string{"metric", m.name, strconv.Itoa(m.count), "", ""})
+	}
+	for _, l := range r.labels[:topN(len(r.labels), top)] {
+		rows = append(rows, []string{"label", l.name, strconv.Itoa(l.values), strconv.Itoa(l.current), strconv.FormatFloat(l.churn(), 'f', 2, 64)})
+	}
+	churn := highChurnLabels(r.labels, churnThreshold)
+	for _, l := range churn[:topN(len(churn), top)] {
+		rows = append(rows, []string{"churn", l.name, strconv.Itoa(l.values), strconv.Itoa(l.current), strconv.FormatFloat(l.churn(), 'f', 2, 64)})
+	}
+
+	return cw.WriteAll(rows)
+}
+
+func NewMetricsCardinalityCmd(ctx context.Context) *cobra.Command {
+	var (
+		matchers       []string
+		start, end     string
+		since          model.Duration
+		top            int
+		churnThreshold float64
+		output         string
+	)
+	cmd := &cobra.Command{
+		Use:   "cardinality",
+		Short: "Report the cardinality of the series of a tenant.",
+		Long: `Report the cardinality of the series of a tenant: the metrics with the most series, the labels with the most values and
+the labels with a high churn, i.e. which had many more values over the time range than at its end, like pod names. The TSDB head
+statistics are shown too if the TSDB status endpoint is available.`,
+		Example: `obsctl metrics cardinality --since 6h
+obsctl metrics cardinality --match '{namespace="monitoring"}' --top 20 -o csv`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			var printReport func(io.Writer, *cardinalityReport, int, float64) error
+			switch output {
+			case "table":
+				printReport = printCardinalityTable
+			case "csv":
+				printReport = printCardinalityCSV
+			default:
+				return fmt.Errorf("unknown format %s", output)
+			}
+
+			if err := resolveRangeOrLast(&start, &end, since, time.Hour, time.Now()); err != nil {
+				return err
+			}
+
+			f, currentTenant, err := fetcher.NewCustomFetcher(ctx, logger)
+			if err != nil {
+				return fmt.Errorf("custom fetcher: %w", err)
+			}
+
+			r, err := fetchCardinality(ctx, f, currentTenant, matchers, start, end)
+			if err != nil {
+				return err
+			}
+
+			return printReport(cmd.OutOrStdout(), r, top, churnThreshold)
+		},
+	}
+
+	cmd.Flags().StringArrayVarP(&matchers, "match", "m", []string{defaultCardinalityMatch}, "Repeated series selector argument that selects the series to report on.")
+	cmd.Flags().StringVarP(&start, "start", "s", "", "Start timestamp, either absolute (e.g. 2022-10-01 10:00 UTC) or relative (e.g. now-1h). Defaults to an hour before the end.")
+	cmd.Flags().StringVarP(&end, "end", "e", "", "End timestamp, either absolute or relative. Defaults to now.")
+	cmd.Flags().Var(&since, "since", "Shorthand for a start timestamp this long before the end, e.g. 2h.")
+	cmd.Flags().IntVar(&top, "top", 10, "Number of metrics and labels to show in each table, or 0 for all.")
+	cmd.Flags().Float64Var(&churnThreshold, "churn-threshold", 2, "Ratio of label values over the range to values at its end from which labels are reported as having a high churn.")
+	cmd.Flags().StringVarP(&output, "output", "o", "table", "Output format. One of: table|csv")
+
+	return cmd
+}
@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
@@ -16,12 +19,15 @@ import (
 	"github.com/ghodss/yaml"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
-	"github.com/guptarohit/asciigraph"
 	"github.com/observatorium/api/client/models"
+	"github.com/observatorium/obsctl/pkg/config"
+	"github.com/observatorium/obsctl/pkg/fetcher"
+	"github.com/observatorium/obsctl/pkg/telemetry"
 	"github.com/observatorium/obsctl/pkg/version"
 	"github.com/prometheus/common/model"
 	"github.com/spf13/cobra"
-	"github.com/wcharczuk/go-chart/v2"
+	"go.opentelemetry.io/otel"
+	"golang.org/x/term"
 )
 
 const (
@@ -59,24 +65,161 @@ func setupLogger(*cobra.Command, []string) {
 	}
 }
 
+// retryFlags are the retry policy set with global flags.
+var retryFlags fetcher.RetryPolicy
+
+// setupRetries makes the retry flags which were set override the retry policy of every API.
+func setupRetries(cmd *cobra.Command) error {
+	overrides := &config.RetryConfig{}
+	flags := cmd.Flags()
+	if flags.Changed("retry.max") {
+		overrides.MaxRetries = &retryFlags.MaxRetries
+	}
+	if flags.Changed("retry.min-backoff") {
+		overrides.MinBackoff = retryFlags.MinBackoff.String()
+	}
+	if flags.Changed("retry.max-backoff") {
+		overrides.MaxBackoff = retryFlags.MaxBackoff.String()
+	}
+	if flags.Changed("rate-limit.qps") {
+		overrides.RateLimit = &retryFlags.RateLimit
+	}
+	if flags.Changed("rate-limit.burst") {
+		overrides.Burst = &retryFlags.Burst
+	}
+
+	if _, err := fetcher.DefaultRetryPolicy.With(overrides); err != nil {
+		return fmt.Errorf("invalid retry flags: %w", err)
+	}
+	fetcher.RetryOverrides = overrides
+
+	return nil
+}
+
+// debugHTTP and printCurl are whether requests to APIs are dumped with their responses or printed as curl commands.
+var debugHTTP, printCurl bool
+
+// otelOptions are how obsctl traces itself, set with global flags.
+var otelOptions telemetry.Options
+
+// setupTelemetry makes obsctl trace itself if --otel.exporter is set.
+func setupTelemetry() error {
+	otelOptions.Version = version.Version
+	if err := telemetry.Setup(otelOptions); err != nil {
+		return fmt.Errorf("setting up tracing: %w", err)
+	}
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		level.Warn(logger).Log("msg", "failed to export traces", "err", err)
+	}))
+
+	return nil
+}
+
+// traceCommands runs the RunE of a command and of all its subcommands in a span, and exports the spans once it
+// returns.
+func traceCommands(c *cobra.Command) {
+	for _, sub := range c.Commands() {
+		traceCommands(sub)
+	}
+	if c.RunE == nil {
+		return
+	}
+
+	runE := c.RunE
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		ctx, end := telemetry.StartCommand(ctx, cmd.CommandPath())
+		cmd.SetContext(ctx)
+
+		err := runE(cmd, args)
+		end(err)
+
+		if err := telemetry.Shutdown(context.Background()); err != nil {
+			level.Warn(logger).Log("msg", "failed to export traces", "err", err)
+		}
+		return err
+	}
+}
+
+// setupTransport makes requests to APIs be recorded or replayed if OBSCTL_RECORD or OBSCTL_REPLAY is set,
+// written to stderr if --debug-http or --print-curl is set, and traced if --otel.exporter is set.
+func setupTransport() error {
+	cassette, err := fetcher.CassetteFromEnv()
+	if err != nil {
+		return err
+	}
+
+	tracing := otelOptions.Exporter != ""
+	if cassette == nil && !debugHTTP && !printCurl && !tracing {
+		config.WrapTransport = nil
+		return nil
+	}
+
+	config.WrapTransport = func(next http.RoundTripper) http.RoundTripper {
+		if cassette != nil {
+			next = cassette(next)
+		}
+		if debugHTTP || printCurl {
+			next = fetcher.NewDebugTransport(next, os.Stderr, debugHTTP, printCurl)
+		}
+		if tracing {
+			// Requests are traced first, so that their traceparent header is dumped too.
+			next = telemetry.Transport(next)
+		}
+		return next
+	}
+
+	return nil
+}
+
 func NewObsctlCmd(ctx context.Context) *cobra.Command {
 	cmd := &cobra.Command{
-		Use:              "obsctl",
-		Short:            "CLI to interact with Observatorium",
-		Long:             `CLI to interact with Observatorium`,
-		Version:          version.Version,
-		PersistentPreRun: setupLogger,
+		Use:     "obsctl",
+		Short:   "CLI to interact with Observatorium",
+		Long:    `CLI to interact with Observatorium`,
+		Version: version.Version,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			setupLogger(cmd, args)
+			if err := setupTelemetry(); err != nil {
+				return err
+			}
+			if err := setupTransport(); err != nil {
+				return err
+			}
+			return setupRetries(cmd)
+		},
 	}
 
 	cmd.AddCommand(NewMetricsCmd(ctx))
 	cmd.AddCommand(NewContextCommand(ctx))
 	cmd.AddCommand(NewLoginCmd(ctx))
 	cmd.AddCommand(NewLogoutCmd(ctx))
+	cmd.AddCommand(NewWhoamiCmd(ctx))
+	cmd.AddCommand(NewTokenCmd(ctx))
+	cmd.AddCommand(NewDoctorCmd(ctx))
 	cmd.AddCommand(NewTracesCmd(ctx))
 	cmd.AddCommand(NewLogsCmd(ctx))
+	cmd.AddCommand(NewReplCmd(ctx))
+	cmd.AddCommand(NewDashboardCmd(ctx))
+	cmd.AddCommand(NewQueryCmd(ctx))
+	traceCommands(cmd)
 
 	cmd.PersistentFlags().StringVar(&logLevel, "log.level", "info", "Log filtering level.")
 	cmd.PersistentFlags().StringVar(&logFormat, "log.format", logFormatCLILog, "Log format to use.")
+	cmd.PersistentFlags().IntVar(&retryFlags.MaxRetries, "retry.max", fetcher.DefaultRetryPolicy.MaxRetries, "Maximum number of retries of requests failing with 429, 502 or 503 responses or connection errors. Writes are only retried if they weren't processed. Overrides the retry config of the API.")
+	cmd.PersistentFlags().DurationVar(&retryFlags.MinBackoff, "retry.min-backoff", fetcher.DefaultRetryPolicy.MinBackoff, "Backoff before the first retry, doubling with every further retry. Overrides the retry config of the API.")
+	cmd.PersistentFlags().DurationVar(&retryFlags.MaxBackoff, "retry.max-backoff", fetcher.DefaultRetryPolicy.MaxBackoff, "Maximum backoff between retries. Longer waits asked for by Retry-After headers aren't retried. Overrides the retry config of the API.")
+	cmd.PersistentFlags().Float64Var(&retryFlags.RateLimit, "rate-limit.qps", fetcher.DefaultRetryPolicy.RateLimit, "Maximum number of requests per second sent to the API, or 0 for no limit. Overrides the retry config of the API.")
+	cmd.PersistentFlags().IntVar(&retryFlags.Burst, "rate-limit.burst", fetcher.DefaultRetryPolicy.Burst, "Number of requests which can be sent at once above the rate limit. Overrides the retry config of the API.")
+	cmd.PersistentFlags().BoolVar(&debugHTTP, "debug-http", false, "Dump requests to the API and their responses, with headers and bodies, to stderr. Credentials are redacted.")
+	cmd.PersistentFlags().BoolVar(&printCurl, "print-curl", false, "Print a curl command equivalent to every request to the API to stderr, with ${TOKEN} in place of the bearer token.")
+	cmd.PersistentFlags().StringVar(&otelOptions.Exporter, "otel.exporter", "", "Trace obsctl itself, exporting the spans of commands, requests, OIDC discovery and token fetches to stdout, stderr, a file or an OTLP/HTTP endpoint. One of stdout, stderr, file or otlp. The trace context is propagated to the API with traceparent headers.")
+	cmd.PersistentFlags().StringVar(&otelOptions.File, "otel.file", "obsctl-traces.json", "File spans are appended to as JSON lines by the file exporter.")
+	cmd.PersistentFlags().StringVar(&otelOptions.Endpoint, "otel.endpoint", "http://localhost:4318", "URL of the OTLP/HTTP receiver spans are sent to by the otlp exporter.")
+	cmd.PersistentFlags().DurationVar(&config.DiscoveryCacheTTL, "oidc.discovery-cache-ttl", config.DiscoveryCacheTTL, "How long the discovered metadata of OIDC issuers is cached next to the config file before being discovered again, or 0 to always discover it.")
 
 	return cmd
 }
@@ -143,14 +286,14 @@ func handleResponse(body []byte, contentType string, statusCode int, cmd *cobra.
 				return fmt.Errorf("request failed with status code %d pretty printing: %v", statusCode, err)
 			}
 
-			return fmt.Errorf(jsonErr)
+			return errors.New(jsonErr)
 		case "application/yaml":
 			jsonErr, err := prettyPrintYAML(body)
 			if err != nil {
 				return fmt.Errorf("request failed with status code %d pretty printing: %v", statusCode, err)
 			}
 
-			return fmt.Errorf(jsonErr)
+			return errors.New(jsonErr)
 		default:
 			return fmt.Errorf("request failed with status code %d, error: %s", statusCode, string(body))
 		}
@@ -159,7 +302,8 @@ func handleResponse(body []byte, contentType string, statusCode int, cmd *cobra.
 	return fmt.Errorf("request failed with status code %d", statusCode)
 }
 
-func handleGraph(body []byte, graph, query, dir string, w io.Writer) error {
+// decodeQueryResult decodes the result of a metrics query API response into a model.Matrix, model.Vector or *model.Scalar.
+func decodeQueryResult(body []byte) (model.Value, error) {
 	// TODO(saswatamcode): Update spec so that we can use client/models directly.
 	var m struct {
 		Data struct {
@@ -174,86 +318,174 @@ func handleGraph(body []byte, graph, query, dir string, w io.Writer) error {
 	}
 
 	if err := json.Unmarshal(body, &m); err != nil {
-		return fmt.Errorf("unmarshal query range response %w", err)
+		return nil, fmt.Errorf("unmarshal query range response %w", err)
 	}
 
-	var matrixResult model.Matrix
-
 	// Decode the Result depending on the ResultType
 	switch m.Data.ResultType {
 	case string(models.MetricRangeQueryResponseResultTypeMatrix):
+		var matrixResult model.Matrix
 		if err := json.Unmarshal(m.Data.Result, &matrixResult); err != nil {
-			return fmt.Errorf("decode result into ValueTypeMatrix %w", err)
+			return nil, fmt.Errorf("decode result into ValueTypeMatrix %w", err)
+		}
+		return matrixResult, nil
+	case model.ValVector.String():
+		var vectorResult model.Vector
+		if err := json.Unmarshal(m.Data.Result, &vectorResult); err != nil {
+			return nil, fmt.Errorf("decode result into ValueTypeVector %w", err)
 		}
+		return vectorResult, nil
+	case model.ValScalar.String():
+		var scalarResult model.Scalar
+		if err := json.Unmarshal(m.Data.Result, &scalarResult); err != nil {
+			return nil, fmt.Errorf("decode result into ValueTypeScalar %w", err)
+		}
+		return &scalarResult, nil
 	default:
 		if m.Warnings != nil {
-			return fmt.Errorf("error: %s, type: %s, warning: %s", m.Error, m.ErrorType, strings.Join(m.Warnings, ", "))
+			return nil, fmt.Errorf("error: %s, type: %s, warning: %s", m.Error, m.ErrorType, strings.Join(m.Warnings, ", "))
 		}
 		if m.Error != "" {
-			return fmt.Errorf("error: %s, type: %s", m.Error, m.ErrorType)
+			return nil, fmt.Errorf("error: %s, type: %s", m.Error, m.ErrorType)
 		}
 
-		return fmt.Errorf("received status code: 200, unknown response type: '%q'", m.Data.ResultType)
+		return nil, fmt.Errorf("received status code: 200, unknown response type: '%q'", m.Data.ResultType)
+	}
+}
+
+func handleGraph(body []byte, graph string, opts graphOptions, out string, w io.Writer) error {
+	result, err := decodeQueryResult(body)
+	if err != nil {
+		return err
+	}
+
+	if opts.width == 0 && graph == "ascii" {
+		opts.width = terminalWidth()
+	}
+
+	// Range query results are drawn as lines, instant vectors as bars of the top series and scalars as a big number.
+	var ascii func() string
+	var render func(w io.Writer) error
+	switch r := result.(type) {
+	case model.Matrix:
+		ascii = func() string { return plotASCII(r, opts) }
+		render = func(w io.Writer) error { return renderChart(r, graph, opts, w) }
+	case model.Vector:
+		ascii = func() string { return plotBarsASCII(r, opts) }
+		render = func(w io.Writer) error { return renderBarChart(r, graph, opts, w) }
+	case *model.Scalar:
+		ascii = func() string { return plotStatASCII(float64(r.Value), opts) }
+		render = func(w io.Writer) error { return renderStat(float64(r.Value), graph, opts, w) }
+	default:
+		return fmt.Errorf("received status code: 200, unknown response type: '%q'", result.Type().String())
 	}
 
 	// Output graph based on type specified.
 	switch graph {
 	case "ascii":
-		var data [][]float64
-
-		for _, ss := range matrixResult {
-			stream := []float64{}
-			for _, sample := range ss.Values {
-				stream = append(stream, float64(sample.Value))
-			}
-			data = append(data, stream)
-		}
-
 		// TODO(saswatamcode): Output data in some format and use standard graphing tools.
-		fmt.Fprintln(w, asciigraph.PlotMany(data, asciigraph.Width(80)))
+		fmt.Fprintln(w, ascii())
 		return nil
-	case "png":
-		var data []chart.Series
-
-		for _, ss := range matrixResult {
-			xstream := []time.Time{}
-			ystream := []float64{}
-			for _, sample := range ss.Values {
-				ystream = append(ystream, float64(sample.Value))
-				xstream = append(xstream, sample.Timestamp.Time())
-			}
-			data = append(data, chart.TimeSeries{
-				Name:    ss.Metric.String(),
-				XValues: xstream,
-				YValues: ystream,
-				YAxis:   chart.YAxisPrimary,
-			})
+	case "png", "svg":
+		// Graphs are rendered in memory first, so that failing to render them doesn't leave a partial file behind.
+		var buf bytes.Buffer
+		if err := render(&buf); err != nil {
+			return err
+		}
+
+		if out == "-" {
+			_, err := buf.WriteTo(w)
+			return err
 		}
 
-		graph := chart.Chart{
-			XAxis: chart.XAxis{
-				Name: "Time",
-			},
-			YAxis: chart.YAxis{
-				Name: "Value",
-			},
-			Series: data,
+		if err := os.WriteFile(out, buf.Bytes(), 0644); err != nil {
+			return fmt.Errorf("could not write graph %s file: %w", graph, err)
 		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported graph type: %s", graph)
+	}
+}
+
+// graphFileName returns the default file name for a graph of the given type in the working directory.
+func graphFileName(graph string) (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("could not get working dir: %w", err)
+	}
 
-		f, err := os.Create(dir)
+	return filepath.Join(wd, "graph-"+time.Now().Format("20060102-150405")+"."+graph), nil
+}
+
+// clearScreen moves the cursor to the top left corner of the terminal and clears it.
+const clearScreen = "\033[H\033[2J"
+
+// watch calls fn every interval until ctx is cancelled, redrawing whatever fn writes to the command output in place.
+// Errors returned by fn are shown in place of the output and do not stop the loop. If the output isn't a terminal,
+// e.g. it is redirected to a file, the outputs of every refresh are appended one after the other instead.
+func watch(ctx context.Context, cmd *cobra.Command, interval time.Duration, title string, fn func() error) error {
+	out := cmd.OutOrStdout()
+	defer cmd.SetOut(out)
+
+	f, ok := out.(*os.File)
+	tty := ok && term.IsTerminal(int(f.Fd()))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for first := true; ; first = false {
+		var buf bytes.Buffer
+		cmd.SetOut(&buf)
+		err := fn()
+
+		switch {
+		case tty:
+			fmt.Fprint(out, clearScreen)
+		case !first:
+			fmt.Fprintln(out)
+		}
+		fmt.Fprintf(out, "Every %s: %s\t%s\n\n", interval, title, time.Now().Format(time.RFC3339))
+		if _, werr := out.Write(buf.Bytes()); werr != nil {
+			return fmt.Errorf("writing output: %w", werr)
+		}
 		if err != nil {
-			return fmt.Errorf("could not create graph png file: %w", err)
+			if ctx.Err() != nil {
+				return nil
+			}
+			fmt.Fprintf(out, "Error: %v\n", err)
 		}
-		defer f.Close()
 
-		if err := graph.Render(chart.PNG, f); err != nil {
-			return fmt.Errorf("could not render graph: %w", err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
 		}
+	}
+}
 
-		return nil
-	default:
-		return fmt.Errorf("unsupported graph type: %s", graph)
+// newSlidingWindow returns a function which moves start and end so that the range ends at the current time,
+// while keeping the width of the range they originally described.
+func newSlidingWindow(start, end *string) (func(), error) {
+	s, err := parseTime(*start)
+	if err != nil {
+		return nil, fmt.Errorf("parsing start timestamp: %w", err)
 	}
+
+	e, err := parseTime(*end)
+	if err != nil {
+		return nil, fmt.Errorf("parsing end timestamp: %w", err)
+	}
+
+	window := e.Sub(s)
+	if window <= 0 {
+		return nil, fmt.Errorf("end timestamp must be after start timestamp")
+	}
+
+	return func() {
+		now := time.Now().UTC()
+		*start = now.Add(-window).Format(time.RFC3339)
+		*end = now.Format(time.RFC3339)
+	}, nil
 }
 
 func openInBrowser(url string) error {
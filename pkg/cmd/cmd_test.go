@@ -2,11 +2,29 @@ package cmd
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/observatorium/obsctl/pkg/config"
+	"github.com/observatorium/obsctl/pkg/fakeapi"
+	"github.com/observatorium/obsctl/pkg/fetcher"
+	"github.com/observatorium/obsctl/pkg/promql"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/cobra"
 )
 
 func TestHandleGraphs(t *testing.T) {
@@ -15,6 +33,11 @@ func TestHandleGraphs(t *testing.T) {
 	testutil.Ok(t, err)
 	dir := t.TempDir()
 
+	// Time axis labels are in local time.
+	local := time.Local
+	time.Local = time.UTC
+	t.Cleanup(func() { time.Local = local })
+
 	t.Run("ascii graph", func(t *testing.T) {
 		for _, n := range tc {
 			out := bytes.NewBufferString("")
@@ -22,7 +45,7 @@ func TestHandleGraphs(t *testing.T) {
 			ib, err := os.ReadFile(wd + "/testdata/" + n + ".json")
 			testutil.Ok(t, err)
 
-			testutil.Ok(t, handleGraph(ib, "ascii", n, path.Join(dir, "test.png"), out))
+			testutil.Ok(t, handleGraph(ib, "ascii", graphOptions{title: n, width: 80}, path.Join(dir, "test.png"), out))
 
 			exp, err := os.ReadFile(wd + "/testdata/" + n + ".txt")
 			testutil.Ok(t, err)
@@ -36,7 +59,7 @@ func TestHandleGraphs(t *testing.T) {
 			ib, err := os.ReadFile(wd + "/testdata/" + n + ".json")
 			testutil.Ok(t, err)
 
-			testutil.Ok(t, handleGraph(ib, "png", n, path.Join(dir, "test.png"), bytes.NewBufferString("")))
+			testutil.Ok(t, handleGraph(ib, "png", graphOptions{title: n}, path.Join(dir, "test.png"), bytes.NewBufferString("")))
 
 			exp, err := os.ReadFile(wd + "/testdata/" + n + ".png")
 			testutil.Ok(t, err)
@@ -47,4 +70,1023 @@ func TestHandleGraphs(t *testing.T) {
 			testutil.Equals(t, exp, out)
 		}
 	})
+
+	t.Run("narrow ascii graph", func(t *testing.T) {
+		ib, err := os.ReadFile(wd + "/testdata/" + tc[0] + ".json")
+		testutil.Ok(t, err)
+
+		// Graphs narrower than their value labels are drawn without panicking.
+		for _, width := range []int{1, 8} {
+			testutil.Ok(t, handleGraph(ib, "ascii", graphOptions{width: width, height: 10}, path.Join(dir, "test.png"), bytes.NewBufferString("")))
+		}
+	})
+
+	t.Run("empty matrix", func(t *testing.T) {
+		empty := []byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`)
+		for _, graph := range []string{"png", "svg"} {
+			file := path.Join(dir, "empty."+graph)
+			err := handleGraph(empty, graph, graphOptions{}, file, bytes.NewBufferString(""))
+			testutil.NotOk(t, err)
+			testutil.Equals(t, "no samples to graph", err.Error())
+
+			// No file is left behind by graphs which failed to render.
+			_, err = os.Stat(file)
+			testutil.Assert(t, os.IsNotExist(err), "expected no %s file, got %v", graph, err)
+		}
+	})
+}
+
+func TestNewSlidingWindow(t *testing.T) {
+	start, end := "2022-10-01T10:00:00Z", "1664622000"
+
+	slide, err := newSlidingWindow(&start, &end)
+	testutil.Ok(t, err)
+
+	slide()
+
+	s, err := parseTime(start)
+	testutil.Ok(t, err)
+	e, err := parseTime(end)
+	testutil.Ok(t, err)
+
+	testutil.Equals(t, time.Hour, e.Sub(s))
+	testutil.Assert(t, time.Since(e) < time.Minute, "expected window to end at the current time, got %s", end)
+
+	start, end = end, start
+	_, err = newSlidingWindow(&start, &end)
+	testutil.NotOk(t, err)
+}
+
+func TestWatchOutput(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Millisecond)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := &cobra.Command{}
+	cmd.SetOut(&out)
+	refreshes := 0
+	testutil.Ok(t, watch(ctx, cmd, 50*time.Millisecond, "up", func() error {
+		refreshes++
+		fmt.Fprintf(cmd.OutOrStdout(), "refresh %d\n", refreshes)
+		return nil
+	}))
+
+	// Refreshes written to something else than a terminal are appended without clearing the screen.
+	testutil.Assert(t, refreshes > 1, "expected several refreshes, got %d", refreshes)
+	testutil.Assert(t, !strings.Contains(out.String(), clearScreen), "unexpected clear screen in %q", out.String())
+	testutil.Equals(t, refreshes, strings.Count(out.String(), "Every 50ms: up\t"))
+	testutil.Assert(t, strings.Contains(out.String(), "refresh 1\n\nEvery 50ms: up\t"), "unexpected output %q", out.String())
+}
+
+func TestWatchRelativeTime(t *testing.T) {
+	var (
+		mtx   sync.Mutex
+		times = map[string][]string{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		times[r.URL.Path] = append(times[r.URL.Path], r.URL.Query().Get("time"))
+		mtx.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	cfg := fmt.Sprintf(`{"apis":{"test":{"url":%q,"contexts":{"test":{"tenant":"test"}}}},"current":{"api":"test","tenant":"test"}}`, srv.URL)
+	testutil.Ok(t, os.WriteFile(path.Join(dir, "config.json"), []byte(cfg), 0600))
+	t.Setenv("OBSCTL_CONFIG_PATH", path.Join(dir, "config.json"))
+
+	for api, queryPath := range map[string]string{
+		"metrics": "/api/metrics/v1/test/api/v1/query",
+		"logs":    "/api/logs/v1/test/loki/api/v1/query",
+	} {
+		t.Run(api, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+
+			cmd := NewObsctlCmd(context.Background())
+			cmd.SetArgs([]string{api, "query", "up", "--time", "now-5m", "--watch", "50ms"})
+			cmd.SetOut(io.Discard)
+			start := time.Now()
+			testutil.Ok(t, cmd.ExecuteContext(ctx))
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			testutil.Assert(t, len(times[queryPath]) > 1, "expected several refreshes, got %v", times)
+
+			// Every refresh evaluates the query five minutes before it ran.
+			for i, ts := range times[queryPath] {
+				evalTime, err := time.Parse(time.RFC3339Nano, ts)
+				testutil.Ok(t, err)
+				testutil.Assert(t, !evalTime.Before(start.Add(-5*time.Minute)), "refresh %d evaluated at %s, before the command started", i, ts)
+				if i > 0 {
+					prev, err := time.Parse(time.RFC3339Nano, times[queryPath][i-1])
+					testutil.Ok(t, err)
+					testutil.Assert(t, evalTime.After(prev), "refresh %d evaluated at %s, not after the previous one", i, ts)
+				}
+			}
+		})
+	}
+}
+
+func TestReplComplete(t *testing.T) {
+	s := &replSession{
+		mode: replModeMetrics,
+		completions: map[string][]string{
+			"metrics/labels":          {"__name__", "instance", "job"},
+			"metrics/values/__name__": {"up", "go_gc_duration_seconds", "go_goroutines"},
+			"metrics/values/job":      {"api", "thanos-query"},
+		},
+	}
+
+	for _, tc := range []struct {
+		line        string
+		head        string
+		completions []string
+	}{
+		{line: "go_", head: "", completions: []string{"go_gc_duration_seconds", "go_goroutines"}},
+		{line: "rate(go_g", head: "rate(", completions: []string{"go_gc_duration_seconds", "go_goroutines"}},
+		{line: "up{", head: "up{", completions: []string{"__name__", "instance", "job"}},
+		{line: `up{instance="a", j`, head: `up{instance="a", `, completions: []string{"job"}},
+		{line: "up{job=", head: "up{job=", completions: []string{`"api"`, `"thanos-query"`}},
+		{line: `up{job=~"th`, head: `up{job=~"`, completions: []string{`thanos-query"`}},
+		{line: `up{job=~'th`, head: `up{job=~'`, completions: []string{`thanos-query'`}},
+		{line: "up{job=`a", head: "up{job=`", completions: []string{"api`"}},
+		{line: `up{job="api"}`, head: `up{job="api"}`, completions: nil},
+		{line: ":ra", head: "", completions: []string{":range"}},
+	} {
+		t.Run(tc.line, func(t *testing.T) {
+			head, completions, tail := s.complete(tc.line, len(tc.line))
+			testutil.Equals(t, tc.head, head)
+			testutil.Equals(t, tc.completions, completions)
+			testutil.Equals(t, "", tail)
+		})
+	}
+
+	// The cursor position is given in runes.
+	line := `up{instance="föö", j} or up`
+	head, completions, tail := s.complete(line, len([]rune(`up{instance="föö", j`)))
+	testutil.Equals(t, `up{instance="föö", `, head)
+	testutil.Equals(t, []string{"job"}, completions)
+	testutil.Equals(t, "} or up", tail)
+}
+
+func TestParseReplDuration(t *testing.T) {
+	for arg, want := range map[string]time.Duration{
+		"":      0,
+		"off":   0,
+		"90s":   90 * time.Second,
+		"1h30m": 90 * time.Minute,
+		"1d":    24 * time.Hour,
+		"1w":    7 * 24 * time.Hour,
+	} {
+		d, err := parseReplDuration(arg)
+		testutil.Ok(t, err)
+		testutil.Equals(t, want, d)
+	}
+
+	_, err := parseReplDuration("-1h")
+	testutil.NotOk(t, err)
+}
+
+func TestLoadDashboard(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("defaults", func(t *testing.T) {
+		testutil.Ok(t, os.WriteFile(path.Join(dir, "board.yaml"), []byte(`
+panels:
+  - query: up
+  - type: logs
+    query: '{app="api"}'
+`), os.ModePerm))
+
+		d, err := loadDashboard(path.Join(dir, "board.yaml"))
+		testutil.Ok(t, err)
+
+		testutil.Equals(t, path.Join(dir, "board.yaml"), d.Title)
+		testutil.Equals(t, model.Duration(30*time.Second), d.Refresh)
+		testutil.Equals(t, model.Duration(time.Hour), d.Range)
+		testutil.Equals(t, 2, d.Columns)
+		testutil.Equals(t, []panelConfig{
+			{Title: "up", Type: panelTypeTimeseries, Datasource: datasourceMetrics, Query: "up"},
+			{Title: `{app="api"}`, Type: panelTypeLogs, Datasource: datasourceLogs, Query: `{app="api"}`},
+		}, d.Panels)
+	})
+
+	t.Run("invalid panel type", func(t *testing.T) {
+		testutil.Ok(t, os.WriteFile(path.Join(dir, "board.yaml"), []byte(`
+refresh: 1m
+panels:
+  - type: heatmap
+    query: up
+`), os.ModePerm))
+
+		_, err := loadDashboard(path.Join(dir, "board.yaml"))
+		testutil.NotOk(t, err)
+	})
+}
+
+func TestDashboardRefresh(t *testing.T) {
+	d := &dashboardConfig{Title: "test", Columns: 1, Range: model.Duration(time.Hour), Panels: []panelConfig{
+		{Title: "up", Type: panelTypeTimeseries, Datasource: datasourceMetrics, Query: "up"},
+	}}
+	updates := make(chan struct{}, 1)
+
+	t.Run("too small", func(t *testing.T) {
+		r := newDashboardRunner(d, nil)
+		r.width, r.height = 10, 4
+
+		r.refresh(updates, false)
+		testutil.Equals(t, []string{"Too small"}, r.panels[0].lines)
+		testutil.Equals(t, 0, r.inFlight[0])
+	})
+
+	t.Run("panics are recovered", func(t *testing.T) {
+		// Querying without a client panics.
+		r := newDashboardRunner(d, nil)
+		r.width, r.height = 80, 20
+
+		r.refresh(updates, false)
+		testutil.NotOk(t, r.panels[0].err)
+		testutil.Equals(t, 0, r.inFlight[0])
+	})
+
+	t.Run("ticks skip panels in flight", func(t *testing.T) {
+		r := newDashboardRunner(d, nil)
+		r.width, r.height = 10, 4
+		r.inFlight[0] = 1
+
+		r.refresh(updates, true)
+		testutil.Equals(t, []string{"Loading..."}, r.panels[0].lines)
+		testutil.Equals(t, 1, r.inFlight[0])
+
+		r.refresh(updates, false)
+		testutil.Equals(t, []string{"Too small"}, r.panels[0].lines)
+		testutil.Equals(t, 1, r.inFlight[0])
+	})
+}
+
+func TestTableLines(t *testing.T) {
+	v := model.Vector{
+		{Metric: model.Metric{"__name__": "up\033[2J", "job": "a"}, Value: 1},
+		{Metric: model.Metric{"__name__": "up", "job": "b"}, Value: 2},
+	}
+	testutil.Equals(t, []string{
+		`           2  up{job="b"}`,
+		`           1  up{job="a"}`,
+	}, tableLines(v))
+
+	// The result of the query isn't sorted in place.
+	testutil.Equals(t, model.SampleValue(1), v[0].Value)
+}
+
+func TestFitLine(t *testing.T) {
+	testutil.Equals(t, "abc  ", fitLine("abc", 5))
+	testutil.Equals(t, "ab", fitLine("abc", 2))
+	testutil.Equals(t, "┤╭╯", fitLine("┤╭╯╰╮", 3))
+	testutil.Equals(t, "\033[31mab\033[0m\033[0m ", fitLine("\033[31mab\033[0m", 3))
+	testutil.Equals(t, "\033[31mab\033[0m", fitLine("\033[31mabc\033[0m", 2))
+	testutil.Equals(t, "", fitLine("abc", 0))
+	testutil.Equals(t, "", fitLine("abc", -3))
+
+	// Escape sequences and line breaks of log lines are removed.
+	testutil.Equals(t, "level=error msg=failed", sanitizeLine("\033[2J\033[31mlevel=error\033[0m\tmsg=failed\r\n"))
+}
+
+func TestGrafanaDashboard(t *testing.T) {
+	dir := t.TempDir()
+	testutil.Ok(t, os.WriteFile(path.Join(dir, "grafana.json"), []byte(`{"dashboard": {
+  "templating": {"list": [
+    {"name": "cluster", "current": {"value": ["a", "b"]}},
+    {"name": "namespace", "allValue": ".+", "current": {"value": "$__all"}}
+  ]},
+  "panels": [
+    {"title": "CPU", "datasource": {"type": "prometheus"}, "targets": [
+      {"expr": "rate(cpu{cluster=~\"$cluster\", namespace=~\"${namespace}\"}[$__rate_interval])"},
+      {"expr": "hidden", "hide": true}
+    ]},
+    {"title": "Row", "type": "row", "panels": [
+      {"title": "Logs", "datasource": "Loki", "targets": [{"expr": "{job=\"$job\"}"}]},
+      {"title": "Elasticsearch", "datasource": {"type": "elasticsearch"}, "targets": [{"expr": "x"}, {"expr": "y"}]},
+      {"title": "Errors", "type": "stat", "datasource": "Loki", "targets": [{"expr": "sum(count_over_time({job=\"$job\"} |= \"error\" [5m]))"}]}
+    ]}
+  ]
+}}`), os.ModePerm))
+
+	d, err := loadGrafanaDashboard(path.Join(dir, "grafana.json"))
+	testutil.Ok(t, err)
+
+	vars := d.variables()
+	testutil.Equals(t, map[string]string{"cluster": "(a|b)", "namespace": ".+"}, vars)
+
+	panels, skipped := d.panels()
+	testutil.Equals(t, []string{"Elasticsearch"}, skipped)
+	testutil.Equals(t, []grafanaPanelQueries{
+		{title: "CPU", queries: []panelConfig{
+			{Title: "CPU", Type: panelTypeTimeseries, Datasource: datasourceMetrics, Query: `rate(cpu{cluster=~"$cluster", namespace=~"${namespace}"}[$__rate_interval])`},
+		}},
+		// Loki queries of log lines are rendered as logs whatever the type of their panel.
+		{title: "Logs", queries: []panelConfig{
+			{Title: "Logs", Type: panelTypeLogs, Datasource: datasourceLogs, Query: `{job="$job"}`},
+		}},
+		{title: "Errors", queries: []panelConfig{
+			{Title: "Errors", Type: panelTypeStat, Datasource: datasourceLogs, Query: `sum(count_over_time({job="$job"} |= "error" [5m]))`},
+		}},
+	}, panels)
+
+	q, missing := substituteVariables(panels[0].queries[0].Query, vars, time.Hour, 15*time.Second)
+	testutil.Equals(t, `rate(cpu{cluster=~"(a|b)", namespace=~".+"}[1m])`, q)
+	testutil.Equals(t, 0, len(missing))
+
+	q, missing = substituteVariables(`label_replace(up{job="$job"}, "a", "$1", "b", "(.*)")`, vars, time.Hour, 15*time.Second)
+	testutil.Equals(t, `label_replace(up{job="$job"}, "a", "$1", "b", "(.*)")`, q)
+	testutil.Equals(t, []string{"job"}, missing)
+
+	// Panels which fail to render don't leave an empty file behind.
+	cmd := &cobra.Command{}
+	cmd.SetOut(io.Discard)
+	testutil.NotOk(t, renderGrafanaPanel(cmd, "CPU", model.Matrix{{Metric: model.Metric{"job": "api"}}}, dir, 0))
+	_, err = os.Stat(panelFileName(dir, 0, "CPU", "png"))
+	testutil.Assert(t, os.IsNotExist(err), "unexpected panel file: %v", err)
+}
+
+func TestGrafanaRender(t *testing.T) {
+	f := newFakeContext(t)
+
+	now := time.Now()
+	tenant := f.api.Tenant("test")
+	tenant.AddSeries(model.Metric{"__name__": "up", "job": "api"}, model.SamplePair{Timestamp: model.TimeFromUnix(now.Add(-time.Minute).Unix()), Value: 1})
+	tenant.AddLogs(model.LabelSet{"app": "api"}, fakeapi.Entry{Time: now.Add(-time.Minute), Line: "level=error msg=\"request failed\""})
+
+	dir := t.TempDir()
+	testutil.Ok(t, os.WriteFile(path.Join(dir, "grafana.json"), []byte(`{"panels": [
+  {"title": "Up", "type": "timeseries", "targets": [{"expr": "up"}]},
+  {"title": "Targets", "type": "stat", "targets": [{"expr": "up"}]},
+  {"title": "API logs", "type": "logs", "datasource": {"type": "loki"}, "targets": [{"expr": "{app=\"api\"}"}]}
+]}`), os.ModePerm))
+
+	out, err := f.run("dashboard", "render", path.Join(dir, "grafana.json"))
+	testutil.Ok(t, err)
+	testutil.Assert(t, strings.HasPrefix(out, "Up\n\n"), "unexpected output %q", out)
+	testutil.Assert(t, strings.Contains(out, "\nTargets\n\n"), "unexpected output %q", out)
+	testutil.Assert(t, strings.Contains(out, "\nAPI logs\n\n"+now.Add(-time.Minute).Format("15:04:05")+` level=error msg="request failed"`+"\n"), "unexpected output %q", out)
+
+	// Logs panels are written as text files next to the PNGs of graphs.
+	out, err = f.run("dashboard", "render", path.Join(dir, "grafana.json"), "--png", path.Join(dir, "out"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, strings.Join([]string{
+		path.Join(dir, "out", "00-up.png"),
+		path.Join(dir, "out", "01-targets.txt"),
+		path.Join(dir, "out", "02-api-logs.txt"),
+	}, "\n")+"\n", out)
+	b, err := os.ReadFile(path.Join(dir, "out", "02-api-logs.txt"))
+	testutil.Ok(t, err)
+	testutil.Assert(t, strings.Contains(string(b), "request failed"), "unexpected logs %q", string(b))
+}
+
+func TestFormatValue(t *testing.T) {
+	for _, tc := range []struct {
+		v    float64
+		unit string
+		exp  string
+	}{
+		{v: 0, exp: "0"},
+		{v: 1234.5678, exp: "1.23k"},
+		{v: 0.000123, exp: "0.000123"},
+		{v: 1536, unit: unitBytes, exp: "1.5KiB"},
+		{v: 3 * 1024 * 1024 * 1024, unit: unitBytes, exp: "3GiB"},
+		{v: 0.25, unit: unitSeconds, exp: "250ms"},
+		{v: 5400, unit: unitSeconds, exp: "1.5h"},
+		{v: 0.995, unit: unitPercent, exp: "99.5%"},
+	} {
+		testutil.Equals(t, tc.exp, formatValue(tc.v, tc.unit))
+	}
+}
+
+func TestLegendNames(t *testing.T) {
+	testutil.Equals(t, []string{`{code="200"}`, `{code="500"}`}, legendNames(model.Matrix{
+		{Metric: model.Metric{"__name__": "http_requests_total", "job": "api", "code": "200"}},
+		{Metric: model.Metric{"__name__": "http_requests_total", "job": "api", "code": "500"}},
+	}))
+	testutil.Equals(t, []string{`{job="api"}`}, legendNames(model.Matrix{
+		{Metric: model.Metric{"job": "api"}},
+	}))
+}
+
+func TestAlignSeries(t *testing.T) {
+	grid, minT, maxT := alignSeries(model.Matrix{
+		{Values: []model.SamplePair{{Timestamp: 0, Value: 1}, {Timestamp: 60000, Value: 2}, {Timestamp: 240000, Value: 5}}},
+		{Values: []model.SamplePair{{Timestamp: 120000, Value: 3}, {Timestamp: 180000, Value: 4}}},
+	})
+	testutil.Equals(t, model.Time(0), minT)
+	testutil.Equals(t, model.Time(240000), maxT)
+	testutil.Equals(t, 2, len(grid))
+
+	// Missing samples are gaps rather than being collapsed.
+	for i, exp := range [][]float64{{1, 2, math.NaN(), math.NaN(), 5}, {math.NaN(), math.NaN(), 3, 4, math.NaN()}} {
+		testutil.Equals(t, len(exp), len(grid[i]))
+		for j := range exp {
+			testutil.Assert(t, exp[j] == grid[i][j] || math.IsNaN(exp[j]) && math.IsNaN(grid[i][j]), "series %d sample %d: %v", i, j, grid[i][j])
+		}
+	}
+
+	// Gaps stay gaps when stretched to more columns.
+	res := resample(grid[0], 9)
+	testutil.Equals(t, []float64{1, 1.5, 2}, res[:3])
+	testutil.Assert(t, math.IsNaN(res[4]), "expected gap, got %v", res[4])
+	testutil.Equals(t, 5.0, res[8])
+
+	// Series without finite values have nothing to plot.
+	testutil.Equals(t, "No data", plotASCII(model.Matrix{
+		{Metric: model.Metric{"job": "api"}},
+		{Metric: model.Metric{"job": "db"}, Values: []model.SamplePair{{Timestamp: 0, Value: model.SampleValue(math.NaN())}}},
+	}, graphOptions{width: 80}))
+}
+
+func TestInstantGraphs(t *testing.T) {
+	t.Run("bars of top series", func(t *testing.T) {
+		vector := model.Vector{
+			{Metric: model.Metric{"job": "api", "code": "200"}, Value: 8},
+			{Metric: model.Metric{"job": "api", "code": "500"}, Value: 2},
+			{Metric: model.Metric{"job": "api", "code": "404"}, Value: 4},
+		}
+
+		testutil.Equals(t, `{code="200"} ████████████████ 8
+{code="404"} ████████         4
+… and 1 more series`, plotBarsASCII(vector, graphOptions{width: 31, top: 2}))
+
+		// Bars narrower than their labels keep the first character of every label.
+		testutil.Equals(t, `… ██████████ 8
+… █████      4
+… and 1 more series`, plotBarsASCII(vector, graphOptions{width: 2, top: 2}))
+		testutil.Equals(t, "… ██████████ 8\n… and 2 more series", plotBarsASCII(vector, graphOptions{width: 1, top: 1}))
+	})
+
+	t.Run("big number", func(t *testing.T) {
+		testutil.Equals(t, `█ █   ███ ███ 
+█ █   █ █ █ █ 
+███   █ █ ███ 
+  █   █ █ █ █ 
+  █ █ ███ ███ k`, plotStatASCII(4080, graphOptions{width: 80}))
+
+		// Numbers which don't fit are shown as is.
+		testutil.Equals(t, "250ms", plotStatASCII(0.25, graphOptions{width: 10, yUnit: unitSeconds}))
+		testutil.Equals(t, "4.08k", plotStatASCII(4080, graphOptions{width: 1}))
+	})
+}
+
+func TestMergeContextResults(t *testing.T) {
+	contexts, err := parseContexts([]string{"staging/a", "production/a", "staging/a"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, []queryContext{{api: "staging", tenant: "a"}, {api: "production", tenant: "a"}}, contexts)
+
+	_, err = parseContexts([]string{"staging"})
+	testutil.NotOk(t, err)
+
+	t.Run("vectors and scalars", func(t *testing.T) {
+		merged, err := mergeContextResults([]contextResult{
+			{context: contexts[0], value: model.Vector{{Metric: model.Metric{"job": "api", "tenant": "x"}, Value: 1}}},
+			{context: contexts[1], value: &model.Scalar{Value: 2}},
+			{context: queryContext{api: "broken", tenant: "a"}, err: fmt.Errorf("connection refused")},
+		})
+		testutil.Ok(t, err)
+		testutil.Equals(t, model.Vector{
+			{Metric: model.Metric{"job": "api", "api": "staging", "tenant": "a", "exported_tenant": "x"}, Value: 1},
+			{Metric: model.Metric{"api": "production", "tenant": "a"}, Value: 2},
+		}, merged)
+	})
+
+	t.Run("existing labels are exported", func(t *testing.T) {
+		testutil.Equals(t,
+			model.Metric{"api": "staging", "tenant": "a", "exported_api": "y", "exported_exported_api": "x"},
+			contextMetric(model.Metric{"api": "x", "exported_api": "y"}, contexts[0]),
+		)
+	})
+
+	t.Run("mixed result types", func(t *testing.T) {
+		_, err := mergeContextResults([]contextResult{
+			{context: contexts[0], value: model.Vector{}},
+			{context: contexts[1], value: model.Matrix{}},
+		})
+		testutil.NotOk(t, err)
+	})
+
+	t.Run("encoded matrix", func(t *testing.T) {
+		merged, err := mergeContextResults([]contextResult{
+			{context: contexts[0], value: model.Matrix{{Metric: model.Metric{"job": "api"}, Values: []model.SamplePair{{Timestamp: 1000, Value: 1}}}}},
+		})
+		testutil.Ok(t, err)
+
+		body, err := encodeQueryResult(merged)
+		testutil.Ok(t, err)
+
+		decoded, err := decodeQueryResult(body)
+		testutil.Ok(t, err)
+		testutil.Equals(t, merged, decoded)
+	})
+}
+
+func TestCompareVectors(t *testing.T) {
+	baseline := model.Vector{
+		{Metric: model.Metric{"job": "a"}, Value: 3},
+		{Metric: model.Metric{"job": "b"}, Value: 100},
+		{Metric: model.Metric{"job": "c"}, Value: model.SampleValue(math.NaN())},
+	}
+	candidate := model.Vector{
+		{Metric: model.Metric{"job": "b"}, Value: 101},
+		{Metric: model.Metric{"job": "c"}, Value: model.SampleValue(math.NaN())},
+		{Metric: model.Metric{"job": "d"}, Value: 1},
+	}
+
+	testutil.Equals(t, []seriesDiff{
+		{metric: model.Metric{"job": "a"}, kind: diffMissing, baseline: 3},
+		{metric: model.Metric{"job": "d"}, kind: diffExtra, candidate: 1},
+		{metric: model.Metric{"job": "b"}, kind: diffChanged, baseline: 100, candidate: 101},
+	}, compareVectors(baseline, candidate, 0))
+
+	// Differences within the tolerance are ignored.
+	testutil.Equals(t, 2, len(compareVectors(baseline, candidate, 0.01)))
+	testutil.Equals(t, 0, len(compareVectors(baseline, baseline, 0)))
+
+	testutil.Equals(t, "+1 (+1.00%)", formatDelta(100, 101))
+	testutil.Equals(t, "-2", formatDelta(0, -2))
+
+	target, err := parseCompareTarget("1d")
+	testutil.Ok(t, err)
+	testutil.Equals(t, compareTarget{offset: 24 * time.Hour}, target)
+
+	target, err = parseCompareTarget("old/team-a")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "old/team-a", target.String())
+
+	_, err = parseCompareTarget("yesterday")
+	testutil.NotOk(t, err)
+}
+
+func TestCompareRange(t *testing.T) {
+	f := newFakeContext(t)
+
+	now := time.Date(2022, 10, 1, 10, 0, 0, 0, time.UTC)
+	sample := func(ts time.Time, v float64) model.SamplePair {
+		return model.SamplePair{Timestamp: model.TimeFromUnix(ts.Unix()), Value: model.SampleValue(v)}
+	}
+	var a, b, c []model.SamplePair
+	for i := 0; i < 5; i++ {
+		ts := now.Add(time.Duration(i) * time.Minute)
+		a = append(a, sample(ts.Add(-time.Hour), float64(i)))
+		b = append(b, sample(ts.Add(-time.Hour), 1))
+		if i > 2 {
+			c = append(c, sample(ts, 1))
+		}
+	}
+	a = append(a, sample(now.Add(time.Minute), 1), sample(now.Add(2*time.Minute), 20), sample(now.Add(3*time.Minute), 3), sample(now.Add(4*time.Minute), 4))
+	tenant := f.api.Tenant("test")
+	tenant.AddSeries(model.Metric{"__name__": "up", "job": "a"}, a...)
+	tenant.AddSeries(model.Metric{"__name__": "up", "job": "b"}, b...)
+	tenant.AddSeries(model.Metric{"__name__": "up", "job": "c"}, c...)
+
+	run := func(args ...string) (string, error) {
+		return f.run(append([]string{"metrics", "compare", "up", "--baseline", "1h"}, args...)...)
+	}
+
+	// Samples are compared at the same time relative to the start of each range.
+	out, err := run("--start", "2022-10-01T10:00:00Z", "--end", "2022-10-01T10:04:00Z", "--step", "1m")
+	testutil.NotOk(t, err)
+	testutil.Equals(t, `STATUS   SERIES       TIME                  BASELINE   CANDIDATE  DELTA
+missing  up{job="a"}  2022-10-01T10:00:00Z  0          -          -
+missing  up{job="b"}  -                     5 samples  -          -
+extra    up{job="c"}  -                     -          2 samples  -
+changed  up{job="a"}  2022-10-01T10:02:00Z  2          20         +18 (+900.00%)
+
+compared 3 series with 12 samples: 2 missing, 1 extra, 1 changed
+`, out)
+
+	out, err = run("--start", "2022-10-01T10:03:00Z", "--end", "2022-10-01T10:04:00Z", "--step", "1m", "--candidate", "test/test")
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(out, "compared 3 series with 6 samples: 1 missing, 1 extra, 0 changed"), "unexpected output %q", out)
+
+	_, err = run("--start", "2022-10-01T10:00:00Z", "--time", "2022-10-01T10:00:00Z")
+	testutil.NotOk(t, err)
+	_, err = run("--start", "2022-10-01T10:00:00Z")
+	testutil.NotOk(t, err)
+
+	diffs, series, samples := compareMatrices(model.Matrix{}, model.Matrix{}, 0)
+	testutil.Equals(t, 0, len(diffs))
+	testutil.Equals(t, 0, series)
+	testutil.Equals(t, 0, samples)
+}
+
+func TestPromQLCommands(t *testing.T) {
+	f := newFakeContext(t)
+
+	out := f.mustRun(t, "metrics", "fmt", "sum(rate(up[5m]))by(job)")
+	testutil.Equals(t, "sum by (job) (rate(up[5m]))\n", out)
+
+	out = f.mustRun(t, "metrics", "explain", "rate(up[1m])", "--step", "30s")
+	testutil.Assert(t, strings.Contains(out, "up"), "unexpected output %q", out)
+
+	// Queries of metrics named like the commands are still run.
+	f.api.Tenant("test").AddSeries(model.Metric{"__name__": "fmt", "job": "a"}, model.SamplePair{Timestamp: model.TimeFromUnix(1664618340), Value: 1})
+	out = f.mustRun(t, "metrics", "query", "fmt", "--time", "2022-10-01T10:00:00Z")
+	testutil.Assert(t, strings.Contains(out, `"job": "a"`), "unexpected output %q", out)
+}
+
+func TestSavedQueryArgs(t *testing.T) {
+	vars, err := parseVars([]string{"ns=monitoring", "selector=a=b"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]string{"ns": "monitoring", "selector": "a=b"}, vars)
+
+	_, err = parseVars([]string{"ns"})
+	testutil.NotOk(t, err)
+
+	now := time.Date(2022, 10, 1, 11, 0, 0, 0, time.UTC)
+
+	args, err := savedQueryArgs(config.SavedQuery{Query: "up"}, "up", now, []string{"--graph", "ascii"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"up", "--graph", "ascii"}, args)
+
+	args, err = savedQueryArgs(config.SavedQuery{Query: "up", Range: "1h", Step: "1m"}, "up", now, nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"up", "--range", "--start", "2022-10-01T10:00:00Z", "--end", "2022-10-01T11:00:00Z", "--step", "1m"}, args)
+}
+
+func TestParseTime(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	testutil.Ok(t, err)
+	now := time.Date(2026, 10, 18, 9, 30, 0, 0, berlin)
+
+	for _, tc := range []struct {
+		in  string
+		exp time.Time
+	}{
+		{in: "1664622000", exp: time.Date(2022, 10, 1, 11, 0, 0, 0, time.UTC)},
+		{in: "2022-10-01T10:00:00Z", exp: time.Date(2022, 10, 1, 10, 0, 0, 0, time.UTC)},
+		{in: "now", exp: now},
+		{in: "now-1h", exp: now.Add(-time.Hour)},
+		{in: "now+5m", exp: now.Add(5 * time.Minute)},
+		{in: "-30m", exp: now.Add(-30 * time.Minute)},
+		{in: "-1d", exp: now.Add(-24 * time.Hour)},
+		{in: "today", exp: time.Date(2026, 10, 18, 0, 0, 0, 0, berlin)},
+		{in: "yesterday", exp: time.Date(2026, 10, 17, 0, 0, 0, 0, berlin)},
+		{in: "2026-10-17", exp: time.Date(2026, 10, 17, 0, 0, 0, 0, berlin)},
+		{in: "2026-10-17 14:00", exp: time.Date(2026, 10, 17, 14, 0, 0, 0, berlin)},
+		{in: "2026-10-17 14:00 UTC", exp: time.Date(2026, 10, 17, 14, 0, 0, 0, time.UTC)},
+		{in: "2026-10-17T14:00:30 America/New_York", exp: time.Date(2026, 10, 17, 18, 0, 30, 0, time.UTC)},
+		{in: "2026-10-17 14:00 +05:30", exp: time.Date(2026, 10, 17, 8, 30, 0, 0, time.UTC)},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			res, err := parseTimeAt(tc.in, now)
+			testutil.Ok(t, err)
+			testutil.Assert(t, tc.exp.Equal(res), "expected %s, got %s", tc.exp, res)
+		})
+	}
+
+	for _, in := range []string{"", "tomorrow", "now-1x", "2026-10-17 14:00 Nowhere/Atlantis"} {
+		_, err := parseTimeAt(in, now)
+		testutil.NotOk(t, err, in)
+	}
+
+	t.Run("since", func(t *testing.T) {
+		start, end := "", ""
+		testutil.Ok(t, resolveRange(&start, &end, model.Duration(2*time.Hour), now))
+		testutil.Equals(t, "2026-10-18T05:30:00Z", start)
+		testutil.Equals(t, "2026-10-18T07:30:00Z", end)
+
+		step, err := rangeStep("", start, end)
+		testutil.Ok(t, err)
+		testutil.Equals(t, "29s", step)
+
+		start = "now-1h"
+		testutil.NotOk(t, resolveRange(&start, &end, model.Duration(2*time.Hour), now))
+	})
+}
+
+func TestCardinalityReport(t *testing.T) {
+	r := &cardinalityReport{
+		series: 4,
+		metrics: seriesPerMetric([]model.LabelSet{
+			{"__name__": "up", "pod": "a"},
+			{"__name__": "http_requests_total", "code": "200"},
+			{"__name__": "up", "pod": "b"},
+			{"__name__": "up", "pod": "c"},
+		}),
+		labels: []labelCardinality{{name: "pod", values: 30, current: 3}, {name: "job", values: 2, current: 2}, {name: "instance", values: 4}},
+	}
+	testutil.Equals(t, []cardinalityEntry{{name: "up", count: 3}, {name: "http_requests_total", count: 1}}, r.metrics)
+
+	testutil.Equals(t, []labelCardinality{{name: "pod", values: 30, current: 3}, {name: "instance", values: 4}}, highChurnLabels(r.labels, 2))
+
+	out := bytes.NewBufferString("")
+	testutil.Ok(t, printCardinalityCSV(out, r, 1, 2))
+	testutil.Equals(t, `kind,name,count,current,churn
+total,series,4,,
+metric,up,3,,
+label,pod,30,3,10.00
+churn,pod,30,3,10.00
+`, out.String())
+}
+
+func TestMetadataAndExemplars(t *testing.T) {
+	out := bytes.NewBufferString("")
+	testutil.Ok(t, printMetadata(out, []byte(`{"status":"success","data":{"up":[{"type":"gauge","help":"Whether the target is up.","unit":""}],"go_gc_duration_seconds":[{"type":"summary","help":"GC pauses.","unit":"seconds"}]}}`)))
+	testutil.Equals(t, `METRIC                  TYPE     UNIT     HELP
+go_gc_duration_seconds  summary  seconds  GC pauses.
+up                      gauge             Whether the target is up.
+`, out.String())
+
+	out.Reset()
+	testutil.Ok(t, printExemplars(out, []byte(`{"status":"success","data":[{"seriesLabels":{"le":"0.5"},"exemplars":[
+  {"labels":{"traceID":"4bf92f3577b34da6"},"value":"0.31","timestamp":1664618400},
+  {"labels":{},"value":"0.2","timestamp":1664618460.5}
+]}]}`)))
+	testutil.Equals(t, `SERIES      TIME                  VALUE  TRACE ID
+{le="0.5"}  2022-10-01T10:00:00Z  0.31   4bf92f3577b34da6
+{le="0.5"}  2022-10-01T10:01:00Z  0.2    -
+
+View a trace with: obsctl traces get <trace id>
+`, out.String())
+
+	spans, err := traceSpans([]byte(`{"data":[{"traceID":"4bf92f3577b34da6","spans":[
+  {"spanID":"b","operationName":"db.query","startTime":1664618400002000,"duration":1500,"processID":"p2"},
+  {"spanID":"a","operationName":"GET /api","startTime":1664618400000000,"duration":310000,"processID":"p1"}
+],"processes":{"p1":{"serviceName":"api"},"p2":{"serviceName":"postgres"}}}]}`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, []span{
+		{id: "a", service: "api", operation: "GET /api", start: time.Date(2022, 10, 1, 10, 0, 0, 0, time.UTC), duration: 310 * time.Millisecond},
+		{id: "b", service: "postgres", operation: "db.query", start: time.Date(2022, 10, 1, 10, 0, 0, 2000000, time.UTC), duration: 1500 * time.Microsecond},
+	}, spans)
+}
+
+func TestEstimateSelectors(t *testing.T) {
+	e, err := promql.Parse(`sum(rate(http_requests_total{code="500"}[5m] offset 1h)) / sum(rate(http_requests_total[5m])) + max_over_time(up[1h:1m]) * up`)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []estimateSelector{
+		{selector: `http_requests_total{code="500"}`, lookback: 5 * time.Minute, offset: time.Hour},
+		{selector: "http_requests_total", lookback: 5 * time.Minute},
+		{selector: "up", lookback: time.Hour},
+		{selector: "up"},
+	}, estimateSelectors(e))
+
+	start := time.Date(2022, 10, 1, 10, 0, 0, 0, time.UTC)
+
+	// Queries which can't be parsed are told apart from failed estimates, so that they are run without one.
+	_, err = estimateQuery(context.Background(), nil, "test", "sum(up", start, start, 0)
+	var parseErr *promql.ParseError
+	testutil.Assert(t, errors.As(err, &parseErr), "expected a parse error, got %v", err)
+
+	testutil.Equals(t, int64(1), querySteps(start, start, 0))
+	testutil.Equals(t, int64(61), querySteps(start, start.Add(time.Hour), time.Minute))
+
+	step, err := parseStep("90")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 90*time.Second, step)
+
+	out := bytes.NewBufferString("")
+	testutil.Ok(t, printEstimate(out, &queryEstimate{steps: 61, selectors: []selectorEstimate{{selector: "up", series: 3, samples: 183}}}, 100))
+	testutil.Equals(t, `SELECTOR  SERIES  SAMPLES
+up        3       183
+Estimated 183 samples over 61 steps (limit 100).
+`, out.String())
+}
+
+func TestSplitRange(t *testing.T) {
+	start := time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC)
+	ranges := splitRange(start, start.Add(50*time.Hour), time.Hour, 24*time.Hour)
+	testutil.Equals(t, []subRange{
+		{start: start, end: start.Add(23 * time.Hour)},
+		{start: start.Add(24 * time.Hour), end: start.Add(47 * time.Hour)},
+		{start: start.Add(48 * time.Hour), end: start.Add(50 * time.Hour)},
+	}, ranges)
+
+	var (
+		mtx      sync.Mutex
+		attempts = map[string]int{}
+	)
+	body, resp, err := fetchSplitRange(context.Background(), ranges, 2, io.Discard, func(_ context.Context, start, end string) ([]byte, *http.Response, error) {
+		mtx.Lock()
+		attempts[start]++
+		mtx.Unlock()
+
+		s, err := parseTime(start)
+		testutil.Ok(t, err)
+		return []byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"a"},"values":[[%d,"1"]]}]}}`, s.Unix())), &http.Response{StatusCode: http.StatusOK}, nil
+	})
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	for _, r := range ranges {
+		testutil.Equals(t, 1, attempts[formatTime(r.start)])
+	}
+
+	v, err := decodeQueryResult(body)
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.Matrix{{
+		Metric: model.Metric{"job": "a"},
+		Values: []model.SamplePair{
+			{Timestamp: model.TimeFromUnix(ranges[0].start.Unix()), Value: 1},
+			{Timestamp: model.TimeFromUnix(ranges[1].start.Unix()), Value: 1},
+			{Timestamp: model.TimeFromUnix(ranges[2].start.Unix()), Value: 1},
+		},
+	}}, v)
+
+	// Failed sub-ranges aren't retried again, as the fetcher already retried their requests.
+	var failures int32
+	body, resp, err = fetchSplitRange(context.Background(), ranges[1:2], 2, io.Discard, func(_ context.Context, start, end string) ([]byte, *http.Response, error) {
+		atomic.AddInt32(&failures, 1)
+		return []byte("unavailable"), &http.Response{StatusCode: http.StatusServiceUnavailable}, nil
+	})
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusServiceUnavailable, resp.StatusCode)
+	testutil.Equals(t, "unavailable", string(body))
+	testutil.Equals(t, int32(1), atomic.LoadInt32(&failures))
+
+	// Failed sub-ranges are returned as they are.
+	body, resp, err = fetchSplitRange(context.Background(), ranges, 2, io.Discard, func(_ context.Context, start, end string) ([]byte, *http.Response, error) {
+		return []byte("bad query"), &http.Response{StatusCode: http.StatusBadRequest}, nil
+	})
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusBadRequest, resp.StatusCode)
+	testutil.Equals(t, "bad query", string(body))
+}
+
+// fakeContext is a fake Observatorium API and OIDC issuer, which obsctl is configured to use.
+type fakeContext struct {
+	api       *fakeapi.API
+	issuer    *fakeapi.Issuer
+	apiSrv    *httptest.Server
+	issuerSrv *httptest.Server
+	// dir is the directory of the config file.
+	dir string
+}
+
+// newFakeContext starts a fake API with the tenant test, and an OIDC issuer with the client obsctl whose secret is
+// secret. The current context of the config is set to the tenant. The servers are closed when the test ends.
+func newFakeContext(t *testing.T) *fakeContext {
+	issuer, err := fakeapi.NewIssuer()
+	testutil.Ok(t, err)
+	issuer.AddClient("obsctl", "secret")
+
+	f := &fakeContext{api: fakeapi.New(), issuer: issuer, dir: t.TempDir()}
+	f.api.Issuer = issuer
+	f.api.Tenant("test")
+	f.issuerSrv = httptest.NewServer(issuer)
+	t.Cleanup(f.issuerSrv.Close)
+	f.apiSrv = httptest.NewServer(f.api)
+	t.Cleanup(f.apiSrv.Close)
+
+	t.Setenv("OBSCTL_CONFIG_PATH", path.Join(f.dir, "config.json"))
+	f.writeConfig(t, f.apiSrv.URL, "test", "secret")
+
+	return f
+}
+
+// writeConfig replaces the config with one whose current context is a tenant of the API at apiURL, authenticated
+// by the fake issuer with the given client secret.
+func (f *fakeContext) writeConfig(t *testing.T, apiURL, tenant, secret string) {
+	cfg := fmt.Sprintf(`{"apis":{"test":{"url":%q,"contexts":{"test":{"tenant":%q,"oidc":{"issuerURL":%q,"clientID":"obsctl","clientSecret":%q}}}}},"current":{"api":"test","tenant":"test"}}`, apiURL, tenant, f.issuerSrv.URL, secret)
+	testutil.Ok(t, os.WriteFile(path.Join(f.dir, "config.json"), []byte(cfg), 0600))
+}
+
+// run runs obsctl with the given arguments and returns its output.
+func (f *fakeContext) run(args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := NewObsctlCmd(context.Background())
+	cmd.SetArgs(args)
+	cmd.SetOut(&out)
+	cmd.SetErr(io.Discard)
+	err := cmd.Execute()
+	return out.String(), err
+}
+
+// mustRun runs obsctl like run, failing the test if it fails.
+func (f *fakeContext) mustRun(t *testing.T, args ...string) string {
+	out, err := f.run(args...)
+	testutil.Ok(t, err, "obsctl %s", strings.Join(args, " "))
+	return out
+}
+
+func TestRecordReplay(t *testing.T) {
+	f := newFakeContext(t)
+	f.api.Tenant("test").AddSeries(model.Metric{"__name__": "up", "job": "a"}, model.SamplePair{Timestamp: model.TimeFromUnix(1664618340), Value: 1})
+
+	t.Setenv(fetcher.RecordEnvVar, path.Join(f.dir, "cassettes"))
+	recorded := f.mustRun(t, "metrics", "query", "up", "--time", "2022-10-01T10:00:00Z")
+	testutil.Equals(t, 1, f.issuer.Issued())
+	testutil.Assert(t, strings.Contains(recorded, `"job": "a"`), "unexpected output %q", recorded)
+
+	// Replaying needs neither the API nor the issuer, whose discovery and token requests were recorded too.
+	f.apiSrv.Close()
+	f.issuerSrv.Close()
+	testutil.Ok(t, os.Remove(path.Join(f.dir, "oidc-discovery.json")))
+	t.Setenv(fetcher.RecordEnvVar, "")
+	t.Setenv(fetcher.ReplayEnvVar, path.Join(f.dir, "cassettes"))
+
+	// Recorded tokens are redacted.
+	testutil.Equals(t, "redacted\n", f.mustRun(t, "token", "print", "--refresh"))
+	testutil.Equals(t, recorded, f.mustRun(t, "metrics", "query", "up", "--time", "2022-10-01T10:00:00Z"))
+}
+
+func TestCommandsWithFakeAPI(t *testing.T) {
+	f := newFakeContext(t)
+
+	now := time.Date(2022, 10, 1, 10, 0, 0, 0, time.UTC)
+	tenant := f.api.Tenant("test")
+	tenant.AddSeries(model.Metric{"__name__": "up", "job": "a"}, model.SamplePair{Timestamp: model.TimeFromUnix(now.Add(-time.Minute).Unix()), Value: 1})
+	tenant.AddSpans(fakeapi.Span{TraceID: "abc", SpanID: "1", Service: "api", Operation: "GET /", Start: now, Duration: time.Second})
+
+	run := func(args ...string) string { return f.mustRun(t, args...) }
+
+	out := run("metrics", "query", "up", "--time", "2022-10-01T10:00:00Z")
+	testutil.Assert(t, strings.Contains(out, `"job": "a"`), "unexpected output %q", out)
+
+	out = run("traces", "get", "abc")
+	testutil.Assert(t, strings.Contains(out, "GET /"), "unexpected output %q", out)
+
+	out = run("traces", "services")
+	testutil.Equals(t, "api\n", out)
+
+	out = run("whoami")
+	testutil.Assert(t, strings.Contains(out, "Tenant:     test"), "unexpected output %q", out)
+	testutil.Assert(t, strings.Contains(out, "Subject:    obsctl"), "unexpected output %q", out)
+	testutil.Assert(t, strings.Contains(out, "expires in "), "unexpected output %q", out)
+
+	var id identity
+	testutil.Ok(t, json.Unmarshal([]byte(run("whoami", "-o", "json")), &id))
+	testutil.Equals(t, f.apiSrv.URL, id.URL)
+	testutil.Equals(t, "access", id.Token)
+	testutil.Equals(t, f.issuerSrv.URL, id.Claims["iss"])
+
+	// The saved token is printed until a new one is asked for.
+	issued := f.issuer.Issued()
+	token := run("token", "print")
+	testutil.Equals(t, token, run("token", "print"))
+	testutil.Equals(t, issued, f.issuer.Issued())
+	refreshed := run("token", "print", "--refresh")
+	testutil.Equals(t, issued+1, f.issuer.Issued())
+	_, err := f.issuer.Verify(strings.TrimSpace(refreshed))
+	testutil.Ok(t, err)
+}
+
+func TestFormatTTL(t *testing.T) {
+	testutil.Equals(t, "expires in 5m0s", formatTTL(5*time.Minute+100*time.Millisecond))
+	testutil.Equals(t, "expired 5m0s ago", formatTTL(-5*time.Minute))
+}
+
+func TestDoctor(t *testing.T) {
+	f := newFakeContext(t)
+
+	doctor := func(apiURL, tenant, secret string) (map[string]checkResult, error) {
+		f.writeConfig(t, apiURL, tenant, secret)
+		out, err := f.run("doctor", "-o", "json")
+
+		var results []checkResult
+		testutil.Ok(t, json.Unmarshal([]byte(out), &results))
+		byName := map[string]checkResult{}
+		for _, r := range results {
+			byName[r.Name] = r
+		}
+		return byName, err
+	}
+
+	results, err := doctor(f.apiSrv.URL, "test", "secret")
+	testutil.Ok(t, err, "%v", results)
+	for _, name := range []string{"config", "context", "dns", "oidc discovery", "oidc token", "metrics", "logs", "traces"} {
+		testutil.Equals(t, checkPass, results[name].Status, "check %s: %s", name, results[name].Detail)
+	}
+	// The fake API is served without TLS.
+	testutil.Equals(t, checkWarn, results["connection"].Status)
+
+	// The token fetched to check the credentials isn't saved.
+	saved, err := os.ReadFile(path.Join(f.dir, "config.json"))
+	testutil.Ok(t, err)
+	testutil.Assert(t, !strings.Contains(string(saved), "access_token"), "expected no saved token, got %s", saved)
+
+	// Certificates are verified with the system CAs, like requests to the API are.
+	tlsSrv := httptest.NewTLSServer(f.api)
+	defer tlsSrv.Close()
+	results, err = doctor(tlsSrv.URL, "test", "secret")
+	testutil.NotOk(t, err)
+	testutil.Equals(t, checkFail, results["connection"].Status)
+	testutil.Assert(t, strings.Contains(results["connection"].Hint, "CAs of the system"), "unexpected hint %q", results["connection"].Hint)
+
+	results, err = doctor(f.apiSrv.URL, "unknown", "secret")
+	testutil.NotOk(t, err)
+	testutil.Equals(t, checkFail, results["metrics"].Status)
+	testutil.Assert(t, strings.Contains(results["metrics"].Hint, "may not exist"), "unexpected hint %q", results["metrics"].Hint)
+
+	results, err = doctor(f.apiSrv.URL, "test", "wrong")
+	testutil.NotOk(t, err)
+	testutil.Equals(t, checkFail, results["oidc token"].Status)
+	testutil.Equals(t, checkSkip, results["metrics"].Status)
+
+	// The issuer is discovered with the same transport as by other commands, so that it can be recorded and replayed.
+	t.Setenv(fetcher.RecordEnvVar, path.Join(f.dir, "cassettes"))
+	_, err = doctor(f.apiSrv.URL, "test", "secret")
+	testutil.Ok(t, err)
+	f.issuerSrv.Close()
+	t.Setenv(fetcher.RecordEnvVar, "")
+	t.Setenv(fetcher.ReplayEnvVar, path.Join(f.dir, "cassettes"))
+	results, _ = doctor(f.apiSrv.URL, "test", "secret")
+	testutil.Equals(t, checkPass, results["oidc discovery"].Status, results["oidc discovery"].Detail)
+	testutil.Equals(t, checkPass, results["oidc token"].Status, results["oidc token"].Detail)
 }
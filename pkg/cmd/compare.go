@@ -0,0 +1,519 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/observatorium/api/client"
+	"github.com/observatorium/api/client/parameters"
+	"github.com/observatorium/obsctl/pkg/fetcher"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/cobra"
+)
+
+// Kinds of differences between the series of two query results.
+const (
+	diffMissing = "missing"
+	diffExtra   = "extra"
+	diffChanged = "changed"
+)
+
+// diffOrder is the order in which kinds of differences are reported.
+var diffOrder = map[string]int{diffMissing: 0, diffExtra: 1, diffChanged: 2}
+
+// compareTarget is one side of a comparison: either a saved context, or the current context with the query
+// evaluated at an offset in the past.
+type compareTarget struct {
+	context *queryContext
+	offset  time.Duration
+}
+
+// parseCompareTarget parses a target, which is either a context in the <api>/<tenant> format or an offset
+// like 1h. An empty target is the current context without an offset.
+func parseCompareTarget(s string) (compareTarget, error) {
+	if s == "" {
+		return compareTarget{}, nil
+	}
+
+	if strings.Contains(s, "/") {
+		contexts, err := parseContexts([]string{s})
+		if err != nil {
+			return compareTarget{}, err
+		}
+		return compareTarget{context: &contexts[0]}, nil
+	}
+
+	d, err := model.ParseDuration(s)
+	if err != nil {
+		return compareTarget{}, fmt.Errorf("invalid target %q: use a context in the format <api>/<tenant> or an offset like 1h", s)
+	}
+
+	return compareTarget{offset: time.Duration(d)}, nil
+}
+
+func (t compareTarget) String() string {
+	if t.context != nil {
+		return t.context.String()
+	}
+	if t.offset == 0 {
+		return "current context"
+	}
+
+	return model.Duration(t.offset).String() + " ago"
+}
+
+// fetcher returns the client and tenant of the target.
+func (t compareTarget) fetcher(ctx context.Context) (*client.ClientWithResponses, parameters.Tenant, error) {
+	var (
+		f      *client.ClientWithResponses
+		tenant parameters.Tenant
+		err    error
+	)
+	if t.context != nil {
+		f, tenant, err = fetcher.NewContextFetcher(ctx, logger, t.context.api, t.context.tenant)
+	} else {
+		f, tenant, err = fetcher.NewCustomFetcher(ctx, logger)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("custom fetcher: %w", err)
+	}
+
+	return f, tenant, nil
+}
+
+// unixSeconds formats a timestamp as the number of seconds since the epoch, to the millisecond.
+func unixSeconds(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', 3, 64)
+}
+
+// query evaluates an instant query for the target, relative to the given evaluation time.
+func (t compareTarget) query(ctx context.Context, query string, evalTime time.Time) (model.Vector, error) {
+	f, tenant, err := t.fetcher(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	q := parameters.PromqlQuery(query)
+	ts := unixSeconds(evalTime.Add(-t.offset))
+	resp, err := f.GetInstantQueryWithResponse(ctx, tenant, &client.GetInstantQueryParams{Query: &q, Time: &ts})
+	if err != nil {
+		return nil, fmt.Errorf("getting response: %w", err)
+	}
+	if err := checkStatus(resp.Body, resp.StatusCode()); err != nil {
+		return nil, err
+	}
+
+	result, err := decodeQueryResult(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r := result.(type) {
+	case model.Vector:
+		return r, nil
+	case *model.Scalar:
+		return model.Vector{{Metric: model.Metric{}, Value: r.Value, Timestamp: r.Timestamp}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported result type %q", result.Type())
+	}
+}
+
+// queryRange evaluates a range query for the target between start and end, relative to which the offset of the
+// target is applied. Timestamps of the result are moved forward by the offset, so that the results of targets with
+// different offsets line up.
+func (t compareTarget) queryRange(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Matrix, error) {
+	f, tenant, err := t.fetcher(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	q := parameters.PromqlQuery(query)
+	startTS, endTS := unixSeconds(start.Add(-t.offset)), unixSeconds(end.Add(-t.offset))
+	stepStr := strconv.FormatFloat(step.Seconds(), 'f', -1, 64)
+	resp, err := f.GetRangeQueryWithResponse(ctx, tenant, &client.GetRangeQueryParams{
+		Query: &q,
+		Start: (*parameters.StartTS)(&startTS),
+		End:   (*parameters.EndTS)(&endTS),
+		Step:  &stepStr,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting response: %w", err)
+	}
+	if err := checkStatus(resp.Body, resp.StatusCode()); err != nil {
+		return nil, err
+	}
+
+	result, err := decodeQueryResult(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	matrix, ok := result.(model.Matrix)
+	if !ok {
+		return nil, fmt.Errorf("unsupported result type %q", result.Type())
+	}
+	for _, ss := range matrix {
+		for i := range ss.Values {
+			ss.Values[i].Timestamp = ss.Values[i].Timestamp.Add(t.offset)
+		}
+	}
+
+	return matrix, nil
+}
+
+// seriesDiff is a difference between the baseline and candidate results for a single series.
+type seriesDiff struct {
+	metric    model.Metric
+	kind      string
+	baseline  model.SampleValue
+	candidate model.SampleValue
+	// ts is the timestamp of the sample which differs in range comparisons. It is zero for instant comparisons and
+	// for series which are missing or extra as a whole.
+	ts model.Time
+	// samples is the number of samples of a series which is missing or extra as a whole in range comparisons.
+	samples int
+}
+
+// compareVectors matches the series of two results by their labels. It returns the series which are only in one
+// of them, and those whose values differ relatively by more than the tolerance, sorted by kind and labels.
+func compareVectors(baseline, candidate model.Vector, tolerance float64) []seriesDiff {
+	byFingerprint := make(map[model.Fingerprint]*model.Sample, len(candidate))
+	for _, s := range candidate {
+		byFingerprint[s.Metric.Fingerprint()] = s
+	}
+
+	var diffs []seriesDiff
+	for _, b := range baseline {
+		c, ok := byFingerprint[b.Metric.Fingerprint()]
+		if !ok {
+			diffs = append(diffs, seriesDiff{metric: b.Metric, kind: diffMissing, baseline: b.Value})
+			continue
+		}
+		delete(byFingerprint, b.Metric.Fingerprint())
+
+		if valuesDiffer(float64(b.Value), float64(c.Value), tolerance) {
+			diffs = append(diffs, seriesDiff{metric: b.Metric, kind: diffChanged, baseline: b.Value, candidate: c.Value})
+		}
+	}
+	for _, c := range candidate {
+		if _, ok := byFingerprint[c.Metric.Fingerprint()]; ok {
+			diffs = append(diffs, seriesDiff{metric: c.Metric, kind: diffExtra, candidate: c.Value})
+		}
+	}
+
+	sortDiffs(diffs)
+
+	return diffs
+}
+
+// compareMatrices matches the series of two range results by their labels, and their samples by timestamp. It
+// returns the series which are only in one of them, the samples which are only in one of the series both have and
+// the samples whose values differ relatively by more than the tolerance, sorted by kind, labels and time. It also
+// returns the number of series and samples compared.
+func compareMatrices(baseline, candidate model.Matrix, tolerance float64) ([]seriesDiff, int, int) {
+	byFingerprint := make(map[model.Fingerprint]*model.SampleStream, len(candidate))
+	for _, ss := range candidate {
+		byFingerprint[ss.Metric.Fingerprint()] = ss
+	}
+
+	var (
+		diffs            []seriesDiff
+		series, compared int
+	)
+	for _, b := range baseline {
+		series++
+		c, ok := byFingerprint[b.Metric.Fingerprint()]
+		if !ok {
+			diffs = append(diffs, seriesDiff{metric: b.Metric, kind: diffMissing, samples: len(b.Values)})
+			compared += len(b.Values)
+			continue
+		}
+		delete(byFingerprint, b.Metric.Fingerprint())
+
+		values := make(map[model.Time]model.SampleValue, len(c.Values))
+		for _, s := range c.Values {
+			values[s.Timestamp] = s.Value
+		}
+		for _, s := range b.Values {
+			compared++
+			v, ok := values[s.Timestamp]
+			if !ok {
+				diffs = append(diffs, seriesDiff{metric: b.Metric, kind: diffMissing, baseline: s.Value, ts: s.Timestamp})
+				continue
+			}
+			delete(values, s.Timestamp)
+
+			if valuesDiffer(float64(s.Value), float64(v), tolerance) {
+				diffs = append(diffs, seriesDiff{metric: b.Metric, kind: diffChanged, baseline: s.Value, candidate: v, ts: s.Timestamp})
+			}
+		}
+		for _, s := range c.Values {
+			if _, ok := values[s.Timestamp]; ok {
+				compared++
+				diffs = append(diffs, seriesDiff{metric: c.Metric, kind: diffExtra, candidate: s.Value, ts: s.Timestamp})
+			}
+		}
+	}
+	for _, c := range candidate {
+		if _, ok := byFingerprint[c.Metric.Fingerprint()]; ok {
+			series++
+			compared += len(c.Values)
+			diffs = append(diffs, seriesDiff{metric: c.Metric, kind: diffExtra, samples: len(c.Values)})
+		}
+	}
+
+	sortDiffs(diffs)
+
+	return diffs, series, compared
+}
+
+// sortDiffs sorts differences by kind, labels and time.
+func sortDiffs(diffs []seriesDiff) {
+	sort.SliceStable(diffs, func(i, j int) bool {
+		if diffs[i].kind != diffs[j].kind {
+			return diffOrder[diffs[i].kind] < diffOrder[diffs[j].kind]
+		}
+		if a, b := diffs[i].metric.String(), diffs[j].metric.String(); a != b {
+			return a < b
+		}
+		return diffs[i].ts < diffs[j].ts
+	})
+}
+
+// valuesDiffer reports whether two values differ by more than the tolerance, relative to the larger of them.
+// NaN values are equal to each other.
+func valuesDiffer(a, b, tolerance float64) bool {
+	if a == b || math.IsNaN(a) && math.IsNaN(b) {
+		return false
+	}
+
+	return !(math.Abs(a-b) <= tolerance*math.Max(math.Abs(a), math.Abs(b)))
+}
+
+// printDiffs writes the differences as a table, followed by a summary. samples is the number of samples compared
+// by range comparisons, whose differences are reported with their time, or zero for instant comparisons.
+func printDiffs(w io.Writer, diffs []seriesDiff, compared, samples int) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	var missing, extra, changed int
+	if len(diffs) > 0 {
+		if samples > 0 {
+			fmt.Fprintln(tw, "STATUS\tSERIES\tTIME\tBASELINE\tCANDIDATE\tDELTA")
+		} else {
+			fmt.Fprintln(tw, "STATUS\tSERIES\tBASELINE\tCANDIDATE\tDELTA")
+		}
+	}
+	for _, d := range diffs {
+		b, c, delta := "-", "-", "-"
+		switch d.kind {
+		case diffMissing:
+			missing++
+			b = d.baseline.String()
+			if d.samples > 0 {
+				b = fmt.Sprintf("%d samples", d.samples)
+			}
+		case diffExtra:
+			extra++
+			c = d.candidate.String()
+			if d.samples > 0 {
+				c = fmt.Sprintf("%d samples", d.samples)
+			}
+		case diffChanged:
+			changed++
+			b, c = d.baseline.String(), d.candidate.String()
+			delta = formatDelta(float64(d.baseline), float64(d.candidate))
+		}
+		if samples > 0 {
+			ts := "-"
+			if d.samples == 0 {
+				ts = d.ts.Time().UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", d.kind, d.metric, ts, b, c, delta)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", d.kind, d.metric, b, c, delta)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	summary := fmt.Sprintf("compared %d series", compared)
+	if samples > 0 {
+		summary += fmt.Sprintf(" with %d samples", samples)
+	}
+	if len(diffs) == 0 {
+		_, err := fmt.Fprintf(w, "%s: results match\n", summary)
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "\n%s: %d missing, %d extra, %d changed\n", summary, missing, extra, changed)
+	return err
+}
+
+// formatDelta formats the difference between two values, with the relative change if there is one.
+func formatDelta(baseline, candidate float64) string {
+	delta := strconv.FormatFloat(candidate-baseline, 'g', 6, 64)
+	if candidate > baseline {
+		delta = "+" + delta
+	}
+	if baseline == 0 || math.IsNaN(baseline) || math.IsInf(baseline, 0) {
+		return delta
+	}
+
+	return fmt.Sprintf("%s (%+.2f%%)", delta, (candidate-baseline)/math.Abs(baseline)*100)
+}
+
+func NewMetricsCompareCmd(ctx context.Context) *cobra.Command {
+	var (
+		baseline, candidate, evalTime, start, end, step string
+		since                                           model.Duration
+		tolerance                                       float64
+	)
+	cmd := &cobra.Command{
+		Use:   "compare",
+		Short: "Compare the results of a query between two contexts or two points in time.",
+		Long: `Compare the results of an instant query between two contexts or two points in time. Series are matched by their labels,
+and series missing from the candidate, extra series in the candidate and series whose values differ by more than the tolerance are
+reported. Exits with a non-zero code if the results differ.
+
+With --start and --end, or --since, a range query is compared instead, sample by sample: samples are matched by their time and
+missing, extra and changed samples are reported too.
+
+Baseline and candidate are either a saved context in the format <api>/<tenant>, or an offset like 1h to evaluate the query in the
+current context that long before the evaluation time or range.`,
+		Example: `obsctl metrics compare 'count by (job) (up)' --baseline old/team-a --candidate new/team-a
+obsctl metrics compare 'sum by (namespace) (kube_pod_info)' --baseline 1d
+obsctl metrics compare 'sum by (job) (rate(http_requests_total[5m]))' --baseline old/team-a --candidate new/team-a --since 7d --step 1h`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			if args[0] == "" {
+				return fmt.Errorf("no query provided")
+			}
+			if tolerance < 0 {
+				return fmt.Errorf("tolerance must not be negative")
+			}
+
+			b, err := parseCompareTarget(baseline)
+			if err != nil {
+				return fmt.Errorf("baseline: %w", err)
+			}
+			c, err := parseCompareTarget(candidate)
+			if err != nil {
+				return fmt.Errorf("candidate: %w", err)
+			}
+			if b.String() == c.String() {
+				return fmt.Errorf("baseline and candidate are the same")
+			}
+
+			if start != "" || end != "" || since > 0 {
+				if evalTime != "" {
+					return fmt.Errorf("--time can't be used with --start, --end or --since")
+				}
+				return compareRange(ctx, cmd, args[0], b, c, start, end, step, since, tolerance)
+			}
+
+			t := time.Now()
+			if evalTime != "" {
+				if t, err = parseTime(evalTime); err != nil {
+					return err
+				}
+			}
+
+			bv, err := b.query(ctx, args[0], t)
+			if err != nil {
+				return fmt.Errorf("querying baseline (%s): %w", b, err)
+			}
+			cv, err := c.query(ctx, args[0], t)
+			if err != nil {
+				return fmt.Errorf("querying candidate (%s): %w", c, err)
+			}
+
+			diffs := compareVectors(bv, cv, tolerance)
+			compared := len(bv)
+			for _, d := range diffs {
+				if d.kind == diffExtra {
+					compared++
+				}
+			}
+
+			if err := printDiffs(cmd.OutOrStdout(), diffs, compared, 0); err != nil {
+				return err
+			}
+			if len(diffs) > 0 {
+				return fmt.Errorf("results of baseline (%s) and candidate (%s) differ", b, c)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&baseline, "baseline", "", "Context (<api>/<tenant>) or offset (e.g. 1h) to use as the baseline. Defaults to the current context.")
+	cmd.Flags().StringVar(&candidate, "candidate", "", "Context (<api>/<tenant>) or offset (e.g. 1h) to compare with the baseline. Defaults to the current context.")
+	cmd.Flags().StringVar(&evalTime, "time", "", "Evaluation timestamp, which offsets are relative to. Defaults to the current time.")
+	cmd.Flags().StringVarP(&start, "start", "s", "", "Start timestamp of a range query to compare, either absolute (e.g. 2022-10-01 10:00 UTC) or relative (e.g. now-1h). Offsets are relative to it.")
+	cmd.Flags().StringVarP(&end, "end", "e", "", "End timestamp of a range query to compare, either absolute or relative. Defaults to now if --since is set.")
+	cmd.Flags().Var(&since, "since", "Shorthand for a range query starting this long before the end, e.g. 2h.")
+	cmd.Flags().StringVar(&step, "step", "", "Query resolution step width of range queries. Picked from the range if not specified.")
+	cmd.Flags().Float64Var(&tolerance, "tolerance", 0, "Relative difference between values of a series, e.g. 0.01 for 1%, up to which they are considered equal.")
+
+	return cmd
+}
+
+// compareRange compares the results of a range query between start and end for the baseline and candidate.
+func compareRange(ctx context.Context, cmd *cobra.Command, query string, b, c compareTarget, start, end, step string, since model.Duration, tolerance float64) error {
+	if err := resolveRange(&start, &end, since, time.Now()); err != nil {
+		return err
+	}
+	if start == "" || end == "" {
+		return fmt.Errorf("both --start and --end must be set to compare range queries, unless --since is")
+	}
+	step, err := rangeStep(step, start, end)
+	if err != nil {
+		return err
+	}
+
+	s, err := parseTime(start)
+	if err != nil {
+		return fmt.Errorf("parsing start timestamp: %w", err)
+	}
+	e, err := parseTime(end)
+	if err != nil {
+		return fmt.Errorf("parsing end timestamp: %w", err)
+	}
+	if !e.After(s) {
+		return fmt.Errorf("end timestamp must be after start timestamp")
+	}
+	st, err := parseStep(step)
+	if err != nil {
+		return err
+	}
+
+	bm, err := b.queryRange(ctx, query, s, e, st)
+	if err != nil {
+		return fmt.Errorf("querying baseline (%s): %w", b, err)
+	}
+	cm, err := c.queryRange(ctx, query, s, e, st)
+	if err != nil {
+		return fmt.Errorf("querying candidate (%s): %w", c, err)
+	}
+
+	diffs, series, samples := compareMatrices(bm, cm, tolerance)
+	if err := printDiffs(cmd.OutOrStdout(), diffs, series, samples); err != nil {
+		return err
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("results of baseline (%s) and candidate (%s) differ", b, c)
+	}
+
+	return nil
+}
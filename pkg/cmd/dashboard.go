@@ -0,0 +1,1007 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ghodss/yaml"
+	"github.com/go-kit/log/level"
+	"github.com/observatorium/api/client"
+	"github.com/observatorium/api/client/parameters"
+	"github.com/observatorium/obsctl/pkg/fetcher"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+const (
+	panelTypeTimeseries = "timeseries"
+	panelTypeStat       = "stat"
+	panelTypeTable      = "table"
+	panelTypeLogs       = "logs"
+
+	datasourceMetrics = "metrics"
+	datasourceLogs    = "logs"
+
+	// minPanelWidth and minPanelHeight are the smallest inner size panels are rendered at.
+	minPanelWidth  = 16
+	minPanelHeight = 3
+)
+
+// dashboardRanges are the time ranges a running dashboard can be switched between.
+var dashboardRanges = []model.Duration{
+	model.Duration(5 * time.Minute),
+	model.Duration(15 * time.Minute),
+	model.Duration(30 * time.Minute),
+	model.Duration(time.Hour),
+	model.Duration(3 * time.Hour),
+	model.Duration(6 * time.Hour),
+	model.Duration(12 * time.Hour),
+	model.Duration(24 * time.Hour),
+	model.Duration(2 * 24 * time.Hour),
+	model.Duration(7 * 24 * time.Hour),
+}
+
+// dashboardConfig represents the YAML definition of a dashboard.
+type dashboardConfig struct {
+	Title   string         `json:"title"`
+	Refresh model.Duration `json:"refresh"`
+	Range   model.Duration `json:"range"`
+	Columns int            `json:"columns"`
+	Panels  []panelConfig  `json:"panels"`
+}
+
+// panelConfig represents a single panel of a dashboard.
+type panelConfig struct {
+	Title string `json:"title"`
+	// Type is one of timeseries, stat, table or logs.
+	Type string `json:"type"`
+	// Datasource is either metrics (PromQL) or logs (LogQL). Panels of type logs always use logs.
+	Datasource string `json:"datasource"`
+	Query      string `json:"query"`
+}
+
+// loadDashboard reads a dashboard definition from a YAML file, validates it and fills in defaults.
+func loadDashboard(path string) (*dashboardConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading dashboard file: %w", err)
+	}
+
+	d := &dashboardConfig{}
+	if err := yaml.Unmarshal(b, d); err != nil {
+		return nil, fmt.Errorf("parsing dashboard file: %w", err)
+	}
+
+	if d.Title == "" {
+		d.Title = path
+	}
+	if d.Refresh == 0 {
+		d.Refresh = model.Duration(30 * time.Second)
+	}
+	if d.Range == 0 {
+		d.Range = model.Duration(time.Hour)
+	}
+	if d.Columns <= 0 {
+		d.Columns = 2
+	}
+	if len(d.Panels) == 0 {
+		return nil, fmt.Errorf("dashboard %s has no panels", path)
+	}
+
+	for i := range d.Panels {
+		p := &d.Panels[i]
+		if p.Query == "" {
+			return nil, fmt.Errorf("panel %d (%s) has no query", i, p.Title)
+		}
+
+		switch p.Type {
+		case "":
+			p.Type = panelTypeTimeseries
+		case panelTypeTimeseries, panelTypeStat, panelTypeTable:
+		case panelTypeLogs:
+			p.Datasource = datasourceLogs
+		default:
+			return nil, fmt.Errorf("panel %d (%s) has unsupported type %s", i, p.Title, p.Type)
+		}
+
+		switch p.Datasource {
+		case "":
+			p.Datasource = datasourceMetrics
+		case datasourceMetrics, datasourceLogs:
+		default:
+			return nil, fmt.Errorf("panel %d (%s) has unsupported datasource %s", i, p.Title, p.Datasource)
+		}
+
+		if p.Title == "" {
+			p.Title = p.Query
+		}
+	}
+
+	return d, nil
+}
+
+func NewDashboardCmd(ctx context.Context) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "dashboard",
+		Short: "Terminal dashboards for a tenant.",
+		Long:  "Terminal dashboards for a tenant.",
+	}
+
+	runCmd := &cobra.Command{
+		Use:   "run <dashboard.yaml>",
+		Short: "Show a dashboard of metrics and logs panels in the terminal.",
+		Long: `Show a dashboard of metrics and logs panels in the terminal, refreshing all panels concurrently on an interval.
+Press + or - to switch the time range, r to refresh and q to quit.
+
+The dashboard is defined in YAML, for example:
+
+  title: API overview
+  refresh: 30s
+  range: 1h
+  columns: 2
+  panels:
+    - title: Requests by code
+      type: timeseries # timeseries, stat, table or logs
+      query: sum by (code) (rate(http_requests_total[5m]))
+    - title: Error logs
+      type: logs
+      query: '{app="api"} |= "error"'`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			d, err := loadDashboard(args[0])
+			if err != nil {
+				return err
+			}
+
+			fd := int(os.Stdin.Fd())
+			if !term.IsTerminal(fd) {
+				return fmt.Errorf("dashboard needs an interactive terminal")
+			}
+
+			f, currentTenant, err := fetcher.NewCustomFetcher(ctx, logger)
+			if err != nil {
+				return fmt.Errorf("custom fetcher: %w", err)
+			}
+
+			r := newDashboardRunner(d, &queryClient{ctx: ctx, f: f, tenant: currentTenant})
+			return r.run(ctx, fd, cmd.OutOrStdout())
+		},
+	}
+
+	var (
+		renderVars []string
+		renderPNG  string
+		renderStep time.Duration
+		renderRng  = model.Duration(time.Hour)
+	)
+	renderCmd := &cobra.Command{
+		Use:   "render <grafana.json>",
+		Short: "Render the panels of a Grafana dashboard for a tenant.",
+		Long: `Render the panels of a Grafana dashboard JSON file for a tenant, either as ASCII graphs in the terminal or as PNG files.
+Prometheus and Loki queries of every panel are run against the current context. Stat, table and logs panels, and Loki
+queries of log lines, are rendered as text like in 'obsctl dashboard run', and written as text files next to the PNG files.
+Template variables are set to the values saved in the dashboard, unless given with --var.`,
+		Example:      `obsctl dashboard render grafana.json --var cluster=x --png out/`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			g, err := loadGrafanaDashboard(args[0])
+			if err != nil {
+				return err
+			}
+
+			vars := g.variables()
+			for _, v := range renderVars {
+				kv := strings.SplitN(v, "=", 2)
+				if len(kv) != 2 || kv[0] == "" {
+					return fmt.Errorf("invalid variable %q: use format <name>=<value>", v)
+				}
+				vars[kv[0]] = kv[1]
+			}
+
+			panels, skipped := g.panels()
+			for _, title := range skipped {
+				level.Warn(logger).Log("msg", "skipping query of unsupported datasource", "panel", title)
+			}
+			if len(panels) == 0 {
+				return fmt.Errorf("no panels with Prometheus or Loki queries found in %s", args[0])
+			}
+
+			if renderPNG != "" {
+				if err := os.MkdirAll(renderPNG, 0755); err != nil {
+					return fmt.Errorf("creating output directory: %w", err)
+				}
+			}
+
+			f, currentTenant, err := fetcher.NewCustomFetcher(ctx, logger)
+			if err != nil {
+				return fmt.Errorf("custom fetcher: %w", err)
+			}
+			c := &queryClient{ctx: ctx, f: f, tenant: currentTenant}
+
+			rng := time.Duration(renderRng)
+			step := renderStep
+			if step == 0 {
+				step = defaultStep(rng)
+			}
+			end := time.Now()
+			start := end.Add(-rng)
+
+			// Stat, table and logs panels are rendered as text, the same way they are shown by dashboard run.
+			text := &dashboardRunner{c: c, color: renderPNG == "" && colorEnabled()}
+
+			failed := 0
+			for i, p := range panels {
+				var (
+					matrix model.Matrix
+					lines  []string
+					graph  bool
+					err    error
+				)
+				for _, q := range p.queries {
+					query, missing := substituteVariables(q.Query, vars, rng, step)
+					if len(missing) > 0 {
+						level.Warn(logger).Log("msg", "template variables have no value, set them with --var", "panel", p.title, "variables", strings.Join(missing, ","))
+					}
+					q.Query = query
+
+					if q.Type != panelTypeTimeseries {
+						var l []string
+						l, err = text.renderPanel(q, start, end, terminalWidth(), grafanaTextPanelHeight)
+						if err != nil {
+							err = fmt.Errorf("query %s: %w", query, err)
+							break
+						}
+						lines = append(lines, l...)
+						continue
+					}
+
+					graph = true
+					var m model.Matrix
+					m, err = c.queryRange(q, start, end, step)
+					if err != nil {
+						err = fmt.Errorf("query %s: %w", query, err)
+						break
+					}
+					matrix = append(matrix, m...)
+				}
+
+				if err == nil && graph {
+					err = renderGrafanaPanel(cmd, p.title, matrix, renderPNG, i)
+				}
+				if err == nil && len(lines) > 0 {
+					err = renderGrafanaText(cmd, p.title, lines, renderPNG, i)
+				}
+				if err != nil {
+					failed++
+					level.Error(logger).Log("msg", "failed rendering panel", "panel", p.title, "error", err)
+				}
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("%d of %d panels could not be rendered", failed, len(panels))
+			}
+
+			return nil
+		},
+	}
+	renderCmd.Flags().StringArrayVar(&renderVars, "var", nil, "Repeated template variable to set, as <name>=<value>.")
+	renderCmd.Flags().StringVar(&renderPNG, "png", "", "If specified, panels are written as PNG or text files into this directory instead of being shown in the terminal.")
+	renderCmd.Flags().Var(&renderRng, "range", "Time range to render, ending now.")
+	renderCmd.Flags().DurationVar(&renderStep, "step", 0, "Query resolution step width. Picked from the range if not specified.")
+
+	cmd.AddCommand(runCmd)
+	cmd.AddCommand(renderCmd)
+
+	return cmd
+}
+
+// renderGrafanaPanel writes a panel as a PNG file into dir, or as an ASCII graph to the command output if dir is empty.
+func renderGrafanaPanel(cmd *cobra.Command, title string, matrix model.Matrix, dir string, i int) error {
+	if len(matrix) == 0 {
+		return fmt.Errorf("no data")
+	}
+
+	if dir == "" {
+		fmt.Fprintf(cmd.OutOrStdout(), "%s\n\n%s\n\n", title, plotASCII(matrix, graphOptions{width: terminalWidth(), color: colorEnabled()}))
+		return nil
+	}
+
+	// Panels are rendered in memory first, so that failing to render them doesn't leave an empty file behind.
+	var buf bytes.Buffer
+	if err := renderChart(matrix, "png", graphOptions{title: title}, &buf); err != nil {
+		return err
+	}
+
+	name := panelFileName(dir, i, title, "png")
+	if err := os.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("could not write graph png file: %w", err)
+	}
+
+	fmt.Fprintln(cmd.OutOrStdout(), name)
+	return nil
+}
+
+// grafanaTextPanelHeight is the number of lines stat, table and logs panels are rendered into.
+const grafanaTextPanelHeight = 20
+
+// renderGrafanaText writes the lines of a stat, table or logs panel as a text file into dir, or to the command
+// output if dir is empty.
+func renderGrafanaText(cmd *cobra.Command, title string, lines []string, dir string, i int) error {
+	text := strings.Join(lines, "\n") + "\n"
+	if dir == "" {
+		fmt.Fprintf(cmd.OutOrStdout(), "%s\n\n%s\n", title, text)
+		return nil
+	}
+
+	name := panelFileName(dir, i, title, "txt")
+	if err := os.WriteFile(name, []byte(text), 0644); err != nil {
+		return fmt.Errorf("could not write panel text file: %w", err)
+	}
+
+	fmt.Fprintln(cmd.OutOrStdout(), name)
+	return nil
+}
+
+// queryClient runs metrics and logs queries for a tenant on behalf of dashboard panels.
+type queryClient struct {
+	ctx    context.Context
+	f      *client.ClientWithResponses
+	tenant parameters.Tenant
+}
+
+// queryRange evaluates a range query of a panel and returns its result as a matrix.
+func (c *queryClient) queryRange(p panelConfig, start, end time.Time, step time.Duration) (model.Matrix, error) {
+	startTS, endTS, stepStr := start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339), step.String()
+
+	var body []byte
+	if p.Datasource == datasourceLogs {
+		query := parameters.LogqlQuery(p.Query)
+		resp, err := c.f.GetLogRangeQueryWithResponse(c.ctx, c.tenant, &client.GetLogRangeQueryParams{
+			Query: &query,
+			Start: (*parameters.StartTS)(&startTS),
+			End:   (*parameters.EndTS)(&endTS),
+			Step:  &stepStr,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("getting response: %w", err)
+		}
+		if err := checkStatus(resp.Body, resp.StatusCode()); err != nil {
+			return nil, err
+		}
+		body = resp.Body
+	} else {
+		query := parameters.PromqlQuery(p.Query)
+		resp, err := c.f.GetRangeQueryWithResponse(c.ctx, c.tenant, &client.GetRangeQueryParams{
+			Query: &query,
+			Start: (*parameters.StartTS)(&startTS),
+			End:   (*parameters.EndTS)(&endTS),
+			Step:  &stepStr,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("getting response: %w", err)
+		}
+		if err := checkStatus(resp.Body, resp.StatusCode()); err != nil {
+			return nil, err
+		}
+		body = resp.Body
+	}
+
+	result, err := decodeQueryResult(body)
+	if err != nil {
+		return nil, err
+	}
+
+	matrix, ok := result.(model.Matrix)
+	if !ok {
+		return nil, fmt.Errorf("expected matrix result, got %s", result.Type())
+	}
+
+	return matrix, nil
+}
+
+// queryInstant evaluates an instant query of a panel at the given time.
+func (c *queryClient) queryInstant(p panelConfig, at time.Time) (model.Value, error) {
+	ts := at.UTC().Format(time.RFC3339)
+
+	var body []byte
+	if p.Datasource == datasourceLogs {
+		query := parameters.LogqlQuery(p.Query)
+		resp, err := c.f.GetLogInstantQueryWithResponse(c.ctx, c.tenant, &client.GetLogInstantQueryParams{Query: &query, Time: &ts})
+		if err != nil {
+			return nil, fmt.Errorf("getting response: %w", err)
+		}
+		if err := checkStatus(resp.Body, resp.StatusCode()); err != nil {
+			return nil, err
+		}
+		body = resp.Body
+	} else {
+		query := parameters.PromqlQuery(p.Query)
+		resp, err := c.f.GetInstantQueryWithResponse(c.ctx, c.tenant, &client.GetInstantQueryParams{Query: &query, Time: &ts})
+		if err != nil {
+			return nil, fmt.Errorf("getting response: %w", err)
+		}
+		if err := checkStatus(resp.Body, resp.StatusCode()); err != nil {
+			return nil, err
+		}
+		body = resp.Body
+	}
+
+	return decodeQueryResult(body)
+}
+
+// logLine is a single log entry of a stream.
+type logLine struct {
+	ts     time.Time
+	stream model.LabelSet
+	line   string
+}
+
+// queryLogs returns up to limit log lines of a LogQL query between start and end, newest first.
+func (c *queryClient) queryLogs(p panelConfig, start, end time.Time, limit int) ([]logLine, error) {
+	query := parameters.LogqlQuery(p.Query)
+	startTS, endTS, direction := start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339), "backward"
+	l := float32(limit)
+
+	resp, err := c.f.GetLogRangeQueryWithResponse(c.ctx, c.tenant, &client.GetLogRangeQueryParams{
+		Query:     &query,
+		Start:     (*parameters.StartTS)(&startTS),
+		End:       (*parameters.EndTS)(&endTS),
+		Limit:     (*parameters.Limit)(&l),
+		Direction: &direction,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting response: %w", err)
+	}
+	if err := checkStatus(resp.Body, resp.StatusCode()); err != nil {
+		return nil, err
+	}
+
+	return decodeStreams(resp.Body)
+}
+
+// decodeStreams decodes the streams of a logs query API response into log lines, newest first.
+func decodeStreams(body []byte) ([]logLine, error) {
+	var m struct {
+		Data struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Stream model.LabelSet `json:"stream"`
+				Values [][2]string    `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("unmarshal logs query response %w", err)
+	}
+	if m.Data.ResultType != "streams" {
+		return nil, fmt.Errorf("expected streams result, got %s", m.Data.ResultType)
+	}
+
+	var lines []logLine
+	for _, s := range m.Data.Result {
+		for _, v := range s.Values {
+			var ns int64
+			if _, err := fmt.Sscan(v[0], &ns); err != nil {
+				return nil, fmt.Errorf("parsing log timestamp %q: %w", v[0], err)
+			}
+			lines = append(lines, logLine{ts: time.Unix(0, ns), stream: s.Stream, line: v[1]})
+		}
+	}
+
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].ts.After(lines[j].ts) })
+
+	return lines, nil
+}
+
+// checkStatus returns an error for non-2xx responses, including the first line of the body.
+func checkStatus(body []byte, statusCode int) error {
+	if statusCode/100 == 2 {
+		return nil
+	}
+
+	msg := strings.TrimSpace(strings.SplitN(string(body), "\n", 2)[0])
+	if msg == "" {
+		return fmt.Errorf("request failed with status code %d", statusCode)
+	}
+
+	return fmt.Errorf("request failed with status code %d: %s", statusCode, msg)
+}
+
+// panelState is the last rendered content of a panel.
+type panelState struct {
+	lines []string
+	err   error
+	gen   int
+}
+
+// dashboardRunner keeps the state of a dashboard running in the terminal.
+type dashboardRunner struct {
+	d *dashboardConfig
+	c *queryClient
+
+	mu       sync.Mutex
+	ranges   []model.Duration
+	rangeIdx int
+	width    int
+	height   int
+	gen      int
+	updated  time.Time
+	panels   []panelState
+	// inFlight is the number of refreshes of every panel which are still running.
+	inFlight []int
+	// color enables colors in graphs and stats.
+	color bool
+}
+
+func newDashboardRunner(d *dashboardConfig, c *queryClient) *dashboardRunner {
+	r := &dashboardRunner{d: d, c: c, panels: make([]panelState, len(d.Panels)), inFlight: make([]int, len(d.Panels)), color: true}
+
+	// Start from the range of the dashboard, adding it to the ones which can be switched between if needed.
+	idx := sort.Search(len(dashboardRanges), func(i int) bool { return dashboardRanges[i] >= d.Range })
+	r.ranges = append(r.ranges, dashboardRanges[:idx]...)
+	if idx == len(dashboardRanges) || dashboardRanges[idx] != d.Range {
+		r.ranges = append(r.ranges, d.Range)
+	}
+	r.ranges = append(r.ranges, dashboardRanges[idx:]...)
+	r.rangeIdx = idx
+
+	for i := range r.panels {
+		r.panels[i].lines = []string{"Loading..."}
+	}
+
+	return r
+}
+
+// run draws the dashboard on the alternate screen of the terminal and handles key presses until the user quits.
+func (r *dashboardRunner) run(ctx context.Context, fd int, out io.Writer) error {
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("setting terminal to raw mode: %w", err)
+	}
+	defer term.Restore(fd, oldState) //nolint:errcheck
+
+	fmt.Fprint(out, "\033[?1049h\033[?25l")
+	defer fmt.Fprint(out, "\033[?25h\033[?1049l")
+
+	// Reading stdin can't be interrupted, so the reader only stops once it reads after the dashboard exited, but it
+	// doesn't block on sending keys no one receives anymore.
+	keys := make(chan byte)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				return
+			}
+			for _, b := range buf[:n] {
+				select {
+				case keys <- b:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+
+	updates := make(chan struct{}, 1)
+	r.resize()
+	r.draw(out)
+	go r.refresh(updates, false)
+
+	refreshTicker := time.NewTicker(time.Duration(r.d.Refresh))
+	defer refreshTicker.Stop()
+
+	// Resizes are polled, as SIGWINCH is not available on all platforms.
+	sizeTicker := time.NewTicker(500 * time.Millisecond)
+	defer sizeTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case k := <-keys:
+			switch k {
+			case 'q', 'Q', 3, 4:
+				return nil
+			case 'r', 'R':
+				go r.refresh(updates, false)
+			case '+', '=', ']':
+				r.switchRange(1)
+				r.draw(out)
+				go r.refresh(updates, false)
+			case '-', '_', '[':
+				r.switchRange(-1)
+				r.draw(out)
+				go r.refresh(updates, false)
+			}
+		case <-refreshTicker.C:
+			go r.refresh(updates, true)
+		case <-sizeTicker.C:
+			if r.resize() {
+				r.draw(out)
+				go r.refresh(updates, false)
+			}
+		case <-updates:
+			r.draw(out)
+		}
+	}
+}
+
+// resize updates the known terminal size and reports whether it changed.
+func (r *dashboardRunner) resize() bool {
+	w, h, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		w, h = 120, 40
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := w != r.width || h != r.height
+	r.width, r.height = w, h
+	return changed
+}
+
+func (r *dashboardRunner) switchRange(delta int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rangeIdx += delta
+	if r.rangeIdx < 0 {
+		r.rangeIdx = 0
+	}
+	if r.rangeIdx >= len(r.ranges) {
+		r.rangeIdx = len(r.ranges) - 1
+	}
+}
+
+// panelSize returns the inner width and height of every panel for the current terminal size.
+func (r *dashboardRunner) panelSize() (int, int) {
+	rows := (len(r.d.Panels) + r.d.Columns - 1) / r.d.Columns
+	return r.width/r.d.Columns - 2, (r.height-1)/rows - 2
+}
+
+// refresh evaluates the queries of all panels concurrently and notifies updates once done.
+// Results of a refresh are dropped for panels which were already updated by a newer one. Refreshes on a tick skip
+// the panels which are still being refreshed, so that slow queries don't pile up.
+func (r *dashboardRunner) refresh(updates chan<- struct{}, tick bool) {
+	r.mu.Lock()
+	r.gen++
+	gen := r.gen
+	rng := time.Duration(r.ranges[r.rangeIdx])
+	width, height := r.panelSize()
+	var panels []int
+	for i := range r.d.Panels {
+		if tick && r.inFlight[i] > 0 {
+			continue
+		}
+		r.inFlight[i]++
+		panels = append(panels, i)
+	}
+	r.mu.Unlock()
+
+	if len(panels) == 0 {
+		return
+	}
+
+	end := time.Now()
+	start := end.Add(-rng)
+
+	var wg sync.WaitGroup
+	for _, i := range panels {
+		wg.Add(1)
+		go func(i int, p panelConfig) {
+			defer wg.Done()
+
+			var (
+				lines []string
+				err   error
+			)
+			func() {
+				// A panel failing to render must not take down the dashboard, which would leave the terminal in
+				// raw mode.
+				defer func() {
+					if rec := recover(); rec != nil {
+						err = fmt.Errorf("rendering panel: %v", rec)
+					}
+				}()
+				lines, err = r.renderPanel(p, start, end, width, height)
+			}()
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.inFlight[i]--
+			if r.panels[i].gen > gen {
+				return
+			}
+			r.panels[i] = panelState{lines: lines, err: err, gen: gen}
+		}(i, r.d.Panels[i])
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	r.updated = end
+	r.mu.Unlock()
+
+	select {
+	case updates <- struct{}{}:
+	default:
+	}
+}
+
+// renderPanel queries and renders the content of a panel into lines fitting width and height. Panels smaller than
+// minPanelWidth and minPanelHeight aren't queried.
+func (r *dashboardRunner) renderPanel(p panelConfig, start, end time.Time, width, height int) ([]string, error) {
+	if width < minPanelWidth || height < minPanelHeight {
+		return []string{"Too small"}, nil
+	}
+
+	switch p.Type {
+	case panelTypeTimeseries:
+		// Aim for about one sample per column of the graph.
+		step := end.Sub(start) / time.Duration(width)
+		if step < time.Second {
+			step = time.Second
+		}
+
+		matrix, err := r.c.queryRange(p, start, end, step.Round(time.Second))
+		if err != nil {
+			return nil, err
+		}
+		if len(matrix) == 0 {
+			return []string{"No data"}, nil
+		}
+
+		return strings.Split(plotASCII(matrix, graphOptions{width: width, height: height, color: r.color}), "\n"), nil
+	case panelTypeStat:
+		result, err := r.c.queryInstant(p, end)
+		if err != nil {
+			return nil, err
+		}
+
+		// Show the value in a large font if there is room for it.
+		stat := func(v model.SampleValue) []string {
+			if height < 7 {
+				return []string{v.String()}
+			}
+			return strings.Split(plotStatASCII(float64(v), graphOptions{width: width, color: r.color}), "\n")
+		}
+
+		switch v := result.(type) {
+		case *model.Scalar:
+			return append([]string{""}, stat(v.Value)...), nil
+		case model.Vector:
+			if len(v) == 0 {
+				return []string{"No data"}, nil
+			}
+			// The series with the lowest labels is shown, without sorting the result in place.
+			first := v[0]
+			for _, s := range v[1:] {
+				if s.Metric.Before(first.Metric) {
+					first = s
+				}
+			}
+			return append(append([]string{""}, stat(first.Value)...), "", sanitizeLine(first.Metric.String())), nil
+		default:
+			return nil, fmt.Errorf("unexpected %s result for stat panel", result.Type())
+		}
+	case panelTypeTable:
+		result, err := r.c.queryInstant(p, end)
+		if err != nil {
+			return nil, err
+		}
+
+		v, ok := result.(model.Vector)
+		if !ok {
+			return nil, fmt.Errorf("unexpected %s result for table panel", result.Type())
+		}
+		if len(v) == 0 {
+			return []string{"No data"}, nil
+		}
+
+		return tableLines(v), nil
+	case panelTypeLogs:
+		entries, err := r.c.queryLogs(p, start, end, height)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			return []string{"No logs"}, nil
+		}
+
+		lines := make([]string, 0, len(entries))
+		for _, e := range entries {
+			lines = append(lines, e.ts.Format("15:04:05")+" "+sanitizeLine(e.line))
+		}
+		return lines, nil
+	}
+
+	return nil, fmt.Errorf("unsupported panel type %s", p.Type)
+}
+
+// tableLines returns a line for every series of a vector, with the highest values first. The vector is sorted as a
+// copy, so that the result of the query isn't modified.
+func tableLines(v model.Vector) []string {
+	sorted := append(model.Vector(nil), v...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Value > sorted[j].Value })
+
+	lines := make([]string, 0, len(sorted))
+	for _, s := range sorted {
+		lines = append(lines, fmt.Sprintf("%12s  %s", s.Value.String(), sanitizeLine(s.Metric.String())))
+	}
+	return lines
+}
+
+// draw writes a full frame of the dashboard to out.
+func (r *dashboardRunner) draw(out io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	width, height := r.panelSize()
+	if width < 4 || height < 1 {
+		fmt.Fprint(out, "\033[H\033[2Jterminal too small")
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("\033[H")
+
+	updated := "never"
+	if !r.updated.IsZero() {
+		updated = r.updated.Format("15:04:05")
+	}
+	header := fmt.Sprintf(" %s | last %s | updated %s | [+/-] range [r] refresh [q] quit", r.d.Title, r.ranges[r.rangeIdx], updated)
+	b.WriteString("\033[7m" + fitLine(header, r.width) + "\033[0m")
+
+	for row := 0; row*r.d.Columns < len(r.d.Panels); row++ {
+		first := row * r.d.Columns
+		last := first + r.d.Columns
+		if last > len(r.d.Panels) {
+			last = len(r.d.Panels)
+		}
+
+		boxes := make([][]string, 0, last-first)
+		for i := first; i < last; i++ {
+			boxes = append(boxes, panelBox(r.d.Panels[i].Title, r.panels[i], width, height))
+		}
+
+		for l := 0; l < height+2; l++ {
+			b.WriteString("\r\n")
+			for _, box := range boxes {
+				b.WriteString(box[l])
+			}
+			// Clear what's left of the line, e.g. when the width doesn't divide evenly.
+			b.WriteString("\033[K")
+		}
+	}
+	b.WriteString("\033[J")
+
+	fmt.Fprint(out, b.String())
+}
+
+// panelBox draws a bordered panel with its title and content, returning height+2 lines of width+2 columns.
+func panelBox(title string, s panelState, width, height int) []string {
+	lines := s.lines
+	if s.err != nil {
+		// Wrap errors, as they are usually longer than the panel is wide.
+		lines = nil
+		msg := []rune("Error: " + s.err.Error())
+		for len(msg) > 0 {
+			n := width
+			if n > len(msg) {
+				n = len(msg)
+			}
+			lines = append(lines, "\033[31m"+string(msg[:n])+"\033[0m")
+			msg = msg[n:]
+		}
+	}
+
+	head := "─ " + title + " "
+	if n := utf8.RuneCountInString(head); n < width {
+		head += strings.Repeat("─", width-n)
+	} else {
+		head = fitLine(head, width)
+	}
+
+	box := []string{"┌" + head + "┐"}
+	for i := 0; i < height; i++ {
+		line := ""
+		if i < len(lines) {
+			line = lines[i]
+		}
+		box = append(box, "│"+fitLine(line, width)+"│")
+	}
+
+	return append(box, "└"+strings.Repeat("─", width)+"┘")
+}
+
+// csiRegexp matches the CSI escape sequences of terminals, like the ones moving the cursor or setting colors.
+var csiRegexp = regexp.MustCompile("\x1b\\[[0-?]*[ -/]*[@-~]")
+
+// sanitizeLine removes the escape sequences and control characters of a line which isn't drawn by obsctl, like a
+// log line, so that they can't mess up the dashboard. Tabs are replaced by a space.
+func sanitizeLine(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, csiRegexp.ReplaceAllString(s, ""))
+}
+
+// fitLine truncates or pads s to exactly width visible characters, keeping ANSI escape sequences intact. It returns
+// an empty string for widths below one.
+func fitLine(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+
+	var (
+		b       strings.Builder
+		visible int
+		escaped bool
+	)
+
+	for i := 0; i < len(s); {
+		if s[i] == '\033' {
+			// Copy the whole CSI sequence, which ends with a byte in the range 0x40-0x7E.
+			j := i + 1
+			if j < len(s) && s[j] == '[' {
+				j++
+				for j < len(s) && (s[j] < 0x40 || s[j] > 0x7e) {
+					j++
+				}
+			}
+			if j < len(s) {
+				j++
+			}
+			b.WriteString(s[i:j])
+			escaped = true
+			i = j
+			continue
+		}
+
+		if visible == width {
+			break
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == '\t' {
+			b.WriteByte(' ')
+		} else {
+			b.WriteRune(r)
+		}
+		visible++
+		i += size
+	}
+
+	if escaped {
+		b.WriteString("\033[0m")
+	}
+
+	return b.String() + strings.Repeat(" ", width-visible)
+}
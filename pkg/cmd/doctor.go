@@ -0,0 +1,411 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/observatorium/obsctl/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+// The statuses of diagnostic checks.
+const (
+	checkPass = "PASS"
+	checkWarn = "WARN"
+	checkFail = "FAIL"
+	checkSkip = "SKIP"
+)
+
+// checkResult is the result of a diagnostic check of obsctl doctor.
+type checkResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Hint is how to fix the problem found by a check which didn't pass.
+	Hint string `json:"hint,omitempty"`
+}
+
+// doctor runs the diagnostic checks of the current context, each depending on the ones before it.
+type doctor struct {
+	timeout time.Duration
+	results []checkResult
+
+	conf   *config.Config
+	tenant config.TenantConfig
+	api    config.APIConfig
+	apiURL *url.URL
+	client *http.Client
+}
+
+func (d *doctor) pass(name, detail string) {
+	d.results = append(d.results, checkResult{Name: name, Status: checkPass, Detail: detail})
+}
+
+func (d *doctor) warn(name, detail, hint string) {
+	d.results = append(d.results, checkResult{Name: name, Status: checkWarn, Detail: detail, Hint: hint})
+}
+
+func (d *doctor) fail(name, detail, hint string) {
+	d.results = append(d.results, checkResult{Name: name, Status: checkFail, Detail: detail, Hint: hint})
+}
+
+func (d *doctor) skip(name, detail string) {
+	d.results = append(d.results, checkResult{Name: name, Status: checkSkip, Detail: detail})
+}
+
+// failed returns the number of checks which failed.
+func (d *doctor) failed() int {
+	n := 0
+	for _, r := range d.results {
+		if r.Status == checkFail {
+			n++
+		}
+	}
+	return n
+}
+
+// run runs all checks. Checks whose prerequisites failed are skipped.
+func (d *doctor) run(ctx context.Context) {
+	if !d.checkConfig() {
+		for _, name := range []string{"context", "dns", "connection", "oidc discovery", "oidc token", "metrics", "logs", "traces"} {
+			d.skip(name, "the config file can't be read")
+		}
+		return
+	}
+
+	if !d.checkContext() {
+		for _, name := range []string{"dns", "connection", "oidc discovery", "oidc token", "metrics", "logs", "traces"} {
+			d.skip(name, "there is no current context")
+		}
+		return
+	}
+
+	network := d.checkDNS(ctx)
+	if network {
+		network = d.checkConnection(ctx)
+	} else {
+		d.skip("connection", "the host of the API doesn't resolve")
+	}
+	if !network {
+		// Authentication doesn't depend on the API, so it is still checked.
+		d.checkOIDC(ctx)
+		for _, name := range []string{"metrics", "logs", "traces"} {
+			d.skip(name, "the API can't be reached")
+		}
+		return
+	}
+
+	if !d.checkOIDC(ctx) {
+		for _, name := range []string{"metrics", "logs", "traces"} {
+			d.skip(name, "requests can't be authenticated")
+		}
+		return
+	}
+
+	d.probe(ctx, "metrics", "api/metrics/v1", "api/v1/labels")
+	d.probe(ctx, "logs", "api/logs/v1", "loki/api/v1/labels")
+	d.probe(ctx, "traces", "api/traces/v1", "api/services")
+}
+
+// checkConfig checks the config file can be read and is valid. Invalid config files are still checked further, as
+// the problems may not be in the current context.
+func (d *doctor) checkConfig() bool {
+	const name = "config"
+	hint := fmt.Sprintf("fix %s, or remove the APIs and contexts with problems with obsctl context rm and add them again", config.Path())
+
+	conf, err := config.Read(logger)
+	if err != nil {
+		d.fail(name, err.Error(), hint)
+		return false
+	}
+
+	if errs := conf.Validate(); len(errs) > 0 {
+		msgs := make([]string, 0, len(errs))
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		d.conf = conf
+		d.fail(name, strings.Join(msgs, "; "), hint)
+		return true
+	}
+
+	contexts := 0
+	for _, api := range conf.APIs {
+		contexts += len(api.Contexts)
+	}
+	d.conf = conf
+	d.pass(name, fmt.Sprintf("%s is valid, version %d with %d APIs and %d contexts", config.Path(), conf.Version, len(conf.APIs), contexts))
+
+	return true
+}
+
+// checkContext checks there is a current context with a valid API URL.
+func (d *doctor) checkContext() bool {
+	const name = "context"
+
+	tenant, api, err := d.conf.GetCurrentContext()
+	if err != nil {
+		d.fail(name, err.Error(), "log in with obsctl login, or switch to a context with obsctl context switch <api>/<tenant>")
+		return false
+	}
+
+	u, err := url.Parse(api.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		d.fail(name, fmt.Sprintf("invalid API URL %q", api.URL), fmt.Sprintf("fix apis.%s.url in %s", d.conf.Current.API, config.Path()))
+		return false
+	}
+	d.tenant, d.api, d.apiURL = tenant, api, u
+	d.pass(name, fmt.Sprintf("%s/%s, tenant %s at %s", d.conf.Current.API, d.conf.Current.Tenant, tenant.Tenant, api.URL))
+
+	return true
+}
+
+// checkDNS checks the host of the API resolves.
+func (d *doctor) checkDNS(ctx context.Context) bool {
+	const name = "dns"
+
+	host := d.apiURL.Hostname()
+	if net.ParseIP(host) != nil {
+		d.pass(name, fmt.Sprintf("%s is an IP address", host))
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		d.fail(name, err.Error(), fmt.Sprintf("check the API URL %s is right, and that your DNS resolver, VPN or proxy settings let you resolve %s", d.api.URL, host))
+		return false
+	}
+
+	d.pass(name, fmt.Sprintf("%s resolves to %s", host, strings.Join(addrs, ", ")))
+	return true
+}
+
+// checkConnection checks the API can be connected to and, if it is served with TLS, that its certificate is trusted
+// by the system CAs obsctl verifies it with.
+func (d *doctor) checkConnection(ctx context.Context) bool {
+	const name = "connection"
+
+	port := d.apiURL.Port()
+	if port == "" {
+		port = "443"
+		if d.apiURL.Scheme == "http" {
+			port = "80"
+		}
+	}
+	addr := net.JoinHostPort(d.apiURL.Hostname(), port)
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	if d.apiURL.Scheme == "http" {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			d.fail(name, err.Error(), fmt.Sprintf("check the API is running and listening on %s, and that no firewall blocks it", addr))
+			return false
+		}
+		conn.Close()
+
+		d.warn(name, fmt.Sprintf("connected to %s, but the API URL isn't https, so tokens and data are sent unencrypted", addr), "use an https API URL, if the API serves one")
+		return true
+	}
+
+	// The certificate is checked by sending a request with the transport requests to the API are sent with, so that
+	// it is trusted by the same CAs, which are the ones of the system.
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, d.apiURL.String(), nil)
+	if err != nil {
+		d.fail(name, err.Error(), "")
+		return false
+	}
+	resp, err := (&http.Client{Transport: config.BaseTransport()}).Do(req)
+	if err != nil {
+		hint := fmt.Sprintf("check the API is running and serves TLS on %s, and that no firewall blocks it", addr)
+		if strings.Contains(err.Error(), "certificate") {
+			hint = "obsctl trusts the CAs of the system, if the API uses a private CA add it to the CAs of the system"
+		}
+		d.fail(name, err.Error(), hint)
+		return false
+	}
+	resp.Body.Close()
+
+	// Responses replayed from a cassette weren't sent over TLS.
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		d.pass(name, fmt.Sprintf("connected to %s", addr))
+		return true
+	}
+
+	cert := resp.TLS.PeerCertificates[0]
+	detail := fmt.Sprintf("certificate of %s issued by %s is trusted by the system CAs, expires %s", cert.Subject.CommonName, cert.Issuer.CommonName, cert.NotAfter.Format(time.RFC3339))
+	if time.Until(cert.NotAfter) < 14*24*time.Hour {
+		d.warn(name, detail, "the certificate of the API expires in less than 14 days, tell the operators of the API")
+		return true
+	}
+
+	d.pass(name, detail)
+	return true
+}
+
+// checkOIDC checks the OIDC issuer of the tenant can be discovered, and issues tokens for its credentials.
+func (d *doctor) checkOIDC(ctx context.Context) bool {
+	if d.tenant.OIDC == nil {
+		d.skip("oidc discovery", "the tenant isn't configured with OIDC")
+		d.skip("oidc token", "the tenant isn't configured with OIDC")
+		return d.authenticate(ctx)
+	}
+
+	dctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	provider, err := oidc.NewProvider(config.IssuerContext(dctx), d.tenant.OIDC.IssuerURL)
+	if err != nil {
+		d.fail("oidc discovery", err.Error(), fmt.Sprintf("check the issuer URL %s is right and reachable; %s/.well-known/openid-configuration should return its metadata", d.tenant.OIDC.IssuerURL, strings.TrimSuffix(d.tenant.OIDC.IssuerURL, "/")))
+		d.skip("oidc token", "the issuer can't be discovered")
+		return false
+	}
+	d.pass("oidc discovery", fmt.Sprintf("%s issues tokens at %s", d.tenant.OIDC.IssuerURL, provider.Endpoint().TokenURL))
+
+	// A new token is fetched, as the saved one doesn't tell whether the credentials still work. It isn't saved, so
+	// that diagnosing a context doesn't change it.
+	tctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	tkn, err := d.tenant.FetchToken(tctx, provider.Endpoint().TokenURL)
+	if err != nil {
+		d.fail("oidc token", err.Error(), "check the client ID, secret and audience of the tenant, and log in again with obsctl login if they changed")
+		return false
+	}
+	detail := "issued a token"
+	if !tkn.Expiry.IsZero() {
+		detail += fmt.Sprintf(" expiring in %s", time.Until(tkn.Expiry).Round(time.Second))
+	}
+	d.pass("oidc token", detail)
+
+	return d.authenticate(ctx)
+}
+
+// authenticate creates the client the tenant's endpoints are probed with. Unlike the clients of other commands, it
+// doesn't save the token it fetches, so that diagnosing a context doesn't change the config file.
+func (d *doctor) authenticate(ctx context.Context) bool {
+	client, err := d.tenant.Client(ctx, logger)
+	if err != nil {
+		d.fail("client", err.Error(), "run the command again with --log.level=debug for details")
+		return false
+	}
+	d.client = client
+
+	return true
+}
+
+// probe checks a read endpoint of the tenant.
+func (d *doctor) probe(ctx context.Context, name, api, endpoint string) {
+	u := *d.apiURL
+	u.Path = path.Join("/", u.Path, api, d.tenant.Tenant, endpoint)
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		d.fail(name, err.Error(), "")
+		return
+	}
+
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	if err != nil {
+		d.fail(name, err.Error(), "check the API is reachable, and try again with --debug-http to see the request")
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	took := time.Since(start).Round(time.Millisecond)
+
+	detail := fmt.Sprintf("GET %s: %s in %s", u.Path, resp.Status, took)
+	if resp.StatusCode/100 != 2 {
+		if msg := strings.TrimSpace(string(body)); msg != "" {
+			detail += ": " + msg
+		}
+	}
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		d.pass(name, detail)
+	case resp.StatusCode == http.StatusUnauthorized:
+		d.fail(name, detail, "the token was rejected; check the tenant's OIDC issuer and audience are the ones the API expects")
+	case resp.StatusCode == http.StatusForbidden:
+		d.fail(name, detail, fmt.Sprintf("the tenant %s may not exist in the API, or may not be allowed to read %s; ask the operators of the API", d.tenant.Tenant, name))
+	case resp.StatusCode == http.StatusNotFound:
+		d.warn(name, detail, fmt.Sprintf("the API may not serve %s, which is fine if the tenant doesn't use them", name))
+	case resp.StatusCode >= 500:
+		d.fail(name, detail, "the API or its backend is failing; try again later, or tell the operators of the API")
+	default:
+		d.fail(name, detail, "try again with --debug-http to see the request and response")
+	}
+}
+
+// printChecks writes the results of checks as a table, with the hints of the ones which didn't pass.
+func printChecks(w io.Writer, results []checkResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Status, r.Name, r.Detail)
+		if r.Hint != "" {
+			fmt.Fprintf(tw, "\t\thint: %s\n", r.Hint)
+		}
+	}
+	return tw.Flush()
+}
+
+func NewDoctorCmd(ctx context.Context) *cobra.Command {
+	var output string
+	var timeout time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check the configuration and connectivity of the current context.",
+		Long: `Check the configuration and connectivity of the current context step by step: the config file, resolving and connecting to the API, its TLS certificate, OIDC discovery and token issuance, and reading metrics, logs and traces of the tenant.
+Checks which don't pass have hints on how to fix them. Exits with an error if any check fails.`,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			if output != "table" && output != "json" {
+				cmd.SilenceUsage = false
+				return fmt.Errorf("unknown output format %q, expected table or json", output)
+			}
+
+			d := &doctor{timeout: timeout}
+			d.run(ctx)
+
+			if output == "json" {
+				b, err := json.MarshalIndent(d.results, "", "\t")
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(cmd.OutOrStdout(), string(b))
+			} else if err := printChecks(cmd.OutOrStdout(), d.results); err != nil {
+				return err
+			}
+
+			if n := d.failed(); n > 0 {
+				return fmt.Errorf("%d of %d checks failed", n, len(d.results))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "table", "Output format. One of: table|json")
+	cmd.Flags().DurationVar(&timeout, "timeout", 10*time.Second, "Timeout of each network check.")
+
+	return cmd
+}
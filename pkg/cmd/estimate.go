@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/observatorium/api/client"
+	"github.com/observatorium/api/client/parameters"
+	"github.com/observatorium/obsctl/pkg/promql"
+	"github.com/prometheus/common/model"
+)
+
+// defaultMaxSamples is the default number of estimated samples above which queries aren't run, which is also
+// the default number of samples a single Prometheus query can load.
+const defaultMaxSamples = 50000000
+
+// estimateSelector is a selector of a query and the window before each evaluation it reads series in.
+type estimateSelector struct {
+	selector string
+	// lookback is how long before the evaluation time samples are read, e.g. the range of a matrix selector.
+	lookback time.Duration
+	offset   time.Duration
+}
+
+// estimateSelectors returns the distinct selectors of a query with the windows they read series in.
+func estimateSelectors(e promql.Expr) []estimateSelector {
+	var res []estimateSelector
+	collectSelectors(e, 0, 0, &res, map[estimateSelector]bool{})
+	return res
+}
+
+func collectSelectors(e promql.Expr, lookback, offset time.Duration, res *[]estimateSelector, seen map[estimateSelector]bool) {
+	add := func(s estimateSelector) {
+		if !seen[s] {
+			seen[s] = true
+			*res = append(*res, s)
+		}
+	}
+
+	switch n := e.(type) {
+	case *promql.VectorSelector:
+		add(estimateSelector{selector: n.Selector(), lookback: lookback, offset: offset + n.Offset})
+	case *promql.MatrixSelector:
+		add(estimateSelector{selector: n.VectorSelector.Selector(), lookback: lookback + n.Range, offset: offset + n.VectorSelector.Offset})
+	case *promql.SubqueryExpr:
+		collectSelectors(n.Expr, lookback+n.Range, offset+n.Offset, res, seen)
+	default:
+		for _, c := range promql.Children(e) {
+			collectSelectors(c, lookback, offset, res, seen)
+		}
+	}
+}
+
+// selectorEstimate is the number of series a selector matches and of samples it is estimated to load.
+type selectorEstimate struct {
+	selector string
+	series   int
+	samples  int64
+}
+
+// queryEstimate is the estimated cost of a query.
+type queryEstimate struct {
+	steps     int64
+	selectors []selectorEstimate
+}
+
+func (e *queryEstimate) samples() int64 {
+	var total int64
+	for _, s := range e.selectors {
+		total += s.samples
+	}
+	return total
+}
+
+// querySteps returns the number of steps a query is evaluated at between start and end, which is one for
+// instant queries, whose step is zero.
+func querySteps(start, end time.Time, step time.Duration) int64 {
+	if step <= 0 || !end.After(start) {
+		return 1
+	}
+	return int64(end.Sub(start)/step) + 1
+}
+
+// estimateQuery estimates the samples a query loads between start and end by counting the series every selector
+// matches and multiplying them by the number of steps.
+func estimateQuery(ctx context.Context, f *client.ClientWithResponses, tenant parameters.Tenant, query string, start, end time.Time, step time.Duration) (*queryEstimate, error) {
+	expr, err := promql.Parse(query)
+	if err != nil {
+		return nil, fmt.Errorf("parsing query: %w", err)
+	}
+
+	est := &queryEstimate{steps: querySteps(start, end, step)}
+	for _, s := range estimateSelectors(expr) {
+		seriesStart := formatTime(start.Add(-s.lookback - s.offset))
+		seriesEnd := formatTime(end.Add(-s.offset))
+		resp, err := f.GetSeriesWithResponse(ctx, tenant, &client.GetSeriesParams{
+			Match: []string{s.selector},
+			Start: (*parameters.StartTS)(&seriesStart),
+			End:   (*parameters.EndTS)(&seriesEnd),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("getting series of %s: %w", s.selector, err)
+		}
+		if err := checkStatus(resp.Body, resp.StatusCode()); err != nil {
+			return nil, fmt.Errorf("getting series of %s: %w", s.selector, err)
+		}
+
+		var series struct {
+			Data []model.LabelSet `json:"data"`
+		}
+		if err := json.Unmarshal(resp.Body, &series); err != nil {
+			return nil, fmt.Errorf("parsing series of %s: %w", s.selector, err)
+		}
+
+		est.selectors = append(est.selectors, selectorEstimate{
+			selector: s.selector,
+			series:   len(series.Data),
+			samples:  int64(len(series.Data)) * est.steps,
+		})
+	}
+
+	return est, nil
+}
+
+// estimateRun estimates a query as it is run by the metrics query command, over its range or at its evaluation time.
+func estimateRun(ctx context.Context, f *client.ClientWithResponses, tenant parameters.Tenant, query string, isRange bool, evalTime, start, end, step string) (*queryEstimate, error) {
+	if !isRange {
+		t := time.Now()
+		if evalTime != "" {
+			var err error
+			if t, err = parseTime(evalTime); err != nil {
+				return nil, err
+			}
+		}
+		return estimateQuery(ctx, f, tenant, query, t, t, 0)
+	}
+
+	if start == "" || end == "" {
+		return nil, fmt.Errorf("start/end timestamp not provided for range query")
+	}
+	s, err := parseTime(start)
+	if err != nil {
+		return nil, err
+	}
+	e, err := parseTime(end)
+	if err != nil {
+		return nil, err
+	}
+	d, err := parseStep(step)
+	if err != nil {
+		return nil, err
+	}
+
+	return estimateQuery(ctx, f, tenant, query, s, e, d)
+}
+
+// printEstimate writes the estimated samples of every selector of a query and their total.
+func printEstimate(w io.Writer, est *queryEstimate, maxSamples int64) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SELECTOR\tSERIES\tSAMPLES")
+	for _, s := range est.selectors {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", s.selector, s.series, s.samples)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "Estimated %d samples over %d steps (limit %d).\n", est.samples(), est.steps, maxSamples)
+	return err
+}
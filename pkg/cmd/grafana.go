@@ -0,0 +1,260 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// grafanaDashboard is the subset of a Grafana dashboard JSON model needed to render its panels.
+type grafanaDashboard struct {
+	Title  string         `json:"title"`
+	Panels []grafanaPanel `json:"panels"`
+	// Rows are used by dashboards from before Grafana 5.
+	Rows []struct {
+		Panels []grafanaPanel `json:"panels"`
+	} `json:"rows"`
+	Templating struct {
+		List []grafanaVariable `json:"list"`
+	} `json:"templating"`
+}
+
+type grafanaPanel struct {
+	Title      string          `json:"title"`
+	Type       string          `json:"type"`
+	Datasource json.RawMessage `json:"datasource"`
+	Targets    []struct {
+		Expr       string          `json:"expr"`
+		Hide       bool            `json:"hide"`
+		Datasource json.RawMessage `json:"datasource"`
+	} `json:"targets"`
+	// Panels are set for collapsed rows.
+	Panels []grafanaPanel `json:"panels"`
+}
+
+type grafanaVariable struct {
+	Name     string `json:"name"`
+	AllValue string `json:"allValue"`
+	Current  struct {
+		Value json.RawMessage `json:"value"`
+	} `json:"current"`
+}
+
+// loadGrafanaDashboard reads a Grafana dashboard JSON file, either as exported from the UI or as returned by the API.
+func loadGrafanaDashboard(path string) (*grafanaDashboard, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading grafana dashboard: %w", err)
+	}
+
+	var wrapped struct {
+		Dashboard *grafanaDashboard `json:"dashboard"`
+	}
+	if err := json.Unmarshal(b, &wrapped); err == nil && wrapped.Dashboard != nil {
+		return wrapped.Dashboard, nil
+	}
+
+	d := &grafanaDashboard{}
+	if err := json.Unmarshal(b, d); err != nil {
+		return nil, fmt.Errorf("parsing grafana dashboard: %w", err)
+	}
+
+	return d, nil
+}
+
+// variables returns the current values of the dashboard template variables, as saved in the dashboard.
+// Multi-value variables are joined as a regex alternation, the same way Grafana formats them for Prometheus.
+func (d *grafanaDashboard) variables() map[string]string {
+	vars := map[string]string{}
+	for _, v := range d.Templating.List {
+		var value string
+		var values []string
+		switch {
+		case json.Unmarshal(v.Current.Value, &value) == nil:
+		case json.Unmarshal(v.Current.Value, &values) == nil:
+			value = strings.Join(values, "|")
+			if len(values) > 1 {
+				value = "(" + value + ")"
+			}
+		default:
+			continue
+		}
+
+		if value == "$__all" || value == "($__all)" {
+			value = ".*"
+			if v.AllValue != "" {
+				value = v.AllValue
+			}
+		}
+
+		vars[v.Name] = value
+	}
+
+	return vars
+}
+
+// panels returns a panel for every Grafana panel with at least one visible query, flattening rows.
+// Each target becomes a separate query of the panel, whose type follows the type of the Grafana panel. Loki
+// queries which select log lines rather than compute metrics are always of type logs. Targets of unsupported
+// datasources are skipped and the titles of their panels returned, once per panel.
+func (d *grafanaDashboard) panels() ([]grafanaPanelQueries, []string) {
+	all := d.Panels
+	for _, r := range d.Rows {
+		all = append(all, r.Panels...)
+	}
+
+	var (
+		res     []grafanaPanelQueries
+		skipped []string
+	)
+	var walk func(ps []grafanaPanel)
+	walk = func(ps []grafanaPanel) {
+		for _, p := range ps {
+			walk(p.Panels)
+
+			q := grafanaPanelQueries{title: p.Title}
+			typ := grafanaPanelType(p.Type)
+			unsupported := false
+			for _, t := range p.Targets {
+				if t.Hide || t.Expr == "" {
+					continue
+				}
+
+				ds := datasourceType(t.Datasource)
+				if ds == "" {
+					ds = datasourceType(p.Datasource)
+				}
+
+				switch ds {
+				case "loki":
+					qt := typ
+					if isLogQuery(t.Expr) {
+						qt = panelTypeLogs
+					}
+					q.queries = append(q.queries, panelConfig{Title: p.Title, Type: qt, Datasource: datasourceLogs, Query: t.Expr})
+				case "", "prometheus", "thanos":
+					if typ == panelTypeLogs {
+						unsupported = true
+						continue
+					}
+					q.queries = append(q.queries, panelConfig{Title: p.Title, Type: typ, Datasource: datasourceMetrics, Query: t.Expr})
+				default:
+					unsupported = true
+				}
+			}
+			if unsupported {
+				skipped = append(skipped, p.Title)
+			}
+
+			if len(q.queries) > 0 {
+				res = append(res, q)
+			}
+		}
+	}
+	walk(all)
+
+	return res, skipped
+}
+
+// grafanaPanelType returns the dashboard panel type which a Grafana panel type is rendered as. Panels showing a
+// single value become stat panels, and any other visualization a time series graph.
+func grafanaPanelType(typ string) string {
+	switch typ {
+	case "stat", "singlestat", "gauge", "bargauge":
+		return panelTypeStat
+	case "table", "table-old":
+		return panelTypeTable
+	case "logs":
+		return panelTypeLogs
+	default:
+		return panelTypeTimeseries
+	}
+}
+
+// isLogQuery returns true if a LogQL query selects log lines, which start with a stream selector, rather than
+// computing metrics from them.
+func isLogQuery(query string) bool {
+	return strings.HasPrefix(strings.TrimSpace(query), "{")
+}
+
+// grafanaPanelQueries are the queries of a single Grafana panel, which are rendered together.
+type grafanaPanelQueries struct {
+	title   string
+	queries []panelConfig
+}
+
+// datasourceType returns the type of a Grafana datasource reference, which is either an object with a type or,
+// in older dashboards, the datasource name. Names and template variables don't tell the type, so they are
+// treated as Prometheus.
+func datasourceType(raw json.RawMessage) string {
+	var ref struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &ref); err == nil {
+		return strings.ToLower(ref.Type)
+	}
+
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil && strings.Contains(strings.ToLower(name), "loki") {
+		return "loki"
+	}
+
+	return ""
+}
+
+var grafanaVariableRegexp = regexp.MustCompile(`\$(\w+)|\$\{(\w+)(?::\w+)?\}|\[\[(\w+)(?::\w+)?\]\]`)
+
+// substituteVariables replaces Grafana template variables in a query, including the global $__interval,
+// $__rate_interval and $__range ones. It returns the names of variables which have no value.
+func substituteVariables(query string, vars map[string]string, rng, step time.Duration) (string, []string) {
+	builtins := map[string]string{
+		"__interval":      model.Duration(step).String(),
+		"__interval_ms":   strconv.FormatInt(step.Milliseconds(), 10),
+		"__rate_interval": model.Duration(4 * step).String(),
+		"__range":         model.Duration(rng).String(),
+		"__range_s":       strconv.FormatInt(int64(rng.Seconds()), 10),
+		"__range_ms":      strconv.FormatInt(rng.Milliseconds(), 10),
+	}
+
+	var missing []string
+	res := grafanaVariableRegexp.ReplaceAllStringFunc(query, func(m string) string {
+		sub := grafanaVariableRegexp.FindStringSubmatch(m)
+		name := sub[1] + sub[2] + sub[3]
+
+		// References like $1 are capture groups, e.g. of label_replace, not variables.
+		if _, err := strconv.Atoi(name); err == nil {
+			return m
+		}
+
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		if v, ok := builtins[name]; ok {
+			return v
+		}
+
+		missing = append(missing, name)
+		return m
+	})
+
+	return res, missing
+}
+
+var fileNameRegexp = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// panelFileName returns a file name with the given extension for the i-th panel, derived from its title.
+func panelFileName(dir string, i int, title, ext string) string {
+	name := strings.Trim(fileNameRegexp.ReplaceAllString(strings.ToLower(title), "-"), "-")
+	if name == "" {
+		name = "panel"
+	}
+
+	return filepath.Join(dir, fmt.Sprintf("%02d-%s.%s", i, name, ext))
+}
@@ -0,0 +1,1017 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/guptarohit/asciigraph"
+	"github.com/prometheus/common/model"
+	"github.com/wcharczuk/go-chart/v2"
+	"golang.org/x/term"
+)
+
+const (
+	graphModeLine    = "line"
+	graphModeArea    = "area"
+	graphModeStacked = "stacked"
+
+	unitBytes   = "bytes"
+	unitSeconds = "seconds"
+	unitPercent = "percent"
+
+	// maxLegendLabel is the maximum length of a series name in a legend, longer ones are truncated.
+	maxLegendLabel = 80
+	// maxLegendValue is the maximum length of a label value in a series name of a legend.
+	maxLegendValue = 20
+	// maxTitle is the maximum length of a graph title, longer ones are truncated.
+	maxTitle = 120
+	// maxASCIILegend is the maximum number of series listed in the legend of an ASCII graph.
+	maxASCIILegend = 10
+	// maxASCIIHeight is the maximum number of rows of an ASCII graph sized to its range of values.
+	maxASCIIHeight = 25
+	// defaultTop is the default number of series shown in bar charts.
+	defaultTop = 10
+)
+
+// graphOptions configure how query results are graphed.
+type graphOptions struct {
+	title string
+	// width and height are in pixels for PNG and SVG graphs and in characters for ASCII ones. Zero picks a default.
+	width, height int
+	// yUnit is one of bytes, seconds or percent, or empty for plain numbers.
+	yUnit    string
+	logScale bool
+	// mode is one of line, area or stacked. Empty is the same as line.
+	mode string
+	// color enables ANSI colors for ASCII graphs.
+	color bool
+	// top is the number of series with the highest values shown in bar charts of instant vectors. Zero shows
+	// defaultTop series.
+	top int
+}
+
+func (o graphOptions) validate() error {
+	switch o.yUnit {
+	case "", unitBytes, unitSeconds, unitPercent:
+	default:
+		return fmt.Errorf("unsupported y-axis unit %q: use one of %s, %s or %s", o.yUnit, unitBytes, unitSeconds, unitPercent)
+	}
+
+	switch o.mode {
+	case "", graphModeLine, graphModeArea, graphModeStacked:
+	default:
+		return fmt.Errorf("unsupported graph mode %q: use one of %s, %s or %s", o.mode, graphModeLine, graphModeArea, graphModeStacked)
+	}
+
+	if o.width < 0 || o.height < 0 {
+		return fmt.Errorf("graph width and height must not be negative")
+	}
+
+	if o.top < 0 {
+		return fmt.Errorf("number of top series must not be negative")
+	}
+
+	return nil
+}
+
+// asciiColors are the colors of series in ASCII graphs, repeating for more series.
+var asciiColors = []asciigraph.AnsiColor{
+	asciigraph.Blue, asciigraph.Green, asciigraph.Red, asciigraph.Yellow, asciigraph.Fuchsia, asciigraph.Aqua,
+	asciigraph.DarkOrange, asciigraph.MediumPurple, asciigraph.YellowGreen, asciigraph.HotPink,
+}
+
+// plotASCII plots every series of a matrix as a line of an ASCII graph of the given width, with a time axis and a
+// legend of series labels below it. Series are aligned by time and missing samples are left as gaps. The height
+// includes the axis and legend, zero sizes the graph to the range of values.
+func plotASCII(matrixResult model.Matrix, opts graphOptions) string {
+	if len(matrixResult) == 0 {
+		return "No data"
+	}
+
+	grid, minT, maxT := alignSeries(matrixResult)
+	lo, hi, ok := minMax(grid)
+	if !ok {
+		return "No data"
+	}
+
+	legend := asciiLegend(matrixResult, opts.color)
+	axis := true
+	plotOpts := []asciigraph.Option{}
+	if opts.height > 0 {
+		// Give the graph itself at least two thirds of the height, dropping parts of the legend and then the axis.
+		rows := opts.height
+		if max := rows / 3; len(legend) > max {
+			legend = legend[:max]
+		}
+		rows -= len(legend)
+		if rows < 5 {
+			axis = false
+		} else {
+			rows -= 2
+		}
+		// The graph has one line more than rows.
+		if rows > 1 {
+			plotOpts = append(plotOpts, asciigraph.Height(rows-1))
+		}
+	} else if hi-lo > maxASCIIHeight {
+		plotOpts = append(plotOpts, asciigraph.Height(maxASCIIHeight))
+	}
+	if opts.color {
+		colors := make([]asciigraph.AnsiColor, len(grid))
+		for i := range colors {
+			colors[i] = asciiColors[i%len(asciiColors)]
+		}
+		plotOpts = append(plotOpts, asciigraph.SeriesColors(colors...))
+	}
+
+	plot := func(columns int) string {
+		data := make([][]float64, len(grid))
+		for i, g := range grid {
+			data[i] = resample(g, columns)
+		}
+		return asciigraph.PlotMany(data, plotOpts...)
+	}
+
+	// The width of the value labels is only known after plotting, so plot again if they took more or less room
+	// than guessed.
+	columns := opts.width - 10
+	if columns < 2 {
+		columns = 2
+	}
+	graph := plot(columns)
+	axisColumn := yAxisColumn(graph)
+	if c := opts.width - axisColumn; c != columns && c >= 2 {
+		columns = c
+		graph = plot(columns)
+		axisColumn = yAxisColumn(graph)
+	}
+
+	lines := []string{graph}
+	if axis {
+		lines = append(lines, timeAxis(minT, maxT, axisColumn, columns)...)
+	}
+	// Graphs narrower than their value labels still show the start of every legend line.
+	legendWidth := opts.width - axisColumn
+	if legendWidth < 1 {
+		legendWidth = 1
+	}
+	for _, l := range legend {
+		lines = append(lines, strings.Repeat(" ", axisColumn)+strings.TrimRight(fitLine(l, legendWidth), " "))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// alignSeries places the samples of every series on a common time grid, with the smallest interval between samples of
+// any series. Missing samples are NaN, which are drawn as gaps.
+func alignSeries(matrixResult model.Matrix) ([][]float64, model.Time, model.Time) {
+	var minT, maxT model.Time
+	var step time.Duration
+	first := true
+	for _, ss := range matrixResult {
+		for i, sample := range ss.Values {
+			if first || sample.Timestamp < minT {
+				minT = sample.Timestamp
+			}
+			if first || sample.Timestamp > maxT {
+				maxT = sample.Timestamp
+			}
+			first = false
+
+			if i > 0 {
+				if d := sample.Timestamp.Sub(ss.Values[i-1].Timestamp); d > 0 && (step == 0 || d < step) {
+					step = d
+				}
+			}
+		}
+	}
+
+	// Limit the grid for series with very different resolutions.
+	n := 1
+	if step > 0 {
+		n = int(maxT.Sub(minT)/step) + 1
+		if n > 10000 {
+			n = 10000
+			step = maxT.Sub(minT) / time.Duration(n-1)
+		}
+	}
+
+	grid := make([][]float64, len(matrixResult))
+	for i, ss := range matrixResult {
+		grid[i] = make([]float64, n)
+		for j := range grid[i] {
+			grid[i][j] = math.NaN()
+		}
+		for _, sample := range ss.Values {
+			j := 0
+			if step > 0 {
+				j = int(math.Round(float64(sample.Timestamp.Sub(minT)) / float64(step)))
+			}
+			grid[i][j] = float64(sample.Value)
+		}
+	}
+
+	return grid, minT, maxT
+}
+
+// resample returns values resized to the given number of columns. Values are averaged when shrinking and linearly
+// interpolated when growing, without interpolating over gaps.
+func resample(values []float64, columns int) []float64 {
+	n := len(values)
+	res := make([]float64, columns)
+
+	if n >= columns {
+		for c := range res {
+			sum, count := 0.0, 0
+			for _, v := range values[c*n/columns : (c+1)*n/columns] {
+				if !math.IsNaN(v) {
+					sum += v
+					count++
+				}
+			}
+
+			res[c] = math.NaN()
+			if count > 0 {
+				res[c] = sum / float64(count)
+			}
+		}
+		return res
+	}
+
+	for c := range res {
+		f := 0.0
+		if columns > 1 {
+			f = float64(c) * float64(n-1) / float64(columns-1)
+		}
+
+		i := int(f)
+		if i+1 < n && !math.IsNaN(values[i]) && !math.IsNaN(values[i+1]) {
+			res[c] = values[i] + (values[i+1]-values[i])*(f-float64(i))
+			continue
+		}
+		res[c] = values[int(math.Round(f))]
+	}
+
+	return res
+}
+
+// minMax returns the lowest and highest finite values of a grid, and false if it has none.
+func minMax(grid [][]float64) (float64, float64, bool) {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	found := false
+	for _, g := range grid {
+		for _, v := range g {
+			if !math.IsNaN(v) && !math.IsInf(v, 0) {
+				lo, hi = math.Min(lo, v), math.Max(hi, v)
+				found = true
+			}
+		}
+	}
+
+	return lo, hi, found
+}
+
+var ansiRegexp = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// yAxisColumn returns the column of the y-axis of an ASCII graph, where the first sample of every series is drawn.
+func yAxisColumn(graph string) int {
+	line := ansiRegexp.ReplaceAllString(strings.SplitN(graph, "\n", 2)[0], "")
+	for i, r := range []rune(line) {
+		if r == '┤' || r == '┼' {
+			return i
+		}
+	}
+
+	return 0
+}
+
+// timeAxis returns an x-axis with time ticks for an ASCII graph, which starts at the given column of the y-axis.
+func timeAxis(minT, maxT model.Time, axisColumn, columns int) []string {
+	format := "15:04"
+	if maxT.Sub(minT) > 24*time.Hour {
+		format = "01-02 15:04"
+	} else if maxT.Sub(minT) < 10*time.Minute {
+		format = "15:04:05"
+	}
+
+	ticks := []rune(strings.Repeat("─", columns))
+	ticks[0] = '└'
+	labels := []rune(strings.Repeat(" ", columns))
+
+	spacing := len(format) + 3
+	for c := 0; c+len(format) <= columns; c += spacing {
+		if c > 0 {
+			ticks[c] = '┬'
+		}
+
+		t := minT.Time()
+		if columns > 1 {
+			t = t.Add(time.Duration(float64(maxT.Sub(minT)) * float64(c) / float64(columns-1)))
+		}
+		copy(labels[c:], []rune(t.Local().Format(format)))
+	}
+
+	pad := strings.Repeat(" ", axisColumn)
+	return []string{pad + string(ticks), strings.TrimRight(pad+string(labels), " ")}
+}
+
+// asciiLegend returns a legend line for every series, marked with the color of the series.
+func asciiLegend(matrixResult model.Matrix, color bool) []string {
+	var lines []string
+	for i, name := range legendNames(matrixResult) {
+		if i == maxASCIILegend {
+			lines = append(lines, fmt.Sprintf("… and %d more series", len(matrixResult)-i))
+			break
+		}
+
+		marker := "■"
+		if color {
+			marker = asciiColors[i%len(asciiColors)].String() + marker + asciigraph.Default.String()
+		}
+		lines = append(lines, marker+" "+name)
+	}
+
+	return lines
+}
+
+// terminalWidth returns the width of the terminal on standard output, or 80 if it is not a terminal.
+func terminalWidth() int {
+	if w, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil && w > 0 {
+		return w
+	}
+
+	return 80
+}
+
+// colorEnabled returns true if standard output is a terminal and colors were not disabled with NO_COLOR.
+func colorEnabled() bool {
+	_, noColor := os.LookupEnv("NO_COLOR")
+	return !noColor && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// renderChart renders every series of a matrix as a PNG or SVG chart, titled and with a legend of series labels.
+func renderChart(matrixResult model.Matrix, format string, opts graphOptions, w io.Writer) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	renderer, err := rendererFor(format)
+	if err != nil {
+		return err
+	}
+
+	if len(matrixResult) == 0 {
+		return fmt.Errorf("no samples to graph")
+	}
+
+	names := legendNames(matrixResult)
+	// Running totals per timestamp of the series stacked so far.
+	stacked := map[model.Time]float64{}
+
+	var data []chart.Series
+	// seriesIndex is the index in the matrix of every graphed series.
+	var seriesIndex []int
+	minY, maxY := math.Inf(1), math.Inf(-1)
+	for i, ss := range matrixResult {
+		xstream := []time.Time{}
+		ystream := []float64{}
+		for _, sample := range ss.Values {
+			v := float64(sample.Value)
+			if opts.mode == graphModeStacked {
+				stacked[sample.Timestamp] += v
+				v = stacked[sample.Timestamp]
+			}
+			if opts.logScale {
+				// Non-positive values have no logarithm, so they are left out like missing samples.
+				if v <= 0 {
+					continue
+				}
+				v = math.Log10(v)
+			}
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+
+			minY, maxY = math.Min(minY, v), math.Max(maxY, v)
+			ystream = append(ystream, v)
+			xstream = append(xstream, sample.Timestamp.Time())
+		}
+		if len(xstream) == 0 {
+			continue
+		}
+
+		style := chart.Style{StrokeColor: chart.GetDefaultColor(i)}
+		if opts.mode == graphModeArea || opts.mode == graphModeStacked {
+			style.FillColor = style.StrokeColor.WithAlpha(64)
+		}
+
+		seriesIndex = append(seriesIndex, i)
+		data = append(data, chart.TimeSeries{
+			Style:   style,
+			XValues: xstream,
+			YValues: ystream,
+			YAxis:   chart.YAxisPrimary,
+		})
+	}
+
+	if len(data) == 0 {
+		return fmt.Errorf("no samples to graph")
+	}
+
+	// Stacked series are drawn from the top down, so that each area only covers the ones above it.
+	if opts.mode == graphModeStacked {
+		for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+			data[i], data[j] = data[j], data[i]
+			seriesIndex[i], seriesIndex[j] = seriesIndex[j], seriesIndex[i]
+		}
+	}
+
+	yAxis := chart.YAxis{
+		Name: "Value",
+		ValueFormatter: func(v interface{}) string {
+			f, _ := v.(float64)
+			return formatValue(f, opts.yUnit)
+		},
+	}
+	if opts.yUnit != "" {
+		yAxis.Name = strings.ToUpper(opts.yUnit[:1]) + opts.yUnit[1:]
+	}
+	if opts.logScale {
+		yAxis.Range, yAxis.Ticks = logTicks(minY, maxY, opts.yUnit)
+	}
+
+	graph := chart.Chart{
+		Width:  opts.width,
+		Height: opts.height,
+		XAxis: chart.XAxis{
+			Name:           "Time",
+			ValueFormatter: chart.TimeValueFormatterWithFormat(timeFormat(matrixResult)),
+		},
+		YAxis:  yAxis,
+		Series: data,
+	}
+
+	// Make room for the legend left of the chart, shortening names which are too wide and leaving out the ones
+	// which don't fit its height.
+	legendWidth, lineHeight, err := fitLegend(names, graph.GetWidth()/3)
+	if err != nil {
+		return err
+	}
+	for i := range data {
+		ts := data[i].(chart.TimeSeries)
+		ts.Name = names[seriesIndex[i]]
+		if i >= (graph.GetHeight()-10)/lineHeight {
+			ts.Name = ""
+		}
+		data[i] = ts
+	}
+
+	padding := chart.Box{Top: 20, Left: legendWidth + 20}
+	if opts.title != "" {
+		padding.Top = 50
+	}
+	graph.Background = chart.Style{Padding: padding}
+	graph.Elements = []chart.Renderable{chart.LegendLeft(&graph), drawTitle(truncate(opts.title, maxTitle))}
+
+	if err := graph.Render(renderer, w); err != nil {
+		return fmt.Errorf("could not render graph: %w", err)
+	}
+
+	return nil
+}
+
+// legendNames returns a legend name for every series of a matrix. Labels with the same value in all series are left
+// out, as they don't tell series apart.
+func legendNames(matrixResult model.Matrix) []string {
+	metrics := make([]model.Metric, len(matrixResult))
+	for i, ss := range matrixResult {
+		metrics[i] = ss.Metric
+	}
+
+	return metricNames(metrics)
+}
+
+// metricNames returns a legend name for every metric, leaving out labels with the same value in all of them.
+func metricNames(metrics []model.Metric) []string {
+	names := make([]string, len(metrics))
+	if len(metrics) == 0 {
+		return names
+	}
+	if len(metrics) == 1 {
+		names[0] = legendName(model.LabelSet(metrics[0]))
+		return names
+	}
+
+	common := model.LabelSet{}
+	for n, v := range metrics[0] {
+		common[n] = v
+	}
+	for _, m := range metrics[1:] {
+		for n, v := range common {
+			if m[n] != v {
+				delete(common, n)
+			}
+		}
+	}
+
+	for i, m := range metrics {
+		ls := model.LabelSet{}
+		for n, v := range m {
+			if _, ok := common[n]; !ok {
+				ls[n] = v
+			}
+		}
+		if len(ls) == 0 {
+			ls = model.LabelSet(m)
+		}
+		names[i] = legendName(ls)
+	}
+
+	return names
+}
+
+// legendName formats a label set for a legend, shortening long label values so that the other labels stay visible.
+func legendName(ls model.LabelSet) string {
+	short := make(model.LabelSet, len(ls))
+	for n, v := range ls {
+		short[n] = model.LabelValue(truncate(string(v), maxLegendValue))
+	}
+
+	return truncate(short.String(), maxLegendLabel)
+}
+
+// fitLegend shortens the given names to fit a left legend of at most maxWidth pixels in the default chart font. It
+// returns the width of the legend and the height of a line in it.
+func fitLegend(names []string, maxWidth int) (int, int, error) {
+	font, err := chart.GetDefaultFont()
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not load font: %w", err)
+	}
+
+	r, err := chart.PNG(1, 1)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not measure legend: %w", err)
+	}
+	r.SetFont(font)
+	r.SetFontSize(8)
+
+	// Paddings and the sample line drawn next to each name, see chart.LegendLeft.
+	const decoration = 5 + 5 + 5 + 25 + 5
+
+	width, height := 0, 0
+	for i, n := range names {
+		b := r.MeasureText(n)
+		for l := len([]rune(n)); b.Width()+decoration > maxWidth && l > 1; l-- {
+			names[i] = truncate(n, l)
+			b = r.MeasureText(names[i])
+		}
+
+		if b.Width() > width {
+			width = b.Width()
+		}
+		if b.Height() > height {
+			height = b.Height()
+		}
+	}
+
+	return width + decoration, height + chart.DefaultMinimumTickVerticalSpacing, nil
+}
+
+// drawTitle returns a chart element drawing a title centered above the canvas, rather than the whole chart like
+// chart titles are, which would overlap with a left legend.
+func drawTitle(title string) chart.Renderable {
+	return func(r chart.Renderer, cb chart.Box, defaults chart.Style) {
+		if title == "" {
+			return
+		}
+
+		r.SetFont(defaults.GetFont())
+		r.SetFontColor(chart.DefaultTextColor)
+		r.SetFontSize(12)
+
+		b := r.MeasureText(title)
+		r.Text(title, cb.Left+(cb.Width()-b.Width())/2, cb.Top-20)
+	}
+}
+
+// timeFormat returns a format for time axis labels, which includes the date only if the series span several days.
+func timeFormat(matrixResult model.Matrix) string {
+	var minT, maxT model.Time
+	for _, ss := range matrixResult {
+		if len(ss.Values) == 0 {
+			continue
+		}
+		if first := ss.Values[0].Timestamp; minT == 0 || first < minT {
+			minT = first
+		}
+		if last := ss.Values[len(ss.Values)-1].Timestamp; last > maxT {
+			maxT = last
+		}
+	}
+
+	if maxT.Sub(minT) > 24*time.Hour {
+		return "01-02 15:04"
+	}
+
+	return "15:04"
+}
+
+// logTicks returns a y-axis range and ticks at powers of ten for values which were already transformed to log10.
+func logTicks(minY, maxY float64, unit string) (chart.Range, []chart.Tick) {
+	lo, hi := math.Floor(minY), math.Ceil(maxY)
+	if lo == hi {
+		hi++
+	}
+
+	var ticks []chart.Tick
+	for e := lo; e <= hi; e++ {
+		ticks = append(ticks, chart.Tick{Value: e, Label: formatValue(math.Pow(10, e), unit)})
+	}
+
+	return &chart.ContinuousRange{Min: lo, Max: hi}, ticks
+}
+
+var (
+	byteUnits     = []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	durationUnits = []struct {
+		name    string
+		seconds float64
+	}{
+		{"d", 24 * 60 * 60},
+		{"h", 60 * 60},
+		{"m", 60},
+		{"s", 1},
+		{"ms", 1e-3},
+		{"µs", 1e-6},
+		{"ns", 1e-9},
+	}
+)
+
+// formatValue formats a value in a human readable way for the given unit. Bytes are scaled by powers of 1024,
+// seconds to the largest fitting unit of time and percentages are expected as ratios, so that 0.5 is 50%.
+func formatValue(v float64, unit string) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	switch unit {
+	case unitBytes:
+		i := 0
+		for math.Abs(v) >= 1024 && i < len(byteUnits)-1 {
+			v /= 1024
+			i++
+		}
+		return formatNumber(v) + byteUnits[i]
+	case unitSeconds:
+		if v == 0 {
+			return "0s"
+		}
+		for _, u := range durationUnits {
+			if math.Abs(v) >= u.seconds {
+				return formatNumber(v/u.seconds) + u.name
+			}
+		}
+		return formatNumber(v/1e-9) + "ns"
+	case unitPercent:
+		return formatNumber(v*100) + "%"
+	default:
+		return formatNumber(v)
+	}
+}
+
+// formatNumber formats a number with at most two decimals, or three significant digits if it is smaller, using SI
+// suffixes for large values.
+func formatNumber(v float64) string {
+	suffixes := []string{"", "k", "M", "G", "T", "P"}
+	i := 0
+	for math.Abs(v) >= 1000 && i < len(suffixes)-1 {
+		v /= 1000
+		i++
+	}
+
+	// Keep small values from being rounded to zero.
+	if v != 0 && math.Abs(v) < 0.01 {
+		return strconv.FormatFloat(v, 'g', 3, 64)
+	}
+
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64) + suffixes[i]
+}
+
+// truncate shortens s to at most n runes, marking it with an ellipsis if it was shortened. It returns an empty
+// string for n below one.
+func truncate(s string, n int) string {
+	if n < 1 {
+		return ""
+	}
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+
+	return string(r[:n-1]) + "…"
+}
+
+// topSamples returns the samples of a vector with the highest values, highest first, and the number of samples left
+// out.
+func topSamples(vector model.Vector, top int) (model.Vector, int) {
+	if top == 0 {
+		top = defaultTop
+	}
+
+	sorted := make(model.Vector, len(vector))
+	copy(sorted, vector)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := float64(sorted[i].Value), float64(sorted[j].Value)
+		return a > b || !math.IsNaN(a) && math.IsNaN(b)
+	})
+
+	if len(sorted) <= top {
+		return sorted, 0
+	}
+
+	return sorted[:top], len(sorted) - top
+}
+
+// barBlocks are the blocks to draw ASCII bars with, in eighths of a character.
+var barBlocks = []rune("▏▎▍▌▋▊▉█")
+
+// plotBarsASCII plots the samples of a vector with the highest values as horizontal bars of the given width, labeled
+// with the series labels and values.
+func plotBarsASCII(vector model.Vector, opts graphOptions) string {
+	if len(vector) == 0 {
+		return "No data"
+	}
+
+	top := opts.top
+	if opts.height > 0 && (top == 0 && opts.height < defaultTop || opts.height < top) {
+		// Leave a line for the number of series left out.
+		top = opts.height - 1
+		if top < 1 {
+			top = 1
+		}
+	}
+	samples, more := topSamples(vector, top)
+
+	metrics := make([]model.Metric, len(samples))
+	values := make([]string, len(samples))
+	labelWidth, valueWidth, maxValue := 0, 0, 0.0
+	for i, s := range samples {
+		metrics[i] = s.Metric
+		values[i] = formatValue(float64(s.Value), opts.yUnit)
+		if l := utf8.RuneCountInString(values[i]); l > valueWidth {
+			valueWidth = l
+		}
+		if v := math.Abs(float64(s.Value)); v > maxValue {
+			maxValue = v
+		}
+	}
+	names := metricNames(metrics)
+	for _, n := range names {
+		if l := utf8.RuneCountInString(n); l > labelWidth {
+			labelWidth = l
+		}
+	}
+	if max := opts.width * 2 / 5; labelWidth > max {
+		labelWidth = max
+	}
+	if labelWidth < 1 {
+		labelWidth = 1
+	}
+
+	barWidth := opts.width - labelWidth - valueWidth - 2
+	if barWidth < 10 {
+		barWidth = 10
+	}
+
+	lines := make([]string, 0, len(samples)+1)
+	for i, s := range samples {
+		bar := ""
+		if v := math.Abs(float64(s.Value)); maxValue > 0 && !math.IsNaN(v) {
+			eighths := int(math.Round(v / maxValue * float64(barWidth*8)))
+			bar = strings.Repeat(string(barBlocks[7]), eighths/8)
+			if eighths%8 > 0 {
+				bar += string(barBlocks[eighths%8-1])
+			}
+		}
+		bar = fitLine(bar, barWidth)
+		if opts.color {
+			bar = asciiColors[i%len(asciiColors)].String() + bar + asciigraph.Default.String()
+		}
+
+		lines = append(lines, fmt.Sprintf("%s %s %*s", fitLine(truncate(names[i], labelWidth), labelWidth), bar, valueWidth, values[i]))
+	}
+	if more > 0 {
+		lines = append(lines, fmt.Sprintf("… and %d more series", more))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// bigDigits are the characters of a large font, five lines high, to show single values with.
+var bigDigits = map[rune][]string{
+	'0': {"███", "█ █", "█ █", "█ █", "███"},
+	'1': {" █ ", "██ ", " █ ", " █ ", "███"},
+	'2': {"███", "  █", "███", "█  ", "███"},
+	'3': {"███", "  █", "███", "  █", "███"},
+	'4': {"█ █", "█ █", "███", "  █", "  █"},
+	'5': {"███", "█  ", "███", "  █", "███"},
+	'6': {"███", "█  ", "███", "█ █", "███"},
+	'7': {"███", "  █", "  █", "  █", "  █"},
+	'8': {"███", "█ █", "███", "█ █", "███"},
+	'9': {"███", "█ █", "███", "  █", "███"},
+	'.': {" ", " ", " ", " ", "█"},
+	'-': {"   ", "   ", "███", "   ", "   "},
+	'+': {"   ", " █ ", "███", " █ ", "   "},
+	'e': {"   ", "███", "█ █", "██ ", "███"},
+}
+
+var numberRegexp = regexp.MustCompile(`^[-+]?[0-9.]+(e[-+]?[0-9]+)?`)
+
+// plotStatASCII shows a single value as a big number in a large font, followed by its unit or SI suffix. If the
+// number doesn't fit the width, it is shown as is.
+func plotStatASCII(v float64, opts graphOptions) string {
+	s := formatValue(v, opts.yUnit)
+	number := numberRegexp.FindString(s)
+	suffix := s[len(number):]
+
+	lines := make([]string, 5)
+	width := 0
+	for _, r := range number {
+		for i, l := range bigDigits[r] {
+			lines[i] += l + " "
+		}
+		width += utf8.RuneCountInString(bigDigits[r][0]) + 1
+	}
+	if number == "" || width+utf8.RuneCountInString(suffix) > opts.width {
+		return s
+	}
+
+	if opts.color {
+		for i := range lines {
+			lines[i] = asciiColors[0].String() + lines[i] + asciigraph.Default.String()
+		}
+	}
+	lines[4] += suffix
+
+	return strings.Join(lines, "\n")
+}
+
+// renderBarChart renders the samples of a vector with the highest values as a PNG or SVG bar chart.
+func renderBarChart(vector model.Vector, format string, opts graphOptions, w io.Writer) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	renderer, err := rendererFor(format)
+	if err != nil {
+		return err
+	}
+
+	samples, _ := topSamples(vector, opts.top)
+	if len(samples) == 0 {
+		return fmt.Errorf("no samples to graph")
+	}
+
+	metrics := make([]model.Metric, len(samples))
+	for i, s := range samples {
+		metrics[i] = s.Metric
+	}
+	names := metricNames(metrics)
+
+	// Bars start at zero, also for negative values.
+	lo, hi := 0.0, 0.0
+	bars := make([]chart.Value, len(samples))
+	for i, s := range samples {
+		v := float64(s.Value)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			v = 0
+		}
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+
+		color := chart.GetDefaultColor(i)
+		bars[i] = chart.Value{
+			Label: names[i],
+			Value: v,
+			Style: chart.Style{FillColor: color, StrokeColor: color},
+		}
+	}
+	if lo == hi {
+		hi = 1
+	}
+
+	graph := chart.BarChart{
+		Title:      truncate(opts.title, maxTitle),
+		TitleStyle: chart.Style{FontSize: 12},
+		Width:      opts.width,
+		Height:     opts.height,
+		Background: chart.Style{Padding: chart.Box{Top: 50, Bottom: 40}},
+		YAxis: chart.YAxis{
+			Range: &chart.ContinuousRange{Min: lo, Max: hi},
+			ValueFormatter: func(v interface{}) string {
+				f, _ := v.(float64)
+				return formatValue(f, opts.yUnit)
+			},
+		},
+		UseBaseValue: true,
+		Bars:         bars,
+	}
+	if graph.Width == 0 {
+		graph.Width = chart.DefaultChartWidth
+	}
+	// Shrink bars, which are 50 pixels wide by default, to fit the chart.
+	if perBar := (graph.Width - 100) / len(bars); perBar < 70 {
+		graph.BarWidth = perBar * 2 / 3
+		graph.BarSpacing = perBar / 3
+	}
+
+	if err := graph.Render(renderer, w); err != nil {
+		return fmt.Errorf("could not render graph: %w", err)
+	}
+
+	return nil
+}
+
+// renderStat renders a single value as a big number in a PNG or SVG image.
+func renderStat(v float64, format string, opts graphOptions, w io.Writer) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	renderer, err := rendererFor(format)
+	if err != nil {
+		return err
+	}
+
+	width, height := opts.width, opts.height
+	if width == 0 {
+		width = 400
+	}
+	if height == 0 {
+		height = 200
+	}
+
+	font, err := chart.GetDefaultFont()
+	if err != nil {
+		return fmt.Errorf("could not load font: %w", err)
+	}
+
+	r, err := renderer(width, height)
+	if err != nil {
+		return fmt.Errorf("could not render graph: %w", err)
+	}
+	r.SetDPI(chart.DefaultDPI)
+	chart.Draw.Box(r, chart.Box{Right: width, Bottom: height}, chart.Style{
+		FillColor:   chart.DefaultBackgroundColor,
+		StrokeColor: chart.DefaultBackgroundColor,
+		StrokeWidth: chart.DefaultStrokeWidth,
+	})
+	r.SetFont(font)
+
+	top := 0
+	if title := truncate(opts.title, maxTitle); title != "" {
+		r.SetFontColor(chart.DefaultTextColor)
+		r.SetFontSize(12)
+		b := r.MeasureText(title)
+		r.Text(title, (width-b.Width())/2, 10+b.Height())
+		top = 20 + b.Height()
+	}
+
+	// Use the largest font size which fits the value into the image.
+	text := formatValue(v, opts.yUnit)
+	size := float64(height-top) / 2
+	r.SetFontSize(size)
+	b := r.MeasureText(text)
+	for size > 6 && (b.Width() > width-20 || b.Height() > height-top-20) {
+		size *= 0.9
+		r.SetFontSize(size)
+		b = r.MeasureText(text)
+	}
+	r.SetFontColor(chart.GetDefaultColor(0))
+	r.Text(text, (width-b.Width())/2, top+(height-top+b.Height())/2)
+
+	if err := r.Save(w); err != nil {
+		return fmt.Errorf("could not render graph: %w", err)
+	}
+
+	return nil
+}
+
+// rendererFor returns the chart renderer for a png or svg graph.
+func rendererFor(format string) (chart.RendererProvider, error) {
+	switch format {
+	case "png":
+		return chart.PNG, nil
+	case "svg":
+		return chart.SVG, nil
+	default:
+		return nil, fmt.Errorf("unsupported graph type: %s", format)
+	}
+}
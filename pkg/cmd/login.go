@@ -19,6 +19,8 @@ func NewLoginCmd(ctx context.Context) *cobra.Command {
 		Short: "Login as a tenant. Will also save tenant details locally.",
 		Long:  "Login as a tenant. Will also save tenant details locally.",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
 			if caFilePath != "" {
 				body, err := os.ReadFile(caFilePath)
 				if err != nil {
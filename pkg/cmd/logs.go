@@ -4,10 +4,12 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/observatorium/api/client"
 	"github.com/observatorium/api/client/parameters"
 	"github.com/observatorium/obsctl/pkg/fetcher"
+	"github.com/prometheus/common/model"
 	"github.com/spf13/cobra"
 )
 
@@ -22,6 +24,7 @@ func NewLogsGetCmd(ctx context.Context) *cobra.Command {
 	var (
 		seriesMatchers         []string
 		seriesStart, seriesEnd string
+		seriesSince            model.Duration
 	)
 	seriesCmd := &cobra.Command{
 		Use:          "series",
@@ -29,6 +32,12 @@ func NewLogsGetCmd(ctx context.Context) *cobra.Command {
 		Long:         "Get series of a tenant.",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			if err := resolveRange(&seriesStart, &seriesEnd, seriesSince, time.Now()); err != nil {
+				return err
+			}
+
 			f, currentTenant, err := fetcher.NewCustomFetcher(ctx, logger)
 			if err != nil {
 				return fmt.Errorf("custom fetcher: %w", err)
@@ -54,8 +63,9 @@ func NewLogsGetCmd(ctx context.Context) *cobra.Command {
 		},
 	}
 	seriesCmd.Flags().StringArrayVarP(&seriesMatchers, "match", "m", nil, "Repeated series selector argument that selects the series to return.")
-	seriesCmd.Flags().StringVarP(&seriesStart, "start", "s", "", "Start timestamp.")
-	seriesCmd.Flags().StringVarP(&seriesEnd, "end", "e", "", "End timestamp.")
+	seriesCmd.Flags().StringVarP(&seriesStart, "start", "s", "", "Start timestamp, either absolute (e.g. 2022-10-01 10:00 UTC) or relative (e.g. now-1h).")
+	seriesCmd.Flags().StringVarP(&seriesEnd, "end", "e", "", "End timestamp, either absolute or relative. Defaults to now if --since is set.")
+	seriesCmd.Flags().Var(&seriesSince, "since", "Shorthand for a start timestamp this long before the end, e.g. 2h.")
 	err := seriesCmd.MarkFlagRequired("match")
 	if err != nil {
 		panic(err)
@@ -64,12 +74,19 @@ func NewLogsGetCmd(ctx context.Context) *cobra.Command {
 	// Labels command.
 	var (
 		labelStart, labelEnd string
+		labelSince           model.Duration
 	)
 	labelsCmd := &cobra.Command{
 		Use:   "labels",
 		Short: "Get labels of a tenant.",
 		Long:  "Get labels of a tenant.",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			if err := resolveRange(&labelStart, &labelEnd, labelSince, time.Now()); err != nil {
+				return err
+			}
+
 			f, currentTenant, err := fetcher.NewCustomFetcher(ctx, logger)
 			if err != nil {
 				return fmt.Errorf("custom fetcher: %w", err)
@@ -92,12 +109,14 @@ func NewLogsGetCmd(ctx context.Context) *cobra.Command {
 		},
 	}
 
-	labelsCmd.Flags().StringVarP(&labelStart, "start", "s", "", "Start timestamp.")
-	labelsCmd.Flags().StringVarP(&labelEnd, "end", "e", "", "End timestamp.")
+	labelsCmd.Flags().StringVarP(&labelStart, "start", "s", "", "Start timestamp, either absolute (e.g. 2022-10-01 10:00 UTC) or relative (e.g. now-1h).")
+	labelsCmd.Flags().StringVarP(&labelEnd, "end", "e", "", "End timestamp, either absolute or relative. Defaults to now if --since is set.")
+	labelsCmd.Flags().Var(&labelSince, "since", "Shorthand for a start timestamp this long before the end, e.g. 2h.")
 
 	// Labelvalues command.
 	var (
 		labelName, labelValuesStart, labelValuesEnd string
+		labelValuesSince                            model.Duration
 	)
 	labelValuesCmd := &cobra.Command{
 		Use:          "labelvalues",
@@ -105,6 +124,12 @@ func NewLogsGetCmd(ctx context.Context) *cobra.Command {
 		Long:         "Get label values of a tenant.",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			if err := resolveRange(&labelValuesStart, &labelValuesEnd, labelValuesSince, time.Now()); err != nil {
+				return err
+			}
+
 			f, currentTenant, err := fetcher.NewCustomFetcher(ctx, logger)
 			if err != nil {
 				return fmt.Errorf("custom fetcher: %w", err)
@@ -128,8 +153,9 @@ func NewLogsGetCmd(ctx context.Context) *cobra.Command {
 		},
 	}
 	labelValuesCmd.Flags().StringVar(&labelName, "name", "", "Name of the label to fetch values for.")
-	labelValuesCmd.Flags().StringVarP(&labelValuesStart, "start", "s", "", "Start timestamp.")
-	labelValuesCmd.Flags().StringVarP(&labelValuesEnd, "end", "e", "", "End timestamp.")
+	labelValuesCmd.Flags().StringVarP(&labelValuesStart, "start", "s", "", "Start timestamp, either absolute (e.g. 2022-10-01 10:00 UTC) or relative (e.g. now-1h).")
+	labelValuesCmd.Flags().StringVarP(&labelValuesEnd, "end", "e", "", "End timestamp, either absolute or relative. Defaults to now if --since is set.")
+	labelValuesCmd.Flags().Var(&labelValuesSince, "since", "Shorthand for a start timestamp this long before the end, e.g. 2h.")
 
 	err = labelValuesCmd.MarkFlagRequired("name")
 	if err != nil {
@@ -143,6 +169,8 @@ func NewLogsGetCmd(ctx context.Context) *cobra.Command {
 		Long:         "Get alerts of a tenant.",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
 			f, currentTenant, err := fetcher.NewCustomFetcher(ctx, logger)
 			if err != nil {
 				return fmt.Errorf("custom fetcher: %w", err)
@@ -164,6 +192,8 @@ func NewLogsGetCmd(ctx context.Context) *cobra.Command {
 		Long:         "Get rules of a tenant.",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
 			f, currentTenant, err := fetcher.NewCustomFetcher(ctx, logger)
 			if err != nil {
 				return fmt.Errorf("custom fetcher: %w", err)
@@ -188,6 +218,8 @@ func NewLogsGetCmd(ctx context.Context) *cobra.Command {
 		Long:         "Get configured rules of a tenant.",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
 			f, currentTenant, err := fetcher.NewCustomFetcher(ctx, logger)
 			if err != nil {
 				return fmt.Errorf("custom fetcher: %w", err)
@@ -244,6 +276,8 @@ func NewLogsSetCmd(ctx context.Context) *cobra.Command {
 		Long:         "Write Loki Rules configuration for a tenant.",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
 			file, err := os.Open(ruleFilePath)
 			if err != nil {
 				return fmt.Errorf("opening rule file: %w", err)
@@ -290,9 +324,11 @@ func NewLogsSetCmd(ctx context.Context) *cobra.Command {
 
 func NewLogsQueryCmd(ctx context.Context) *cobra.Command {
 	var (
-		isRange                                     bool
-		time, start, end, direction, step, interval string
-		limit                                       float32
+		isRange                                         bool
+		evalTime, start, end, direction, step, interval string
+		limit                                           float32
+		watchInterval                                   time.Duration
+		since                                           model.Duration
 	)
 	cmd := &cobra.Command{
 		Use:          "query",
@@ -302,6 +338,8 @@ func NewLogsQueryCmd(ctx context.Context) *cobra.Command {
 		Args:         cobra.ExactArgs(1),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
 			if args[0] == "" {
 				return fmt.Errorf("no query provided")
 			}
@@ -311,76 +349,120 @@ func NewLogsQueryCmd(ctx context.Context) *cobra.Command {
 				return fmt.Errorf("custom fetcher: %w", err)
 			}
 
-			query := parameters.LogqlQuery(args[0])
-
+			now := time.Now()
+			if since > 0 {
+				isRange = true
+			}
+			// Relative evaluation times are resolved again on every refresh of --watch.
+			timeExpr := evalTime
+			if err := resolveTime("--time", &evalTime, now); err != nil {
+				return err
+			}
+			if err := resolveRange(&start, &end, since, now); err != nil {
+				return err
+			}
 			if isRange {
-				params := &client.GetLogRangeQueryParams{Query: &query}
-				if limit != 0 {
-					params.Limit = (*parameters.Limit)(&limit)
+				if step, err = rangeStep(step, start, end); err != nil {
+					return err
 				}
+			}
 
-				if start == "" || end == "" {
-					return fmt.Errorf("start/end timestamp not provided for range query")
-				}
-
-				params.Start = (*parameters.StartTS)(&start)
-				params.End = (*parameters.EndTS)(&end)
-
-				if step != "" {
-					params.Step = &step
-				}
+			query := parameters.LogqlQuery(args[0])
 
-				if interval != "" {
-					params.Interval = &interval
+			run := func() error {
+				if isRange {
+					params := &client.GetLogRangeQueryParams{Query: &query}
+					if limit != 0 {
+						params.Limit = (*parameters.Limit)(&limit)
+					}
+
+					if start == "" || end == "" {
+						return fmt.Errorf("start/end timestamp not provided for range query")
+					}
+
+					params.Start = (*parameters.StartTS)(&start)
+					params.End = (*parameters.EndTS)(&end)
+
+					if step != "" {
+						params.Step = &step
+					}
+
+					if interval != "" {
+						params.Interval = &interval
+					}
+
+					if direction != "" {
+						params.Direction = &direction
+					}
+
+					resp, err := f.GetLogRangeQueryWithResponse(ctx, currentTenant, params)
+					if err != nil {
+						return fmt.Errorf("getting response: %w", err)
+					}
+
+					return handleResponse(resp.Body, resp.HTTPResponse.Header.Get("content-type"), resp.StatusCode(), cmd)
+				} else {
+					params := &client.GetLogInstantQueryParams{Query: &query}
+					if evalTime != "" {
+						params.Time = &evalTime
+					}
+
+					if limit != 0 {
+						params.Limit = (*parameters.Limit)(&limit)
+					}
+
+					if direction != "" {
+						params.Direction = &direction
+					}
+
+					resp, err := f.GetLogInstantQueryWithResponse(ctx, currentTenant, params)
+					if err != nil {
+						return fmt.Errorf("getting response: %w", err)
+					}
+
+					return handleResponse(resp.Body, resp.HTTPResponse.Header.Get("content-type"), resp.StatusCode(), cmd)
 				}
+			}
 
-				if direction != "" {
-					params.Direction = &direction
-				}
+			if watchInterval <= 0 {
+				return run()
+			}
 
-				resp, err := f.GetLogRangeQueryWithResponse(ctx, currentTenant, params)
+			// Range queries keep their width but slide to the current time on every refresh.
+			slide := func() {}
+			if isRange {
+				slide, err = newSlidingWindow(&start, &end)
 				if err != nil {
-					return fmt.Errorf("getting response: %w", err)
-				}
-
-				return handleResponse(resp.Body, resp.HTTPResponse.Header.Get("content-type"), resp.StatusCode(), cmd)
-			} else {
-				params := &client.GetLogInstantQueryParams{Query: &query}
-				if time != "" {
-					params.Time = &time
-				}
-
-				if limit != 0 {
-					params.Limit = (*parameters.Limit)(&limit)
-				}
-
-				if direction != "" {
-					params.Direction = &direction
+					return err
 				}
+			}
 
-				resp, err := f.GetLogInstantQueryWithResponse(ctx, currentTenant, params)
-				if err != nil {
-					return fmt.Errorf("getting response: %w", err)
+			return watch(ctx, cmd, watchInterval, args[0], func() error {
+				slide()
+				evalTime = timeExpr
+				if err := resolveTime("--time", &evalTime, time.Now()); err != nil {
+					return err
 				}
-
-				return handleResponse(resp.Body, resp.HTTPResponse.Header.Get("content-type"), resp.StatusCode(), cmd)
-			}
+				return run()
+			})
 		},
 	}
 
 	// Flags for instant query.
-	cmd.Flags().StringVar(&time, "time", "", "Evaluation timestamp. Only used if --range is false.")
+	cmd.Flags().StringVar(&evalTime, "time", "", "Evaluation timestamp, either absolute (e.g. 2022-10-01 10:00 UTC) or relative (e.g. now-1h). Only used if --range is false.")
 
 	// Flags for range query.
 	cmd.Flags().BoolVar(&isRange, "range", false, "If true, query will be evaluated as a range query. See https://prometheus.io/docs/prometheus/latest/querying/api/#range-queries.")
-	cmd.Flags().StringVarP(&start, "start", "s", "", "Start timestamp. Must be provided if --range is true.")
-	cmd.Flags().StringVarP(&end, "end", "e", "", "End timestamp. Must be provided if --range is true.")
-	cmd.Flags().StringVar(&step, "step", "", "Query resolution step width. Only used if --range is provided.")
+	cmd.Flags().StringVarP(&start, "start", "s", "", "Start timestamp, either absolute (e.g. 2022-10-01 10:00 UTC) or relative (e.g. now-1h). Must be provided if --range is true, unless --since is.")
+	cmd.Flags().StringVarP(&end, "end", "e", "", "End timestamp, either absolute or relative. Must be provided if --range is true, defaults to now if --since is set.")
+	cmd.Flags().Var(&since, "since", "Shorthand for a range query starting this long before the end, e.g. 2h.")
+	cmd.Flags().StringVar(&step, "step", "", "Query resolution step width. Only used if --range is provided. Picked from the range if not specified.")
 	cmd.Flags().StringVar(&interval, "interval", "", "return entries at (or greater than) the specified interval,Only used if --range is provided.")
 
 	// // Common flags.
 	cmd.Flags().Float32Var(&limit, "limit", 100, "The max number of entries to return. Only used if --range is false.")
 	cmd.Flags().StringVar(&direction, "direction", "", "Determines the sort order of logs.. Only used if --range is false.")
+	cmd.Flags().DurationVar(&watchInterval, "watch", 0, "If specified, query will be re-evaluated at the given interval (e.g. 10s) and the output redrawn in place until interrupted, or appended if it isn't a terminal. Range queries keep their width and slide to the current time.")
 
 	return cmd
 }
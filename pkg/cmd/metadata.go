@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/observatorium/obsctl/pkg/fetcher"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/cobra"
+)
+
+// metricMetadata is the metadata of a metric, as returned by the Prometheus metadata API.
+type metricMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// printMetadata writes the metadata of every metric as a table, sorted by metric name.
+func printMetadata(w io.Writer, body []byte) error {
+	var res struct {
+		Data map[string][]metricMetadata `json:"data"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return fmt.Errorf("parsing metadata: %w", err)
+	}
+
+	if len(res.Data) == 0 {
+		_, err := fmt.Fprintln(w, "No metadata found")
+		return err
+	}
+
+	names := make([]string, 0, len(res.Data))
+	for name := range res.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "METRIC\tTYPE\tUNIT\tHELP")
+	for _, name := range names {
+		// A metric can have different metadata in different targets.
+		for _, m := range res.Data[name] {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", name, m.Type, m.Unit, m.Help)
+		}
+	}
+
+	return tw.Flush()
+}
+
+// exemplarSeries are the exemplars of a series, as returned by the Prometheus exemplars API.
+type exemplarSeries struct {
+	SeriesLabels model.LabelSet `json:"seriesLabels"`
+	Exemplars    []struct {
+		Labels    model.LabelSet    `json:"labels"`
+		Value     model.SampleValue `json:"value"`
+		Timestamp model.Time        `json:"timestamp"`
+	} `json:"exemplars"`
+}
+
+// traceIDLabels are the exemplar labels which commonly hold a trace ID.
+var traceIDLabels = []model.LabelName{"trace_id", "traceID", "traceId", "TraceID"}
+
+// exemplarTraceID returns the trace ID of an exemplar, or an empty string if it has none.
+func exemplarTraceID(labels model.LabelSet) string {
+	for _, name := range traceIDLabels {
+		if id, ok := labels[name]; ok {
+			return string(id)
+		}
+	}
+
+	return ""
+}
+
+// printExemplars writes exemplars as a table with their trace IDs, followed by how to look the traces up.
+func printExemplars(w io.Writer, body []byte) error {
+	var res struct {
+		Data []exemplarSeries `json:"data"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return fmt.Errorf("parsing exemplars: %w", err)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERIES\tTIME\tVALUE\tTRACE ID")
+	var traced, total int
+	for _, s := range res.Data {
+		for _, e := range s.Exemplars {
+			id := exemplarTraceID(e.Labels)
+			if id != "" {
+				traced++
+			} else {
+				id = "-"
+			}
+			total++
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.SeriesLabels, e.Timestamp.Time().UTC().Format(time.RFC3339), e.Value, id)
+		}
+	}
+	if total == 0 {
+		_, err := fmt.Fprintln(w, "No exemplars found")
+		return err
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if traced > 0 {
+		_, err := fmt.Fprintln(w, "\nView a trace with: obsctl traces get <trace id>")
+		return err
+	}
+
+	return nil
+}
+
+func NewMetricsMetadataCmd(ctx context.Context) *cobra.Command {
+	var (
+		metric, output string
+		limit          int
+	)
+	cmd := &cobra.Command{
+		Use:          "metadata",
+		Short:        "Get metadata of metrics of a tenant.",
+		Long:         "Get the type, help and unit of metrics of a tenant.",
+		Example:      `obsctl metrics get metadata --metric http_requests_total`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			if output != "table" && output != "json" {
+				return fmt.Errorf("unknown format %s", output)
+			}
+
+			f, currentTenant, err := fetcher.NewCustomFetcher(ctx, logger)
+			if err != nil {
+				return fmt.Errorf("custom fetcher: %w", err)
+			}
+
+			params := url.Values{}
+			if metric != "" {
+				params.Set("metric", metric)
+			}
+			if limit > 0 {
+				params.Set("limit", strconv.Itoa(limit))
+			}
+
+			resp, body, err := fetcher.Get(ctx, f, "/api/metrics/v1/"+string(currentTenant)+"/api/v1/metadata", params)
+			if err != nil {
+				return fmt.Errorf("getting response: %w", err)
+			}
+
+			if output == "json" || resp.StatusCode/100 != 2 {
+				return handleResponse(body, resp.Header.Get("content-type"), resp.StatusCode, cmd)
+			}
+
+			return printMetadata(cmd.OutOrStdout(), body)
+		},
+	}
+
+	cmd.Flags().StringVar(&metric, "metric", "", "Metric name to get the metadata of. All metrics if not specified.")
+	cmd.Flags().IntVar(&limit, "limit", 0, "Maximum number of metrics to return.")
+	cmd.Flags().StringVarP(&output, "output", "o", "table", "Output format. One of: json|table")
+
+	return cmd
+}
+
+func NewMetricsExemplarsCmd(ctx context.Context) *cobra.Command {
+	var (
+		start, end, output string
+		since              model.Duration
+	)
+	cmd := &cobra.Command{
+		Use:   "exemplars",
+		Short: "Get exemplars of a query for a tenant.",
+		Long:  "Get exemplars of the series selected by a PromQL query for a tenant, with the IDs of the traces they link to.",
+		Example: `obsctl metrics get exemplars 'http_request_duration_seconds_bucket{job="api"}' --since 1h
+obsctl traces get <trace id>`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			if strings.TrimSpace(args[0]) == "" {
+				return fmt.Errorf("no query provided")
+			}
+			if output != "table" && output != "json" {
+				return fmt.Errorf("unknown format %s", output)
+			}
+
+			if err := resolveRangeOrLast(&start, &end, since, time.Hour, time.Now()); err != nil {
+				return err
+			}
+
+			f, currentTenant, err := fetcher.NewCustomFetcher(ctx, logger)
+			if err != nil {
+				return fmt.Errorf("custom fetcher: %w", err)
+			}
+
+			params := url.Values{"query": {args[0]}, "start": {start}, "end": {end}}
+			resp, body, err := fetcher.Get(ctx, f, "/api/metrics/v1/"+string(currentTenant)+"/api/v1/query_exemplars", params)
+			if err != nil {
+				return fmt.Errorf("getting response: %w", err)
+			}
+
+			if output == "json" || resp.StatusCode/100 != 2 {
+				return handleResponse(body, resp.Header.Get("content-type"), resp.StatusCode, cmd)
+			}
+
+			return printExemplars(cmd.OutOrStdout(), body)
+		},
+	}
+
+	cmd.Flags().StringVarP(&start, "start", "s", "", "Start timestamp, either absolute (e.g. 2022-10-01 10:00 UTC) or relative (e.g. now-1h). Defaults to an hour before the end.")
+	cmd.Flags().StringVarP(&end, "end", "e", "", "End timestamp, either absolute or relative. Defaults to now.")
+	cmd.Flags().Var(&since, "since", "Shorthand for a start timestamp this long before the end, e.g. 2h.")
+	cmd.Flags().StringVarP(&output, "output", "o", "table", "Output format. One of: json|table")
+
+	return cmd
+}
@@ -2,17 +2,20 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
-	"path"
+	"strings"
 	"time"
 
 	"github.com/go-kit/log/level"
 	"github.com/observatorium/api/client"
 	"github.com/observatorium/api/client/parameters"
 	"github.com/observatorium/obsctl/pkg/fetcher"
+	"github.com/observatorium/obsctl/pkg/promql"
 	"github.com/observatorium/obsctl/pkg/proxy"
+	"github.com/prometheus/common/model"
 	"github.com/spf13/cobra"
 )
 
@@ -27,6 +30,7 @@ func NewMetricsGetCmd(ctx context.Context) *cobra.Command {
 	var (
 		seriesMatchers         []string
 		seriesStart, seriesEnd string
+		seriesSince            model.Duration
 	)
 	seriesCmd := &cobra.Command{
 		Use:          "series",
@@ -34,6 +38,12 @@ func NewMetricsGetCmd(ctx context.Context) *cobra.Command {
 		Long:         "Get series of a tenant.",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			if err := resolveRange(&seriesStart, &seriesEnd, seriesSince, time.Now()); err != nil {
+				return err
+			}
+
 			f, currentTenant, err := fetcher.NewCustomFetcher(ctx, logger)
 			if err != nil {
 				return fmt.Errorf("custom fetcher: %w", err)
@@ -59,8 +69,9 @@ func NewMetricsGetCmd(ctx context.Context) *cobra.Command {
 		},
 	}
 	seriesCmd.Flags().StringArrayVarP(&seriesMatchers, "match", "m", nil, "Repeated series selector argument that selects the series to return.")
-	seriesCmd.Flags().StringVarP(&seriesStart, "start", "s", "", "Start timestamp.")
-	seriesCmd.Flags().StringVarP(&seriesEnd, "end", "e", "", "End timestamp.")
+	seriesCmd.Flags().StringVarP(&seriesStart, "start", "s", "", "Start timestamp, either absolute (e.g. 2022-10-01 10:00 UTC) or relative (e.g. now-1h).")
+	seriesCmd.Flags().StringVarP(&seriesEnd, "end", "e", "", "End timestamp, either absolute or relative. Defaults to now if --since is set.")
+	seriesCmd.Flags().Var(&seriesSince, "since", "Shorthand for a start timestamp this long before the end, e.g. 2h.")
 	err := seriesCmd.MarkFlagRequired("match")
 	if err != nil {
 		panic(err)
@@ -70,12 +81,19 @@ func NewMetricsGetCmd(ctx context.Context) *cobra.Command {
 	var (
 		labelMatchers        []string
 		labelStart, labelEnd string
+		labelSince           model.Duration
 	)
 	labelsCmd := &cobra.Command{
 		Use:   "labels",
 		Short: "Get labels of a tenant.",
 		Long:  "Get labels of a tenant.",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			if err := resolveRange(&labelStart, &labelEnd, labelSince, time.Now()); err != nil {
+				return err
+			}
+
 			f, currentTenant, err := fetcher.NewCustomFetcher(ctx, logger)
 			if err != nil {
 				return fmt.Errorf("custom fetcher: %w", err)
@@ -101,13 +119,15 @@ func NewMetricsGetCmd(ctx context.Context) *cobra.Command {
 		},
 	}
 	labelsCmd.Flags().StringArrayVarP(&labelMatchers, "match", "m", []string{}, "Repeated series selector argument that selects the series from which to read the label names.")
-	labelsCmd.Flags().StringVarP(&labelStart, "start", "s", "", "Start timestamp.")
-	labelsCmd.Flags().StringVarP(&labelEnd, "end", "e", "", "End timestamp.")
+	labelsCmd.Flags().StringVarP(&labelStart, "start", "s", "", "Start timestamp, either absolute (e.g. 2022-10-01 10:00 UTC) or relative (e.g. now-1h).")
+	labelsCmd.Flags().StringVarP(&labelEnd, "end", "e", "", "End timestamp, either absolute or relative. Defaults to now if --since is set.")
+	labelsCmd.Flags().Var(&labelSince, "since", "Shorthand for a start timestamp this long before the end, e.g. 2h.")
 
 	// Labelvalues command.
 	var (
 		labelValuesMatchers                         []string
 		labelName, labelValuesStart, labelValuesEnd string
+		labelValuesSince                            model.Duration
 	)
 	labelValuesCmd := &cobra.Command{
 		Use:          "labelvalues",
@@ -115,6 +135,12 @@ func NewMetricsGetCmd(ctx context.Context) *cobra.Command {
 		Long:         "Get label values of a tenant.",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			if err := resolveRange(&labelValuesStart, &labelValuesEnd, labelValuesSince, time.Now()); err != nil {
+				return err
+			}
+
 			f, currentTenant, err := fetcher.NewCustomFetcher(ctx, logger)
 			if err != nil {
 				return fmt.Errorf("custom fetcher: %w", err)
@@ -141,8 +167,9 @@ func NewMetricsGetCmd(ctx context.Context) *cobra.Command {
 	}
 	labelValuesCmd.Flags().StringVar(&labelName, "name", "", "Name of the label to fetch values for.")
 	labelValuesCmd.Flags().StringArrayVarP(&labelValuesMatchers, "match", "m", []string{}, "Repeated series selector argument that selects the series from which to read the label values.")
-	labelValuesCmd.Flags().StringVarP(&labelValuesStart, "start", "s", "", "Start timestamp.")
-	labelValuesCmd.Flags().StringVarP(&labelValuesEnd, "end", "e", "", "End timestamp.")
+	labelValuesCmd.Flags().StringVarP(&labelValuesStart, "start", "s", "", "Start timestamp, either absolute (e.g. 2022-10-01 10:00 UTC) or relative (e.g. now-1h).")
+	labelValuesCmd.Flags().StringVarP(&labelValuesEnd, "end", "e", "", "End timestamp, either absolute or relative. Defaults to now if --since is set.")
+	labelValuesCmd.Flags().Var(&labelValuesSince, "since", "Shorthand for a start timestamp this long before the end, e.g. 2h.")
 
 	err = labelValuesCmd.MarkFlagRequired("name")
 	if err != nil {
@@ -160,6 +187,8 @@ func NewMetricsGetCmd(ctx context.Context) *cobra.Command {
 		Long:         "Get rules of a tenant.",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
 			f, currentTenant, err := fetcher.NewCustomFetcher(ctx, logger)
 			if err != nil {
 				return fmt.Errorf("custom fetcher: %w", err)
@@ -194,6 +223,8 @@ func NewMetricsGetCmd(ctx context.Context) *cobra.Command {
 		Long:         "Get configured rules of a tenant.",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
 			f, currentTenant, err := fetcher.NewCustomFetcher(ctx, logger)
 			if err != nil {
 				return fmt.Errorf("custom fetcher: %w", err)
@@ -219,6 +250,8 @@ func NewMetricsGetCmd(ctx context.Context) *cobra.Command {
 	cmd.AddCommand(seriesCmd)
 	cmd.AddCommand(labelsCmd)
 	cmd.AddCommand(labelValuesCmd)
+	cmd.AddCommand(NewMetricsMetadataCmd(ctx))
+	cmd.AddCommand(NewMetricsExemplarsCmd(ctx))
 	cmd.AddCommand(rulesCmd)
 	cmd.AddCommand(rulesRawCmd)
 
@@ -233,6 +266,8 @@ func NewMetricsSetCmd(ctx context.Context) *cobra.Command {
 		Long:         "Write Prometheus Rules configuration for a tenant.",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
 			file, err := os.Open(ruleFilePath)
 			if err != nil {
 				return fmt.Errorf("opening rule file: %w", err)
@@ -274,6 +309,15 @@ func NewMetricsQueryCmd(ctx context.Context) *cobra.Command {
 	var (
 		isRange                                    bool
 		evalTime, timeout, start, end, step, graph string
+		graphOut                                   string
+		graphOpts                                  graphOptions
+		watchInterval                              time.Duration
+		since                                      model.Duration
+		contextNames                               []string
+		estimate, force                            bool
+		maxSamples                                 int64
+		splitInterval                              model.Duration
+		splitConcurrency                           int
 	)
 	cmd := &cobra.Command{
 		Use:          "query",
@@ -283,50 +327,131 @@ func NewMetricsQueryCmd(ctx context.Context) *cobra.Command {
 		Args:         cobra.ExactArgs(1),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
 			if args[0] == "" {
 				return fmt.Errorf("no query provided")
 			}
-
-			f, currentTenant, err := fetcher.NewCustomFetcher(ctx, logger)
-			if err != nil {
-				return fmt.Errorf("custom fetcher: %w", err)
+			if splitConcurrency < 1 {
+				return fmt.Errorf("--split-concurrency must be at least 1")
 			}
 
-			query := parameters.PromqlQuery(args[0])
+			// Queries against several contexts don't use the current one.
+			var (
+				f             *client.ClientWithResponses
+				currentTenant parameters.Tenant
+				contexts      []queryContext
+				err           error
+			)
+			if len(contextNames) > 0 {
+				if contexts, err = parseContexts(contextNames); err != nil {
+					return err
+				}
+			} else {
+				f, currentTenant, err = fetcher.NewCustomFetcher(ctx, logger)
+				if err != nil {
+					return fmt.Errorf("custom fetcher: %w", err)
+				}
+			}
 
+			now := time.Now()
+			if since > 0 {
+				isRange = true
+			}
+			// Relative evaluation times are resolved again on every refresh of --watch.
+			timeExpr := evalTime
+			if err := resolveTime("--time", &evalTime, now); err != nil {
+				return err
+			}
+			if err := resolveRange(&start, &end, since, now); err != nil {
+				return err
+			}
 			if isRange {
-				params := &client.GetRangeQueryParams{Query: &query}
-				if timeout != "" {
-					params.Timeout = (*parameters.QueryTimeout)(&timeout)
+				if step, err = rangeStep(step, start, end); err != nil {
+					return err
 				}
+			}
 
-				if start == "" || end == "" {
-					return fmt.Errorf("start/end timestamp not provided for range query")
+			if estimate {
+				if len(contexts) > 0 {
+					return fmt.Errorf("--estimate can't be used with --contexts")
 				}
 
-				params.Start = (*parameters.StartTS)(&start)
-				params.End = (*parameters.EndTS)(&end)
-
-				if step != "" {
-					params.Step = &step
+				est, err := estimateRun(ctx, f, currentTenant, args[0], isRange, evalTime, start, end, step)
+				var parseErr *promql.ParseError
+				switch {
+				case errors.As(err, &parseErr):
+					// The parser of obsctl may not know all the syntax of the API, which judges the query instead.
+					level.Warn(logger).Log("msg", "can't estimate a query obsctl can't parse, running it anyway", "err", err)
+				case err != nil:
+					return fmt.Errorf("estimating query: %w", err)
+				default:
+					if err := printEstimate(cmd.ErrOrStderr(), est, maxSamples); err != nil {
+						return err
+					}
+					if est.samples() > maxSamples && !force {
+						return fmt.Errorf("estimated %d samples exceed the limit of %d, narrow down the query or pass --force to run it anyway", est.samples(), maxSamples)
+					}
 				}
+			}
 
-				resp, err := f.GetRangeQueryWithResponse(ctx, currentTenant, params)
-				if err != nil {
-					return fmt.Errorf("getting response: %w", err)
+			query := parameters.PromqlQuery(args[0])
+
+			graphOpts.title = args[0]
+			graphOpts.color = colorEnabled()
+			if err := graphOpts.validate(); err != nil {
+				return err
+			}
+
+			// The default graph file is named once, so that --watch overwrites it rather than writing a new file on
+			// every refresh.
+			if graphOut == "" && (graph == "png" || graph == "svg") {
+				if graphOut, err = graphFileName(graph); err != nil {
+					return err
 				}
+			}
+			writeGraph := func(body []byte) error {
+				return handleGraph(body, graph, graphOpts, graphOut, cmd.OutOrStdout())
+			}
 
-				if graph != "" {
-					wd, err := os.Getwd()
+			do := func(f *client.ClientWithResponses, tenant parameters.Tenant) ([]byte, *http.Response, error) {
+				if isRange {
+					if start == "" || end == "" {
+						return nil, nil, fmt.Errorf("start/end timestamp not provided for range query")
+					}
+
+					fetchRange := func(ctx context.Context, start, end string) ([]byte, *http.Response, error) {
+						params := &client.GetRangeQueryParams{Query: &query}
+						if timeout != "" {
+							params.Timeout = (*parameters.QueryTimeout)(&timeout)
+						}
+
+						params.Start = (*parameters.StartTS)(&start)
+						params.End = (*parameters.EndTS)(&end)
+
+						if step != "" {
+							params.Step = &step
+						}
+
+						resp, err := f.GetRangeQueryWithResponse(ctx, tenant, params)
+						if err != nil {
+							return nil, nil, fmt.Errorf("getting response: %w", err)
+						}
+
+						return resp.Body, resp.HTTPResponse, nil
+					}
+
+					ranges, err := splitQueryRange(start, end, step, time.Duration(splitInterval))
 					if err != nil {
-						return fmt.Errorf("could not get working dir: %w", err)
+						return nil, nil, err
+					}
+					if len(ranges) > 1 {
+						return fetchSplitRange(ctx, ranges, splitConcurrency, cmd.ErrOrStderr(), fetchRange)
 					}
 
-					return handleGraph(resp.Body, graph, string(query), path.Join(wd, "graph"+time.Now().String()+".png"), cmd.OutOrStdout())
+					return fetchRange(ctx, start, end)
 				}
 
-				return handleResponse(resp.Body, resp.HTTPResponse.Header.Get("content-type"), resp.StatusCode(), cmd)
-			} else {
 				params := &client.GetInstantQueryParams{Query: &query}
 				if evalTime != "" {
 					params.Time = &evalTime
@@ -335,28 +460,125 @@ func NewMetricsQueryCmd(ctx context.Context) *cobra.Command {
 					params.Timeout = (*parameters.QueryTimeout)(&timeout)
 				}
 
-				resp, err := f.GetInstantQueryWithResponse(ctx, currentTenant, params)
+				resp, err := f.GetInstantQueryWithResponse(ctx, tenant, params)
+				if err != nil {
+					return nil, nil, fmt.Errorf("getting response: %w", err)
+				}
+
+				return resp.Body, resp.HTTPResponse, nil
+			}
+
+			// runContexts queries all contexts and outputs their merged results. Results of the contexts which
+			// succeeded are still output if others fail.
+			runContexts := func() error {
+				results := queryContexts(ctx, contexts, do)
+
+				var errs []string
+				for _, r := range results {
+					if r.err != nil {
+						errs = append(errs, fmt.Sprintf("  %s: %v", r.context, r.err))
+					}
+				}
+				failed := fmt.Errorf("query failed for %d of %d contexts:\n%s", len(errs), len(results), strings.Join(errs, "\n"))
+				if len(errs) == len(results) {
+					return failed
+				}
+
+				merged, err := mergeContextResults(results)
+				if err != nil {
+					return err
+				}
+
+				body, err := encodeQueryResult(merged)
+				if err != nil {
+					return fmt.Errorf("encoding merged results: %w", err)
+				}
+
+				if graph != "" {
+					err = writeGraph(body)
+				} else {
+					err = handleResponse(body, "application/json", http.StatusOK, cmd)
+				}
+				if err != nil {
+					return err
+				}
+
+				if len(errs) > 0 {
+					return failed
+				}
+
+				return nil
+			}
+
+			run := func() error {
+				if len(contexts) > 0 {
+					return runContexts()
+				}
+
+				body, resp, err := do(f, currentTenant)
 				if err != nil {
-					return fmt.Errorf("getting response: %w", err)
+					return err
 				}
 
-				return handleResponse(resp.Body, resp.HTTPResponse.Header.Get("content-type"), resp.StatusCode(), cmd)
+				if graph != "" && resp.StatusCode/100 == 2 {
+					return writeGraph(body)
+				}
+
+				return handleResponse(body, resp.Header.Get("content-type"), resp.StatusCode, cmd)
+			}
+
+			if watchInterval <= 0 {
+				return run()
+			}
+
+			// Range queries keep their width but slide to the current time on every refresh.
+			slide := func() {}
+			if isRange {
+				slide, err = newSlidingWindow(&start, &end)
+				if err != nil {
+					return err
+				}
 			}
+
+			return watch(ctx, cmd, watchInterval, args[0], func() error {
+				slide()
+				evalTime = timeExpr
+				if err := resolveTime("--time", &evalTime, time.Now()); err != nil {
+					return err
+				}
+				return run()
+			})
 		},
 	}
 
 	// Flags for instant query.
-	cmd.Flags().StringVar(&evalTime, "time", "", "Evaluation timestamp. Only used if --range is false.")
+	cmd.Flags().StringVar(&evalTime, "time", "", "Evaluation timestamp, either absolute (e.g. 2022-10-01 10:00 UTC) or relative (e.g. now-1h). Only used if --range is false.")
 
 	// Flags for range query.
 	cmd.Flags().BoolVar(&isRange, "range", false, "If true, query will be evaluated as a range query. See https://prometheus.io/docs/prometheus/latest/querying/api/#range-queries.")
-	cmd.Flags().StringVarP(&start, "start", "s", "", "Start timestamp. Must be provided if --range is true.")
-	cmd.Flags().StringVarP(&end, "end", "e", "", "End timestamp. Must be provided if --range is true.")
-	cmd.Flags().StringVar(&step, "step", "", "Query resolution step width. Only used if --range is provided.")
-	cmd.Flags().StringVar(&graph, "graph", "", "If specified, range query result will output an (ascii|png) graph.")
+	cmd.Flags().StringVarP(&start, "start", "s", "", "Start timestamp, either absolute (e.g. 2022-10-01 10:00 UTC) or relative (e.g. now-1h). Must be provided if --range is true, unless --since is.")
+	cmd.Flags().StringVarP(&end, "end", "e", "", "End timestamp, either absolute or relative. Must be provided if --range is true, defaults to now if --since is set.")
+	cmd.Flags().Var(&since, "since", "Shorthand for a range query starting this long before the end, e.g. 2h.")
+	cmd.Flags().StringVar(&step, "step", "", "Query resolution step width. Only used if --range is provided. Picked from the range if not specified.")
+	splitInterval = model.Duration(defaultSplitInterval)
+	cmd.Flags().Var(&splitInterval, "split", "Ranges wider than this are split into sub-ranges of this width, aligned to the step, which are fetched concurrently and stitched back together. Set to 0 to never split.")
+	cmd.Flags().IntVar(&splitConcurrency, "split-concurrency", defaultSplitConcurrency, "Maximum number of sub-ranges of a split range query fetched at the same time.")
+	cmd.Flags().StringVar(&graph, "graph", "", "If specified, query result will output an (ascii|png|svg) graph. Range query results are drawn as lines, instant vectors as bars of the top series and scalars as a big number.")
+	cmd.Flags().StringVar(&graphOut, "out", "", "File to write png or svg graphs to, or - for standard output. Defaults to a timestamped file in the working directory, which is overwritten on every refresh of --watch.")
+	cmd.Flags().IntVar(&graphOpts.width, "width", 0, "Width of the graph, in pixels for png and svg graphs and in characters for ascii ones. Picked automatically if not specified.")
+	cmd.Flags().IntVar(&graphOpts.height, "height", 0, "Height of the graph, in pixels for png and svg graphs and in lines for ascii ones. Picked automatically if not specified.")
+	cmd.Flags().StringVar(&graphOpts.yUnit, "y-unit", "", "Unit of the values for y-axis labels of png and svg graphs. One of bytes, seconds or percent (of ratios between 0 and 1).")
+	cmd.Flags().BoolVar(&graphOpts.logScale, "log-scale", false, "If true, png and svg graphs use a logarithmic y-axis. Values that are not positive are left out.")
+	cmd.Flags().IntVar(&graphOpts.top, "top", defaultTop, "Number of series with the highest values drawn as bars for instant vector graphs.")
+	cmd.Flags().StringVar(&graphOpts.mode, "graph-mode", graphModeLine, "How series of png and svg graphs are drawn. One of line, area or stacked.")
 
 	// Common flags.
 	cmd.Flags().StringVar(&timeout, "timeout", "", "Evaluation timeout. Optional.")
+	cmd.Flags().StringSliceVar(&contextNames, "contexts", nil, "Comma-separated list of saved contexts (<api>/<tenant>) to run the query against concurrently instead of the current one. Series are labelled with the api and tenant they come from and merged into a single result.")
+	cmd.Flags().BoolVar(&estimate, "estimate", false, "If true, the number of samples the query loads is estimated from the series its selectors match and the number of steps, and printed to stderr before running the query. Queries obsctl can't parse are run without an estimate, with a warning.")
+	cmd.Flags().Int64Var(&maxSamples, "max-samples", defaultMaxSamples, "Number of estimated samples above which the query isn't run. Only used if --estimate is true.")
+	cmd.Flags().BoolVar(&force, "force", false, "If true, the query is run even if its estimated samples exceed --max-samples.")
+	cmd.Flags().DurationVar(&watchInterval, "watch", 0, "If specified, query will be re-evaluated at the given interval (e.g. 10s) and the output redrawn in place until interrupted, or appended if it isn't a terminal. Range queries keep their width and slide to the current time.")
 
 	return cmd
 }
@@ -370,6 +592,8 @@ func NewMetricsUICmd(ctx context.Context) *cobra.Command {
 		Note that all request URLs will have /api/metrics/v1/ prefixed in their paths.`,
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
 			// Run a server as we would in main.
 			s, err := proxy.NewProxyServer(ctx, logger, "metrics", listen)
 			if err != nil {
@@ -409,6 +633,10 @@ func NewMetricsCmd(ctx context.Context) *cobra.Command {
 	cmd.AddCommand(NewMetricsGetCmd(ctx))
 	cmd.AddCommand(NewMetricsSetCmd(ctx))
 	cmd.AddCommand(NewMetricsQueryCmd(ctx))
+	cmd.AddCommand(NewMetricsCompareCmd(ctx))
+	cmd.AddCommand(NewMetricsFmtCmd())
+	cmd.AddCommand(NewMetricsExplainCmd())
+	cmd.AddCommand(NewMetricsCardinalityCmd(ctx))
 	cmd.AddCommand(NewMetricsUICmd(ctx))
 
 	return cmd
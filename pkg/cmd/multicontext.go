@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/observatorium/api/client"
+	"github.com/observatorium/api/client/parameters"
+	"github.com/observatorium/obsctl/pkg/fetcher"
+	"github.com/prometheus/common/model"
+)
+
+// Labels added to the results of queries against several contexts, to tell where each series comes from.
+const (
+	contextAPILabel    model.LabelName = "api"
+	contextTenantLabel model.LabelName = "tenant"
+)
+
+// queryContext is a saved context, i.e. an API and one of its tenants.
+type queryContext struct {
+	api    string
+	tenant string
+}
+
+func (c queryContext) String() string {
+	return c.api + "/" + c.tenant
+}
+
+// parseContexts parses contexts in the <api>/<tenant> format, ignoring duplicates.
+func parseContexts(names []string) ([]queryContext, error) {
+	var res []queryContext
+	seen := map[queryContext]bool{}
+	for _, n := range names {
+		cntxt := strings.Split(n, "/")
+		if len(cntxt) != 2 || cntxt[0] == "" || cntxt[1] == "" {
+			return nil, fmt.Errorf("invalid context name %q: use format <api>/<tenant>", n)
+		}
+
+		c := queryContext{api: cntxt[0], tenant: cntxt[1]}
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		res = append(res, c)
+	}
+
+	return res, nil
+}
+
+// queryFunc runs a query with the given client and tenant, returning the response body and HTTP response.
+type queryFunc func(f *client.ClientWithResponses, tenant parameters.Tenant) ([]byte, *http.Response, error)
+
+// contextResult is the result of a query against a single context.
+type contextResult struct {
+	context queryContext
+	value   model.Value
+	err     error
+}
+
+// queryContexts runs a query against all contexts concurrently and returns their results in the same order.
+// Clients are created one after another, as each of them may refresh and save a token to the config file.
+func queryContexts(ctx context.Context, contexts []queryContext, query queryFunc) []contextResult {
+	res := make([]contextResult, len(contexts))
+
+	var wg sync.WaitGroup
+	for i, c := range contexts {
+		res[i].context = c
+
+		f, tenant, err := fetcher.NewContextFetcher(ctx, logger, c.api, c.tenant)
+		if err != nil {
+			res[i].err = fmt.Errorf("custom fetcher: %w", err)
+			continue
+		}
+
+		wg.Add(1)
+		go func(r *contextResult) {
+			defer wg.Done()
+
+			body, resp, err := query(f, tenant)
+			if err != nil {
+				r.err = err
+				return
+			}
+			if err := checkStatus(body, resp.StatusCode); err != nil {
+				r.err = err
+				return
+			}
+
+			r.value, r.err = decodeQueryResult(body)
+		}(&res[i])
+	}
+	wg.Wait()
+
+	return res
+}
+
+// mergeContextResults merges successful results of queries against several contexts into a single result,
+// labelling every series with the API and tenant it comes from. Scalars become samples of an instant vector.
+func mergeContextResults(results []contextResult) (model.Value, error) {
+	var (
+		matrix   model.Matrix
+		vector   model.Vector
+		isMatrix bool
+		isVector bool
+	)
+	for _, r := range results {
+		if r.err != nil {
+			continue
+		}
+
+		switch v := r.value.(type) {
+		case model.Matrix:
+			for _, s := range v {
+				s.Metric = contextMetric(s.Metric, r.context)
+				matrix = append(matrix, s)
+			}
+			isMatrix = true
+		case model.Vector:
+			for _, s := range v {
+				s.Metric = contextMetric(s.Metric, r.context)
+				vector = append(vector, s)
+			}
+			isVector = true
+		case *model.Scalar:
+			vector = append(vector, &model.Sample{Metric: contextMetric(nil, r.context), Value: v.Value, Timestamp: v.Timestamp})
+			isVector = true
+		default:
+			return nil, fmt.Errorf("context %s: unsupported result type %q", r.context, r.value.Type())
+		}
+	}
+
+	if isMatrix && isVector {
+		return nil, fmt.Errorf("contexts returned both range and instant results")
+	}
+	if isMatrix {
+		return matrix, nil
+	}
+
+	return vector, nil
+}
+
+// contextMetric returns a copy of the metric with the API and tenant labels of the context set. Like Prometheus does
+// for target labels, the values the metric already had for these labels are kept with an "exported_" prefix.
+func contextMetric(m model.Metric, c queryContext) model.Metric {
+	res := make(model.Metric, len(m)+2)
+	for k, v := range m {
+		res[k] = v
+	}
+	for name, v := range map[model.LabelName]string{contextAPILabel: c.api, contextTenantLabel: c.tenant} {
+		if old, ok := res[name]; ok {
+			exported := "exported_" + name
+			for _, ok := res[exported]; ok; _, ok = res[exported] {
+				exported = "exported_" + exported
+			}
+			res[exported] = old
+		}
+		res[name] = model.LabelValue(v)
+	}
+
+	return res
+}
+
+// queryResponse is a Prometheus API query response.
+type queryResponse struct {
+	Status string            `json:"status"`
+	Data   queryResponseData `json:"data"`
+}
+
+type queryResponseData struct {
+	ResultType string      `json:"resultType"`
+	Result     model.Value `json:"result"`
+}
+
+// encodeQueryResult encodes a query result as a Prometheus API response body.
+func encodeQueryResult(v model.Value) ([]byte, error) {
+	return json.Marshal(queryResponse{Status: "success", Data: queryResponseData{ResultType: v.Type().String(), Result: v}})
+}
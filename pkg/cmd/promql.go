@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/observatorium/obsctl/pkg/promql"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/cobra"
+)
+
+// printExplanation writes the type, syntax tree, selectors and lint warnings of a PromQL expression.
+func printExplanation(w io.Writer, e promql.Expr, step time.Duration) error {
+	fmt.Fprintf(w, "Type: %s\n\nSyntax tree:\n", e.Type())
+	fmt.Fprint(w, promql.Tree(e))
+
+	fmt.Fprintln(w, "\nSelectors:")
+	for _, s := range promql.Selectors(e) {
+		fmt.Fprintf(w, "  %s\n", s)
+	}
+
+	warnings := promql.Lint(e, step)
+	if len(warnings) == 0 {
+		_, err := fmt.Fprintln(w, "\nNo warnings.")
+		return err
+	}
+
+	fmt.Fprintln(w, "\nWarnings:")
+	for _, warning := range warnings {
+		if _, err := fmt.Fprintf(w, "  - %s\n", warning); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func NewMetricsFmtCmd() *cobra.Command {
+	var width int
+	cmd := &cobra.Command{
+		Use:   "fmt <query>",
+		Short: "Format a PromQL query.",
+		Long:  "Format a PromQL query, breaking it over several lines if it is too long. The query is parsed locally and isn't sent to the tenant.",
+		Example: `obsctl metrics fmt 'sum(rate(http_requests_total{job="api"}[5m]))by(code)'
+obsctl metrics fmt --width 60 "$(cat query.promql)"`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			e, err := promql.Parse(args[0])
+			if err != nil {
+				return err
+			}
+
+			_, err = fmt.Fprintln(cmd.OutOrStdout(), promql.Pretty(e, width))
+			return err
+		},
+	}
+
+	cmd.Flags().IntVar(&width, "width", 100, "Maximum width of a line before the query is broken over several lines.")
+
+	return cmd
+}
+
+func NewMetricsExplainCmd() *cobra.Command {
+	var step model.Duration
+	cmd := &cobra.Command{
+		Use:   "explain <query>",
+		Short: "Explain a PromQL query and warn about common mistakes.",
+		Long: `Explain a PromQL query by printing its syntax tree and the selectors it touches. The query is parsed locally and isn't sent to the tenant.
+
+Warnings are printed for common mistakes:
+  - rate, irate or increase over a metric which looks like a gauge, as its name doesn't end like the one of a counter (e.g. _total),
+  - histogram_quantile over an aggregation which drops the le label, e.g. without a by clause,
+  - ranges and subquery ranges shorter than 4x the step of the range query, if --step is set,
+  - functions unknown to obsctl, which may be misspelled or newer than obsctl, and whose arguments aren't checked.`,
+		Example:      `obsctl metrics explain 'histogram_quantile(0.9, sum(rate(http_request_duration_seconds_bucket[1m])))' --step 30s`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			e, err := promql.Parse(args[0])
+			if err != nil {
+				return err
+			}
+
+			return printExplanation(cmd.OutOrStdout(), e, time.Duration(step))
+		},
+	}
+
+	cmd.Flags().Var(&step, "step", "Step of the range query the query is used in, to check that its ranges are wide enough.")
+
+	return cmd
+}
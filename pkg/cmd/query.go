@@ -0,0 +1,228 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/observatorium/obsctl/pkg/config"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/cobra"
+)
+
+// parseVars parses template variables in the key=value format.
+func parseVars(vars []string) (map[string]string, error) {
+	res := make(map[string]string, len(vars))
+	for _, v := range vars {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid variable %q: use format <name>=<value>", v)
+		}
+		res[kv[0]] = kv[1]
+	}
+
+	return res, nil
+}
+
+// savedQueryArgs returns the arguments of the metrics or logs query command which runs a saved query, ending
+// at the given time. Extra arguments are passed to the command as is.
+func savedQueryArgs(q config.SavedQuery, query string, now time.Time, extra []string) ([]string, error) {
+	args := []string{query}
+	if q.Range != "" {
+		rng, err := model.ParseDuration(q.Range)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q: %w", q.Range, err)
+		}
+
+		args = append(args,
+			"--range",
+			"--start", now.Add(-time.Duration(rng)).UTC().Format(time.RFC3339),
+			"--end", now.UTC().Format(time.RFC3339),
+		)
+		if q.Step != "" {
+			args = append(args, "--step", q.Step)
+		}
+	}
+
+	return append(args, extra...), nil
+}
+
+func NewQueryCmd(ctx context.Context) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "query",
+		Short: "Save, list & run named PromQL and LogQL queries.",
+		Long:  "Save, list & run named PromQL and LogQL queries. Saved queries are stored next to the config file and are Go templates, so variables like {{.namespace}} can be set when running them.",
+	}
+
+	// Save command.
+	var (
+		saveType, saveRange, saveStep string
+		saveAPI, saveTenant           string
+	)
+	saveCmd := &cobra.Command{
+		Use:   "save <name> <query>",
+		Short: "Save a query under a name.",
+		Long:  "Save a query under a name, replacing any query saved with the same name. The query can use Go template variables, e.g. {{.namespace}}, which must be set when running it.",
+		Example: `obsctl query save pod-cpu 'sum by (pod) (rate(container_cpu_usage_seconds_total{namespace="{{.ns}}"}[5m]))' --range 1h --step 1m
+obsctl query save api-errors '{app="api"} |= "error"' --type logs --api production`,
+		Args:         cobra.ExactArgs(2),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if saveRange != "" {
+				if _, err := model.ParseDuration(saveRange); err != nil {
+					return fmt.Errorf("invalid range %q: %w", saveRange, err)
+				}
+			} else if saveStep != "" {
+				return fmt.Errorf("step can only be set for range queries")
+			}
+
+			queries, err := config.ReadQueries(logger)
+			if err != nil {
+				return err
+			}
+
+			return queries.AddQuery(logger, args[0], config.SavedQuery{
+				Type:   saveType,
+				Query:  args[1],
+				Range:  saveRange,
+				Step:   saveStep,
+				API:    saveAPI,
+				Tenant: saveTenant,
+			})
+		},
+	}
+	saveCmd.Flags().StringVar(&saveType, "type", config.QueryTypeMetrics, "Type of the query, either metrics (PromQL) or logs (LogQL).")
+	saveCmd.Flags().StringVar(&saveRange, "range", "", "If specified, the query is run as a range query over this duration (e.g. 1h) until the current time.")
+	saveCmd.Flags().StringVar(&saveStep, "step", "", "Query resolution step width of range queries.")
+	saveCmd.Flags().StringVar(&saveAPI, "api", "", "If specified, the query can only be used when the current context is of this API.")
+	saveCmd.Flags().StringVar(&saveTenant, "tenant", "", "If specified, the query can only be used when the current context is of this tenant.")
+
+	// Run command.
+	var runVars []string
+	runCmd := &cobra.Command{
+		Use:   "run <name> [-- <query flags>]",
+		Short: "Run a saved query.",
+		Long:  "Run a saved query in the current context. Flags after -- are passed to the metrics or logs query command, e.g. to graph the results.",
+		Example: `obsctl query run pod-cpu --var ns=monitoring
+obsctl query run pod-cpu --var ns=monitoring -- --graph ascii`,
+		Args:         cobra.MinimumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if dash := cmd.ArgsLenAtDash(); dash > 1 || dash == -1 && len(args) > 1 {
+				return fmt.Errorf("expected a single query name, pass query flags after --")
+			}
+
+			vars, err := parseVars(runVars)
+			if err != nil {
+				return err
+			}
+
+			queries, err := config.ReadQueries(logger)
+			if err != nil {
+				return err
+			}
+
+			q, ok := queries.Queries[args[0]]
+			if !ok {
+				return fmt.Errorf("query with name %s doesn't exist", args[0])
+			}
+
+			conf, err := config.Read(logger)
+			if err != nil {
+				return err
+			}
+
+			if !q.InScope(conf.Current.API, conf.Current.Tenant) {
+				return fmt.Errorf("query %s can only be used in %s, but the current context is %s/%s", args[0], q.Scope(), conf.Current.API, conf.Current.Tenant)
+			}
+
+			query, err := q.Render(vars)
+			if err != nil {
+				return err
+			}
+
+			queryArgs, err := savedQueryArgs(q, query, time.Now(), args[1:])
+			if err != nil {
+				return err
+			}
+
+			var queryCmd *cobra.Command
+			switch q.Type {
+			case config.QueryTypeLogs:
+				queryCmd = NewLogsQueryCmd(ctx)
+			default:
+				queryCmd = NewMetricsQueryCmd(ctx)
+			}
+			queryCmd.SetArgs(queryArgs)
+			queryCmd.SetOut(cmd.OutOrStdout())
+			queryCmd.SetErr(cmd.ErrOrStderr())
+			queryCmd.SilenceErrors = true
+
+			return queryCmd.ExecuteContext(cmd.Context())
+		},
+	}
+	runCmd.Flags().StringArrayVar(&runVars, "var", nil, "Repeated template variable of the query in the format <name>=<value>.")
+
+	// List command.
+	var listAll bool
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List saved queries.",
+		Long:  "List saved queries which can be used in the current context.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			queries, err := config.ReadQueries(logger)
+			if err != nil {
+				return err
+			}
+
+			conf, err := config.Read(logger)
+			if err != nil {
+				return err
+			}
+
+			names := make([]string, 0, len(queries.Queries))
+			for name, q := range queries.Queries {
+				if listAll || q.InScope(conf.Current.API, conf.Current.Tenant) {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+
+			tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "NAME\tTYPE\tRANGE\tSTEP\tSCOPE\tQUERY")
+			for _, name := range names {
+				q := queries.Queries[name]
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", name, q.Type, q.Range, q.Step, q.Scope(), q.Query)
+			}
+
+			return tw.Flush()
+		},
+	}
+	listCmd.Flags().BoolVar(&listAll, "all", false, "If true, queries scoped to other contexts are listed too.")
+
+	// Remove command.
+	rmCmd := &cobra.Command{
+		Use:   "rm <name>",
+		Short: "Remove a saved query.",
+		Long:  "Remove a saved query.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			queries, err := config.ReadQueries(logger)
+			if err != nil {
+				return err
+			}
+
+			return queries.RemoveQuery(logger, args[0])
+		},
+	}
+
+	cmd.AddCommand(saveCmd)
+	cmd.AddCommand(runCmd)
+	cmd.AddCommand(listCmd)
+	cmd.AddCommand(rmCmd)
+
+	return cmd
+}
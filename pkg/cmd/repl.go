@@ -0,0 +1,548 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/observatorium/api/client"
+	"github.com/observatorium/api/client/parameters"
+	"github.com/observatorium/obsctl/pkg/config"
+	"github.com/observatorium/obsctl/pkg/fetcher"
+	"github.com/peterh/liner"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/cobra"
+)
+
+const (
+	replModeMetrics = "metrics"
+	replModeLogs    = "logs"
+
+	replHistoryFile = "repl_history"
+)
+
+var replCommands = []string{":context", ":graph", ":help", ":logs", ":metrics", ":quit", ":range", ":step"}
+
+const replHelp = `Type a PromQL or LogQL expression to evaluate it against the current tenant. Press Tab to complete
+metric names, label names and label values.
+
+Commands:
+  :metrics                   Evaluate PromQL expressions (default).
+  :logs                      Evaluate LogQL expressions.
+  :range <duration|off>      Evaluate range queries over the last <duration>, e.g. 1h or 1d. Instant queries are used if off.
+  :step <duration|off>       Query resolution step width for range queries. Picked from the range if off.
+  :graph <ascii|png|svg|off> Output metrics query results as a graph. PNG and SVG graphs are written to files.
+  :context [<api>/<tenant>]  View or switch the current context. Switching is saved like 'obsctl context switch'.
+  :help                      Show this help.
+  :quit                      Exit, same as Ctrl+D.
+`
+
+// replSession holds the state of an interactive session, which is kept between evaluated expressions.
+type replSession struct {
+	ctx context.Context
+	cmd *cobra.Command
+
+	f      *client.ClientWithResponses
+	tenant parameters.Tenant
+	name   string
+
+	mode  string
+	rng   time.Duration
+	step  time.Duration
+	graph string
+
+	// completions caches label names and values for the session, so that completing does not hit the API on every Tab.
+	completions map[string][]string
+}
+
+func NewReplCmd(ctx context.Context) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "repl",
+		Short:        "Interactive prompt to query metrics and logs of a tenant.",
+		Long:         "Interactive prompt to query metrics and logs of a tenant, with persistent history and completion of metric names, label names and label values. Type :help in the prompt for available commands.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			s := &replSession{ctx: ctx, cmd: cmd, mode: replModeMetrics}
+			if err := s.connect(); err != nil {
+				return err
+			}
+
+			line := liner.NewLiner()
+			defer line.Close()
+
+			line.SetCtrlCAborts(true)
+			line.SetWordCompleter(s.complete)
+
+			historyPath := config.FilePath(replHistoryFile)
+			if f, err := os.Open(historyPath); err == nil {
+				if _, err := line.ReadHistory(f); err != nil {
+					level.Debug(logger).Log("msg", "failed reading repl history", "error", err)
+				}
+				f.Close()
+			}
+
+			defer func() {
+				f, err := os.OpenFile(historyPath, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0600)
+				if err != nil {
+					level.Warn(logger).Log("msg", "failed saving repl history", "error", err)
+					return
+				}
+				defer f.Close()
+
+				if _, err := line.WriteHistory(f); err != nil {
+					level.Warn(logger).Log("msg", "failed saving repl history", "error", err)
+				}
+			}()
+
+			for ctx.Err() == nil {
+				input, err := line.Prompt(s.prompt())
+				if err == liner.ErrPromptAborted {
+					continue
+				}
+				if err == io.EOF {
+					fmt.Fprintln(cmd.OutOrStdout())
+					return nil
+				}
+				if err != nil {
+					return fmt.Errorf("reading input: %w", err)
+				}
+
+				input = strings.TrimSpace(input)
+				if input == "" {
+					continue
+				}
+				line.AppendHistory(input)
+
+				if strings.HasPrefix(input, ":") {
+					quit, err := s.command(input)
+					if err != nil {
+						fmt.Fprintf(cmd.ErrOrStderr(), "Error: %v\n", err)
+					}
+					if quit {
+						return nil
+					}
+					continue
+				}
+
+				if err := s.query(input); err != nil {
+					fmt.Fprintf(cmd.ErrOrStderr(), "Error: %v\n", err)
+				}
+			}
+
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+// connect (re)creates the fetcher for the current context and drops any completions cached for the previous one.
+func (s *replSession) connect() error {
+	f, currentTenant, err := fetcher.NewCustomFetcher(s.ctx, logger)
+	if err != nil {
+		return fmt.Errorf("custom fetcher: %w", err)
+	}
+
+	cfg, err := config.Read(logger)
+	if err != nil {
+		return fmt.Errorf("getting reading config: %w", err)
+	}
+
+	s.f = f
+	s.tenant = currentTenant
+	s.name = cfg.Current.API + "/" + cfg.Current.Tenant
+	s.completions = map[string][]string{}
+
+	return nil
+}
+
+func (s *replSession) prompt() string {
+	if s.rng > 0 {
+		return fmt.Sprintf("%s %s[%s]> ", s.name, s.mode, s.rng)
+	}
+
+	return fmt.Sprintf("%s %s> ", s.name, s.mode)
+}
+
+// command handles a single :command line and reports whether the session should end.
+func (s *replSession) command(input string) (bool, error) {
+	fields := strings.Fields(input)
+	arg := ""
+	if len(fields) > 1 {
+		arg = fields[1]
+	}
+
+	switch fields[0] {
+	case ":quit", ":q", ":exit":
+		return true, nil
+	case ":help", ":h":
+		fmt.Fprint(s.cmd.OutOrStdout(), replHelp)
+	case ":metrics":
+		s.mode = replModeMetrics
+	case ":logs":
+		s.mode = replModeLogs
+	case ":range":
+		d, err := parseReplDuration(arg)
+		if err != nil {
+			return false, fmt.Errorf("parsing range: %w", err)
+		}
+		s.rng = d
+	case ":step":
+		d, err := parseReplDuration(arg)
+		if err != nil {
+			return false, fmt.Errorf("parsing step: %w", err)
+		}
+		s.step = d
+	case ":graph":
+		switch arg {
+		case "ascii", "png", "svg":
+			s.graph = arg
+		case "", "off":
+			s.graph = ""
+		default:
+			return false, fmt.Errorf("unsupported graph type: %s", arg)
+		}
+	case ":context":
+		if arg == "" {
+			fmt.Fprintf(s.cmd.OutOrStdout(), "The current context is: %s\n", s.name)
+			return false, nil
+		}
+
+		cntxt := strings.Split(arg, "/")
+		if len(cntxt) != 2 {
+			return false, fmt.Errorf("invalid context name: use format <api>/<tenant>")
+		}
+
+		conf, err := config.Read(logger)
+		if err != nil {
+			return false, err
+		}
+
+		if err := conf.SetCurrentContext(logger, cntxt[0], cntxt[1]); err != nil {
+			return false, err
+		}
+
+		return false, s.connect()
+	default:
+		return false, fmt.Errorf("unknown command %s, see :help", fields[0])
+	}
+
+	return false, nil
+}
+
+// parseReplDuration parses a duration argument, where an empty argument or "off" disable the setting.
+func parseReplDuration(arg string) (time.Duration, error) {
+	if arg == "" || arg == "off" {
+		return 0, nil
+	}
+
+	d, err := model.ParseDuration(arg)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(d), nil
+}
+
+// query evaluates an expression with the current session settings and writes the result to the command output.
+func (s *replSession) query(q string) error {
+	end := time.Now().UTC()
+	endTS := end.Format(time.RFC3339)
+	startTS := end.Add(-s.rng).Format(time.RFC3339)
+	step := s.step
+	if step == 0 {
+		step = defaultStep(s.rng)
+	}
+	stepStr := step.String()
+
+	var (
+		body        []byte
+		contentType string
+		statusCode  int
+	)
+
+	switch {
+	case s.mode == replModeMetrics && s.rng > 0:
+		query := parameters.PromqlQuery(q)
+		resp, err := s.f.GetRangeQueryWithResponse(s.ctx, s.tenant, &client.GetRangeQueryParams{
+			Query: &query,
+			Start: (*parameters.StartTS)(&startTS),
+			End:   (*parameters.EndTS)(&endTS),
+			Step:  &stepStr,
+		})
+		if err != nil {
+			return fmt.Errorf("getting response: %w", err)
+		}
+
+		body, contentType, statusCode = resp.Body, resp.HTTPResponse.Header.Get("content-type"), resp.StatusCode()
+	case s.mode == replModeMetrics:
+		query := parameters.PromqlQuery(q)
+		resp, err := s.f.GetInstantQueryWithResponse(s.ctx, s.tenant, &client.GetInstantQueryParams{Query: &query})
+		if err != nil {
+			return fmt.Errorf("getting response: %w", err)
+		}
+
+		body, contentType, statusCode = resp.Body, resp.HTTPResponse.Header.Get("content-type"), resp.StatusCode()
+	case s.rng > 0:
+		query := parameters.LogqlQuery(q)
+		resp, err := s.f.GetLogRangeQueryWithResponse(s.ctx, s.tenant, &client.GetLogRangeQueryParams{
+			Query: &query,
+			Start: (*parameters.StartTS)(&startTS),
+			End:   (*parameters.EndTS)(&endTS),
+			Step:  &stepStr,
+		})
+		if err != nil {
+			return fmt.Errorf("getting response: %w", err)
+		}
+
+		body, contentType, statusCode = resp.Body, resp.HTTPResponse.Header.Get("content-type"), resp.StatusCode()
+	default:
+		query := parameters.LogqlQuery(q)
+		resp, err := s.f.GetLogInstantQueryWithResponse(s.ctx, s.tenant, &client.GetLogInstantQueryParams{Query: &query})
+		if err != nil {
+			return fmt.Errorf("getting response: %w", err)
+		}
+
+		body, contentType, statusCode = resp.Body, resp.HTTPResponse.Header.Get("content-type"), resp.StatusCode()
+	}
+
+	if s.mode == replModeMetrics && s.graph != "" && statusCode/100 == 2 {
+		out, err := graphFileName(s.graph)
+		if err != nil {
+			return err
+		}
+
+		if err := handleGraph(body, s.graph, graphOptions{title: q, color: colorEnabled()}, out, s.cmd.OutOrStdout()); err != nil {
+			return err
+		}
+		if s.graph != "ascii" {
+			fmt.Fprintln(s.cmd.OutOrStdout(), out)
+		}
+		return nil
+	}
+
+	return handleResponse(body, contentType, statusCode, s.cmd)
+}
+
+const (
+	completeNone = iota
+	completeMetricName
+	completeLabelName
+	completeLabelValue
+)
+
+// completionContext works out what is being typed at the end of head, which is a partial PromQL or LogQL expression.
+// It returns the kind of completion, the label name in case of a label value and the prefix typed so far.
+// For label values, quote is the opening quote if it has already been typed.
+func completionContext(head string) (kind int, label, prefix, quote string) {
+	// Find the start of the current matcher, if inside a selector.
+	matcherStart := -1
+	var open byte
+	for i := 0; i < len(head); i++ {
+		c := head[i]
+		if open != 0 {
+			if c == '\\' && open != '`' {
+				i++
+			} else if c == open {
+				open = 0
+			}
+			continue
+		}
+
+		switch c {
+		case '"', '\'', '`':
+			open = c
+		case '{', ',':
+			if c == '{' || matcherStart != -1 {
+				matcherStart = i + 1
+			}
+		case '}':
+			matcherStart = -1
+		}
+	}
+
+	if matcherStart == -1 {
+		if open != 0 {
+			return completeNone, "", "", ""
+		}
+
+		i := len(head)
+		for i > 0 && isMetricNameChar(head[i-1]) {
+			i--
+		}
+		return completeMetricName, "", head[i:], ""
+	}
+
+	matcher := head[matcherStart:]
+	op := strings.IndexAny(matcher, "=!~")
+	if op == -1 {
+		return completeLabelName, "", strings.TrimLeft(matcher, " "), ""
+	}
+
+	label = strings.TrimSpace(matcher[:op])
+	value := strings.TrimLeft(matcher[op:], "=!~ ")
+	if value == "" {
+		return completeLabelValue, label, "", ""
+	}
+	if open != 0 && value[0] == open {
+		return completeLabelValue, label, value[1:], string(open)
+	}
+
+	return completeNone, "", "", ""
+}
+
+func isMetricNameChar(c byte) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// complete is a liner.WordCompleter for expressions and commands typed in the prompt. The position of the cursor is
+// given in runes, not bytes.
+func (s *replSession) complete(line string, pos int) (string, []string, string) {
+	r := []rune(line)
+	head, tail := string(r[:pos]), string(r[pos:])
+
+	if strings.HasPrefix(head, ":") && !strings.Contains(head, " ") {
+		return "", filterPrefix(replCommands, head, ""), tail
+	}
+
+	kind, label, prefix, quote := completionContext(head)
+	head = head[:len(head)-len(prefix)]
+
+	switch kind {
+	case completeMetricName:
+		if s.mode != replModeMetrics || prefix == "" {
+			return head, nil, tail
+		}
+		return head, filterPrefix(s.labelValues("__name__"), prefix, ""), tail
+	case completeLabelName:
+		return head, filterPrefix(s.labelNames(), prefix, ""), tail
+	case completeLabelValue:
+		// Values are closed with the quote they were opened with.
+		if quote != "" {
+			return head, filterPrefix(s.labelValues(label), prefix, quote), tail
+		}
+
+		values := filterPrefix(s.labelValues(label), prefix, `"`)
+		for i := range values {
+			values[i] = `"` + values[i]
+		}
+		return head, values, tail
+	}
+
+	return head, nil, tail
+}
+
+// filterPrefix returns the candidates starting with prefix, each followed by suffix.
+func filterPrefix(candidates []string, prefix, suffix string) []string {
+	var res []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, prefix) {
+			res = append(res, c+suffix)
+		}
+	}
+
+	return res
+}
+
+// labelNames returns the label names of the tenant for the current mode, caching them for the session.
+func (s *replSession) labelNames() []string {
+	key := s.mode + "/labels"
+	if names, ok := s.completions[key]; ok {
+		return names
+	}
+
+	var (
+		body       []byte
+		statusCode int
+	)
+	if s.mode == replModeMetrics {
+		resp, err := s.f.GetLabelsWithResponse(s.ctx, s.tenant, &client.GetLabelsParams{})
+		if err != nil {
+			level.Debug(logger).Log("msg", "failed fetching label names", "error", err)
+			return nil
+		}
+		body, statusCode = resp.Body, resp.StatusCode()
+	} else {
+		resp, err := s.f.GetLogLabelsWithResponse(s.ctx, s.tenant, &client.GetLogLabelsParams{})
+		if err != nil {
+			level.Debug(logger).Log("msg", "failed fetching label names", "error", err)
+			return nil
+		}
+		body, statusCode = resp.Body, resp.StatusCode()
+	}
+
+	return s.cache(key, body, statusCode)
+}
+
+// labelValues returns the values of a label of the tenant for the current mode, caching them for the session.
+func (s *replSession) labelValues(name string) []string {
+	key := s.mode + "/values/" + name
+	if values, ok := s.completions[key]; ok {
+		return values
+	}
+
+	var (
+		body       []byte
+		statusCode int
+	)
+	if s.mode == replModeMetrics {
+		resp, err := s.f.GetLabelValuesWithResponse(s.ctx, s.tenant, name, &client.GetLabelValuesParams{})
+		if err != nil {
+			level.Debug(logger).Log("msg", "failed fetching label values", "label", name, "error", err)
+			return nil
+		}
+		body, statusCode = resp.Body, resp.StatusCode()
+	} else {
+		resp, err := s.f.GetLogLabelValuesWithResponse(s.ctx, s.tenant, name, &client.GetLogLabelValuesParams{})
+		if err != nil {
+			level.Debug(logger).Log("msg", "failed fetching label values", "label", name, "error", err)
+			return nil
+		}
+		body, statusCode = resp.Body, resp.StatusCode()
+	}
+
+	return s.cache(key, body, statusCode)
+}
+
+// cache decodes a list of strings from an API response and stores it under key. Failed responses are not cached,
+// so that they are retried on the next completion.
+func (s *replSession) cache(key string, body []byte, statusCode int) []string {
+	values, err := decodeStringList(body, statusCode)
+	if err != nil {
+		level.Debug(logger).Log("msg", "failed decoding completions", "key", key, "error", err)
+		return nil
+	}
+
+	s.completions[key] = values
+	return values
+}
+
+// decodeStringList decodes the data of a labels or label values API response.
+func decodeStringList(body []byte, statusCode int) ([]string, error) {
+	if statusCode/100 != 2 {
+		return nil, fmt.Errorf("request failed with status code %d", statusCode)
+	}
+
+	var r struct {
+		Data []string `json:"data"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, err
+	}
+	if r.Data == nil {
+		return nil, errors.New("no data in response")
+	}
+
+	sort.Strings(r.Data)
+	return r.Data, nil
+}
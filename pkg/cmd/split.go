@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/term"
+)
+
+const (
+	// defaultSplitInterval is the default width above which range queries are split into sub-ranges.
+	defaultSplitInterval = 24 * time.Hour
+	// defaultSplitConcurrency is the default number of sub-ranges fetched at the same time.
+	defaultSplitConcurrency = 4
+)
+
+// subRange is a part of the range of a range query.
+type subRange struct {
+	start, end time.Time
+}
+
+func (r subRange) String() string {
+	return formatTime(r.start) + " - " + formatTime(r.end)
+}
+
+// splitRange splits the range from start to end into sub-ranges at most width wide. Sub-ranges are aligned to the
+// step, so that every step of the whole range is evaluated in exactly one of them.
+func splitRange(start, end time.Time, step, width time.Duration) []subRange {
+	steps := width / step
+	if steps < 1 {
+		steps = 1
+	}
+
+	var ranges []subRange
+	for s := start; !s.After(end); s = s.Add(steps * step) {
+		e := s.Add((steps - 1) * step)
+		if e.After(end) {
+			e = end
+		}
+		ranges = append(ranges, subRange{start: s, end: e})
+	}
+
+	return ranges
+}
+
+// splitQueryRange parses the range and step of a range query and splits the range if it is wider than width,
+// or returns a single sub-range if it isn't or width is zero.
+func splitQueryRange(start, end, step string, width time.Duration) ([]subRange, error) {
+	s, err := parseTime(start)
+	if err != nil {
+		return nil, err
+	}
+	e, err := parseTime(end)
+	if err != nil {
+		return nil, err
+	}
+	if width <= 0 || e.Sub(s) <= width {
+		return []subRange{{start: s, end: e}}, nil
+	}
+
+	d, err := parseStep(step)
+	if err != nil {
+		return nil, err
+	}
+
+	return splitRange(s, e, d, width), nil
+}
+
+// subRangeFetch runs a range query from start to end.
+type subRangeFetch func(ctx context.Context, start, end string) ([]byte, *http.Response, error)
+
+// subRangeResult is the outcome of fetching a sub-range. Either matrix is set, or the body and response or error
+// it failed with.
+type subRangeResult struct {
+	matrix model.Matrix
+	body   []byte
+	resp   *http.Response
+	err    error
+}
+
+// fetchSplitRange fetches the sub-ranges of a range query with at most concurrency of them at a time, and stitches
+// their results back together. Progress is reported to w. Requests of sub-ranges are retried by the fetcher like any
+// other, so if a sub-range fails, the others are cancelled and its body and response are returned as they are.
+func fetchSplitRange(ctx context.Context, ranges []subRange, concurrency int, w io.Writer, fetch subRangeFetch) ([]byte, *http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	p := newSplitProgress(w, len(ranges))
+	results := make([]subRangeResult, len(ranges))
+	sem := make(chan struct{}, concurrency)
+	var (
+		wg     sync.WaitGroup
+		mtx    sync.Mutex
+		failed = -1
+	)
+	for i, r := range ranges {
+		wg.Add(1)
+		go func(i int, r subRange) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			res := fetchSubRange(ctx, r, fetch)
+			if res.matrix == nil {
+				// Only the first failure is reported, the others are caused by cancelling the remaining sub-ranges.
+				mtx.Lock()
+				if failed == -1 {
+					failed = i
+					cancel()
+				}
+				mtx.Unlock()
+			} else {
+				p.done()
+			}
+			results[i] = res
+		}(i, r)
+	}
+	wg.Wait()
+	p.finish()
+
+	if failed >= 0 {
+		res := results[failed]
+		if res.err != nil {
+			return nil, nil, fmt.Errorf("sub-range %s: %w", ranges[failed], res.err)
+		}
+		return res.body, res.resp, nil
+	}
+
+	parts := make([]model.Matrix, 0, len(results))
+	for _, res := range results {
+		parts = append(parts, res.matrix)
+	}
+
+	body, err := encodeQueryResult(mergeMatrices(parts))
+	if err != nil {
+		return nil, nil, fmt.Errorf("encoding stitched results: %w", err)
+	}
+
+	return body, &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"application/json"}}}, nil
+}
+
+// fetchSubRange fetches a sub-range and decodes its matrix.
+func fetchSubRange(ctx context.Context, r subRange, fetch subRangeFetch) subRangeResult {
+	body, resp, err := fetch(ctx, formatTime(r.start), formatTime(r.end))
+	if err != nil || resp.StatusCode/100 != 2 {
+		return subRangeResult{body: body, resp: resp, err: err}
+	}
+
+	v, err := decodeQueryResult(body)
+	if err != nil {
+		return subRangeResult{err: err}
+	}
+	matrix, ok := v.(model.Matrix)
+	if !ok {
+		return subRangeResult{err: fmt.Errorf("expected a matrix, got %s", v.Type())}
+	}
+	if matrix == nil {
+		matrix = model.Matrix{}
+	}
+
+	return subRangeResult{matrix: matrix}
+}
+
+// mergeMatrices stitches the matrices of consecutive sub-ranges into one, appending the samples of every series in
+// the order of the sub-ranges.
+func mergeMatrices(parts []model.Matrix) model.Matrix {
+	res := model.Matrix{}
+	streams := map[model.Fingerprint]*model.SampleStream{}
+	for _, m := range parts {
+		for _, s := range m {
+			fp := s.Metric.Fingerprint()
+			if stream, ok := streams[fp]; ok {
+				stream.Values = append(stream.Values, s.Values...)
+				continue
+			}
+
+			stream := &model.SampleStream{Metric: s.Metric, Values: append([]model.SamplePair(nil), s.Values...)}
+			streams[fp] = stream
+			res = append(res, stream)
+		}
+	}
+	sort.Sort(res)
+
+	return res
+}
+
+// splitProgress reports how many sub-ranges of a range query were fetched, on a single line redrawn in place if
+// w is a terminal and on a line per sub-range otherwise.
+type splitProgress struct {
+	mtx     sync.Mutex
+	w       io.Writer
+	tty     bool
+	fetched int
+	total   int
+}
+
+func newSplitProgress(w io.Writer, total int) *splitProgress {
+	f, ok := w.(*os.File)
+	return &splitProgress{w: w, tty: ok && term.IsTerminal(int(f.Fd())), total: total}
+}
+
+func (p *splitProgress) done() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.fetched++
+	if p.tty {
+		fmt.Fprintf(p.w, "\rFetched %d/%d sub-ranges", p.fetched, p.total)
+		return
+	}
+	fmt.Fprintf(p.w, "Fetched %d/%d sub-ranges\n", p.fetched, p.total)
+}
+
+func (p *splitProgress) finish() {
+	if p.tty {
+		fmt.Fprintln(p.w)
+	}
+}
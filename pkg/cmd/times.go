@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// dateLayouts are the layouts of absolute times accepted besides RFC3339, in local time unless followed by a zone.
+var dateLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// parseTime parses a timestamp relative to the current time. See parseTimeAt for the accepted formats.
+func parseTime(s string) (time.Time, error) {
+	return parseTimeAt(s, time.Now())
+}
+
+// parseTimeAt parses a timestamp given as any of:
+//   - Unix seconds or RFC3339, as accepted by the query APIs,
+//   - now, today or yesterday, the latter two being midnight in local time,
+//   - a duration relative to now, e.g. now-1h, now+5m or -30m,
+//   - a date with an optional time, e.g. 2022-10-01 or 2022-10-01 14:00, followed by an optional zone like
+//     UTC, Europe/Berlin or +02:00. Local time is used if there is no zone.
+func parseTimeAt(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))).UTC(), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+
+	switch s {
+	case "now":
+		return now, nil
+	case "today":
+		y, m, d := now.Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, now.Location()), nil
+	case "yesterday":
+		y, m, d := now.Date()
+		return time.Date(y, m, d-1, 0, 0, 0, 0, now.Location()), nil
+	}
+
+	if rel := strings.TrimPrefix(s, "now"); strings.HasPrefix(rel, "-") || strings.HasPrefix(rel, "+") {
+		d, err := model.ParseDuration(rel[1:])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp: %w", s, err)
+		}
+		if rel[0] == '-' {
+			return now.Add(-time.Duration(d)), nil
+		}
+		return now.Add(time.Duration(d)), nil
+	}
+
+	date, loc := s, now.Location()
+	if i := strings.LastIndex(s, " "); i > 0 {
+		if l, err := parseZone(s[i+1:]); err == nil {
+			date, loc = s[:i], l
+		}
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.ParseInLocation(layout, date, loc); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseZone parses a time zone given either as a name or as an offset from UTC.
+func parseZone(s string) (*time.Location, error) {
+	if strings.HasPrefix(s, "+") || strings.HasPrefix(s, "-") {
+		for _, layout := range []string{"-07:00", "-0700", "-07"} {
+			if t, err := time.Parse(layout, s); err == nil {
+				_, offset := t.Zone()
+				return time.FixedZone(s, offset), nil
+			}
+		}
+		return nil, fmt.Errorf("invalid zone offset %q", s)
+	}
+
+	// Names like 2022-10-01 aren't zones, but would be looked up as files.
+	if s == "" || strings.ContainsAny(s, ":.") || s[0] >= '0' && s[0] <= '9' {
+		return nil, fmt.Errorf("invalid zone %q", s)
+	}
+
+	return time.LoadLocation(s)
+}
+
+// formatTime formats a timestamp the way it is passed to the query APIs.
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// resolveTime replaces a time expression with the timestamp it refers to. Empty expressions are left as is.
+func resolveTime(name string, s *string, now time.Time) error {
+	if *s == "" {
+		return nil
+	}
+
+	t, err := parseTimeAt(*s, now)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", name, err)
+	}
+	*s = formatTime(t)
+
+	return nil
+}
+
+// resolveRange replaces the start and end time expressions with the timestamps they refer to. If since is set,
+// start is set to that long before end, which defaults to now.
+func resolveRange(start, end *string, since model.Duration, now time.Time) error {
+	if since > 0 {
+		if *start != "" {
+			return fmt.Errorf("--since and --start can't be used together")
+		}
+		if *end == "" {
+			*end = "now"
+		}
+	}
+
+	if err := resolveTime("--start", start, now); err != nil {
+		return err
+	}
+	if err := resolveTime("--end", end, now); err != nil {
+		return err
+	}
+
+	if since > 0 {
+		e, err := parseTimeAt(*end, now)
+		if err != nil {
+			return err
+		}
+		*start = formatTime(e.Add(-time.Duration(since)))
+	}
+
+	return nil
+}
+
+// resolveRangeOrLast is like resolveRange, but the range defaults to the last given duration until now if neither
+// start nor since are set.
+func resolveRangeOrLast(start, end *string, since model.Duration, last time.Duration, now time.Time) error {
+	if *start == "" && since == 0 {
+		since = model.Duration(last)
+	}
+
+	return resolveRange(start, end, since, now)
+}
+
+// rangeStep returns the step for a range query from start to end if step isn't set, picked from the width of the range.
+func rangeStep(step, start, end string) (string, error) {
+	if step != "" || start == "" || end == "" {
+		return step, nil
+	}
+
+	s, err := parseTime(start)
+	if err != nil {
+		return "", err
+	}
+	e, err := parseTime(end)
+	if err != nil {
+		return "", err
+	}
+
+	return model.Duration(defaultStep(e.Sub(s))).String(), nil
+}
+
+// parseStep parses a query resolution step given either as a duration or as a number of seconds.
+func parseStep(s string) (time.Duration, error) {
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+
+	sec, err := strconv.ParseFloat(s, 64)
+	if err != nil || sec <= 0 {
+		return 0, fmt.Errorf("invalid step %q", s)
+	}
+
+	return time.Duration(sec * float64(time.Second)), nil
+}
+
+// defaultStep picks a query resolution step which gives roughly 250 points over the given range.
+func defaultStep(rng time.Duration) time.Duration {
+	step := (rng / 250).Round(time.Second)
+	if step < time.Second {
+		return time.Second
+	}
+
+	return step
+}
@@ -5,13 +5,68 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
+	"path"
+	"sort"
+	"text/tabwriter"
+	"time"
 
 	"github.com/go-kit/log/level"
 	"github.com/observatorium/obsctl/pkg/config"
 	"github.com/spf13/cobra"
 )
 
+// getTraces sends a GET request to an endpoint of the traces API of the current tenant, e.g. api/services, and
+// returns the body of its response.
+func getTraces(ctx context.Context, endpoint ...string) ([]byte, error) {
+	cfg, err := config.Read(logger)
+	if err != nil {
+		return nil, fmt.Errorf("getting reading config: %w", err)
+	}
+
+	client, err := cfg.Client(ctx, logger)
+	if err != nil {
+		return nil, fmt.Errorf("getting current client: %w", err)
+	}
+
+	level.Debug(logger).Log(
+		"msg", "Using configuration",
+		"URL", cfg.APIs[cfg.Current.API].URL,
+		"tenant", cfg.Current.Tenant)
+
+	u, err := url.Parse(cfg.APIs[cfg.Current.API].URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing url: %w", err)
+	}
+	u.Path = path.Join(append([]string{u.Path, "api/traces/v1", cfg.Current.Tenant}, endpoint...)...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("getting: %w", err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("getting: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		level.Debug(logger).Log(
+			"msg", "/"+path.Join(endpoint...)+" request failed",
+			"statusCode", resp.StatusCode,
+			"status", resp.Status,
+			"body", string(bodyBytes))
+		return nil, fmt.Errorf("%d: %s", resp.StatusCode, resp.Status)
+	}
+
+	return bodyBytes, nil
+}
+
 func NewTraceServicesCmd(ctx context.Context) *cobra.Command {
 	var outputFormat string
 	cmd := &cobra.Command{
@@ -19,60 +74,83 @@ func NewTraceServicesCmd(ctx context.Context) *cobra.Command {
 		Short: "List names of services",
 		Long:  "List names of services with trace information",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
 			// Don't print CLI flag usage if we get network error
 			cmd.SilenceUsage = true
 
-			cfg, err := config.Read(logger)
+			bodyBytes, err := getTraces(ctx, "api/services")
 			if err != nil {
-				return fmt.Errorf("getting reading config: %w", err)
+				return err
 			}
 
-			client, err := cfg.Client(ctx, logger)
-			if err != nil {
-				return fmt.Errorf("getting current client: %w", err)
+			switch outputFormat {
+			case "table":
+				svcs, err := services(bodyBytes)
+				if err != nil {
+					return fmt.Errorf("parsing services: %w", err)
+				}
+				if len(svcs) == 0 {
+					fmt.Fprintln(cmd.ErrOrStderr(), "No services found")
+					return nil
+				}
+				fmt.Fprintln(cmd.ErrOrStderr(), "SERVICE")
+				for _, svc := range svcs {
+					fmt.Fprintln(cmd.OutOrStdout(), svc)
+				}
+			case "json":
+				json, err := prettyPrintJSON(bodyBytes)
+				if err != nil {
+					return fmt.Errorf("failed to pretty print JSON: %s", err)
+				}
+				fmt.Fprintln(cmd.OutOrStdout(), json)
+			default:
+				cmd.SilenceUsage = false
+				return fmt.Errorf("unknown format %s", outputFormat)
 			}
+			return nil
+		},
+	}
 
-			level.Debug(logger).Log(
-				"msg", "Using configuration",
-				"URL", cfg.APIs[cfg.Current.API].URL,
-				"tenant", cfg.Current.Tenant)
+	cmd.Flags().StringVarP(&outputFormat, "output", "o", "table", "Output format. One of: json|table")
 
-			svcUrl, err := url.Parse(cfg.APIs[cfg.Current.API].URL)
-			if err != nil {
-				return fmt.Errorf("parsing url: %w", err)
-			}
-			svcUrl.Path = "api/traces/v1/rhobs/api/services"
-			resp, err := client.Get(svcUrl.String())
-			if err != nil {
-				return fmt.Errorf("getting: %w", err)
-			}
-			bodyBytes, err := io.ReadAll(resp.Body)
+	return cmd
+}
+
+func NewTraceGetCmd(ctx context.Context) *cobra.Command {
+	var outputFormat string
+	cmd := &cobra.Command{
+		Use:   "get <trace id>",
+		Short: "Get a trace",
+		Long:  "Get the spans of a trace by its ID, e.g. one linked from an exemplar",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			// Don't print CLI flag usage if we get network error
+			cmd.SilenceUsage = true
+
+			bodyBytes, err := getTraces(ctx, "api/traces", url.PathEscape(args[0]))
 			if err != nil {
-				return fmt.Errorf("getting: %w", err)
-			}
-			if resp.StatusCode >= 300 {
-				level.Debug(logger).Log(
-					"msg", "/api/services request failed",
-					"statusCode", resp.StatusCode,
-					"status", resp.Status,
-					"body", string(bodyBytes))
-				return fmt.Errorf("%d: %s", resp.StatusCode, resp.Status)
+				return err
 			}
 
 			switch outputFormat {
 			case "table":
-				svcs, err := services(bodyBytes)
+				spans, err := traceSpans(bodyBytes)
 				if err != nil {
-					return fmt.Errorf("parsing services: %w", err)
+					return fmt.Errorf("parsing trace: %w", err)
 				}
-				if len(svcs) == 0 {
-					fmt.Fprintln(cmd.OutOrStderr(), "No services found")
+				if len(spans) == 0 {
+					fmt.Fprintln(cmd.ErrOrStderr(), "No spans found")
 					return nil
 				}
-				fmt.Fprintln(cmd.OutOrStderr(), "SERVICE")
-				for _, svc := range svcs {
-					fmt.Fprintln(cmd.OutOrStdout(), svc)
+				tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+				fmt.Fprintln(tw, "SPAN ID\tSERVICE\tOPERATION\tSTART\tDURATION")
+				for _, s := range spans {
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s.id, s.service, s.operation, s.start.Format(time.RFC3339Nano), s.duration)
 				}
+				return tw.Flush()
 			case "json":
 				json, err := prettyPrintJSON(bodyBytes)
 				if err != nil {
@@ -100,6 +178,7 @@ func NewTracesCmd(ctx context.Context) *cobra.Command {
 	}
 
 	cmd.AddCommand(NewTraceServicesCmd(ctx))
+	cmd.AddCommand(NewTraceGetCmd(ctx))
 
 	return cmd
 }
@@ -129,3 +208,51 @@ func services(js []byte) ([]string, error) {
 	}
 	return retval, nil
 }
+
+// span is a span of a trace, with the name of the service which reported it.
+type span struct {
+	id        string
+	service   string
+	operation string
+	start     time.Time
+	duration  time.Duration
+}
+
+// traceSpans converts the internal Jaeger API /api/traces/{id} response
+// into a list of spans, ordered by their start time
+func traceSpans(js []byte) ([]span, error) {
+	var result struct {
+		Data []struct {
+			Spans []struct {
+				SpanID        string `json:"spanID"`
+				OperationName string `json:"operationName"`
+				// StartTime and Duration are in microseconds.
+				StartTime int64  `json:"startTime"`
+				Duration  int64  `json:"duration"`
+				ProcessID string `json:"processID"`
+			} `json:"spans"`
+			Processes map[string]struct {
+				ServiceName string `json:"serviceName"`
+			} `json:"processes"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(js, &result); err != nil {
+		return nil, err
+	}
+
+	var spans []span
+	for _, t := range result.Data {
+		for _, s := range t.Spans {
+			spans = append(spans, span{
+				id:        s.SpanID,
+				service:   t.Processes[s.ProcessID].ServiceName,
+				operation: s.OperationName,
+				start:     time.UnixMicro(s.StartTime).UTC(),
+				duration:  time.Duration(s.Duration) * time.Microsecond,
+			})
+		}
+	}
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].start.Before(spans[j].start) })
+
+	return spans, nil
+}
@@ -0,0 +1,264 @@
+package cmd
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/observatorium/obsctl/pkg/config"
+	"github.com/spf13/cobra"
+	"golang.org/x/oauth2"
+)
+
+// identity is who the current context is authenticated as.
+type identity struct {
+	API    string `json:"api"`
+	URL    string `json:"url"`
+	Tenant string `json:"tenant"`
+	// Token is the kind of token the claims were decoded from, either "access" or "id".
+	Token  string                 `json:"token,omitempty"`
+	Expiry *time.Time             `json:"expiry,omitempty"`
+	TTL    string                 `json:"ttl,omitempty"`
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+// decodeJWTClaims returns the claims of a JWT, without verifying its signature.
+func decodeJWTClaims(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("not a JWT, expected 3 parts but got %d", len(parts))
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("decoding JWT payload: %w", err)
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("parsing JWT claims: %w", err)
+	}
+
+	return claims, nil
+}
+
+// claimStrings returns a claim which is either a string or a list of strings, like the audience, as a list.
+func claimStrings(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		res := make([]string, 0, len(v))
+		for _, s := range v {
+			res = append(res, fmt.Sprint(s))
+		}
+		return res
+	}
+	return nil
+}
+
+// tokenIdentity fills in the identity from the claims of a token. The access token is decoded if it is a JWT,
+// otherwise or if idToken is set the ID token is.
+func tokenIdentity(id *identity, tkn *oauth2.Token, idToken bool) error {
+	if !idToken {
+		claims, err := decodeJWTClaims(tkn.AccessToken)
+		if err == nil {
+			id.Token, id.Claims = "access", claims
+			return nil
+		}
+	}
+
+	raw, ok := tkn.Extra("id_token").(string)
+	if !ok || raw == "" {
+		if idToken {
+			return fmt.Errorf("the issuer didn't return an ID token")
+		}
+		return fmt.Errorf("the access token is opaque and the issuer didn't return an ID token, so there are no claims to show")
+	}
+
+	claims, err := decodeJWTClaims(raw)
+	if err != nil {
+		return fmt.Errorf("decoding ID token: %w", err)
+	}
+	id.Token, id.Claims = "id", claims
+
+	return nil
+}
+
+// formatTTL describes how long a token is valid for, or how long ago it expired.
+func formatTTL(ttl time.Duration) string {
+	ttl = ttl.Round(time.Second)
+	if ttl < 0 {
+		return "expired " + (-ttl).String() + " ago"
+	}
+
+	return "expires in " + ttl.String()
+}
+
+// printIdentity writes the identity as a table of its fields and main claims, followed by the other claims.
+func printIdentity(w io.Writer, id *identity) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "API:\t%s (%s)\n", id.API, id.URL)
+	fmt.Fprintf(tw, "Tenant:\t%s\n", id.Tenant)
+
+	if id.Claims == nil {
+		fmt.Fprintln(tw, "Authentication:\tnone")
+		return tw.Flush()
+	}
+
+	if id.Expiry != nil {
+		fmt.Fprintf(tw, "Expiry:\t%s (%s)\n", id.Expiry.Format(time.RFC3339), id.TTL)
+	}
+	fmt.Fprintf(tw, "Token:\t%s\n", id.Token)
+
+	fields := []struct{ name, claim string }{
+		{"Subject", "sub"},
+		{"Issuer", "iss"},
+		{"Audience", "aud"},
+		{"Groups", "groups"},
+		{"Client ID", "client_id"},
+		{"Scope", "scope"},
+	}
+	shown := map[string]bool{"exp": true}
+	for _, m := range fields {
+		shown[m.claim] = true
+		if v := claimStrings(id.Claims, m.claim); len(v) > 0 {
+			fmt.Fprintf(tw, "%s:\t%s\n", m.name, strings.Join(v, ", "))
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	var others []string
+	for k := range id.Claims {
+		if !shown[k] {
+			others = append(others, k)
+		}
+	}
+	if len(others) == 0 {
+		return nil
+	}
+	sort.Strings(others)
+
+	fmt.Fprintln(w, "\nOther claims:")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, k := range others {
+		b, err := json.Marshal(id.Claims[k])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "  %s:\t%s\n", k, b)
+	}
+	return tw.Flush()
+}
+
+func NewWhoamiCmd(ctx context.Context) *cobra.Command {
+	var output string
+	var idToken bool
+
+	cmd := &cobra.Command{
+		Use:   "whoami",
+		Short: "Show the identity the current context is authenticated as.",
+		Long:  "Show the API and tenant of the current context, and the claims of its token: subject, audience, groups and expiry. The access token is decoded if it is a JWT, otherwise the ID token is. Signatures aren't verified.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			if output != "table" && output != "json" {
+				return fmt.Errorf("unknown output format %q, expected table or json", output)
+			}
+
+			conf, err := config.Read(logger)
+			if err != nil {
+				return err
+			}
+
+			tenant, api, err := conf.GetCurrentContext()
+			if err != nil {
+				return err
+			}
+
+			id := &identity{API: conf.Current.API, URL: api.URL, Tenant: tenant.Tenant}
+			if tenant.OIDC != nil {
+				tkn, err := conf.Token(ctx, logger, false)
+				if err != nil {
+					return err
+				}
+				// ID tokens aren't saved, so a new token is needed to get one.
+				if _, ok := tkn.Extra("id_token").(string); idToken && !ok {
+					if tkn, err = conf.Token(ctx, logger, true); err != nil {
+						return err
+					}
+				}
+
+				if err := tokenIdentity(id, tkn, idToken); err != nil {
+					return err
+				}
+				if !tkn.Expiry.IsZero() {
+					expiry := tkn.Expiry.UTC()
+					id.Expiry = &expiry
+					id.TTL = formatTTL(time.Until(expiry))
+				}
+			}
+
+			if output == "json" {
+				b, err := json.MarshalIndent(id, "", "\t")
+				if err != nil {
+					return err
+				}
+				_, err = fmt.Fprintln(cmd.OutOrStdout(), string(b))
+				return err
+			}
+
+			return printIdentity(cmd.OutOrStdout(), id)
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "table", "Output format. One of: table|json")
+	cmd.Flags().BoolVar(&idToken, "id-token", false, "Decode the ID token rather than the access token. A new token is fetched if the saved one has no ID token.")
+
+	return cmd
+}
+
+func NewTokenCmd(ctx context.Context) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "token",
+		Short: "Token operations for the current context.",
+		Long:  "Token operations for the current context.",
+	}
+
+	var refresh bool
+	printCmd := &cobra.Command{
+		Use:     "print",
+		Short:   "Print the bearer token of the current context.",
+		Long:    "Print the bearer token of the current context, e.g. to send requests with other tools. The saved token is printed until it expires, unless --refresh is set.",
+		Example: `curl -H "Authorization: Bearer $(obsctl token print)" https://observatorium.example.com/api/metrics/v1/tenant/api/v1/query?query=up`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			conf, err := config.Read(logger)
+			if err != nil {
+				return err
+			}
+
+			tkn, err := conf.Token(ctx, logger, refresh)
+			if err != nil {
+				return err
+			}
+
+			_, err = fmt.Fprintln(cmd.OutOrStdout(), tkn.AccessToken)
+			return err
+		},
+	}
+	printCmd.Flags().BoolVar(&refresh, "refresh", false, "Fetch a new token even if the saved one hasn't expired.")
+
+	cmd.AddCommand(printCmd)
+
+	return cmd
+}
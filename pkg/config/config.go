@@ -1,7 +1,9 @@
 package config
 
 import (
+	"bytes"
 	"context"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,14 +12,13 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
-	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/clientcredentials"
 )
 
 const (
@@ -42,6 +43,16 @@ func getConfigFilePath() string {
 	return filepath.Join(usrConfigDir, configDirName, configFileName)
 }
 
+// Path returns the path of the obsctl config file.
+func Path() string {
+	return getConfigFilePath()
+}
+
+// FilePath returns the path of a file with the given name, kept next to the obsctl config file.
+func FilePath(name string) string {
+	return filepath.Join(filepath.Dir(getConfigFilePath()), name)
+}
+
 func ensureConfigDir() error {
 	if err := os.MkdirAll(path.Dir(getConfigFilePath()), 0700); err != nil {
 		return fmt.Errorf("creating config directory: %w", err)
@@ -54,6 +65,9 @@ func ensureConfigDir() error {
 type Config struct {
 	pathOverride string
 
+	// Version is the version of the structure of the config file, which is migrated when it is read by a newer
+	// version of obsctl.
+	Version int                  `json:"version"`
 	APIs    map[string]APIConfig `json:"apis"`
 	Current struct {
 		API    string `json:"api"`
@@ -65,6 +79,21 @@ type Config struct {
 type APIConfig struct {
 	URL      string                  `json:"url"`
 	Contexts map[string]TenantConfig `json:"contexts"`
+	Retry    *RetryConfig            `json:"retry,omitempty"`
+}
+
+// RetryConfig represents how requests to an instance of Observatorium are retried and rate limited.
+// Fields which aren't set fall back to the global flags.
+type RetryConfig struct {
+	// MaxRetries is how many times a failed request is retried, 0 disabling retries.
+	MaxRetries *int `json:"maxRetries,omitempty"`
+	// MinBackoff and MaxBackoff are the durations, e.g. 500ms, between which the backoff between retries grows.
+	MinBackoff string `json:"minBackoff,omitempty"`
+	MaxBackoff string `json:"maxBackoff,omitempty"`
+	// RateLimit is the maximum number of requests per second, 0 disabling the rate limit.
+	RateLimit *float64 `json:"rateLimit,omitempty"`
+	// Burst is how many requests can be sent at once above the rate limit.
+	Burst *int `json:"burst,omitempty"`
 }
 
 // TenantConfig represents configuration for a tenant.
@@ -85,53 +114,32 @@ type OIDCConfig struct {
 	OfflineAccess bool   `json:"offlineAccess"`
 }
 
-// Client returns a OAuth2 HTTP client based on the configuration for a tenant.
-func (t *TenantConfig) Client(ctx context.Context, logger log.Logger) (*http.Client, error) {
-	if t.OIDC != nil {
-		provider, err := oidc.NewProvider(ctx, t.OIDC.IssuerURL)
-		if err != nil {
-			return nil, fmt.Errorf("constructing oidc provider: %w", err)
-		}
-
-		scopes := []string{"openid"}
-
-		if t.OIDC.OfflineAccess {
-			scopes = append(scopes, "offline_access")
-		}
-
-		ccc := clientcredentials.Config{
-			ClientID:     t.OIDC.ClientID,
-			ClientSecret: t.OIDC.ClientSecret,
-			TokenURL:     provider.Endpoint().TokenURL,
-			Scopes:       scopes,
-		}
+// WrapTransport, if set, wraps the transport which sends requests to APIs once they are authenticated, e.g. to
+// debug them.
+var WrapTransport func(http.RoundTripper) http.RoundTripper
 
-		if t.OIDC.Audience != "" {
-			ccc.EndpointParams = url.Values{
-				"audience": []string{t.OIDC.Audience},
-			}
-		}
-
-		ts := ccc.TokenSource(ctx)
+// BaseTransport returns the transport requests to APIs are sent with, beneath their authentication.
+func BaseTransport() http.RoundTripper {
+	if WrapTransport != nil {
+		return WrapTransport(http.DefaultTransport)
+	}
 
-		// If token has not expired, we can reuse.
-		if t.OIDC.Token != nil {
-			currentTime := time.Now()
-			if t.OIDC.Token.Expiry.After(currentTime) {
-				ts = oauth2.ReuseTokenSource(t.OIDC.Token, ts)
-			}
-		}
+	return http.DefaultTransport
+}
 
-		tkn, err := ts.Token()
+// Client returns a OAuth2 HTTP client based on the configuration for a tenant.
+func (t *TenantConfig) Client(ctx context.Context, logger log.Logger) (*http.Client, error) {
+	if t.OIDC != nil {
+		ts, err := t.authenticate(ctx, logger)
 		if err != nil {
-			return nil, fmt.Errorf("fetching token: %w", err)
+			return nil, err
 		}
 
-		t.OIDC.Token = tkn
-
-		level.Debug(logger).Log("msg", "fetched token", "tenant", t.Tenant)
+		return &http.Client{Transport: &oauth2.Transport{Source: ts, Base: BaseTransport()}}, nil
+	}
 
-		return oauth2.NewClient(ctx, ts), nil
+	if WrapTransport != nil {
+		return &http.Client{Transport: BaseTransport()}, nil
 	}
 
 	return http.DefaultClient, nil
@@ -140,63 +148,34 @@ func (t *TenantConfig) Client(ctx context.Context, logger log.Logger) (*http.Cli
 // Tenant returns a OAuth2 HTTP transport based on the configuration for a tenant.
 func (t *TenantConfig) Transport(ctx context.Context, logger log.Logger) (http.RoundTripper, error) {
 	if t.OIDC != nil {
-		provider, err := oidc.NewProvider(ctx, t.OIDC.IssuerURL)
+		ts, err := t.authenticate(ctx, logger)
 		if err != nil {
-			return nil, fmt.Errorf("constructing oidc provider: %w", err)
+			return nil, err
 		}
 
-		scopes := []string{"openid"}
-
-		if t.OIDC.OfflineAccess {
-			scopes = append(scopes, "offline_access")
-		}
-
-		ccc := clientcredentials.Config{
-			ClientID:     t.OIDC.ClientID,
-			ClientSecret: t.OIDC.ClientSecret,
-			TokenURL:     provider.Endpoint().TokenURL,
-			Scopes:       scopes,
-		}
-
-		if t.OIDC.Audience != "" {
-			ccc.EndpointParams = url.Values{
-				"audience": []string{t.OIDC.Audience},
-			}
-		}
-
-		ts := ccc.TokenSource(ctx)
-
-		// If token has not expired, we can reuse.
-		if t.OIDC.Token != nil {
-			currentTime := time.Now()
-			if t.OIDC.Token.Expiry.After(currentTime) {
-				ts = oauth2.ReuseTokenSource(t.OIDC.Token, ts)
-			}
-		}
-
-		tkn, err := ts.Token()
-		if err != nil {
-			return nil, fmt.Errorf("fetching token: %w", err)
-		}
-
-		t.OIDC.Token = tkn
-
-		level.Debug(logger).Log("msg", "fetched token", "tenant", t.Tenant)
-
 		return &oauth2.Transport{
 			Source: ts,
-			Base:   http.DefaultTransport,
+			Base:   BaseTransport(),
 		}, nil
 	}
 
-	return http.DefaultTransport, nil
+	return BaseTransport(), nil
 }
 
 // Client returns an OAuth2 HTTP client based on the current context configuration.
 func (c *Config) Client(ctx context.Context, logger log.Logger) (*http.Client, error) {
-	tenant, _, err := c.GetCurrentContext()
+	if c.Current.API == "" || c.Current.Tenant == "" {
+		return nil, fmt.Errorf("getting current context: current context is empty")
+	}
+
+	return c.ContextClient(ctx, logger, c.Current.API, c.Current.Tenant)
+}
+
+// ContextClient returns an OAuth2 HTTP client based on the configuration of the given context.
+func (c *Config) ContextClient(ctx context.Context, logger log.Logger, api string, tenantName string) (*http.Client, error) {
+	tenant, _, err := c.GetContext(api, tenantName)
 	if err != nil {
-		return nil, fmt.Errorf("getting current context: %w", err)
+		return nil, fmt.Errorf("getting context %s/%s: %w", api, tenantName, err)
 	}
 
 	client, err := tenant.Client(ctx, logger)
@@ -204,7 +183,7 @@ func (c *Config) Client(ctx context.Context, logger log.Logger) (*http.Client, e
 		return nil, err
 	}
 
-	c.APIs[c.Current.API].Contexts[c.Current.Tenant] = tenant
+	c.APIs[api].Contexts[tenantName] = tenant
 	if err := c.Save(logger); err != nil {
 		return nil, fmt.Errorf("updating token in config file: %w", err)
 	}
@@ -236,6 +215,28 @@ func (c *Config) Transport(ctx context.Context, logger log.Logger) (http.RoundTr
 	return transport, nil
 }
 
+// Token returns the token of the current context, fetching a new one if refresh is set.
+func (c *Config) Token(ctx context.Context, logger log.Logger, refresh bool) (*oauth2.Token, error) {
+	tenant, _, err := c.GetCurrentContext()
+	if err != nil {
+		return nil, fmt.Errorf("getting current context: %w", err)
+	}
+
+	tkn, err := tenant.Token(ctx, logger, refresh)
+	if err != nil {
+		return nil, err
+	}
+
+	c.APIs[c.Current.API].Contexts[c.Current.Tenant] = tenant
+	if err := c.Save(logger); err != nil {
+		return nil, fmt.Errorf("updating token in config file: %w", err)
+	}
+
+	level.Debug(logger).Log("msg", "updated token in config file", "tenant", tenant.Tenant)
+
+	return tkn, nil
+}
+
 // Read loads configuration from disk.
 func Read(logger log.Logger) (*Config, error) {
 	if err := ensureConfigDir(); err != nil {
@@ -248,12 +249,49 @@ func Read(logger log.Logger) (*Config, error) {
 	}
 	defer file.Close()
 
-	cfg := Config{pathOverride: getConfigFilePath()}
+	b, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	cfg := Config{pathOverride: getConfigFilePath(), Version: CurrentVersion()}
+	if len(bytes.TrimSpace(b)) == 0 {
+		level.Debug(logger).Log("msg", "config file is empty")
+		return &cfg, nil
+	}
+
+	var raw map[string]interface{}
+	if err := decode(b, &raw); err != nil {
+		return nil, fmt.Errorf("parsing config file: %w", err)
+	}
+	if raw == nil {
+		raw = map[string]interface{}{}
+	}
+
+	migrated, err := migrate(logger, raw, b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing config file: %w", err)
+	}
+	if migrated {
+		if b, err = json.Marshal(raw); err != nil {
+			return nil, fmt.Errorf("encoding migrated config file: %w", err)
+		}
+	}
 
-	if err := json.NewDecoder(file).Decode(&cfg); err != nil && err != io.EOF {
+	if err := decode(b, &cfg); err != nil {
 		return nil, fmt.Errorf("parsing config file: %w", err)
 	}
 
+	if migrated {
+		if err := cfg.Save(logger); err != nil {
+			return nil, fmt.Errorf("saving migrated config file: %w", err)
+		}
+	}
+
+	for _, err := range cfg.Validate() {
+		level.Warn(logger).Log("msg", "invalid config file", "err", err)
+	}
+
 	level.Debug(logger).Log("msg", "read and parsed config file")
 
 	return &cfg, nil
@@ -265,6 +303,8 @@ func (c *Config) Save(logger log.Logger) error {
 		return err
 	}
 
+	c.Version = CurrentVersion()
+
 	file, err := os.OpenFile(getConfigFilePath(), os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0600)
 	if err != nil {
 		return fmt.Errorf("opening config file: %w", err)
@@ -407,13 +447,83 @@ func (c *Config) RemoveTenant(logger log.Logger, name string, api string) error
 	return c.Save(logger)
 }
 
+// ValidationError is a problem with the value of a key of the configuration file, e.g. apis.prod.url.
+type ValidationError struct {
+	Key string
+	Err error
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Key, e.Err)
+}
+
+// Validate returns the problems with the configuration which would make obsctl fail, sorted by key.
+func (c *Config) Validate() []ValidationError {
+	var errs []ValidationError
+	invalid := func(key string, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Key: key, Err: fmt.Errorf(format, args...)})
+	}
+
+	for name, api := range c.APIs {
+		key := "apis." + name
+		if api.URL == "" {
+			invalid(key+".url", "is empty")
+		} else if u, err := url.Parse(api.URL); err != nil {
+			invalid(key+".url", "%v", err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid(key+".url", "%q is not an http or https URL", api.URL)
+		}
+
+		if api.Retry != nil {
+			for field, d := range map[string]string{"minBackoff": api.Retry.MinBackoff, "maxBackoff": api.Retry.MaxBackoff} {
+				if d == "" {
+					continue
+				}
+				if _, err := time.ParseDuration(d); err != nil {
+					invalid(key+".retry."+field, "%v", err)
+				}
+			}
+		}
+
+		for tenantName, tenant := range api.Contexts {
+			key := key + ".contexts." + tenantName
+			if tenant.Tenant == "" {
+				invalid(key+".tenant", "is empty")
+			}
+			if len(tenant.CAFile) > 0 && !x509.NewCertPool().AppendCertsFromPEM(tenant.CAFile) {
+				invalid(key+".ca", "has no PEM encoded certificate")
+			}
+			if tenant.OIDC != nil {
+				if tenant.OIDC.IssuerURL == "" {
+					invalid(key+".oidc.issuerURL", "is empty")
+				}
+				if tenant.OIDC.ClientID == "" {
+					invalid(key+".oidc.clientID", "is empty")
+				}
+			}
+		}
+	}
+
+	if c.Current.API != "" {
+		if api, ok := c.APIs[c.Current.API]; !ok {
+			invalid("current.api", "API %s doesn't exist", c.Current.API)
+		} else if _, ok := api.Contexts[c.Current.Tenant]; !ok {
+			invalid("current.tenant", "tenant %s doesn't exist in API %s", c.Current.Tenant, c.Current.API)
+		}
+	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Key < errs[j].Key })
+
+	return errs
+}
+
 func (c *Config) GetContext(api string, tenant string) (TenantConfig, APIConfig, error) {
 	if _, ok := c.APIs[api]; !ok {
-		return TenantConfig{}, APIConfig{}, fmt.Errorf("api with name %s doesn't exist", c.Current.API)
+		return TenantConfig{}, APIConfig{}, fmt.Errorf("api with name %s doesn't exist", api)
 	}
 
 	if _, ok := c.APIs[api].Contexts[tenant]; !ok {
-		return TenantConfig{}, APIConfig{}, fmt.Errorf("tenant with name %s doesn't exist in api %s", c.Current.Tenant, c.Current.API)
+		return TenantConfig{}, APIConfig{}, fmt.Errorf("tenant with name %s doesn't exist in api %s", tenant, api)
 	}
 
 	return c.APIs[api].Contexts[tenant], c.APIs[api], nil
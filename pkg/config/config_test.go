@@ -990,3 +990,35 @@ func TestRemoveContext(t *testing.T) {
 		testutil.Equals(t, cfg.APIs, exp)
 	})
 }
+
+func TestValidate(t *testing.T) {
+	cfg := Config{
+		APIs: map[string]APIConfig{
+			"prod": {URL: "https://prod.api:9090", Contexts: map[string]TenantConfig{
+				"first": {Tenant: "first", OIDC: &OIDCConfig{IssuerURL: "https://issuer"}},
+			}},
+			"stage": {URL: "stage.api", Retry: &RetryConfig{MinBackoff: "1x"}, Contexts: map[string]TenantConfig{
+				"second": {Tenant: "second", CAFile: []byte("not a CA")},
+			}},
+		},
+	}
+	cfg.Current.API = "prod"
+	cfg.Current.Tenant = "third"
+
+	var keys []string
+	for _, err := range cfg.Validate() {
+		keys = append(keys, err.Key)
+	}
+	testutil.Equals(t, []string{
+		"apis.prod.contexts.first.oidc.clientID",
+		"apis.stage.contexts.second.ca",
+		"apis.stage.retry.minBackoff",
+		"apis.stage.url",
+		"current.tenant",
+	}, keys)
+
+	cfg.Current.Tenant = "first"
+	cfg.APIs["prod"].Contexts["first"].OIDC.ClientID = "obsctl"
+	delete(cfg.APIs, "stage")
+	testutil.Equals(t, 0, len(cfg.Validate()))
+}
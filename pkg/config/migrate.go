@@ -0,0 +1,129 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// migration upgrades a config file from the version before it. Config files are migrated as decoded JSON rather
+// than as a Config, as older versions may not fit the Config struct anymore.
+type migration struct {
+	description string
+	migrate     func(cfg map[string]interface{}) error
+}
+
+// migrations are the migrations of config files, the one at index i upgrading version i to version i+1. Changes to
+// the structure of Config need a migration, so that the files of users keep working.
+var migrations = []migration{
+	{
+		description: "version the config file",
+		// Version 0 is config files written before they were versioned, which have the structure of version 1.
+		migrate: func(map[string]interface{}) error { return nil },
+	},
+}
+
+// CurrentVersion returns the version of config files read and written by obsctl.
+func CurrentVersion() int {
+	return len(migrations)
+}
+
+// configVersion returns the version of a config file decoded as JSON, which is 0 if it has none.
+func configVersion(raw map[string]interface{}) (int, error) {
+	v, ok := raw["version"]
+	if !ok {
+		return 0, nil
+	}
+
+	f, ok := v.(float64)
+	if !ok || f < 0 || f != math.Trunc(f) {
+		return 0, ValidationError{Key: "version", Err: fmt.Errorf("expected a non-negative integer, got %v", v)}
+	}
+	if int(f) > CurrentVersion() {
+		return 0, ValidationError{Key: "version", Err: fmt.Errorf("version %d is newer than version %d supported by this obsctl, upgrade obsctl to use this config file", int(f), CurrentVersion())}
+	}
+
+	return int(f), nil
+}
+
+// migrate upgrades a config file decoded as JSON to the current version. If it was upgraded, the original file is
+// backed up next to it, and migrate returns true.
+func migrate(logger log.Logger, raw map[string]interface{}, original []byte) (bool, error) {
+	from, err := configVersion(raw)
+	if err != nil {
+		return false, err
+	}
+	if from == CurrentVersion() {
+		return false, nil
+	}
+
+	for v := from; v < CurrentVersion(); v++ {
+		m := migrations[v]
+		if err := m.migrate(raw); err != nil {
+			return false, fmt.Errorf("migrating config file from version %d to %d (%s): %w", v, v+1, m.description, err)
+		}
+		raw["version"] = v + 1
+
+		level.Debug(logger).Log("msg", "migrated config file", "from", v, "to", v+1, "migration", m.description)
+	}
+
+	backup := fmt.Sprintf("%s.v%d.bak", getConfigFilePath(), from)
+	if err := os.WriteFile(backup, original, 0600); err != nil {
+		return false, fmt.Errorf("backing up config file before migrating it: %w", err)
+	}
+
+	level.Info(logger).Log("msg", fmt.Sprintf("upgraded config file from version %d to %d, the original is backed up at %s", from, CurrentVersion(), backup))
+
+	return true, nil
+}
+
+// decode decodes a config file, returning the key of values of the wrong type and the position of syntax errors.
+func decode(b []byte, v interface{}) error {
+	err := json.Unmarshal(b, v)
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+		key := typeErr.Field
+		if key == "" {
+			key = "(root)"
+		}
+		return ValidationError{Key: key, Err: fmt.Errorf("expected %s, got %s", jsonType(typeErr.Type), typeErr.Value)}
+	}
+	if syntaxErr, ok := err.(*json.SyntaxError); ok {
+		line, col := 1, 0
+		for _, c := range b[:syntaxErr.Offset] {
+			col++
+			if c == '\n' {
+				line, col = line+1, 0
+			}
+		}
+		return fmt.Errorf("line %d, column %d: %w", line, col, err)
+	}
+
+	return err
+}
+
+// jsonType returns the name of the JSON type values of a Go type are decoded from.
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Slice, reflect.Array:
+		// []byte are decoded from base64 strings.
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "a base64 string"
+		}
+		return "a list"
+	case reflect.Ptr:
+		return jsonType(t.Elem())
+	default:
+		return "a number"
+	}
+}
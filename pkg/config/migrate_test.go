@@ -0,0 +1,91 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/go-kit/log"
+)
+
+func TestMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv("OBSCTL_CONFIG_PATH", path)
+
+	t.Run("unversioned config is upgraded with a backup", func(t *testing.T) {
+		original := `{"apis":{"stage":{"url":"https://stage.api:9090","contexts":{"first":{"tenant":"first"}}}},"current":{"api":"stage","tenant":"first"}}`
+		testutil.Ok(t, os.WriteFile(path, []byte(original), 0600))
+
+		cfg, err := Read(log.NewNopLogger())
+		testutil.Ok(t, err)
+		testutil.Equals(t, CurrentVersion(), cfg.Version)
+		testutil.Equals(t, "first", cfg.APIs["stage"].Contexts["first"].Tenant)
+
+		backup, err := os.ReadFile(path + ".v0.bak")
+		testutil.Ok(t, err)
+		testutil.Equals(t, original, string(backup))
+
+		b, err := os.ReadFile(path)
+		testutil.Ok(t, err)
+		testutil.Assert(t, strings.Contains(string(b), fmt.Sprintf(`"version": %d`, CurrentVersion())), "config wasn't saved with its version: %s", b)
+	})
+
+	t.Run("registered migrations are applied in order", func(t *testing.T) {
+		defer func(m []migration) { migrations = m }(migrations)
+		migrations = append(migrations, migration{
+			description: "rename endpoints to apis",
+			migrate: func(cfg map[string]interface{}) error {
+				cfg["apis"] = cfg["endpoints"]
+				delete(cfg, "endpoints")
+				return nil
+			},
+		})
+
+		testutil.Ok(t, os.WriteFile(path, []byte(`{"version":1,"endpoints":{"stage":{"url":"https://stage.api:9090"}}}`), 0600))
+
+		cfg, err := Read(log.NewNopLogger())
+		testutil.Ok(t, err)
+		testutil.Equals(t, 2, cfg.Version)
+		testutil.Equals(t, "https://stage.api:9090", cfg.APIs["stage"].URL)
+
+		_, err = os.Stat(path + ".v1.bak")
+		testutil.Ok(t, err)
+	})
+
+	t.Run("newer config is rejected", func(t *testing.T) {
+		testutil.Ok(t, os.WriteFile(path, []byte(fmt.Sprintf(`{"version":%d}`, CurrentVersion()+1)), 0600))
+
+		_, err := Read(log.NewNopLogger())
+		var verr ValidationError
+		testutil.Assert(t, errors.As(err, &verr), "unexpected error %v", err)
+		testutil.Equals(t, "version", verr.Key)
+	})
+
+	t.Run("negative version is rejected", func(t *testing.T) {
+		testutil.Ok(t, os.WriteFile(path, []byte(`{"version":-1}`), 0600))
+
+		_, err := Read(log.NewNopLogger())
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "version: expected a non-negative integer, got -1"), "unexpected error %v", err)
+	})
+
+	t.Run("invalid values name their key", func(t *testing.T) {
+		testutil.Ok(t, os.WriteFile(path, []byte(`{"version":1,"apis":{"stage":{"url":9090}}}`), 0600))
+
+		_, err := Read(log.NewNopLogger())
+		testutil.NotOk(t, err)
+		testutil.Equals(t, "parsing config file: apis.stage.url: expected a string, got number", err.Error())
+	})
+
+	t.Run("syntax errors name their position", func(t *testing.T) {
+		testutil.Ok(t, os.WriteFile(path, []byte("{\n  \"version\": 1,\n  \"apis\": {,\n}"), 0600))
+
+		_, err := Read(log.NewNopLogger())
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "line 3, column 12"), "unexpected error %v", err)
+	})
+}
@@ -0,0 +1,281 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/observatorium/obsctl/pkg/telemetry"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const discoveryCacheFileName = "oidc-discovery.json"
+
+// DiscoveryCacheTTL is how long the discovered metadata of OIDC issuers is cached on disk before being discovered
+// again, or 0 to always discover it.
+var DiscoveryCacheTTL = 24 * time.Hour
+
+// discovery is the cached metadata of an OIDC issuer.
+type discovery struct {
+	TokenURL     string    `json:"tokenURL"`
+	DiscoveredAt time.Time `json:"discoveredAt"`
+	// Metadata is the whole discovery document of the issuer.
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+// discoveryCache is the structure of the OIDC discovery cache file, which is next to the configuration file.
+type discoveryCache struct {
+	Issuers map[string]discovery `json:"issuers"`
+}
+
+// readDiscoveryCache loads the OIDC discovery cache from disk. A missing or unreadable cache is empty, as it is
+// only an optimization.
+func readDiscoveryCache(logger log.Logger) *discoveryCache {
+	c := &discoveryCache{Issuers: map[string]discovery{}}
+
+	b, err := os.ReadFile(FilePath(discoveryCacheFileName))
+	if err != nil {
+		return c
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		level.Debug(logger).Log("msg", "ignoring invalid OIDC discovery cache", "err", err)
+		return &discoveryCache{Issuers: map[string]discovery{}}
+	}
+	if c.Issuers == nil {
+		c.Issuers = map[string]discovery{}
+	}
+
+	return c
+}
+
+// save writes the OIDC discovery cache to disk.
+func (c *discoveryCache) save() error {
+	if err := ensureConfigDir(); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding OIDC discovery cache: %w", err)
+	}
+	if err := os.WriteFile(FilePath(discoveryCacheFileName), b, 0600); err != nil {
+		return fmt.Errorf("writing OIDC discovery cache: %w", err)
+	}
+
+	return nil
+}
+
+// IssuerContext returns a context whose requests to OIDC issuers are sent with the base transport, so that
+// discovery and token requests are recorded, replayed, debugged and traced like requests to APIs.
+func IssuerContext(ctx context.Context) context.Context {
+	return oidc.ClientContext(ctx, &http.Client{Transport: BaseTransport()})
+}
+
+// discoveryMtx guards the OIDC discovery cache file.
+var discoveryMtx sync.Mutex
+
+// discover returns the discovered metadata of an OIDC issuer, from the cache if it was discovered within the TTL
+// and from the issuer otherwise. It returns whether the metadata was cached.
+func discover(ctx context.Context, logger log.Logger, issuerURL string) (discovery, bool, error) {
+	discoveryMtx.Lock()
+	defer discoveryMtx.Unlock()
+
+	cache := readDiscoveryCache(logger)
+	if d, ok := cache.Issuers[issuerURL]; ok && time.Since(d.DiscoveredAt) < DiscoveryCacheTTL {
+		level.Debug(logger).Log("msg", "using cached OIDC discovery", "issuer", issuerURL, "discoveredAt", d.DiscoveredAt)
+		return d, true, nil
+	}
+
+	spanCtx, span := telemetry.Start(ctx, "oidc discovery")
+	provider, err := oidc.NewProvider(IssuerContext(spanCtx), issuerURL)
+	telemetry.End(span, err)
+	if err != nil {
+		return discovery{}, false, fmt.Errorf("constructing oidc provider: %w", err)
+	}
+
+	d := discovery{TokenURL: provider.Endpoint().TokenURL, DiscoveredAt: time.Now()}
+	if err := provider.Claims(&d.Metadata); err != nil {
+		return discovery{}, false, fmt.Errorf("reading oidc discovery document: %w", err)
+	}
+
+	if DiscoveryCacheTTL > 0 {
+		cache.Issuers[issuerURL] = d
+		if err := cache.save(); err != nil {
+			level.Warn(logger).Log("msg", "failed to cache OIDC discovery", "err", err)
+		}
+	}
+
+	return d, false, nil
+}
+
+// forgetDiscovery removes an OIDC issuer from the discovery cache, e.g. if its cached token URL stopped working.
+func forgetDiscovery(logger log.Logger, issuerURL string) {
+	discoveryMtx.Lock()
+	defer discoveryMtx.Unlock()
+
+	cache := readDiscoveryCache(logger)
+	if _, ok := cache.Issuers[issuerURL]; !ok {
+		return
+	}
+	delete(cache.Issuers, issuerURL)
+	if err := cache.save(); err != nil {
+		level.Warn(logger).Log("msg", "failed to update OIDC discovery cache", "err", err)
+	}
+}
+
+var (
+	tokenSourcesMtx sync.Mutex
+	// tokenSources are the token sources of tenants, shared by all clients and transports of the process so that
+	// they don't each fetch tokens.
+	tokenSources = map[string]oauth2.TokenSource{}
+)
+
+// tokenSourceKey returns the key of the token source of a tenant, which is different for every set of OIDC
+// credentials.
+func (t *TenantConfig) tokenSourceKey() string {
+	return strings.Join([]string{t.Tenant, t.OIDC.IssuerURL, t.OIDC.ClientID, t.OIDC.Audience, strconv.FormatBool(t.OIDC.OfflineAccess)}, "\x00")
+}
+
+// clientCredentials returns the client credentials flow of a tenant configured with OIDC, fetching tokens from the
+// given token URL of its issuer.
+func (t *TenantConfig) clientCredentials(tokenURL string) *clientcredentials.Config {
+	scopes := []string{"openid"}
+
+	if t.OIDC.OfflineAccess {
+		scopes = append(scopes, "offline_access")
+	}
+
+	ccc := &clientcredentials.Config{
+		ClientID:     t.OIDC.ClientID,
+		ClientSecret: t.OIDC.ClientSecret,
+		TokenURL:     tokenURL,
+		Scopes:       scopes,
+	}
+
+	if t.OIDC.Audience != "" {
+		ccc.EndpointParams = url.Values{
+			"audience": []string{t.OIDC.Audience},
+		}
+	}
+
+	return ccc
+}
+
+// tokenSource returns the token source of a tenant configured with OIDC, which reuses the token of the tenant
+// until it expires.
+func (t *TenantConfig) tokenSource(ctx context.Context, logger log.Logger) (oauth2.TokenSource, bool, error) {
+	key := t.tokenSourceKey()
+
+	tokenSourcesMtx.Lock()
+	defer tokenSourcesMtx.Unlock()
+
+	if ts, ok := tokenSources[key]; ok {
+		return ts, false, nil
+	}
+
+	d, cached, err := discover(ctx, logger, t.OIDC.IssuerURL)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ts := t.clientCredentials(d.TokenURL).TokenSource(IssuerContext(ctx))
+
+	// If token has not expired, we can reuse.
+	if t.OIDC.Token != nil {
+		currentTime := time.Now()
+		if t.OIDC.Token.Expiry.After(currentTime) {
+			ts = oauth2.ReuseTokenSource(t.OIDC.Token, ts)
+		}
+	}
+
+	// Tokens are reused by all clients until they expire.
+	ts = oauth2.ReuseTokenSource(nil, ts)
+	tokenSources[key] = ts
+
+	return ts, cached, nil
+}
+
+// forgetTokenSource removes the shared token source of a tenant, so that the next one fetches a new token.
+func (t *TenantConfig) forgetTokenSource() {
+	tokenSourcesMtx.Lock()
+	defer tokenSourcesMtx.Unlock()
+
+	delete(tokenSources, t.tokenSourceKey())
+}
+
+// authenticate returns the token source of a tenant configured with OIDC once it has a valid token, which is
+// kept in the tenant config. If the token can't be fetched with a cached token URL, the issuer is discovered again.
+func (t *TenantConfig) authenticate(ctx context.Context, logger log.Logger) (oauth2.TokenSource, error) {
+	for {
+		ts, cached, err := t.tokenSource(ctx, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		_, span := telemetry.Start(ctx, "fetch token")
+		tkn, err := ts.Token()
+		telemetry.End(span, err)
+		if err != nil {
+			t.forgetTokenSource()
+			if cached {
+				level.Debug(logger).Log("msg", "fetching token with cached OIDC discovery failed, discovering again", "err", err)
+				forgetDiscovery(logger, t.OIDC.IssuerURL)
+				continue
+			}
+			return nil, fmt.Errorf("fetching token: %w", err)
+		}
+
+		t.OIDC.Token = tkn
+
+		level.Debug(logger).Log("msg", "fetched token", "tenant", t.Tenant)
+
+		return ts, nil
+	}
+}
+
+// Token returns the token of a tenant configured with OIDC, which is the saved one until it expires unless refresh
+// is set. Fresh tokens also hold the ID token of the tenant, if the issuer returned one.
+func (t *TenantConfig) Token(ctx context.Context, logger log.Logger, refresh bool) (*oauth2.Token, error) {
+	if t.OIDC == nil {
+		return nil, fmt.Errorf("tenant %s is not configured with OIDC", t.Tenant)
+	}
+
+	if refresh {
+		t.OIDC.Token = nil
+		t.forgetTokenSource()
+	}
+
+	if _, err := t.authenticate(ctx, logger); err != nil {
+		return nil, err
+	}
+
+	return t.OIDC.Token, nil
+}
+
+// FetchToken fetches a new token of a tenant configured with OIDC from the given token URL of its issuer, e.g. to
+// check its credentials. The token is neither kept in the tenant config nor shared with its clients.
+func (t *TenantConfig) FetchToken(ctx context.Context, tokenURL string) (*oauth2.Token, error) {
+	if t.OIDC == nil {
+		return nil, fmt.Errorf("tenant %s is not configured with OIDC", t.Tenant)
+	}
+
+	spanCtx, span := telemetry.Start(ctx, "fetch token")
+	tkn, err := t.clientCredentials(tokenURL).Token(IssuerContext(spanCtx))
+	telemetry.End(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("fetching token: %w", err)
+	}
+
+	return tkn, nil
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/go-kit/log"
+	"github.com/observatorium/obsctl/pkg/fakeapi"
+	"golang.org/x/oauth2"
+)
+
+func TestOIDC(t *testing.T) {
+	tmpDir := t.TempDir()
+	testutil.Ok(t, os.Setenv("OBSCTL_CONFIG_PATH", filepath.Join(tmpDir, "config.json")))
+	t.Cleanup(func() { testutil.Ok(t, os.Unsetenv("OBSCTL_CONFIG_PATH")) })
+
+	issuer, err := fakeapi.NewIssuer()
+	testutil.Ok(t, err)
+	issuer.AddClient("obsctl", "secret")
+
+	var discoveries int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/.well-known/openid-configuration") {
+			atomic.AddInt32(&discoveries, 1)
+		}
+		issuer.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	// newProcess forgets the token sources of the process, as if obsctl was run again.
+	newProcess := func() {
+		tokenSourcesMtx.Lock()
+		tokenSources = map[string]oauth2.TokenSource{}
+		tokenSourcesMtx.Unlock()
+	}
+
+	ctx := context.Background()
+	tenant := func() *TenantConfig {
+		return &TenantConfig{Tenant: "test", OIDC: &OIDCConfig{IssuerURL: srv.URL, ClientID: "obsctl", ClientSecret: "secret"}}
+	}
+
+	t.Run("clients and transports share a token", func(t *testing.T) {
+		newProcess()
+
+		a := tenant()
+		_, err := a.Client(ctx, log.NewNopLogger())
+		testutil.Ok(t, err)
+
+		b := tenant()
+		_, err = b.Transport(ctx, log.NewNopLogger())
+		testutil.Ok(t, err)
+
+		testutil.Equals(t, int32(1), atomic.LoadInt32(&discoveries))
+		testutil.Equals(t, 1, issuer.Issued())
+		testutil.Equals(t, a.OIDC.Token.AccessToken, b.OIDC.Token.AccessToken)
+
+		raw, err := os.ReadFile(filepath.Join(tmpDir, discoveryCacheFileName))
+		testutil.Ok(t, err)
+		var cache discoveryCache
+		testutil.Ok(t, json.Unmarshal(raw, &cache))
+		testutil.Equals(t, srv.URL+"/oauth2/token", cache.Issuers[srv.URL].TokenURL)
+	})
+
+	t.Run("discovery is cached on disk", func(t *testing.T) {
+		newProcess()
+
+		tc := tenant()
+		_, err := tc.Client(ctx, log.NewNopLogger())
+		testutil.Ok(t, err)
+
+		testutil.Equals(t, int32(1), atomic.LoadInt32(&discoveries))
+		testutil.Equals(t, 2, issuer.Issued())
+	})
+
+	t.Run("saved tokens are reused until they expire", func(t *testing.T) {
+		newProcess()
+
+		tc := tenant()
+		tc.OIDC.Token = &oauth2.Token{AccessToken: "saved", TokenType: "Bearer", Expiry: time.Now().Add(time.Hour)}
+		_, err := tc.Transport(ctx, log.NewNopLogger())
+		testutil.Ok(t, err)
+
+		testutil.Equals(t, "saved", tc.OIDC.Token.AccessToken)
+		testutil.Equals(t, 2, issuer.Issued())
+	})
+
+	t.Run("discovery is done again after the TTL", func(t *testing.T) {
+		newProcess()
+
+		ttl := DiscoveryCacheTTL
+		DiscoveryCacheTTL = 0
+		t.Cleanup(func() { DiscoveryCacheTTL = ttl })
+
+		_, err := tenant().Client(ctx, log.NewNopLogger())
+		testutil.Ok(t, err)
+
+		testutil.Equals(t, int32(2), atomic.LoadInt32(&discoveries))
+	})
+
+	t.Run("stale discovery is done again", func(t *testing.T) {
+		newProcess()
+
+		cache := discoveryCache{Issuers: map[string]discovery{
+			srv.URL: {TokenURL: srv.URL + "/moved", DiscoveredAt: time.Now()},
+		}}
+		testutil.Ok(t, cache.save())
+
+		_, err := tenant().Client(ctx, log.NewNopLogger())
+		testutil.Ok(t, err)
+
+		testutil.Equals(t, int32(3), atomic.LoadInt32(&discoveries))
+		testutil.Equals(t, srv.URL+"/oauth2/token", readDiscoveryCache(log.NewNopLogger()).Issuers[srv.URL].TokenURL)
+	})
+}
@@ -0,0 +1,160 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const queriesFileName = "queries.json"
+
+// Types of saved queries.
+const (
+	QueryTypeMetrics = "metrics"
+	QueryTypeLogs    = "logs"
+)
+
+// SavedQuery is a PromQL or LogQL query saved under a name. The query is a Go template, which is
+// executed with the variables passed when running it.
+type SavedQuery struct {
+	Type  string `json:"type"`
+	Query string `json:"query"`
+	// Range and Step are set for range queries.
+	Range string `json:"range,omitempty"`
+	Step  string `json:"step,omitempty"`
+	// API and Tenant optionally restrict the contexts in which the query can be used.
+	API    string `json:"api,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// InScope returns true if the query can be used in the given context.
+func (q SavedQuery) InScope(api string, tenant string) bool {
+	return (q.API == "" || q.API == api) && (q.Tenant == "" || q.Tenant == tenant)
+}
+
+// Scope returns the contexts in which the query can be used, in the <api>/<tenant> format with * for any.
+func (q SavedQuery) Scope() string {
+	if q.API == "" && q.Tenant == "" {
+		return ""
+	}
+
+	api, tenant := q.API, q.Tenant
+	if api == "" {
+		api = "*"
+	}
+	if tenant == "" {
+		tenant = "*"
+	}
+
+	return api + "/" + tenant
+}
+
+// Render executes the query template with the given variables. All variables used by the query must be set.
+func (q SavedQuery) Render(vars map[string]string) (string, error) {
+	tmpl, err := template.New("query").Option("missingkey=error").Parse(q.Query)
+	if err != nil {
+		return "", fmt.Errorf("parsing query template: %w", err)
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("executing query template: %w", err)
+	}
+
+	return b.String(), nil
+}
+
+// Queries represents the structure of the saved queries file, which is next to the configuration file.
+type Queries struct {
+	Queries map[string]SavedQuery `json:"queries"`
+}
+
+// ReadQueries loads saved queries from disk.
+func ReadQueries(logger log.Logger) (*Queries, error) {
+	if err := ensureConfigDir(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(FilePath(queriesFileName), os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening queries file: %w", err)
+	}
+	defer file.Close()
+
+	q := Queries{}
+	if err := json.NewDecoder(file).Decode(&q); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("parsing queries file: %w", err)
+	}
+
+	level.Debug(logger).Log("msg", "read and parsed queries file")
+
+	return &q, nil
+}
+
+// Save writes saved queries to the disk.
+func (q *Queries) Save(logger log.Logger) error {
+	if err := ensureConfigDir(); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(FilePath(queriesFileName), os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("opening queries file: %w", err)
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(q); err != nil {
+		return fmt.Errorf("writing queries: %w", err)
+	}
+
+	level.Debug(logger).Log("msg", "saved queries in queries file")
+
+	return nil
+}
+
+// AddQuery saves a query under a name, replacing any query with the same name, and saves the queries to disk.
+func (q *Queries) AddQuery(logger log.Logger, name string, query SavedQuery) error {
+	if name == "" {
+		return fmt.Errorf("query name is empty")
+	}
+
+	if query.Type != QueryTypeMetrics && query.Type != QueryTypeLogs {
+		return fmt.Errorf("invalid query type %q: must be %s or %s", query.Type, QueryTypeMetrics, QueryTypeLogs)
+	}
+
+	if _, err := template.New("query").Parse(query.Query); err != nil {
+		return fmt.Errorf("parsing query template: %w", err)
+	}
+
+	if q.Queries == nil {
+		q.Queries = make(map[string]SavedQuery)
+		level.Debug(logger).Log("msg", "initialize saved queries map")
+	}
+
+	if _, ok := q.Queries[name]; ok {
+		level.Debug(logger).Log("msg", "replacing saved query", "name", name)
+	}
+
+	q.Queries[name] = query
+
+	return q.Save(logger)
+}
+
+// RemoveQuery removes a saved query and saves the queries to disk.
+func (q *Queries) RemoveQuery(logger log.Logger, name string) error {
+	if _, ok := q.Queries[name]; !ok {
+		return fmt.Errorf("query with name %s doesn't exist", name)
+	}
+
+	delete(q.Queries, name)
+
+	return q.Save(logger)
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+func TestSavedQueries(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Cleanup(func() { testutil.Ok(t, os.RemoveAll(tmpDir)) })
+	testutil.Ok(t, os.MkdirAll(filepath.Join(tmpDir, "obsctl", "test"), os.ModePerm))
+	testutil.Ok(t, os.Setenv("OBSCTL_CONFIG_PATH", filepath.Join(tmpDir, "obsctl", "test", "config.json")))
+
+	tlogger := level.NewFilter(log.NewJSONLogger(log.NewSyncWriter(os.Stderr)), level.AllowDebug())
+
+	t.Run("save and read", func(t *testing.T) {
+		q, err := ReadQueries(tlogger)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 0, len(q.Queries))
+
+		cpu := SavedQuery{Type: QueryTypeMetrics, Query: `rate(cpu{ns="{{.ns}}"}[5m])`, Range: "1h", Step: "1m"}
+		testutil.Ok(t, q.AddQuery(tlogger, "cpu", cpu))
+		testutil.NotOk(t, q.AddQuery(tlogger, "invalid", SavedQuery{Type: "traces", Query: "up"}))
+		testutil.NotOk(t, q.AddQuery(tlogger, "invalid", SavedQuery{Type: QueryTypeMetrics, Query: "up{job={{.job}"}))
+
+		_, err = os.Stat(filepath.Join(tmpDir, "obsctl", "test", "queries.json"))
+		testutil.Ok(t, err)
+
+		q, err = ReadQueries(tlogger)
+		testutil.Ok(t, err)
+		testutil.Equals(t, map[string]SavedQuery{"cpu": cpu}, q.Queries)
+
+		testutil.Ok(t, q.RemoveQuery(tlogger, "cpu"))
+		testutil.NotOk(t, q.RemoveQuery(tlogger, "cpu"))
+	})
+
+	t.Run("render", func(t *testing.T) {
+		q := SavedQuery{Type: QueryTypeMetrics, Query: `up{ns="{{.ns}}"}`}
+
+		res, err := q.Render(map[string]string{"ns": "monitoring"})
+		testutil.Ok(t, err)
+		testutil.Equals(t, `up{ns="monitoring"}`, res)
+
+		_, err = q.Render(nil)
+		testutil.NotOk(t, err)
+	})
+
+	t.Run("scope", func(t *testing.T) {
+		q := SavedQuery{Type: QueryTypeMetrics, Query: "up", API: "prod"}
+		testutil.Equals(t, "prod/*", q.Scope())
+		testutil.Assert(t, q.InScope("prod", "a"), "expected query to be in scope")
+		testutil.Assert(t, !q.InScope("stage", "a"), "expected query to be out of scope")
+
+		q = SavedQuery{Type: QueryTypeMetrics, Query: "up"}
+		testutil.Equals(t, "", q.Scope())
+		testutil.Assert(t, q.InScope("stage", "a"), "expected query to be in scope")
+	})
+}
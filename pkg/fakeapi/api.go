@@ -0,0 +1,174 @@
+// Package fakeapi provides an in-memory fake of the Observatorium API and of an OIDC issuer, so that clients of
+// the API can be tested with httptest instead of a deployment.
+//
+// The fake serves the tenant-prefixed metrics, logs and traces read APIs and the metrics and logs rules APIs from
+// data added to its tenants. It doesn't evaluate PromQL or LogQL: instant and range queries of metrics are answered
+// for plain selectors, or with results set for a query beforehand, and queries of logs for stream selectors
+// followed by line filters.
+package fakeapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// API is a fake Observatorium API, to be served with httptest.NewServer.
+type API struct {
+	// Issuer, if set, is the issuer of the tokens requests must be authenticated with. Requests without a valid
+	// token are rejected.
+	Issuer *Issuer
+
+	mtx     sync.Mutex
+	tenants map[string]*Tenant
+}
+
+// New returns a fake API without tenants.
+func New() *API {
+	return &API{tenants: map[string]*Tenant{}}
+}
+
+// Tenant returns the data of a tenant, adding the tenant if it doesn't exist yet. Requests for tenants which were
+// never added are rejected, as the API does for unknown tenants.
+func (a *API) Tenant(name string) *Tenant {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	t, ok := a.tenants[name]
+	if !ok {
+		t = &Tenant{queries: map[string]model.Value{}, logRules: map[string][]ruleGroup{}}
+		a.tenants[name] = t
+	}
+
+	return t
+}
+
+// ServeHTTP routes requests of the form /api/{metrics,logs,traces}/v1/{tenant}/... to the data of the tenant.
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 5)
+	if len(parts) < 5 || parts[0] != "api" || parts[2] != "v1" {
+		http.NotFound(w, r)
+		return
+	}
+	signal, tenant, path := parts[1], parts[3], parts[4]
+
+	if a.Issuer != nil {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, err := a.Issuer.Verify(token); err != nil {
+			http.Error(w, fmt.Sprintf("invalid token: %s", err), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	a.mtx.Lock()
+	t, ok := a.tenants[tenant]
+	a.mtx.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown tenant %q", tenant), http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch signal {
+	case "metrics":
+		t.serveMetrics(w, r, path)
+	case "logs":
+		t.serveLogs(w, r, path)
+	case "traces":
+		t.serveTraces(w, r, path)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Tenant is the data of a tenant of the fake API. Its methods can be called while the API is serving requests.
+type Tenant struct {
+	mtx sync.RWMutex
+
+	series   []*model.SampleStream
+	queries  map[string]model.Value
+	rules    []byte
+	streams  []*Stream
+	logRules map[string][]ruleGroup
+	spans    []Span
+}
+
+// writeJSON writes a JSON response.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeData writes a successful response of the Prometheus and Loki APIs.
+func writeData(w http.ResponseWriter, data interface{}) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "success", "data": data})
+}
+
+// writeError writes an error response of the Prometheus and Loki APIs.
+func writeError(w http.ResponseWriter, code int, err error) {
+	errorType := "bad_data"
+	if code/100 == 5 {
+		errorType = "internal"
+	}
+	writeJSON(w, code, map[string]interface{}{"status": "error", "errorType": errorType, "error": err.Error()})
+}
+
+// writeYAML writes a YAML response.
+func writeYAML(w http.ResponseWriter, b []byte) {
+	w.Header().Set("Content-Type", "application/yaml")
+	_, _ = w.Write(b)
+}
+
+// parseTime parses a timestamp parameter given as Unix seconds or in RFC 3339, or returns def if it is empty.
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec := int64(f)
+		return time.Unix(sec, int64((f-float64(sec))*1e9)).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return t, nil
+}
+
+// parseDuration parses a duration parameter given in seconds or as a Prometheus duration, or returns def if it is
+// empty.
+func parseDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	d, err := model.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return time.Duration(d), nil
+}
+
+// sortedKeys returns the keys of a set in order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
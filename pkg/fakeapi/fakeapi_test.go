@@ -0,0 +1,131 @@
+package fakeapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/prometheus/common/model"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+func TestAPI(t *testing.T) {
+	issuer, err := NewIssuer()
+	testutil.Ok(t, err)
+	issuer.AddClient("obsctl", "secret")
+	issuerSrv := httptest.NewServer(issuer)
+	defer issuerSrv.Close()
+
+	api := New()
+	api.Issuer = issuer
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	now := time.Date(2022, 10, 1, 10, 0, 0, 0, time.UTC)
+	tenant := api.Tenant("test")
+	tenant.AddSeries(model.Metric{"__name__": "up", "job": "a"}, model.SamplePair{Timestamp: model.TimeFromUnix(now.Add(-time.Minute).Unix()), Value: 1})
+	tenant.AddSeries(model.Metric{"__name__": "up", "job": "b"}, model.SamplePair{Timestamp: model.TimeFromUnix(now.Add(-time.Hour).Unix()), Value: 0})
+	tenant.SetQueryResult("sum(up)", model.Vector{{Metric: model.Metric{}, Value: 1, Timestamp: model.TimeFromUnix(now.Unix())}})
+	tenant.AddLogs(model.LabelSet{"job": "a"}, Entry{Time: now.Add(-2 * time.Minute), Line: "level=info msg=started"}, Entry{Time: now.Add(-time.Minute), Line: "level=error msg=failed"})
+	tenant.AddSpans(Span{TraceID: "abc", SpanID: "1", Service: "api", Operation: "GET /", Start: now, Duration: time.Second})
+
+	ccc := clientcredentials.Config{ClientID: "obsctl", ClientSecret: "secret", TokenURL: issuerSrv.URL + "/oauth2/token"}
+	c := ccc.Client(context.Background())
+
+	get := func(path string, code int, v interface{}) {
+		t.Helper()
+		resp, err := c.Get(srv.URL + path)
+		testutil.Ok(t, err)
+		defer resp.Body.Close()
+
+		testutil.Equals(t, code, resp.StatusCode)
+		if v != nil {
+			testutil.Ok(t, json.NewDecoder(resp.Body).Decode(v))
+		}
+	}
+
+	var query struct {
+		Data struct {
+			ResultType string       `json:"resultType"`
+			Result     model.Vector `json:"result"`
+		} `json:"data"`
+	}
+	// Only series with a sample within the lookback delta are returned.
+	get("/api/metrics/v1/test/api/v1/query?query=up&time=2022-10-01T10:00:00Z", http.StatusOK, &query)
+	testutil.Equals(t, "vector", query.Data.ResultType)
+	testutil.Equals(t, 1, len(query.Data.Result))
+	testutil.Equals(t, model.LabelValue("a"), query.Data.Result[0].Metric["job"])
+
+	get("/api/metrics/v1/test/api/v1/query?query=sum(up)", http.StatusOK, &query)
+	testutil.Equals(t, model.SampleValue(1), query.Data.Result[0].Value)
+	get("/api/metrics/v1/test/api/v1/query?query=rate(up[5m])", http.StatusBadRequest, nil)
+
+	var labels struct {
+		Data []string `json:"data"`
+	}
+	get(`/api/metrics/v1/test/api/v1/label/job/values?match[]=up{job=~"a|b"}`, http.StatusOK, &labels)
+	testutil.Equals(t, []string{"a", "b"}, labels.Data)
+
+	var logs struct {
+		Data struct {
+			Result []struct {
+				Values [][2]string `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	get(`/api/logs/v1/test/loki/api/v1/query_range?query={job="a"}|="error"&end=2022-10-01T10:00:00Z`, http.StatusOK, &logs)
+	testutil.Equals(t, 1, len(logs.Data.Result))
+	testutil.Equals(t, "level=error msg=failed", logs.Data.Result[0].Values[0][1])
+
+	var trace struct {
+		Data []struct {
+			Spans []struct {
+				OperationName string `json:"operationName"`
+			} `json:"spans"`
+		} `json:"data"`
+	}
+	get("/api/traces/v1/test/api/traces/abc", http.StatusOK, &trace)
+	testutil.Equals(t, "GET /", trace.Data[0].Spans[0].OperationName)
+	get("/api/traces/v1/test/api/traces/def", http.StatusNotFound, nil)
+
+	get("/api/metrics/v1/other/api/v1/labels", http.StatusForbidden, nil)
+
+	// Rules are validated when they are set.
+	for rules, code := range map[string]int{
+		"groups:\n- name: test\n  rules:\n  - record: job:up:sum\n    expr: sum by (job) (up)\n": http.StatusOK,
+		"groups:\n- name: test\n  rules:\n  - record: job:up:sum\n    expr: sum by (job) (up\n":  http.StatusBadRequest,
+	} {
+		req, err := http.NewRequest(http.MethodPut, srv.URL+"/api/metrics/v1/test/api/v1/rules/raw", strings.NewReader(rules))
+		testutil.Ok(t, err)
+		resp, err := c.Do(req)
+		testutil.Ok(t, err)
+		resp.Body.Close()
+		testutil.Equals(t, code, resp.StatusCode)
+	}
+	var rules struct {
+		Data struct {
+			Groups []struct {
+				Rules []struct {
+					Name string `json:"name"`
+					Type string `json:"type"`
+				} `json:"rules"`
+			} `json:"groups"`
+		} `json:"data"`
+	}
+	get("/api/metrics/v1/test/api/v1/rules", http.StatusOK, &rules)
+	testutil.Equals(t, "job:up:sum", rules.Data.Groups[0].Rules[0].Name)
+	testutil.Equals(t, "recording", rules.Data.Groups[0].Rules[0].Type)
+
+	// The token is reused for every request.
+	testutil.Equals(t, 1, issuer.Issued())
+
+	resp, err := http.Get(srv.URL + "/api/metrics/v1/test/api/v1/labels")
+	testutil.Ok(t, err)
+	resp.Body.Close()
+	testutil.Equals(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,385 @@
+package fakeapi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/observatorium/obsctl/pkg/promql"
+	"github.com/prometheus/common/model"
+)
+
+// defaultLogsLimit is the maximum number of log lines returned by queries without a limit, as in Loki.
+const defaultLogsLimit = 100
+
+// Stream is a stream of log lines with the same labels.
+type Stream struct {
+	Labels  model.LabelSet
+	Entries []Entry
+}
+
+// Entry is a log line.
+type Entry struct {
+	Time time.Time
+	Line string
+}
+
+// AddLogs adds log lines to the stream with the given labels.
+func (t *Tenant) AddLogs(labels model.LabelSet, entries ...Entry) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for _, s := range t.streams {
+		if s.Labels.Equal(labels) {
+			s.Entries = append(s.Entries, entries...)
+			return
+		}
+	}
+	t.streams = append(t.streams, &Stream{Labels: labels, Entries: entries})
+}
+
+func (t *Tenant) serveLogs(w http.ResponseWriter, r *http.Request, path string) {
+	switch {
+	case path == "loki/api/v1/query":
+		writeError(w, http.StatusBadRequest, errors.New("log queries are not supported as an instant query type, please change your query to a range query type"))
+	case path == "loki/api/v1/query_range":
+		t.serveLogsQueryRange(w, r)
+	case path == "loki/api/v1/labels":
+		t.serveLogLabels(w, "")
+	case strings.HasPrefix(path, "loki/api/v1/label/") && strings.HasSuffix(path, "/values"):
+		t.serveLogLabels(w, strings.TrimSuffix(strings.TrimPrefix(path, "loki/api/v1/label/"), "/values"))
+	case path == "loki/api/v1/rules":
+		t.serveAllLogRules(w)
+	case strings.HasPrefix(path, "loki/api/v1/rules/"):
+		t.serveLogRules(w, r, strings.Split(strings.TrimPrefix(path, "loki/api/v1/rules/"), "/"))
+	case path == "prometheus/api/v1/rules":
+		t.mtx.RLock()
+		defer t.mtx.RUnlock()
+
+		writeData(w, rulesData(t.logRules))
+	case path == "prometheus/api/v1/alerts":
+		writeData(w, map[string]interface{}{"alerts": []interface{}{}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// lineFilter filters log lines containing or matching a string, or not.
+type lineFilter struct {
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func (f lineFilter) matches(line string) bool {
+	switch f.op {
+	case "|=":
+		return strings.Contains(line, f.value)
+	case "!=":
+		return !strings.Contains(line, f.value)
+	case "|~":
+		return f.re.MatchString(line)
+	default:
+		return !f.re.MatchString(line)
+	}
+}
+
+// parseLogQuery parses a LogQL query made of a stream selector followed by line filters, which is all the fake
+// evaluates.
+func parseLogQuery(q string) (*promql.VectorSelector, []lineFilter, error) {
+	q = strings.TrimSpace(q)
+	end := selectorEnd(q)
+	if !strings.HasPrefix(q, "{") || end < 0 {
+		return nil, nil, fmt.Errorf("only stream selectors followed by line filters can be evaluated: %q", q)
+	}
+
+	expr, err := promql.Parse(q[:end+1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing stream selector: %w", err)
+	}
+	vs := expr.(*promql.VectorSelector)
+
+	var filters []lineFilter
+	for rest := strings.TrimSpace(q[end+1:]); rest != ""; rest = strings.TrimSpace(rest) {
+		if len(rest) < 2 {
+			return nil, nil, fmt.Errorf("unexpected %q in query", rest)
+		}
+		f := lineFilter{op: rest[:2]}
+		switch f.op {
+		case "|=", "!=", "|~", "!~":
+		default:
+			return nil, nil, fmt.Errorf("only line filters can follow stream selectors, got %q", rest)
+		}
+
+		rest = strings.TrimSpace(rest[2:])
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line filter without a string: %q", rest)
+		}
+		rest = rest[len(quoted):]
+		if f.value, err = strconv.Unquote(quoted); err != nil {
+			return nil, nil, err
+		}
+		if f.op == "|~" || f.op == "!~" {
+			if f.re, err = regexp.Compile(f.value); err != nil {
+				return nil, nil, fmt.Errorf("invalid regular expression %q: %w", f.value, err)
+			}
+		}
+		filters = append(filters, f)
+	}
+
+	return vs, filters, nil
+}
+
+// selectorEnd returns the index of the brace closing the stream selector at the start of a query, skipping braces
+// within quoted label values, or -1 if it isn't closed.
+func selectorEnd(q string) int {
+	var quote byte
+	for i := 0; i < len(q); i++ {
+		c := q[i]
+		switch {
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case c == '}':
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *Tenant) serveLogsQueryRange(w http.ResponseWriter, r *http.Request) {
+	end, err := parseTime(r.Form.Get("end"), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	start, err := parseTime(r.Form.Get("start"), end.Add(-time.Hour))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit := defaultLogsLimit
+	if l := r.Form.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", l))
+			return
+		}
+	}
+	forward := r.Form.Get("direction") == "forward"
+
+	vs, filters, err := parseLogQuery(r.Form.Get("query"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	type match struct {
+		stream *Stream
+		entry  Entry
+	}
+	var matches []match
+	for _, s := range t.streams {
+		ok, err := matchSelector(vs, s.Labels)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !ok {
+			continue
+		}
+
+	entries:
+		for _, e := range s.Entries {
+			if e.Time.Before(start) || !e.Time.Before(end) {
+				continue
+			}
+			for _, f := range filters {
+				if !f.matches(e.Line) {
+					continue entries
+				}
+			}
+			matches = append(matches, match{stream: s, entry: e})
+		}
+	}
+
+	// The limit applies to the lines of all streams, in the direction of the query.
+	sort.SliceStable(matches, func(i, j int) bool {
+		if forward {
+			return matches[i].entry.Time.Before(matches[j].entry.Time)
+		}
+		return matches[i].entry.Time.After(matches[j].entry.Time)
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	type streamResult struct {
+		Stream model.LabelSet `json:"stream"`
+		Values [][2]string    `json:"values"`
+	}
+	result := []*streamResult{}
+	byStream := map[*Stream]*streamResult{}
+	for _, m := range matches {
+		res, ok := byStream[m.stream]
+		if !ok {
+			res = &streamResult{Stream: m.stream.Labels}
+			byStream[m.stream] = res
+			result = append(result, res)
+		}
+		res.Values = append(res.Values, [2]string{strconv.FormatInt(m.entry.Time.UnixNano(), 10), m.entry.Line})
+	}
+
+	writeData(w, map[string]interface{}{"resultType": "streams", "result": result})
+}
+
+// serveLogLabels serves the label names of streams, or the values of the given label.
+func (t *Tenant) serveLogLabels(w http.ResponseWriter, name string) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	set := map[string]bool{}
+	for _, s := range t.streams {
+		for n, v := range s.Labels {
+			switch {
+			case name == "":
+				set[string(n)] = true
+			case string(n) == name:
+				set[string(v)] = true
+			}
+		}
+	}
+	writeData(w, sortedKeys(set))
+}
+
+// SetLogRules replaces the rule group of a namespace of logs rules with the same name as the given one, which is
+// a Loki rule group in YAML, or adds it.
+func (t *Tenant) SetLogRules(namespace string, b []byte) error {
+	var g ruleGroup
+	if err := yaml.Unmarshal(b, &g); err != nil {
+		return fmt.Errorf("parsing rule group: %w", err)
+	}
+	if err := g.validate(); err != nil {
+		return err
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	groups := t.logRules[namespace]
+	for i := range groups {
+		if groups[i].Name == g.Name {
+			groups[i] = g
+			return nil
+		}
+	}
+	t.logRules[namespace] = append(groups, g)
+	return nil
+}
+
+func (t *Tenant) serveAllLogRules(w http.ResponseWriter) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	if len(t.logRules) == 0 {
+		http.Error(w, "no rule groups found", http.StatusNotFound)
+		return
+	}
+	writeRuleGroups(w, t.logRules)
+}
+
+// serveLogRules serves the rule groups of a namespace of logs rules, given as the first path segment, or the
+// group given as the second one.
+func (t *Tenant) serveLogRules(w http.ResponseWriter, r *http.Request, path []string) {
+	namespace := path[0]
+	if len(path) > 2 || namespace == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(path) == 1 && r.Method == http.MethodPost {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := t.SetLogRules(namespace, b); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	groups, ok := t.logRules[namespace]
+	if !ok {
+		http.Error(w, "no rule groups found", http.StatusNotFound)
+		return
+	}
+
+	if len(path) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			writeRuleGroups(w, map[string][]ruleGroup{namespace: groups})
+		case http.MethodDelete:
+			delete(t.logRules, namespace)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	for i, g := range groups {
+		if g.Name != path[1] {
+			continue
+		}
+		switch r.Method {
+		case http.MethodGet:
+			b, err := yaml.Marshal(g)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeYAML(w, b)
+		case http.MethodDelete:
+			t.logRules[namespace] = append(groups[:i:i], groups[i+1:]...)
+			if len(t.logRules[namespace]) == 0 {
+				delete(t.logRules, namespace)
+			}
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	http.Error(w, "no rule group found", http.StatusNotFound)
+}
+
+// writeRuleGroups writes rule groups by namespace in YAML, as Loki's ruler does.
+func writeRuleGroups(w http.ResponseWriter, groups map[string][]ruleGroup) {
+	b, err := yaml.Marshal(groups)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeYAML(w, b)
+}
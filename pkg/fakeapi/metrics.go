@@ -0,0 +1,457 @@
+package fakeapi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/observatorium/obsctl/pkg/promql"
+	"github.com/prometheus/common/model"
+)
+
+// lookbackDelta is how far before an evaluation time the latest sample of a series is looked up, as in Prometheus.
+const lookbackDelta = 5 * time.Minute
+
+// errUnsupportedQuery is returned for queries which the fake can't evaluate.
+var errUnsupportedQuery = errors.New("only selectors and queries whose result was set with SetQueryResult can be evaluated")
+
+// AddSeries adds a series with its samples, which are expected to be in order.
+func (t *Tenant) AddSeries(metric model.Metric, samples ...model.SamplePair) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.series = append(t.series, &model.SampleStream{Metric: metric, Values: samples})
+}
+
+// SetQueryResult sets the result of both instant and range queries of exactly the given query, which is returned
+// as it is whatever the time of the query.
+func (t *Tenant) SetQueryResult(query string, v model.Value) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.queries[query] = v
+}
+
+// SetRules replaces the metrics rules of the tenant with the given Prometheus rules file.
+func (t *Tenant) SetRules(b []byte) error {
+	if _, err := parseRules(b); err != nil {
+		return err
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.rules = b
+	return nil
+}
+
+// Rules returns the metrics rules file of the tenant.
+func (t *Tenant) Rules() []byte {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	return t.rules
+}
+
+func (t *Tenant) serveMetrics(w http.ResponseWriter, r *http.Request, path string) {
+	switch {
+	case path == "api/v1/query":
+		t.serveQuery(w, r)
+	case path == "api/v1/query_range":
+		t.serveQueryRange(w, r)
+	case path == "api/v1/series":
+		t.serveSeries(w, r)
+	case path == "api/v1/labels":
+		t.serveLabels(w, r, "")
+	case strings.HasPrefix(path, "api/v1/label/") && strings.HasSuffix(path, "/values"):
+		t.serveLabels(w, r, strings.TrimSuffix(strings.TrimPrefix(path, "api/v1/label/"), "/values"))
+	case path == "api/v1/rules":
+		t.serveRules(w)
+	case path == "api/v1/rules/raw":
+		t.serveRawRules(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (t *Tenant) serveQuery(w http.ResponseWriter, r *http.Request) {
+	ts, err := parseTime(r.Form.Get("time"), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	query := r.Form.Get("query")
+	if v, ok := t.queries[query]; ok {
+		writeData(w, queryData(v))
+		return
+	}
+
+	expr, err := promql.Parse(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var v model.Value
+	switch e := expr.(type) {
+	case *promql.VectorSelector:
+		v, err = t.evalVector(e, ts)
+	case *promql.MatrixSelector:
+		v, err = t.evalMatrix(e, ts)
+	default:
+		err = errUnsupportedQuery
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeData(w, queryData(v))
+}
+
+func (t *Tenant) serveQueryRange(w http.ResponseWriter, r *http.Request) {
+	start, err := parseTime(r.Form.Get("start"), time.Time{})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	end, err := parseTime(r.Form.Get("end"), time.Time{})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	step, err := parseDuration(r.Form.Get("step"), 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if step <= 0 || end.Before(start) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid range from %s to %s with step %s", start, end, step))
+		return
+	}
+
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	query := r.Form.Get("query")
+	if v, ok := t.queries[query]; ok {
+		writeData(w, queryData(v))
+		return
+	}
+
+	expr, err := promql.Parse(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	vs, ok := expr.(*promql.VectorSelector)
+	if !ok {
+		writeError(w, http.StatusBadRequest, errUnsupportedQuery)
+		return
+	}
+
+	res := model.Matrix{}
+	streams := map[model.Fingerprint]*model.SampleStream{}
+	for ts := start; !ts.After(end); ts = ts.Add(step) {
+		v, err := t.evalVector(vs, ts)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		for _, s := range v {
+			fp := s.Metric.Fingerprint()
+			stream, ok := streams[fp]
+			if !ok {
+				stream = &model.SampleStream{Metric: s.Metric}
+				streams[fp] = stream
+				res = append(res, stream)
+			}
+			stream.Values = append(stream.Values, model.SamplePair{Timestamp: s.Timestamp, Value: s.Value})
+		}
+	}
+	sort.Sort(res)
+
+	writeData(w, queryData(res))
+}
+
+// queryData returns the data of a query response with a result.
+func queryData(v model.Value) map[string]interface{} {
+	return map[string]interface{}{"resultType": v.Type().String(), "result": v}
+}
+
+// evalVector returns the latest sample within the lookback delta of every series a selector matches.
+func (t *Tenant) evalVector(vs *promql.VectorSelector, ts time.Time) (model.Vector, error) {
+	at := model.TimeFromUnixNano(ts.Add(-vs.Offset).UnixNano())
+	from := at.Add(-lookbackDelta)
+
+	res := model.Vector{}
+	for _, s := range t.series {
+		ok, err := matchSelector(vs, model.LabelSet(s.Metric))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		for i := len(s.Values) - 1; i >= 0; i-- {
+			p := s.Values[i]
+			if p.Timestamp.After(at) {
+				continue
+			}
+			if p.Timestamp.After(from) {
+				res = append(res, &model.Sample{Metric: s.Metric, Value: p.Value, Timestamp: model.TimeFromUnixNano(ts.UnixNano())})
+			}
+			break
+		}
+	}
+
+	return res, nil
+}
+
+// evalMatrix returns the samples within the range of a selector of every series it matches.
+func (t *Tenant) evalMatrix(ms *promql.MatrixSelector, ts time.Time) (model.Matrix, error) {
+	at := model.TimeFromUnixNano(ts.Add(-ms.VectorSelector.Offset).UnixNano())
+	from := at.Add(-ms.Range)
+
+	res := model.Matrix{}
+	for _, s := range t.series {
+		ok, err := matchSelector(ms.VectorSelector, model.LabelSet(s.Metric))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		var values []model.SamplePair
+		for _, p := range s.Values {
+			if p.Timestamp.After(from) && !p.Timestamp.After(at) {
+				values = append(values, p)
+			}
+		}
+		if len(values) > 0 {
+			res = append(res, &model.SampleStream{Metric: s.Metric, Values: values})
+		}
+	}
+
+	return res, nil
+}
+
+// matchSelector returns whether the labels of a series or stream match a selector.
+func matchSelector(vs *promql.VectorSelector, lset model.LabelSet) (bool, error) {
+	if vs.Name != "" && string(lset[model.MetricNameLabel]) != vs.Name {
+		return false, nil
+	}
+	for _, m := range vs.Matchers {
+		ok, err := m.Matches(string(lset[model.LabelName(m.Name)]))
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchingSeries returns the series matching any of the selectors given with match[], or all of them if there
+// are none. Time ranges are ignored.
+func (t *Tenant) matchingSeries(r *http.Request) ([]*model.SampleStream, error) {
+	var selectors []*promql.VectorSelector
+	for _, m := range r.Form["match[]"] {
+		expr, err := promql.Parse(m)
+		if err != nil {
+			return nil, err
+		}
+		vs, ok := expr.(*promql.VectorSelector)
+		if !ok {
+			return nil, fmt.Errorf("invalid series selector %q", m)
+		}
+		selectors = append(selectors, vs)
+	}
+	if len(selectors) == 0 {
+		return t.series, nil
+	}
+
+	var res []*model.SampleStream
+	for _, s := range t.series {
+		for _, vs := range selectors {
+			ok, err := matchSelector(vs, model.LabelSet(s.Metric))
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				res = append(res, s)
+				break
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func (t *Tenant) serveSeries(w http.ResponseWriter, r *http.Request) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	series, err := t.matchingSeries(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	res := make([]model.Metric, 0, len(series))
+	for _, s := range series {
+		res = append(res, s.Metric)
+	}
+	writeData(w, res)
+}
+
+// serveLabels serves the label names of series, or the values of the given label.
+func (t *Tenant) serveLabels(w http.ResponseWriter, r *http.Request, name string) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	series, err := t.matchingSeries(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	set := map[string]bool{}
+	for _, s := range series {
+		for n, v := range s.Metric {
+			switch {
+			case name == "":
+				set[string(n)] = true
+			case string(n) == name:
+				set[string(v)] = true
+			}
+		}
+	}
+	writeData(w, sortedKeys(set))
+}
+
+// ruleGroup is a group of a Prometheus or Loki rules file.
+type ruleGroup struct {
+	Name     string `json:"name"`
+	Interval string `json:"interval,omitempty"`
+	Rules    []rule `json:"rules"`
+}
+
+type rule struct {
+	Record      string            `json:"record,omitempty"`
+	Alert       string            `json:"alert,omitempty"`
+	Expr        string            `json:"expr"`
+	For         string            `json:"for,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// validate checks that a group has a name and that its rules are either recording or alerting rules.
+func (g ruleGroup) validate() error {
+	if g.Name == "" {
+		return errors.New("rule group without a name")
+	}
+	for i, r := range g.Rules {
+		if (r.Record == "") == (r.Alert == "") {
+			return fmt.Errorf("rule %d of group %q must have either a record or an alert name", i, g.Name)
+		}
+		if r.Expr == "" {
+			return fmt.Errorf("rule %d of group %q has no expression", i, g.Name)
+		}
+	}
+	return nil
+}
+
+// parseRules parses and validates a Prometheus rules file.
+func parseRules(b []byte) ([]ruleGroup, error) {
+	var f struct {
+		Groups []ruleGroup `json:"groups"`
+	}
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("parsing rules: %w", err)
+	}
+	for _, g := range f.Groups {
+		if err := g.validate(); err != nil {
+			return nil, err
+		}
+		for _, r := range g.Rules {
+			if _, err := promql.Parse(r.Expr); err != nil {
+				return nil, fmt.Errorf("parsing expression %q of group %q: %w", r.Expr, g.Name, err)
+			}
+		}
+	}
+	return f.Groups, nil
+}
+
+// rulesData returns the data of a Prometheus rules API response for rule groups of the given files.
+func rulesData(files map[string][]ruleGroup) map[string]interface{} {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	groups := []interface{}{}
+	for _, file := range names {
+		for _, g := range files[file] {
+			rules := []interface{}{}
+			for _, r := range g.Rules {
+				res := map[string]interface{}{"query": r.Expr, "labels": r.Labels, "health": "ok"}
+				if r.Record != "" {
+					res["name"], res["type"] = r.Record, "recording"
+				} else {
+					res["name"], res["type"] = r.Alert, "alerting"
+					res["annotations"], res["state"], res["alerts"] = r.Annotations, "inactive", []interface{}{}
+				}
+				rules = append(rules, res)
+			}
+			groups = append(groups, map[string]interface{}{"name": g.Name, "file": file, "interval": g.Interval, "rules": rules})
+		}
+	}
+
+	return map[string]interface{}{"groups": groups}
+}
+
+func (t *Tenant) serveRules(w http.ResponseWriter) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	groups, err := parseRules(t.rules)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeData(w, rulesData(map[string][]ruleGroup{"rules.yaml": groups}))
+}
+
+func (t *Tenant) serveRawRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		t.mtx.RLock()
+		defer t.mtx.RUnlock()
+
+		writeYAML(w, t.rules)
+	case http.MethodPut:
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := t.SetRules(b); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		_, _ = fmt.Fprintln(w, "successfully updated rules file")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
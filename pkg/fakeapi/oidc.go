@@ -0,0 +1,219 @@
+package fakeapi
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultTokenTTL is how long tokens are valid if the issuer doesn't set it.
+	defaultTokenTTL = time.Hour
+	// keyID is the ID of the key tokens are signed with.
+	keyID = "fakeapi"
+)
+
+// Issuer is a fake OIDC issuer which grants tokens to clients with the client credentials flow, to be served with
+// httptest.NewServer. Its issuer URL is the URL it is served at.
+type Issuer struct {
+	// TokenTTL is how long tokens are valid, an hour if zero.
+	TokenTTL time.Duration
+
+	key     *rsa.PrivateKey
+	mtx     sync.Mutex
+	clients map[string]string
+	issued  int
+}
+
+// NewIssuer returns an issuer without clients, signing tokens with a new key.
+func NewIssuer() (*Issuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("generating key: %w", err)
+	}
+
+	return &Issuer{key: key, clients: map[string]string{}}, nil
+}
+
+// AddClient adds a client which can get tokens with the given secret.
+func (i *Issuer) AddClient(id, secret string) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	i.clients[id] = secret
+}
+
+// Issued returns how many tokens were granted, e.g. to check that clients reuse them.
+func (i *Issuer) Issued() int {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	return i.issued
+}
+
+// ServeHTTP serves the discovery document, the keys and the token endpoint of the issuer.
+func (i *Issuer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	url := scheme + "://" + r.Host
+
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                                url,
+			"authorization_endpoint":                url + "/oauth2/auth",
+			"token_endpoint":                        url + "/oauth2/token",
+			"jwks_uri":                              url + "/.well-known/jwks.json",
+			"grant_types_supported":                 []string{"client_credentials"},
+			"response_types_supported":              []string{"token"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	case "/.well-known/jwks.json":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(i.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(i.key.E)).Bytes()),
+		}}})
+	case "/oauth2/token":
+		i.serveToken(w, r, url)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveToken grants a token to a client authenticated with either basic authentication or form parameters.
+func (i *Issuer) serveToken(w http.ResponseWriter, r *http.Request, url string) {
+	tokenError := func(code int, errorType string) {
+		writeJSON(w, code, map[string]string{"error": errorType})
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(http.StatusBadRequest, "invalid_request")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "client_credentials" {
+		tokenError(http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	i.mtx.Lock()
+	want, ok := i.clients[id]
+	if ok && want == secret {
+		i.issued++
+	}
+	i.mtx.Unlock()
+	if !ok || want != secret {
+		tokenError(http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	ttl := i.TokenTTL
+	if ttl == 0 {
+		ttl = defaultTokenTTL
+	}
+	now := time.Now()
+	audience := id
+	if a := r.PostForm.Get("audience"); a != "" {
+		audience = a
+	}
+
+	token, err := i.sign(map[string]interface{}{
+		"iss":       url,
+		"sub":       id,
+		"aud":       audience,
+		"client_id": id,
+		"scope":     r.PostForm.Get("scope"),
+		"iat":       now.Unix(),
+		"exp":       now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		tokenError(http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "bearer",
+		"expires_in":   int(ttl.Seconds()),
+		"scope":        r.PostForm.Get("scope"),
+	})
+}
+
+// sign returns a JWT with the given claims, signed with RS256.
+func (i *Issuer) sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Verify checks that a token was signed by the issuer and hasn't expired, and returns its claims.
+func (i *Issuer) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&i.key.PublicKey, crypto.SHA256, sum[:], sig); err != nil {
+		return nil, errors.New("invalid signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed claims")
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("malformed claims")
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok || time.Unix(int64(exp), 0).Before(time.Now()) {
+		return nil, errors.New("token expired")
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,107 @@
+package fakeapi
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Span is a span of a trace.
+type Span struct {
+	TraceID, SpanID, ParentSpanID string
+	Service, Operation            string
+	Start                         time.Time
+	Duration                      time.Duration
+}
+
+// AddSpans adds spans to the traces of the tenant.
+func (t *Tenant) AddSpans(spans ...Span) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.spans = append(t.spans, spans...)
+}
+
+// serveTraces serves the services and traces of the Jaeger query API.
+func (t *Tenant) serveTraces(w http.ResponseWriter, r *http.Request, path string) {
+	switch {
+	case path == "api/services":
+		t.serveServices(w)
+	case strings.HasPrefix(path, "api/traces/") && !strings.Contains(strings.TrimPrefix(path, "api/traces/"), "/"):
+		t.serveTrace(w, strings.TrimPrefix(path, "api/traces/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (t *Tenant) serveServices(w http.ResponseWriter) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	set := map[string]bool{}
+	for _, s := range t.spans {
+		set[s.Service] = true
+	}
+	services := sortedKeys(set)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": services, "total": len(services)})
+}
+
+// jaegerSpan is a span in the Jaeger query API, with times in microseconds.
+type jaegerSpan struct {
+	TraceID       string              `json:"traceID"`
+	SpanID        string              `json:"spanID"`
+	OperationName string              `json:"operationName"`
+	References    []map[string]string `json:"references"`
+	StartTime     int64               `json:"startTime"`
+	Duration      int64               `json:"duration"`
+	ProcessID     string              `json:"processID"`
+}
+
+func (t *Tenant) serveTrace(w http.ResponseWriter, id string) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	var spans []jaegerSpan
+	processes := map[string]map[string]string{}
+	processIDs := map[string]string{}
+	for _, s := range t.spans {
+		if s.TraceID != id {
+			continue
+		}
+
+		pid, ok := processIDs[s.Service]
+		if !ok {
+			pid = "p" + strconv.Itoa(len(processIDs)+1)
+			processIDs[s.Service] = pid
+			processes[pid] = map[string]string{"serviceName": s.Service}
+		}
+
+		refs := []map[string]string{}
+		if s.ParentSpanID != "" {
+			refs = append(refs, map[string]string{"refType": "CHILD_OF", "traceID": s.TraceID, "spanID": s.ParentSpanID})
+		}
+		spans = append(spans, jaegerSpan{
+			TraceID:       s.TraceID,
+			SpanID:        s.SpanID,
+			OperationName: s.Operation,
+			References:    refs,
+			StartTime:     s.Start.UnixMicro(),
+			Duration:      s.Duration.Microseconds(),
+			ProcessID:     pid,
+		})
+	}
+
+	if len(spans) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"data":   nil,
+			"errors": []map[string]interface{}{{"code": http.StatusNotFound, "msg": "trace not found"}},
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": []map[string]interface{}{{"traceID": id, "spans": spans, "processes": processes}},
+	})
+}
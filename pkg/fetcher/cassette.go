@@ -0,0 +1,344 @@
+package fetcher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// RecordEnvVar is the environment variable with the directory responses of APIs are recorded to.
+	RecordEnvVar = "OBSCTL_RECORD"
+	// ReplayEnvVar is the environment variable with the directory recorded responses are replayed from, instead of
+	// sending requests to APIs.
+	ReplayEnvVar = "OBSCTL_REPLAY"
+)
+
+// cassette is a recorded request and its response.
+type cassette struct {
+	Request  cassetteRequest  `json:"request"`
+	Response cassetteResponse `json:"response"`
+}
+
+type cassetteRequest struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Query  string `json:"query,omitempty"`
+	// Relative is the query with its times relative to when the command ran, if it has any. Requests are matched by
+	// it if no request with the same absolute times was recorded, so that commands like the ones using --since can
+	// be replayed later.
+	Relative string `json:"relative,omitempty"`
+}
+
+type cassetteResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header,omitempty"`
+	// Body is the body of the response if it is text, and BodyBase64 the encoded body otherwise.
+	Body       string `json:"body,omitempty"`
+	BodyBase64 string `json:"bodyBase64,omitempty"`
+}
+
+// key returns what a request is recorded under, which is its method, path and query with sorted parameters.
+// Bodies and headers aren't part of the key.
+func (r cassetteRequest) key() string {
+	return r.Method + " " + r.Path + "?" + r.Query
+}
+
+// relativeKey returns what a request is matched by if its key wasn't recorded, or an empty string if it has no
+// times.
+func (r cassetteRequest) relativeKey() string {
+	if r.Relative == "" {
+		return ""
+	}
+	return r.Method + " " + r.Path + "?" + r.Relative
+}
+
+// file returns the name of the file a request is recorded in, readable but unique to its key.
+func (r cassetteRequest) file() string {
+	sum := sha256.Sum256([]byte(r.key()))
+	name := strings.Trim(strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' {
+			return c
+		}
+		return '_'
+	}, r.Path), "_")
+
+	return fmt.Sprintf("%s_%s_%s.json", strings.ToLower(r.Method), name, hex.EncodeToString(sum[:4]))
+}
+
+// newCassetteRequest returns the cassette request of a request sent by a command which ran at now.
+func newCassetteRequest(req *http.Request, now time.Time) cassetteRequest {
+	q := req.URL.Query()
+	return cassetteRequest{Method: req.Method, Path: req.URL.Path, Query: q.Encode(), Relative: relativeQuery(q, now)}
+}
+
+// timeParams are the query parameters of the APIs which hold times.
+var timeParams = []string{"time", "start", "end"}
+
+// relativeQuery returns a query with its times replaced by how long before now they are, to the minute, or an empty
+// string if it has no times. Times are rounded, as now is taken before commands work out their own times.
+func relativeQuery(q url.Values, now time.Time) string {
+	rel := url.Values{}
+	relative := false
+	for k, v := range q {
+		rel[k] = v
+	}
+	for _, p := range timeParams {
+		t, ok := parseParamTime(q.Get(p))
+		if !ok {
+			continue
+		}
+		rel.Set(p, "now-"+now.Sub(t).Round(time.Minute).String())
+		relative = true
+	}
+	if !relative {
+		return ""
+	}
+
+	return rel.Encode()
+}
+
+// parseParamTime parses a time parameter, which is either an RFC 3339 timestamp, a Unix timestamp in seconds or,
+// for the logs API, in nanoseconds.
+func parseParamTime(v string) (time.Time, bool) {
+	if v == "" {
+		return time.Time{}, false
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, true
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	// Timestamps in seconds won't be this big for a while.
+	if f > 1e15 {
+		return time.Unix(0, int64(f)), true
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)), true
+}
+
+// redactedTokens are the fields of OAuth 2.0 token responses whose values aren't recorded.
+var redactedTokens = []string{"access_token", "refresh_token", "id_token"}
+
+// redactTokens replaces the tokens of an OAuth 2.0 token response with a placeholder, so that recorded responses
+// don't hold credentials. Other bodies are returned as they are.
+func redactTokens(body []byte) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body
+	}
+
+	redacted := false
+	for _, f := range redactedTokens {
+		if _, ok := fields[f]; ok {
+			fields[f] = json.RawMessage(`"redacted"`)
+			redacted = true
+		}
+	}
+	if !redacted {
+		return body
+	}
+
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return b
+}
+
+// CassetteFromEnv returns a function wrapping transports so that they record responses to the directory set with
+// OBSCTL_RECORD, or replay them from the one set with OBSCTL_REPLAY. It returns nil if neither is set. Times in the
+// requests of the transports are relative to when CassetteFromEnv was called, which is when the command ran.
+func CassetteFromEnv() (func(http.RoundTripper) http.RoundTripper, error) {
+	record, replay := os.Getenv(RecordEnvVar), os.Getenv(ReplayEnvVar)
+	now := time.Now()
+	switch {
+	case record != "" && replay != "":
+		return nil, fmt.Errorf("only one of %s and %s can be set", RecordEnvVar, ReplayEnvVar)
+	case record != "":
+		if err := os.MkdirAll(record, 0700); err != nil {
+			return nil, fmt.Errorf("creating record directory: %w", err)
+		}
+		return func(next http.RoundTripper) http.RoundTripper {
+			return &recordTransport{next: next, dir: record, now: now}
+		}, nil
+	case replay != "":
+		if _, err := os.Stat(replay); err != nil {
+			return nil, fmt.Errorf("opening replay directory: %w", err)
+		}
+		t := &replayTransport{dir: replay, now: now}
+		return func(http.RoundTripper) http.RoundTripper { return t }, nil
+	}
+
+	return nil, nil
+}
+
+// recordTransport sends requests with another transport and saves their responses as cassettes in a directory.
+type recordTransport struct {
+	next http.RoundTripper
+	dir  string
+	now  time.Time
+	mtx  sync.Mutex
+}
+
+// NewRecordTransport returns a transport which sends requests with next and records their responses in dir,
+// replacing the earlier response of the same request. Responses which couldn't be received aren't recorded, and
+// the tokens of OAuth 2.0 token responses are redacted.
+func NewRecordTransport(next http.RoundTripper, dir string) http.RoundTripper {
+	return &recordTransport{next: next, dir: dir, now: time.Now()}
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("reading response to record: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	c := cassette{
+		Request:  newCassetteRequest(req, t.now),
+		Response: cassetteResponse{StatusCode: resp.StatusCode, Header: resp.Header},
+	}
+	body = redactTokens(body)
+	if utf8.Valid(body) {
+		c.Response.Body = string(body)
+	} else {
+		c.Response.BodyBase64 = base64.StdEncoding.EncodeToString(body)
+	}
+
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("encoding cassette: %w", err)
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if err := os.WriteFile(filepath.Join(t.dir, c.Request.file()), b, 0600); err != nil {
+		return nil, fmt.Errorf("recording response: %w", err)
+	}
+
+	return resp, nil
+}
+
+// replayTransport serves responses from cassettes in a directory instead of sending requests.
+type replayTransport struct {
+	dir string
+	now time.Time
+
+	relativeOnce sync.Once
+	// relative are the files of the recorded requests with times, by their relative key.
+	relative map[string]string
+}
+
+// NewReplayTransport returns a transport which responds to requests with the responses recorded in dir, failing
+// requests which weren't recorded.
+func NewReplayTransport(dir string) http.RoundTripper {
+	return &replayTransport{dir: dir, now: time.Now()}
+}
+
+// readCassette reads a recorded response from a file in the directory.
+func (t *replayTransport) readCassette(file string) (*cassette, error) {
+	b, err := os.ReadFile(filepath.Join(t.dir, file))
+	if err != nil {
+		return nil, err
+	}
+
+	var c cassette
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("parsing recorded response %s: %w", file, err)
+	}
+	return &c, nil
+}
+
+// relativeFile returns the file of the recorded request with the same relative key, if there is one.
+func (t *replayTransport) relativeFile(r cassetteRequest) (string, bool) {
+	t.relativeOnce.Do(func() {
+		t.relative = map[string]string{}
+		entries, err := os.ReadDir(t.dir)
+		if err != nil {
+			return
+		}
+		for _, e := range entries {
+			if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+				continue
+			}
+			c, err := t.readCassette(e.Name())
+			if err != nil {
+				continue
+			}
+			if k := c.Request.relativeKey(); k != "" {
+				t.relative[k] = e.Name()
+			}
+		}
+	})
+
+	file, ok := t.relative[r.relativeKey()]
+	return file, ok && r.relativeKey() != ""
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	r := newCassetteRequest(req, t.now)
+	c, err := t.readCassette(r.file())
+	if errors.Is(err, os.ErrNotExist) {
+		file, ok := t.relativeFile(r)
+		if !ok {
+			return nil, fmt.Errorf("no recorded response for %s in %s", r.key(), t.dir)
+		}
+		c, err = t.readCassette(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading recorded response: %w", err)
+	}
+
+	body := []byte(c.Response.Body)
+	if c.Response.BodyBase64 != "" {
+		if body, err = base64.StdEncoding.DecodeString(c.Response.BodyBase64); err != nil {
+			return nil, fmt.Errorf("decoding recorded response %s: %w", r.file(), err)
+		}
+	}
+
+	header := c.Response.Header
+	if header == nil {
+		header = http.Header{}
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", c.Response.StatusCode, http.StatusText(c.Response.StatusCode)),
+		StatusCode:    c.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,78 @@
+package fetcher
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+)
+
+func TestCassette(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			_, _ = w.Write([]byte(`{"access_token":"secret","token_type":"bearer"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	recordedAt := time.Date(2022, 10, 1, 10, 0, 0, 0, time.UTC)
+	record := &http.Client{Transport: &recordTransport{next: http.DefaultTransport, dir: dir, now: recordedAt}}
+
+	query := func(c *http.Client, base string, now time.Time) (string, error) {
+		start := strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)
+		resp, err := c.Get(base + "/api/v1/query_range?query=up&start=" + start + "&end=" + strconv.FormatInt(now.Unix(), 10))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	body, err := query(record, srv.URL, recordedAt)
+	testutil.Ok(t, err)
+	testutil.Equals(t, `{"status":"success"}`, body)
+	resp, err := record.Get(srv.URL + "/token")
+	testutil.Ok(t, err)
+	b, err := io.ReadAll(resp.Body)
+	testutil.Ok(t, err)
+	resp.Body.Close()
+	// Tokens are only redacted in the recording.
+	testutil.Equals(t, `{"access_token":"secret","token_type":"bearer"}`, string(b))
+
+	// Requests made by a command which ran later are matched by their times relative to when it ran.
+	replayedAt := recordedAt.Add(24 * time.Hour)
+	replay := &http.Client{Transport: &replayTransport{dir: dir, now: replayedAt}}
+	body, err = query(replay, "http://localhost", replayedAt)
+	testutil.Ok(t, err)
+	testutil.Equals(t, `{"status":"success"}`, body)
+
+	_, err = query(replay, "http://localhost", replayedAt.Add(-2*time.Hour))
+	testutil.NotOk(t, err)
+
+	resp, err = replay.Get("http://localhost/token")
+	testutil.Ok(t, err)
+	b, err = io.ReadAll(resp.Body)
+	testutil.Ok(t, err)
+	resp.Body.Close()
+	testutil.Equals(t, `{"access_token":"redacted","token_type":"bearer"}`, string(b))
+}
+
+func TestParseParamTime(t *testing.T) {
+	want := time.Date(2022, 10, 1, 10, 0, 0, 500000000, time.UTC)
+	for _, v := range []string{"2022-10-01T10:00:00.5Z", "1664618400.5", strconv.FormatInt(want.UnixNano(), 10)} {
+		got, ok := parseParamTime(v)
+		testutil.Equals(t, true, ok)
+		testutil.Assert(t, got.Equal(want), "%s parsed as %v, want %v", v, got, want)
+	}
+
+	_, ok := parseParamTime("up")
+	testutil.Equals(t, false, ok)
+}
@@ -0,0 +1,210 @@
+package fetcher
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// curlTokenPlaceholder is the placeholder of the bearer token in printed curl commands.
+const curlTokenPlaceholder = "${TOKEN}"
+
+// redactedHeaders are the headers whose values are left out of dumped requests.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization"}
+
+// redactedFormFields are the fields of form bodies whose values are left out of dumped requests, like the client
+// secret of OAuth 2.0 token requests.
+var redactedFormFields = []string{"client_secret", "refresh_token", "assertion"}
+
+// curlSkippedHeaders are the headers which curl sets itself and aren't printed in curl commands.
+var curlSkippedHeaders = map[string]bool{"Accept-Encoding": true, "User-Agent": true, "Content-Length": true}
+
+// debugTransport writes requests and their responses, or the curl commands reproducing requests, to a writer.
+type debugTransport struct {
+	next       http.RoundTripper
+	w          io.Writer
+	dump, curl bool
+	mtx        sync.Mutex
+}
+
+// NewDebugTransport returns a transport which sends requests with next and writes them to w, either dumped with
+// their responses if dump is true, or as curl commands if curl is true. Credentials are never written.
+func NewDebugTransport(next http.RoundTripper, w io.Writer, dump, curl bool) http.RoundTripper {
+	return &debugTransport{next: next, w: w, dump: dump, curl: curl}
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.curl {
+		t.write([]byte(CurlCommand(req, body) + "\n"))
+	}
+	if t.dump {
+		t.write(dumpRequest(req, body))
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if !t.dump {
+		return resp, err
+	}
+	if err != nil {
+		t.write([]byte(fmt.Sprintf("< error: %s\n\n", err)))
+		return resp, err
+	}
+
+	// The response is read to be dumped and replaced with what was read.
+	b, err := httputil.DumpResponse(resp, false)
+	if err != nil {
+		return nil, fmt.Errorf("dumping response: %w", err)
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("reading response body: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	t.write(prefixLines(append(b, redactTokens(respBody)...), "< "))
+
+	return resp, nil
+}
+
+func (t *debugTransport) write(b []byte) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	_, _ = t.w.Write(b)
+}
+
+// readBody reads the body of a request and replaces it so that it can still be sent.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading request body: %w", err)
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
+
+// dumpRequest dumps a request with its body, redacting credentials.
+func dumpRequest(req *http.Request, body []byte) []byte {
+	r := req.Clone(req.Context())
+	for _, h := range redactedHeaders {
+		if v := r.Header.Get(h); v != "" {
+			r.Header.Set(h, redact(v))
+		}
+	}
+	body = redactForm(req, body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+
+	b, err := httputil.DumpRequestOut(r, true)
+	if err != nil {
+		return []byte(fmt.Sprintf("> error dumping request: %s\n", err))
+	}
+
+	return prefixLines(b, "> ")
+}
+
+// redact replaces the credentials of an Authorization header, keeping the scheme, e.g. Bearer.
+func redact(v string) string {
+	if i := strings.Index(v, " "); i > 0 {
+		return v[:i] + " <redacted>"
+	}
+
+	return "<redacted>"
+}
+
+// redactForm replaces the credentials of a form body with a placeholder. Other bodies are returned as they are.
+func redactForm(req *http.Request, body []byte) []byte {
+	if !strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return body
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return body
+	}
+
+	redacted := false
+	for _, f := range redactedFormFields {
+		if _, ok := form[f]; ok {
+			form.Set(f, "redacted")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return body
+	}
+
+	return []byte(form.Encode())
+}
+
+// prefixLines prefixes every line of a dump with the direction of the message, ending it with an empty line.
+func prefixLines(b []byte, prefix string) []byte {
+	lines := strings.Split(strings.TrimRight(strings.ReplaceAll(string(b), "\r\n", "\n"), "\n"), "\n")
+	var out strings.Builder
+	for _, l := range lines {
+		out.WriteString(prefix + l + "\n")
+	}
+	out.WriteString("\n")
+
+	return []byte(out.String())
+}
+
+// CurlCommand returns a curl command which sends the same request, with a placeholder instead of the bearer token.
+// Other credentials, like the ones of OAuth 2.0 token requests, are redacted.
+func CurlCommand(req *http.Request, body []byte) string {
+	args := []string{"curl"}
+	if req.Method != http.MethodGet {
+		args = append(args, "-X", req.Method)
+	}
+	args = append(args, shellQuote(req.URL.String()))
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if curlSkippedHeaders[name] {
+			continue
+		}
+		for _, v := range req.Header[name] {
+			if name == "Authorization" {
+				if strings.HasPrefix(v, "Bearer ") {
+					// Double quotes let the shell expand the placeholder.
+					args = append(args, "-H", `"Authorization: Bearer `+curlTokenPlaceholder+`"`)
+				} else {
+					args = append(args, "-H", shellQuote("Authorization: "+redact(v)))
+				}
+				continue
+			}
+			args = append(args, "-H", shellQuote(name+": "+v))
+		}
+	}
+
+	if len(body) > 0 {
+		args = append(args, "--data-binary", shellQuote(string(redactForm(req, body))))
+	}
+
+	return strings.Join(args, " ")
+}
+
+// shellQuote quotes a string for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
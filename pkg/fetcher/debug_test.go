@@ -0,0 +1,74 @@
+package fetcher
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+)
+
+func TestDebugTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(append([]byte("got "), body...))
+	}))
+	defer srv.Close()
+
+	var out bytes.Buffer
+	c := &http.Client{Transport: NewDebugTransport(http.DefaultTransport, &out, true, true)}
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/metrics/v1/test/api/v1/query", strings.NewReader("query=up{job='a'}"))
+	testutil.Ok(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.Do(req)
+	testutil.Ok(t, err)
+	defer resp.Body.Close()
+
+	// The body is still sent and returned after being dumped.
+	body, err := io.ReadAll(resp.Body)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "got query=up{job='a'}", string(body))
+
+	dump := out.String()
+	testutil.Assert(t, !strings.Contains(dump, "secret"), "token not redacted:\n%s", dump)
+	testutil.Assert(t, strings.Contains(dump, "> Authorization: Bearer <redacted>\n"), "no redacted header:\n%s", dump)
+	testutil.Assert(t, strings.Contains(dump, "> query=up{job='a'}\n"), "no request body:\n%s", dump)
+	testutil.Assert(t, strings.Contains(dump, "< got query=up{job='a'}\n"), "no response body:\n%s", dump)
+	testutil.Assert(t, strings.HasPrefix(dump, `curl -X POST '`+srv.URL+`/api/metrics/v1/test/api/v1/query' -H "Authorization: Bearer ${TOKEN}" -H 'Content-Type: application/x-www-form-urlencoded' --data-binary 'query=up{job='\''a'\''}'`+"\n"), "unexpected curl command:\n%s", dump)
+}
+
+func TestDebugTransportTokenRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"issued","token_type":"bearer"}`))
+	}))
+	defer srv.Close()
+
+	var out bytes.Buffer
+	c := &http.Client{Transport: NewDebugTransport(http.DefaultTransport, &out, true, true)}
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/token", strings.NewReader("client_id=obsctl&client_secret=secret&grant_type=client_credentials"))
+	testutil.Ok(t, err)
+	req.SetBasicAuth("obsctl", "secret")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.Do(req)
+	testutil.Ok(t, err)
+	defer resp.Body.Close()
+
+	// Tokens are only redacted in the dump.
+	body, err := io.ReadAll(resp.Body)
+	testutil.Ok(t, err)
+	testutil.Equals(t, `{"access_token":"issued","token_type":"bearer"}`, string(body))
+
+	dump := out.String()
+	testutil.Assert(t, !strings.Contains(dump, "=secret"), "client secret not redacted:\n%s", dump)
+	testutil.Assert(t, !strings.Contains(dump, "issued"), "token not redacted:\n%s", dump)
+	testutil.Assert(t, strings.Contains(dump, "> Authorization: Basic <redacted>\n"), "no redacted header:\n%s", dump)
+	testutil.Assert(t, strings.Contains(dump, `< {"access_token":"redacted","token_type":"bearer"}`+"\n"), "no redacted response body:\n%s", dump)
+	testutil.Assert(t, strings.HasPrefix(dump, `curl -X POST '`+srv.URL+`/token' -H 'Authorization: Basic <redacted>' -H 'Content-Type: application/x-www-form-urlencoded' --data-binary 'client_id=obsctl&client_secret=redacted&grant_type=client_credentials'`+"\n"), "unexpected curl command:\n%s", dump)
+}
@@ -3,7 +3,10 @@ package fetcher
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
@@ -24,8 +27,45 @@ func NewCustomFetcher(ctx context.Context, logger log.Logger) (*client.ClientWit
 		return nil, "", fmt.Errorf("getting current client: %w", err)
 	}
 
-	fc, err := client.NewClientWithResponses(cfg.APIs[cfg.Current.API].URL, func(f *client.Client) error {
-		f.Client = c
+	fc, err := newClient(logger, cfg.APIs[cfg.Current.API], c)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return fc, parameters.Tenant(cfg.Current.Tenant), nil
+}
+
+// NewContextFetcher returns a ClientWithResponses like NewCustomFetcher, but for the given context
+// instead of the current one.
+func NewContextFetcher(ctx context.Context, logger log.Logger, api string, tenant string) (*client.ClientWithResponses, parameters.Tenant, error) {
+	cfg, err := config.Read(logger)
+	if err != nil {
+		return nil, "", fmt.Errorf("getting reading config: %w", err)
+	}
+
+	c, err := cfg.ContextClient(ctx, logger, api, tenant)
+	if err != nil {
+		return nil, "", fmt.Errorf("getting client: %w", err)
+	}
+
+	fc, err := newClient(logger, cfg.APIs[api], c)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return fc, parameters.Tenant(tenant), nil
+}
+
+// newClient returns a ClientWithResponses for an API, which sends requests with the given HTTP client and retries
+// them according to the retry policy of the API.
+func newClient(logger log.Logger, api config.APIConfig, c *http.Client) (*client.ClientWithResponses, error) {
+	policy, err := retryPolicy(api.Retry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retry policy: %w", err)
+	}
+
+	fc, err := client.NewClientWithResponses(api.URL, func(f *client.Client) error {
+		f.Client = newRetryDoer(logger, c, policy)
 		return nil
 	}, client.WithRequestEditorFn(func(ctx context.Context, req *http.Request) error {
 		level.Debug(logger).Log(
@@ -35,8 +75,52 @@ func NewCustomFetcher(ctx context.Context, logger log.Logger) (*client.ClientWit
 		return nil
 	}))
 	if err != nil {
-		return nil, "", fmt.Errorf("getting fetcher client: %w", err)
+		return nil, fmt.Errorf("getting fetcher client: %w", err)
 	}
 
-	return fc, parameters.Tenant(cfg.Current.Tenant), nil
+	return fc, nil
+}
+
+// Get sends a GET request to an API path which the generated client has no method for, e.g. the TSDB status of a
+// tenant, using the HTTP client and request editors of the given client. It returns the response and its body.
+func Get(ctx context.Context, fc *client.ClientWithResponses, path string, query url.Values) (*http.Response, []byte, error) {
+	c, ok := fc.ClientInterface.(*client.Client)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported client %T", fc.ClientInterface)
+	}
+
+	u, err := url.Parse(c.Server)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing server URL: %w", err)
+	}
+
+	u, err = u.Parse("./" + strings.TrimPrefix(path, "/"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing path: %w", err)
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	for _, edit := range c.RequestEditors {
+		if err := edit(ctx, req); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading response: %w", err)
+	}
+
+	return resp, body, nil
 }
@@ -0,0 +1,255 @@
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/observatorium/api/client"
+	"github.com/observatorium/obsctl/pkg/config"
+	"golang.org/x/time/rate"
+)
+
+// RetryPolicy is how failed requests are retried and how fast requests are sent.
+type RetryPolicy struct {
+	// MaxRetries is how many times a failed request is retried.
+	MaxRetries int
+	// MinBackoff is the backoff before the first retry, which doubles on every further retry up to MaxBackoff.
+	// Retry-After headers asking to wait longer than MaxBackoff aren't retried.
+	MinBackoff, MaxBackoff time.Duration
+	// RateLimit is the maximum number of requests per second, or 0 for no limit.
+	RateLimit float64
+	// Burst is how many requests can be sent at once above the rate limit.
+	Burst int
+}
+
+var (
+	// DefaultRetryPolicy is the policy of APIs which don't override it in their config.
+	DefaultRetryPolicy = RetryPolicy{MaxRetries: 3, MinBackoff: 500 * time.Millisecond, MaxBackoff: 30 * time.Second, Burst: 1}
+	// RetryOverrides overrides both the default policy and the one of APIs, e.g. with flags.
+	RetryOverrides *config.RetryConfig
+)
+
+// retryPolicy returns the policy for an API, given its retry config if it has one.
+func retryPolicy(c *config.RetryConfig) (RetryPolicy, error) {
+	p, err := DefaultRetryPolicy.With(c)
+	if err != nil {
+		return p, err
+	}
+
+	return p.With(RetryOverrides)
+}
+
+// With returns the policy with the fields set in a retry config replaced.
+func (p RetryPolicy) With(c *config.RetryConfig) (RetryPolicy, error) {
+	if c == nil {
+		return p, nil
+	}
+
+	if c.MaxRetries != nil {
+		p.MaxRetries = *c.MaxRetries
+	}
+	if c.MinBackoff != "" {
+		d, err := time.ParseDuration(c.MinBackoff)
+		if err != nil {
+			return p, fmt.Errorf("invalid minimum backoff %q: %w", c.MinBackoff, err)
+		}
+		p.MinBackoff = d
+	}
+	if c.MaxBackoff != "" {
+		d, err := time.ParseDuration(c.MaxBackoff)
+		if err != nil {
+			return p, fmt.Errorf("invalid maximum backoff %q: %w", c.MaxBackoff, err)
+		}
+		p.MaxBackoff = d
+	}
+	if c.RateLimit != nil {
+		p.RateLimit = *c.RateLimit
+	}
+	if c.Burst != nil {
+		p.Burst = *c.Burst
+	}
+
+	return p, p.validate()
+}
+
+func (p RetryPolicy) validate() error {
+	switch {
+	case p.MaxRetries < 0:
+		return fmt.Errorf("maximum retries can't be negative")
+	case p.MinBackoff < 0 || p.MaxBackoff < p.MinBackoff:
+		return fmt.Errorf("backoff must be between a non-negative minimum and a maximum which isn't lower")
+	case p.RateLimit < 0:
+		return fmt.Errorf("rate limit can't be negative")
+	case p.RateLimit > 0 && p.Burst < 1:
+		return fmt.Errorf("burst must be at least 1")
+	}
+
+	return nil
+}
+
+// backoff returns how long to wait before a retry, growing exponentially with the number of the retry, starting at
+// zero. The backoff is jittered between half and all of it, so that clients don't retry all at once.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.MinBackoff
+	for i := 0; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// readOnlyPaths are the suffixes of API paths which can be POSTed to without changing anything, e.g. queries too
+// long for a URL.
+var readOnlyPaths = []string{"/query", "/query_range", "/series", "/labels", "/query_exemplars"}
+
+// idempotent returns whether a request can be sent again without side effects if it might have been processed.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	case http.MethodPost:
+		for _, suffix := range readOnlyPaths {
+			if strings.HasSuffix(req.URL.Path, suffix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// retryAfter returns the wait asked for by the Retry-After header of a response, given in seconds or as a date.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+		return time.Duration(sec) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// shouldRetry returns whether a request which got the given response or error is retried, and how long to wait
+// before. Connection refused errors and 429 responses are retried for every request, as they weren't processed.
+// Connection resets and 502 or 503 responses are only retried for idempotent requests, as writes may have been
+// applied even though they failed.
+func (p RetryPolicy) shouldRetry(req *http.Request, resp *http.Response, err error, retry int) (time.Duration, bool) {
+	if retry >= p.MaxRetries || req.Context().Err() != nil {
+		return 0, false
+	}
+	// Requests whose body can't be read again can't be retried.
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return 0, false
+	}
+
+	if err != nil {
+		switch {
+		case errors.Is(err, syscall.ECONNREFUSED):
+		case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+			if !idempotent(req) {
+				return 0, false
+			}
+		default:
+			return 0, false
+		}
+		return p.backoff(retry), true
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		if !idempotent(req) {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+
+	if d, ok := retryAfter(resp, time.Now()); ok {
+		// Waiting longer than the maximum backoff would look like the command hangs, so the error is returned instead.
+		return d, d <= p.MaxBackoff
+	}
+
+	return p.backoff(retry), true
+}
+
+// retryDoer is an HTTP client which retries failed requests and limits the rate of requests.
+type retryDoer struct {
+	doer    client.HttpRequestDoer
+	policy  RetryPolicy
+	limiter *rate.Limiter
+	logger  log.Logger
+}
+
+func newRetryDoer(logger log.Logger, doer client.HttpRequestDoer, policy RetryPolicy) *retryDoer {
+	d := &retryDoer{doer: doer, policy: policy, logger: logger}
+	if policy.RateLimit > 0 {
+		d.limiter = rate.NewLimiter(rate.Limit(policy.RateLimit), policy.Burst)
+	}
+
+	return d
+}
+
+func (d *retryDoer) Do(req *http.Request) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		if d.limiter != nil {
+			if err := d.limiter.Wait(req.Context()); err != nil {
+				return nil, err
+			}
+		}
+
+		if retry > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := d.doer.Do(req)
+		wait, ok := d.policy.shouldRetry(req, resp, err, retry)
+		if !ok {
+			return resp, err
+		}
+
+		reason := fmt.Sprint(err)
+		if resp != nil {
+			reason = resp.Status
+			// The body is drained so that the connection can be reused.
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		level.Debug(d.logger).Log("msg", "retrying request", "method", req.Method, "URL", req.URL, "reason", reason, "wait", wait)
+
+		t := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		case <-t.C:
+		}
+	}
+}
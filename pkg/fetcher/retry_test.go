@@ -0,0 +1,92 @@
+package fetcher
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"github.com/go-kit/log"
+	"github.com/observatorium/obsctl/pkg/config"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	maxRetries := 5
+	p, err := DefaultRetryPolicy.With(&config.RetryConfig{MaxRetries: &maxRetries, MinBackoff: "1s", MaxBackoff: "4s"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, RetryPolicy{MaxRetries: 5, MinBackoff: time.Second, MaxBackoff: 4 * time.Second, Burst: 1}, p)
+
+	for retry, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		d := p.backoff(retry)
+		testutil.Assert(t, d >= want/2 && d <= want, "backoff %v of retry %d not within [%v, %v]", d, retry, want/2, want)
+	}
+
+	_, err = DefaultRetryPolicy.With(&config.RetryConfig{MinBackoff: "1m"})
+	testutil.NotOk(t, err)
+
+	now := time.Date(2022, 10, 1, 10, 0, 0, 0, time.UTC)
+	d, ok := retryAfter(&http.Response{Header: http.Header{"Retry-After": {"7"}}}, now)
+	testutil.Equals(t, true, ok)
+	testutil.Equals(t, 7*time.Second, d)
+	d, ok = retryAfter(&http.Response{Header: http.Header{"Retry-After": {now.Add(time.Minute).Format(http.TimeFormat)}}}, now)
+	testutil.Equals(t, true, ok)
+	testutil.Equals(t, time.Minute, d)
+
+	get, err := http.NewRequest(http.MethodGet, "http://localhost/api/metrics/v1/test/api/v1/rules", nil)
+	testutil.Ok(t, err)
+	query, err := http.NewRequest(http.MethodPost, "http://localhost/api/metrics/v1/test/api/v1/query_range", nil)
+	testutil.Ok(t, err)
+	put, err := http.NewRequest(http.MethodPut, "http://localhost/api/metrics/v1/test/api/v1/rules/raw", nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, true, idempotent(get))
+	testutil.Equals(t, true, idempotent(query))
+	testutil.Equals(t, false, idempotent(put))
+
+	// Writes are only retried if they were rejected before being processed.
+	_, ok = p.shouldRetry(put, &http.Response{StatusCode: http.StatusServiceUnavailable}, nil, 0)
+	testutil.Equals(t, false, ok)
+	_, ok = p.shouldRetry(put, &http.Response{StatusCode: http.StatusTooManyRequests}, nil, 0)
+	testutil.Equals(t, true, ok)
+	_, ok = p.shouldRetry(get, &http.Response{StatusCode: http.StatusServiceUnavailable}, nil, 0)
+	testutil.Equals(t, true, ok)
+	_, ok = p.shouldRetry(get, &http.Response{StatusCode: http.StatusInternalServerError}, nil, 0)
+	testutil.Equals(t, false, ok)
+	_, ok = p.shouldRetry(get, &http.Response{StatusCode: http.StatusServiceUnavailable}, nil, 5)
+	testutil.Equals(t, false, ok)
+	_, ok = p.shouldRetry(get, &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"60"}}}, nil, 0)
+	testutil.Equals(t, false, ok)
+}
+
+func TestRetryDoer(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	defer srv.Close()
+
+	d := newRetryDoer(log.NewNopLogger(), srv.Client(), RetryPolicy{MaxRetries: 3, MaxBackoff: time.Second, RateLimit: 1000, Burst: 1})
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/query", strings.NewReader("query=up"))
+	testutil.Ok(t, err)
+
+	resp, err := d.Do(req)
+	testutil.Ok(t, err)
+	defer resp.Body.Close()
+
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	testutil.Equals(t, int32(3), atomic.LoadInt32(&calls))
+
+	// The body is sent again with every retry.
+	body, err := io.ReadAll(resp.Body)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "query=up", string(body))
+}
@@ -0,0 +1,212 @@
+package promql
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// ValueType is the type an expression evaluates to.
+type ValueType string
+
+const (
+	ValueTypeScalar ValueType = "scalar"
+	ValueTypeVector ValueType = "instant vector"
+	ValueTypeMatrix ValueType = "range vector"
+	ValueTypeString ValueType = "string"
+)
+
+// Expr is a node of the syntax tree of a query.
+type Expr interface {
+	// Type returns the type the expression evaluates to.
+	Type() ValueType
+	// String returns the expression formatted on a single line.
+	String() string
+}
+
+// NumberLiteral is a number, kept as written.
+type NumberLiteral struct {
+	Val string
+}
+
+// StringLiteral is a quoted string, kept as written.
+type StringLiteral struct {
+	Val string
+}
+
+// LabelMatcher matches the value of a label with one of =, !=, =~ or !~.
+type LabelMatcher struct {
+	Name  string
+	Op    string
+	Value string
+}
+
+// Matches returns whether a label value matches. Regular expressions are anchored, as in Prometheus.
+func (m *LabelMatcher) Matches(v string) (bool, error) {
+	value := unquote(m.Value)
+	switch m.Op {
+	case "=":
+		return v == value, nil
+	case "!=":
+		return v != value, nil
+	}
+
+	re, err := regexp.Compile("^(?:" + value + ")$")
+	if err != nil {
+		return false, fmt.Errorf("invalid regular expression %q: %w", value, err)
+	}
+	if m.Op == "!~" {
+		return !re.MatchString(v), nil
+	}
+	return re.MatchString(v), nil
+}
+
+// VectorSelector selects series by metric name and label matchers.
+type VectorSelector struct {
+	Name     string
+	Matchers []*LabelMatcher
+	Offset   time.Duration
+	At       string
+}
+
+// MatrixSelector selects a range of samples of the series of a vector selector.
+type MatrixSelector struct {
+	VectorSelector *VectorSelector
+	Range          time.Duration
+}
+
+// SubqueryExpr evaluates an expression over a range at a step.
+type SubqueryExpr struct {
+	Expr   Expr
+	Range  time.Duration
+	Step   time.Duration
+	Offset time.Duration
+	At     string
+}
+
+// Call is a function call.
+type Call struct {
+	Func *Function
+	Args []Expr
+}
+
+// AggregateExpr aggregates a vector, optionally by or without some labels.
+type AggregateExpr struct {
+	Op       string
+	Expr     Expr
+	Param    Expr
+	Grouping []string
+	// Without is whether the grouping labels are dropped rather than kept.
+	Without bool
+	// HasGrouping is whether there is a by or without clause, even if it has no labels.
+	HasGrouping bool
+}
+
+// VectorMatching describes how the series of both sides of a binary expression are matched.
+type VectorMatching struct {
+	// On is whether the labels are matched on rather than ignored.
+	On     bool
+	Labels []string
+	// Card is group_left or group_right for many-to-one and one-to-many matching, or empty.
+	Card    string
+	Include []string
+}
+
+// BinaryExpr is a binary operation.
+type BinaryExpr struct {
+	Op         string
+	LHS, RHS   Expr
+	ReturnBool bool
+	Matching   *VectorMatching
+}
+
+// ParenExpr is an expression in parentheses.
+type ParenExpr struct {
+	Expr Expr
+}
+
+// UnaryExpr is a negated, or explicitly positive, expression.
+type UnaryExpr struct {
+	Op   string
+	Expr Expr
+}
+
+func (e *NumberLiteral) Type() ValueType  { return ValueTypeScalar }
+func (e *StringLiteral) Type() ValueType  { return ValueTypeString }
+func (e *VectorSelector) Type() ValueType { return ValueTypeVector }
+func (e *MatrixSelector) Type() ValueType { return ValueTypeMatrix }
+func (e *SubqueryExpr) Type() ValueType   { return ValueTypeMatrix }
+func (e *Call) Type() ValueType           { return e.Func.ReturnType }
+func (e *AggregateExpr) Type() ValueType  { return ValueTypeVector }
+func (e *ParenExpr) Type() ValueType      { return e.Expr.Type() }
+func (e *UnaryExpr) Type() ValueType      { return e.Expr.Type() }
+
+func (e *BinaryExpr) Type() ValueType {
+	if e.LHS.Type() == ValueTypeScalar && e.RHS.Type() == ValueTypeScalar {
+		return ValueTypeScalar
+	}
+
+	return ValueTypeVector
+}
+
+// Children returns the expressions directly below an expression in the syntax tree.
+func Children(e Expr) []Expr {
+	switch n := e.(type) {
+	case *MatrixSelector:
+		return []Expr{n.VectorSelector}
+	case *SubqueryExpr:
+		return []Expr{n.Expr}
+	case *Call:
+		return n.Args
+	case *AggregateExpr:
+		if n.Param != nil {
+			return []Expr{n.Param, n.Expr}
+		}
+		return []Expr{n.Expr}
+	case *BinaryExpr:
+		return []Expr{n.LHS, n.RHS}
+	case *ParenExpr:
+		return []Expr{n.Expr}
+	case *UnaryExpr:
+		return []Expr{n.Expr}
+	}
+
+	return nil
+}
+
+// Inspect calls f for every expression of the syntax tree in depth-first order, skipping the children of
+// expressions for which f returns false.
+func Inspect(e Expr, f func(Expr) bool) {
+	if !f(e) {
+		return
+	}
+	for _, c := range Children(e) {
+		Inspect(c, f)
+	}
+}
+
+// unwrapParens returns the expression inside any parentheses.
+func unwrapParens(e Expr) Expr {
+	for {
+		p, ok := e.(*ParenExpr)
+		if !ok {
+			return e
+		}
+		e = p.Expr
+	}
+}
+
+// MetricName returns the metric name a vector selector selects, either by name or by an equality matcher on
+// __name__, or an empty string if it selects any name.
+func (e *VectorSelector) MetricName() string {
+	if e.Name != "" {
+		return e.Name
+	}
+	for _, m := range e.Matchers {
+		if m.Name == "__name__" && m.Op == "=" {
+			return unquote(m.Value)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,88 @@
+package promql
+
+// Function is a PromQL function.
+type Function struct {
+	Name       string
+	ArgTypes   []ValueType
+	ReturnType ValueType
+	// Variadic is the number of trailing arguments which are optional, or -1 if the last one can be repeated.
+	Variadic int
+	// Unknown is set for functions which aren't in Functions, whose arguments aren't checked.
+	Unknown bool
+}
+
+// Functions are the functions known to the parser, by name. They follow the functions of the upstream parser in
+// promql/parser/functions.go of github.com/prometheus/prometheus, currently as of Prometheus v3.7, including the
+// experimental ones, and must be updated when Prometheus adds functions. Calls to functions missing from this list
+// are still parsed, see unknownFunction, so that queries using newer functions than obsctl knows keep working.
+var Functions = map[string]*Function{}
+
+// unknownFunction returns a function which isn't known to the parser. It may take any arguments and is assumed to
+// return an instant vector, as almost all functions do.
+func unknownFunction(name string) *Function {
+	return &Function{Name: name, ReturnType: ValueTypeVector, Variadic: -1, Unknown: true}
+}
+
+func init() {
+	v, m, s, str := ValueTypeVector, ValueTypeMatrix, ValueTypeScalar, ValueTypeString
+	add := func(name string, ret ValueType, variadic int, args ...ValueType) {
+		Functions[name] = &Function{Name: name, ArgTypes: args, ReturnType: ret, Variadic: variadic}
+	}
+
+	for _, name := range []string{
+		"abs", "ceil", "exp", "floor", "ln", "log2", "log10", "sgn", "sqrt", "sort", "sort_desc", "timestamp",
+		"acos", "acosh", "asin", "asinh", "atan", "atanh", "cos", "cosh", "sin", "sinh", "tan", "tanh", "deg", "rad",
+		"histogram_count", "histogram_sum", "histogram_avg", "histogram_stddev", "histogram_stdvar", "absent",
+	} {
+		add(name, v, 0, v)
+	}
+	for _, name := range []string{
+		"changes", "delta", "deriv", "idelta", "increase", "irate", "rate", "resets", "absent_over_time",
+		"avg_over_time", "count_over_time", "last_over_time", "max_over_time", "min_over_time", "present_over_time",
+		"stddev_over_time", "stdvar_over_time", "sum_over_time", "mad_over_time", "first_over_time",
+		"ts_of_first_over_time", "ts_of_last_over_time", "ts_of_max_over_time", "ts_of_min_over_time",
+	} {
+		add(name, v, 0, m)
+	}
+	for _, name := range []string{"day_of_month", "day_of_week", "day_of_year", "days_in_month", "hour", "minute", "month", "year"} {
+		add(name, v, 1, v)
+	}
+
+	add("clamp", v, 0, v, s, s)
+	add("clamp_max", v, 0, v, s)
+	add("clamp_min", v, 0, v, s)
+	add("round", v, 1, v, s)
+	add("histogram_quantile", v, 0, s, v)
+	add("histogram_fraction", v, 0, s, s, v)
+	add("holt_winters", v, 0, m, s, s)
+	add("double_exponential_smoothing", v, 0, m, s, s)
+	add("predict_linear", v, 0, m, s)
+	add("quantile_over_time", v, 0, s, m)
+	add("label_join", v, -1, v, str, str, str)
+	add("label_replace", v, 0, v, str, str, str, str)
+	add("sort_by_label", v, -1, v, str)
+	add("sort_by_label_desc", v, -1, v, str)
+	add("info", v, 1, v, v)
+	add("scalar", s, 0, v)
+	add("vector", v, 0, s)
+	add("time", s, 0)
+	add("pi", s, 0)
+}
+
+// aggregators are the aggregation operators, with the type of their parameter if they have one.
+var aggregators = map[string]ValueType{
+	"sum":          "",
+	"min":          "",
+	"max":          "",
+	"avg":          "",
+	"group":        "",
+	"stddev":       "",
+	"stdvar":       "",
+	"count":        "",
+	"count_values": ValueTypeString,
+	"bottomk":      ValueTypeScalar,
+	"topk":         ValueTypeScalar,
+	"quantile":     ValueTypeScalar,
+	"limitk":       ValueTypeScalar,
+	"limit_ratio":  ValueTypeScalar,
+}
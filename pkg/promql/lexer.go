@@ -0,0 +1,264 @@
+// Package promql parses, formats and checks PromQL queries locally, without sending them to a tenant.
+// It covers the PromQL grammar needed to explain queries, not the evaluation of them.
+//
+// The parser of github.com/prometheus/prometheus isn't used, as its module brings the dependencies of the whole
+// Prometheus server, TSDB, service discovery and all, into obsctl, and isn't versioned for use as a library. The
+// functions it knows track the upstream ones, see Functions.
+package promql
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type itemType int
+
+const (
+	itemEOF itemType = iota
+	itemIdentifier
+	itemNumber
+	itemDuration
+	itemString
+	itemLeftBrace
+	itemRightBrace
+	itemLeftParen
+	itemRightParen
+	itemLeftBracket
+	itemRightBracket
+	itemComma
+	itemColon
+	itemAt
+	// Label matchers.
+	itemAssign
+	itemNotEqual
+	itemRegexMatch
+	itemRegexNoMatch
+	// Binary operators, besides the and, or, unless and atan2 keywords.
+	itemAdd
+	itemSub
+	itemMul
+	itemDiv
+	itemMod
+	itemPow
+	itemEqual
+	itemLess
+	itemLessEqual
+	itemGreater
+	itemGreaterEqual
+)
+
+// item is a token of a query and its position in it.
+type item struct {
+	typ itemType
+	pos int
+	val string
+}
+
+func (i item) String() string {
+	if i.typ == itemEOF {
+		return "end of input"
+	}
+
+	return fmt.Sprintf("%q", i.val)
+}
+
+// durationUnits are the units of durations, longest first so that ms is not read as m.
+var durationUnits = []string{"ms", "s", "m", "h", "d", "w", "y"}
+
+// lex splits a query into items, ending with an EOF item.
+func lex(input string) ([]item, error) {
+	var items []item
+	pos, brackets := 0, 0
+	for pos < len(input) {
+		r, size := utf8.DecodeRuneInString(input[pos:])
+		start := pos
+
+		switch {
+		case unicode.IsSpace(r):
+			pos += size
+			continue
+		case r == '#':
+			// Comments run until the end of the line.
+			for pos < len(input) && input[pos] != '\n' {
+				pos++
+			}
+			continue
+		case r == '"' || r == '\'' || r == '`':
+			end, err := scanString(input, pos)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item{typ: itemString, pos: start, val: input[start:end]})
+			pos = end
+			continue
+		case isDigit(r) || r == '.' && pos+1 < len(input) && isDigit(rune(input[pos+1])):
+			typ, end := scanNumber(input, pos)
+			items = append(items, item{typ: typ, pos: start, val: input[start:end]})
+			pos = end
+			continue
+		case r == ':' && brackets > 0:
+			// Colons separate the range and step of subqueries, but can otherwise start metric names.
+			items = append(items, item{typ: itemColon, pos: start, val: ":"})
+			pos++
+			continue
+		case isIdentStart(r):
+			for pos < len(input) && isIdentChar(rune(input[pos])) {
+				pos++
+			}
+			items = append(items, item{typ: itemIdentifier, pos: start, val: input[start:pos]})
+			continue
+		}
+
+		typ, n := operator(input[pos:])
+		if n == 0 {
+			return nil, &ParseError{Pos: pos, Err: fmt.Sprintf("unexpected character %q", r)}
+		}
+		switch typ {
+		case itemLeftBracket:
+			brackets++
+		case itemRightBracket:
+			brackets--
+		}
+		items = append(items, item{typ: typ, pos: start, val: input[pos : pos+n]})
+		pos += n
+	}
+
+	return append(items, item{typ: itemEOF, pos: len(input)}), nil
+}
+
+// operator returns the type and length of the punctuation or operator at the start of s, or a length of 0.
+func operator(s string) (itemType, int) {
+	for _, op := range []struct {
+		val string
+		typ itemType
+	}{
+		{"==", itemEqual}, {"!=", itemNotEqual}, {"=~", itemRegexMatch}, {"!~", itemRegexNoMatch},
+		{"<=", itemLessEqual}, {">=", itemGreaterEqual},
+		{"{", itemLeftBrace}, {"}", itemRightBrace}, {"(", itemLeftParen}, {")", itemRightParen},
+		{"[", itemLeftBracket}, {"]", itemRightBracket}, {",", itemComma}, {":", itemColon}, {"@", itemAt},
+		{"=", itemAssign}, {"+", itemAdd}, {"-", itemSub}, {"*", itemMul}, {"/", itemDiv}, {"%", itemMod},
+		{"^", itemPow}, {"<", itemLess}, {">", itemGreater},
+	} {
+		if strings.HasPrefix(s, op.val) {
+			return op.typ, len(op.val)
+		}
+	}
+
+	return 0, 0
+}
+
+// scanString returns the end of the quoted string starting at pos.
+func scanString(input string, pos int) (int, error) {
+	quote := input[pos]
+	for i := pos + 1; i < len(input); i++ {
+		switch {
+		case input[i] == '\\' && quote != '`':
+			i++
+		case input[i] == '\n' && quote != '`':
+			return 0, &ParseError{Pos: pos, Err: "unterminated quoted string"}
+		case input[i] == quote:
+			return i + 1, nil
+		}
+	}
+
+	return 0, &ParseError{Pos: pos, Err: "unterminated quoted string"}
+}
+
+// scanNumber returns the type and end of the number or duration starting at pos.
+func scanNumber(input string, pos int) (itemType, int) {
+	if strings.HasPrefix(input[pos:], "0x") || strings.HasPrefix(input[pos:], "0X") {
+		end := pos + 2
+		for end < len(input) && strings.ContainsRune("0123456789abcdefABCDEF", rune(input[end])) {
+			end++
+		}
+		return itemNumber, end
+	}
+
+	// Durations are integers followed by units, possibly several like 1h30m.
+	end := pos
+	isDuration := false
+	for {
+		digits := end
+		for digits < len(input) && isDigit(rune(input[digits])) {
+			digits++
+		}
+		if digits == end {
+			break
+		}
+
+		unit := ""
+		for _, u := range durationUnits {
+			if strings.HasPrefix(input[digits:], u) && !isLetter(input, digits+len(u)) {
+				unit = u
+				break
+			}
+		}
+		if unit == "" {
+			break
+		}
+		end = digits + len(unit)
+		isDuration = true
+	}
+	if isDuration {
+		return itemDuration, end
+	}
+
+	end = pos
+	for end < len(input) && isDigit(rune(input[end])) {
+		end++
+	}
+	if end < len(input) && input[end] == '.' {
+		end++
+		for end < len(input) && isDigit(rune(input[end])) {
+			end++
+		}
+	}
+	if end < len(input) && (input[end] == 'e' || input[end] == 'E') {
+		exp := end + 1
+		if exp < len(input) && (input[exp] == '+' || input[exp] == '-') {
+			exp++
+		}
+		if exp < len(input) && isDigit(rune(input[exp])) {
+			end = exp
+			for end < len(input) && isDigit(rune(input[end])) {
+				end++
+			}
+		}
+	}
+
+	return itemNumber, end
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// isLetter returns whether the input has a letter or underscore at pos.
+func isLetter(input string, pos int) bool {
+	if pos >= len(input) {
+		return false
+	}
+	r := rune(input[pos])
+
+	return r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || r == ':' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+}
+
+func isIdentChar(r rune) bool {
+	return isIdentStart(r) || isDigit(r)
+}
+
+// ParseError is an error in a query at a byte position.
+type ParseError struct {
+	Pos int
+	Err string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at char %d: %s", e.Pos+1, e.Err)
+}
@@ -0,0 +1,114 @@
+package promql
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Selectors returns the distinct vector and matrix selectors of an expression, in the order they appear.
+func Selectors(e Expr) []string {
+	var selectors []string
+	seen := map[string]bool{}
+	Inspect(e, func(n Expr) bool {
+		switch n.(type) {
+		case *VectorSelector, *MatrixSelector:
+			if s := n.String(); !seen[s] {
+				seen[s] = true
+				selectors = append(selectors, s)
+			}
+			return false
+		}
+		return true
+	})
+
+	return selectors
+}
+
+// counterFunctions are the functions which only make sense over counters.
+var counterFunctions = map[string]bool{"rate": true, "irate": true, "increase": true}
+
+// counterSuffixes are the suffixes of the names of counters and of the counters of histograms and summaries.
+var counterSuffixes = []string{"_total", "_count", "_sum", "_bucket"}
+
+// Lint returns warnings about common mistakes in an expression. If step isn't zero, it's the step of the range
+// query the expression is used in.
+func Lint(e Expr, step time.Duration) []string {
+	var warnings []string
+	Inspect(e, func(n Expr) bool {
+		switch n := n.(type) {
+		case *Call:
+			if n.Func.Unknown {
+				warnings = append(warnings, fmt.Sprintf("%s: %s is unknown to obsctl, so its arguments weren't checked; it may be misspelled or newer than obsctl", n, n.Func.Name))
+			}
+			if w := lintCounterFunction(n); w != "" {
+				warnings = append(warnings, w)
+			}
+			if w := lintHistogramQuantile(n); w != "" {
+				warnings = append(warnings, w)
+			}
+		case *MatrixSelector:
+			if step > 0 && n.Range < 4*step {
+				warnings = append(warnings, fmt.Sprintf("%s: range %s is shorter than 4x the step %s, so samples between steps may be missed", n, formatDuration(n.Range), formatDuration(step)))
+			}
+		case *SubqueryExpr:
+			if step > 0 && n.Range < 4*step {
+				warnings = append(warnings, fmt.Sprintf("%s: subquery range %s is shorter than 4x the step %s", n.suffix(), formatDuration(n.Range), formatDuration(step)))
+			}
+		}
+		return true
+	})
+
+	return warnings
+}
+
+// lintCounterFunction warns about rate and similar functions over metrics which aren't named like counters.
+func lintCounterFunction(c *Call) string {
+	if !counterFunctions[c.Func.Name] {
+		return ""
+	}
+	ms, ok := c.Args[0].(*MatrixSelector)
+	if !ok {
+		return ""
+	}
+
+	name := ms.VectorSelector.MetricName()
+	if name == "" {
+		return ""
+	}
+	for _, suffix := range counterSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return ""
+		}
+	}
+
+	return fmt.Sprintf("%s: %s looks like a gauge, as its name doesn't end with any of %s, but %s is only meant for counters; use deriv or delta for gauges", c, name, strings.Join(counterSuffixes, ", "), c.Func.Name)
+}
+
+// lintHistogramQuantile warns about histogram_quantile over an aggregation which drops the le label.
+func lintHistogramQuantile(c *Call) string {
+	if c.Func.Name != "histogram_quantile" {
+		return ""
+	}
+	a, ok := unwrapParens(c.Args[1]).(*AggregateExpr)
+	if !ok {
+		return ""
+	}
+
+	hasLe := false
+	for _, l := range a.Grouping {
+		if l == "le" {
+			hasLe = true
+		}
+	}
+	switch {
+	case !a.HasGrouping || !a.Without && len(a.Grouping) == 0:
+		return fmt.Sprintf("%s: %s has no by clause, so the le label histogram_quantile needs is aggregated away; use %s by (le)", c, a.Op, a.Op)
+	case a.Without && hasLe:
+		return fmt.Sprintf("%s: %s drops the le label histogram_quantile needs; remove le from the without clause", c, a.Op)
+	case !a.Without && !hasLe:
+		return fmt.Sprintf("%s: %s drops the le label histogram_quantile needs; add le to the by clause", c, a.Op)
+	}
+
+	return ""
+}
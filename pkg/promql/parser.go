@@ -0,0 +1,647 @@
+package promql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// binaryOps are the binary operators by precedence, from the loosest to the tightest binding.
+var binaryOps = map[string]int{
+	"or":     1,
+	"and":    2,
+	"unless": 2,
+	"==":     3,
+	"!=":     3,
+	"<":      3,
+	"<=":     3,
+	">":      3,
+	">=":     3,
+	"+":      4,
+	"-":      4,
+	"*":      5,
+	"/":      5,
+	"%":      5,
+	"atan2":  5,
+	"^":      6,
+}
+
+func isComparison(op string) bool {
+	return binaryOps[op] == 3
+}
+
+func isSetOperator(op string) bool {
+	return op == "and" || op == "or" || op == "unless"
+}
+
+type parser struct {
+	items []item
+	pos   int
+}
+
+// Parse parses a PromQL query into its syntax tree.
+func Parse(input string) (Expr, error) {
+	items, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{items: items}
+	if p.peek().typ == itemEOF {
+		return nil, &ParseError{Pos: 0, Err: "no expression found in input"}
+	}
+
+	e, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if it := p.peek(); it.typ != itemEOF {
+		return nil, p.errorf(it, "unexpected %s", it)
+	}
+
+	return e, nil
+}
+
+func (p *parser) peek() item {
+	return p.items[p.pos]
+}
+
+func (p *parser) next() item {
+	it := p.items[p.pos]
+	if it.typ != itemEOF {
+		p.pos++
+	}
+	return it
+}
+
+func (p *parser) errorf(it item, format string, args ...interface{}) error {
+	return &ParseError{Pos: it.pos, Err: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) expect(typ itemType, context string) (item, error) {
+	it := p.next()
+	if it.typ != typ {
+		return it, p.errorf(it, "unexpected %s in %s", it, context)
+	}
+	return it, nil
+}
+
+// binaryOp returns the binary operator at the current position, if any.
+func (p *parser) binaryOp() (string, bool) {
+	it := p.peek()
+	switch it.typ {
+	case itemAdd, itemSub, itemMul, itemDiv, itemMod, itemPow, itemEqual, itemNotEqual, itemLess, itemLessEqual, itemGreater, itemGreaterEqual:
+		return it.val, true
+	case itemIdentifier:
+		op := strings.ToLower(it.val)
+		if _, ok := binaryOps[op]; ok {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+// parseExpr parses an expression whose binary operators bind tighter than the given precedence.
+func (p *parser) parseExpr(prec int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op, ok := p.binaryOp()
+		if !ok || binaryOps[op] <= prec {
+			return lhs, nil
+		}
+		opItem := p.next()
+
+		b := &BinaryExpr{Op: op, LHS: lhs}
+		if it := p.peek(); it.typ == itemIdentifier && it.val == "bool" {
+			if !isComparison(op) {
+				return nil, p.errorf(it, "bool modifier can only be used on comparison operators")
+			}
+			p.next()
+			b.ReturnBool = true
+		}
+		if b.Matching, err = p.parseVectorMatching(); err != nil {
+			return nil, err
+		}
+
+		// ^ is right-associative, so its right-hand side may contain other ^ operators.
+		rhsPrec := binaryOps[op]
+		if op == "^" {
+			rhsPrec--
+		}
+		if b.RHS, err = p.parseExpr(rhsPrec); err != nil {
+			return nil, err
+		}
+
+		if err := checkBinary(b); err != nil {
+			return nil, p.errorf(opItem, "%s", err)
+		}
+		lhs = b
+	}
+}
+
+// parseVectorMatching parses the optional on, ignoring, group_left and group_right modifiers of a binary operator.
+func (p *parser) parseVectorMatching() (*VectorMatching, error) {
+	it := p.peek()
+	if it.typ != itemIdentifier || it.val != "on" && it.val != "ignoring" {
+		return nil, nil
+	}
+	p.next()
+
+	m := &VectorMatching{On: it.val == "on"}
+	var err error
+	if m.Labels, err = p.parseLabels(); err != nil {
+		return nil, err
+	}
+
+	if it := p.peek(); it.typ == itemIdentifier && (it.val == "group_left" || it.val == "group_right") {
+		p.next()
+		m.Card = it.val
+		if p.peek().typ == itemLeftParen {
+			if m.Include, err = p.parseLabels(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// parseLabels parses a parenthesized list of label names.
+func (p *parser) parseLabels() ([]string, error) {
+	if _, err := p.expect(itemLeftParen, "label list"); err != nil {
+		return nil, err
+	}
+
+	labels := []string{}
+	for {
+		it := p.next()
+		switch {
+		case it.typ == itemRightParen:
+			return labels, nil
+		case it.typ == itemIdentifier:
+			labels = append(labels, it.val)
+		default:
+			return nil, p.errorf(it, "unexpected %s in label list", it)
+		}
+
+		if sep := p.next(); sep.typ == itemRightParen {
+			return labels, nil
+		} else if sep.typ != itemComma {
+			return nil, p.errorf(sep, "unexpected %s in label list", sep)
+		}
+	}
+}
+
+// parseUnary parses an optionally negated expression. Negation binds looser than ^, so -2^2 is -4.
+func (p *parser) parseUnary() (Expr, error) {
+	it := p.peek()
+	if it.typ != itemAdd && it.typ != itemSub {
+		return p.parsePostfix()
+	}
+	p.next()
+
+	e, err := p.parseExpr(binaryOps["^"] - 1)
+	if err != nil {
+		return nil, err
+	}
+	if t := e.Type(); t != ValueTypeScalar && t != ValueTypeVector {
+		return nil, p.errorf(it, "unary expression only allowed on expressions of type scalar or instant vector, got %s", t)
+	}
+
+	return &UnaryExpr{Op: it.val, Expr: e}, nil
+}
+
+// parsePostfix parses an expression followed by any range, subquery, offset and @ modifiers.
+func (p *parser) parsePostfix() (Expr, error) {
+	e, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		it := p.peek()
+		switch {
+		case it.typ == itemLeftBracket:
+			if e, err = p.parseRange(e); err != nil {
+				return nil, err
+			}
+		case it.typ == itemIdentifier && it.val == "offset":
+			p.next()
+			d, err := p.parseDuration(true)
+			if err != nil {
+				return nil, err
+			}
+			if err := setOffset(e, d); err != nil {
+				return nil, p.errorf(it, "%s", err)
+			}
+		case it.typ == itemAt:
+			p.next()
+			at, err := p.parseAt()
+			if err != nil {
+				return nil, err
+			}
+			if err := setAt(e, at); err != nil {
+				return nil, p.errorf(it, "%s", err)
+			}
+		default:
+			return e, nil
+		}
+	}
+}
+
+// parseRange parses the range of a matrix selector or the range and step of a subquery.
+func (p *parser) parseRange(e Expr) (Expr, error) {
+	open := p.next()
+	rng, err := p.parseDuration(false)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().typ == itemRightBracket {
+		p.next()
+		vs, ok := e.(*VectorSelector)
+		if !ok {
+			return nil, p.errorf(open, "ranges only allowed for vector selectors")
+		}
+		if vs.Offset != 0 || vs.At != "" {
+			return nil, p.errorf(open, "no offset or @ modifiers allowed before range")
+		}
+		return &MatrixSelector{VectorSelector: vs, Range: rng}, nil
+	}
+
+	if _, err := p.expect(itemColon, "range"); err != nil {
+		return nil, err
+	}
+	sq := &SubqueryExpr{Expr: e, Range: rng}
+	if p.peek().typ != itemRightBracket {
+		if sq.Step, err = p.parseDuration(false); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.expect(itemRightBracket, "subquery"); err != nil {
+		return nil, err
+	}
+	if t := e.Type(); t != ValueTypeVector {
+		return nil, p.errorf(open, "subquery is only allowed on instant vector, got %s", t)
+	}
+
+	return sq, nil
+}
+
+// parseDuration parses a duration, which can be negated if signed is true.
+func (p *parser) parseDuration(signed bool) (time.Duration, error) {
+	neg := false
+	if it := p.peek(); signed && it.typ == itemSub {
+		p.next()
+		neg = true
+	}
+
+	it := p.next()
+	if it.typ != itemDuration {
+		return 0, p.errorf(it, "unexpected %s, expected duration", it)
+	}
+	d, err := model.ParseDuration(it.val)
+	if err != nil {
+		return 0, p.errorf(it, "invalid duration %q: %s", it.val, err)
+	}
+	if neg {
+		return -time.Duration(d), nil
+	}
+	return time.Duration(d), nil
+}
+
+// parseAt parses the timestamp of an @ modifier, either a Unix timestamp, start() or end().
+func (p *parser) parseAt() (string, error) {
+	it := p.next()
+	switch {
+	case it.typ == itemNumber:
+		return it.val, nil
+	case it.typ == itemIdentifier && (it.val == "start" || it.val == "end"):
+		if _, err := p.expect(itemLeftParen, "@ modifier"); err != nil {
+			return "", err
+		}
+		if _, err := p.expect(itemRightParen, "@ modifier"); err != nil {
+			return "", err
+		}
+		return it.val + "()", nil
+	}
+
+	return "", p.errorf(it, "unexpected %s in @ modifier, expected timestamp, start() or end()", it)
+}
+
+func setOffset(e Expr, d time.Duration) error {
+	switch n := e.(type) {
+	case *VectorSelector:
+		if n.Offset != 0 {
+			return fmt.Errorf("offset may not be set multiple times")
+		}
+		n.Offset = d
+	case *MatrixSelector:
+		return setOffset(n.VectorSelector, d)
+	case *SubqueryExpr:
+		if n.Offset != 0 {
+			return fmt.Errorf("offset may not be set multiple times")
+		}
+		n.Offset = d
+	default:
+		return fmt.Errorf("offset modifier must be preceded by a vector selector, matrix selector or subquery")
+	}
+	return nil
+}
+
+func setAt(e Expr, at string) error {
+	switch n := e.(type) {
+	case *VectorSelector:
+		if n.At != "" {
+			return fmt.Errorf("@ may not be set multiple times")
+		}
+		n.At = at
+	case *MatrixSelector:
+		return setAt(n.VectorSelector, at)
+	case *SubqueryExpr:
+		if n.At != "" {
+			return fmt.Errorf("@ may not be set multiple times")
+		}
+		n.At = at
+	default:
+		return fmt.Errorf("@ modifier must be preceded by a vector selector, matrix selector or subquery")
+	}
+	return nil
+}
+
+// parsePrimary parses a literal, a selector, a function call, an aggregation or a parenthesized expression.
+func (p *parser) parsePrimary() (Expr, error) {
+	it := p.next()
+	switch it.typ {
+	case itemNumber:
+		return &NumberLiteral{Val: it.val}, nil
+	case itemString:
+		return &StringLiteral{Val: it.val}, nil
+	case itemLeftParen:
+		e, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(itemRightParen, "parenthesized expression"); err != nil {
+			return nil, err
+		}
+		return &ParenExpr{Expr: e}, nil
+	case itemLeftBrace:
+		p.pos--
+		return p.parseSelector(item{})
+	case itemIdentifier:
+	default:
+		return nil, p.errorf(it, "unexpected %s", it)
+	}
+
+	name := it.val
+	next := p.peek()
+	if lower := strings.ToLower(name); lower == "inf" || lower == "nan" {
+		return &NumberLiteral{Val: name}, nil
+	}
+	if _, ok := aggregators[name]; ok && (next.typ == itemLeftParen || next.typ == itemIdentifier && (next.val == "by" || next.val == "without")) {
+		return p.parseAggregate(it)
+	}
+	if next.typ == itemLeftParen {
+		f, ok := Functions[name]
+		if !ok {
+			f = unknownFunction(name)
+		}
+		return p.parseCall(it, f)
+	}
+
+	return p.parseSelector(it)
+}
+
+// parseSelector parses a vector selector, starting with its metric name unless name is empty.
+func (p *parser) parseSelector(name item) (Expr, error) {
+	vs := &VectorSelector{Name: name.val}
+	if p.peek().typ == itemLeftBrace {
+		open := p.next()
+		for p.peek().typ != itemRightBrace {
+			label, err := p.expect(itemIdentifier, "label matching")
+			if err != nil {
+				return nil, err
+			}
+			op := p.next()
+			switch op.typ {
+			case itemAssign, itemNotEqual, itemRegexMatch, itemRegexNoMatch:
+			default:
+				return nil, p.errorf(op, "unexpected %s in label matching, expected one of =, !=, =~ or !~", op)
+			}
+			value, err := p.expect(itemString, "label matching")
+			if err != nil {
+				return nil, err
+			}
+			vs.Matchers = append(vs.Matchers, &LabelMatcher{Name: label.val, Op: op.val, Value: value.val})
+
+			if p.peek().typ == itemComma {
+				p.next()
+			} else if it := p.peek(); it.typ != itemRightBrace {
+				return nil, p.errorf(it, "unexpected %s in label matching, expected , or }", it)
+			}
+		}
+		p.next()
+
+		if vs.Name == "" && !hasNonEmptyMatcher(vs.Matchers) {
+			return nil, p.errorf(open, "vector selector must contain at least one non-empty matcher")
+		}
+	}
+
+	return vs, nil
+}
+
+// hasNonEmptyMatcher returns whether any of the matchers doesn't match the empty string, which Prometheus requires
+// of selectors without a metric name so that they don't select every series.
+func hasNonEmptyMatcher(matchers []*LabelMatcher) bool {
+	for _, m := range matchers {
+		v := unquote(m.Value)
+		switch m.Op {
+		case "=":
+			if v != "" {
+				return true
+			}
+		case "!=":
+			if v == "" {
+				return true
+			}
+		case "=~":
+			if v != "" && v != ".*" && v != ".*?" {
+				return true
+			}
+		case "!~":
+			if v == ".*" || v == ".+" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseCall parses the arguments of a function call and checks their types.
+func (p *parser) parseCall(name item, f *Function) (Expr, error) {
+	args, err := p.parseArgs("function call")
+	if err != nil {
+		return nil, err
+	}
+	if f.Unknown {
+		return &Call{Func: f, Args: args}, nil
+	}
+
+	minArgs, maxArgs := len(f.ArgTypes), len(f.ArgTypes)
+	switch {
+	case f.Variadic > 0:
+		minArgs -= f.Variadic
+	case f.Variadic < 0:
+		maxArgs = -1
+	}
+	if len(args) < minArgs || maxArgs >= 0 && len(args) > maxArgs {
+		return nil, p.errorf(name, "expected %s in call to function %q, got %d", argCount(minArgs, maxArgs), f.Name, len(args))
+	}
+
+	for i, a := range args {
+		want := f.ArgTypes[len(f.ArgTypes)-1]
+		if i < len(f.ArgTypes) {
+			want = f.ArgTypes[i]
+		}
+		if got := a.Type(); got != want {
+			return nil, p.errorf(name, "expected type %s in call to function %q, got %s", want, f.Name, got)
+		}
+	}
+
+	return &Call{Func: f, Args: args}, nil
+}
+
+func argCount(minArgs, maxArgs int) string {
+	switch {
+	case maxArgs < 0:
+		return fmt.Sprintf("at least %d argument(s)", minArgs)
+	case minArgs == maxArgs:
+		return fmt.Sprintf("%d argument(s)", minArgs)
+	}
+	return fmt.Sprintf("%d to %d arguments", minArgs, maxArgs)
+}
+
+// parseArgs parses a parenthesized, comma separated list of expressions.
+func (p *parser) parseArgs(context string) ([]Expr, error) {
+	if _, err := p.expect(itemLeftParen, context); err != nil {
+		return nil, err
+	}
+
+	args := []Expr{}
+	if p.peek().typ == itemRightParen {
+		p.next()
+		return args, nil
+	}
+	for {
+		e, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, e)
+
+		it := p.next()
+		switch it.typ {
+		case itemRightParen:
+			return args, nil
+		case itemComma:
+		default:
+			return nil, p.errorf(it, "unexpected %s in %s, expected , or )", it, context)
+		}
+	}
+}
+
+// parseAggregate parses an aggregation, whose by or without clause can come either before or after its arguments.
+func (p *parser) parseAggregate(op item) (Expr, error) {
+	a := &AggregateExpr{Op: op.val}
+	if err := p.parseGrouping(a); err != nil {
+		return nil, err
+	}
+
+	args, err := p.parseArgs("aggregation")
+	if err != nil {
+		return nil, err
+	}
+	if !a.HasGrouping {
+		if err := p.parseGrouping(a); err != nil {
+			return nil, err
+		}
+	}
+
+	paramType := aggregators[op.val]
+	want := 1
+	if paramType != "" {
+		want = 2
+	}
+	if len(args) != want {
+		return nil, p.errorf(op, "wrong number of arguments for aggregate expression provided, expected %d, got %d", want, len(args))
+	}
+	if paramType != "" {
+		a.Param = args[0]
+		if got := a.Param.Type(); got != paramType {
+			return nil, p.errorf(op, "expected type %s in aggregation parameter, got %s", paramType, got)
+		}
+	}
+	a.Expr = args[len(args)-1]
+	if got := a.Expr.Type(); got != ValueTypeVector {
+		return nil, p.errorf(op, "expected type %s in aggregation expression, got %s", ValueTypeVector, got)
+	}
+
+	return a, nil
+}
+
+func (p *parser) parseGrouping(a *AggregateExpr) error {
+	it := p.peek()
+	if it.typ != itemIdentifier || it.val != "by" && it.val != "without" {
+		return nil
+	}
+	p.next()
+
+	labels, err := p.parseLabels()
+	if err != nil {
+		return err
+	}
+	a.Grouping, a.Without, a.HasGrouping = labels, it.val == "without", true
+	return nil
+}
+
+// checkBinary checks the types of the operands of a binary expression.
+func checkBinary(b *BinaryExpr) error {
+	lt, rt := b.LHS.Type(), b.RHS.Type()
+	for _, t := range []ValueType{lt, rt} {
+		if t != ValueTypeScalar && t != ValueTypeVector {
+			return fmt.Errorf("binary expression must contain only scalar and instant vector types, got %s", t)
+		}
+	}
+
+	scalars := lt == ValueTypeScalar && rt == ValueTypeScalar
+	switch {
+	case isComparison(b.Op) && scalars && !b.ReturnBool:
+		return fmt.Errorf("comparisons between scalars must use bool modifier")
+	case isSetOperator(b.Op) && (lt != ValueTypeVector || rt != ValueTypeVector):
+		return fmt.Errorf("set operator %q not allowed in binary scalar expression", b.Op)
+	case b.Matching != nil && (lt != ValueTypeVector || rt != ValueTypeVector):
+		return fmt.Errorf("vector matching only allowed between instant vectors")
+	case b.Matching != nil && b.Matching.Card != "" && isSetOperator(b.Op):
+		return fmt.Errorf("no grouping allowed for %q operation", b.Op)
+	}
+	return nil
+}
+
+// unquote returns the value of a string literal quoted with double quotes, single quotes or backticks.
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '\'' {
+		s = `"` + strings.ReplaceAll(strings.ReplaceAll(s[1:len(s)-1], `\'`, `'`), `"`, `\"`) + `"`
+	}
+	if u, err := strconv.Unquote(s); err == nil {
+		return u
+	}
+	return s
+}
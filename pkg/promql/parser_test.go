@@ -0,0 +1,148 @@
+package promql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		input, want string
+	}{
+		{input: "up", want: "up"},
+		{input: `up{job="api",code=~'5..',}`, want: `up{job="api", code=~'5..'}`},
+		{input: `{__name__="up"}`, want: `{__name__="up"}`},
+		{input: "rate(http_requests_total[5m] offset 1h)", want: "rate(http_requests_total[5m] offset 1h)"},
+		{input: "http_requests_total offset -1h30m @ 1609746000", want: "http_requests_total @ 1609746000 offset -1h30m"},
+		{input: "max_over_time(rate(x_total[1m])[1h:5m])", want: "max_over_time(rate(x_total[1m])[1h:5m])"},
+		{input: "max_over_time(deriv(x[1m])[1h:])", want: "max_over_time(deriv(x[1m])[1h:])"},
+		{input: "sum(rate(x_total[5m])) by (job, pod)", want: "sum by (job, pod) (rate(x_total[5m]))"},
+		{input: "topk without(job)(5, x)", want: "topk without (job) (5, x)"},
+		{input: "a + on(job) group_left(pod) b", want: "a + on (job) group_left (pod) b"},
+		{input: "a > bool 1", want: "a > bool 1"},
+		{input: "a or b and c", want: "a or b and c"},
+		{input: "-2 ^ 2", want: "-2 ^ 2"},
+		{input: "count # comment\n", want: "count"},
+		{input: "time()", want: "time()"},
+		{input: `info(rate(x_total[5m]), target_info{k8s_cluster_name=~".+"})`, want: `info(rate(x_total[5m]), target_info{k8s_cluster_name=~".+"})`},
+		// Functions newer than the parser are parsed without checking their arguments.
+		{input: "future_over_time(x[5m], 1)", want: "future_over_time(x[5m], 1)"},
+	} {
+		t.Run(tc.input, func(t *testing.T) {
+			e, err := Parse(tc.input)
+			testutil.Ok(t, err)
+			testutil.Equals(t, tc.want, e.String())
+		})
+	}
+
+	t.Run("precedence", func(t *testing.T) {
+		e, err := Parse("a or b and c * d ^ e ^ f")
+		testutil.Ok(t, err)
+		or := e.(*BinaryExpr)
+		testutil.Equals(t, "or", or.Op)
+		and := or.RHS.(*BinaryExpr)
+		testutil.Equals(t, "and", and.Op)
+		mul := and.RHS.(*BinaryExpr)
+		testutil.Equals(t, "*", mul.Op)
+		pow := mul.RHS.(*BinaryExpr)
+		testutil.Equals(t, "d", pow.LHS.String())
+		testutil.Equals(t, "e ^ f", pow.RHS.String())
+
+		e, err = Parse("-a ^ b")
+		testutil.Ok(t, err)
+		testutil.Equals(t, "a ^ b", e.(*UnaryExpr).Expr.String())
+	})
+
+	for _, tc := range []struct {
+		input, err string
+	}{
+		{input: "", err: "parse error at char 1: no expression found in input"},
+		{input: "rate(x)", err: `parse error at char 1: expected type range vector in call to function "rate", got instant vector`},
+		{input: "info(x[5m])", err: `parse error at char 1: expected type instant vector in call to function "info", got range vector`},
+		{input: "sum(x", err: "parse error at char 6: unexpected end of input in aggregation, expected , or )"},
+		{input: `x{job="a"`, err: "parse error at char 10: unexpected end of input in label matching, expected , or }"},
+		{input: "{}", err: "parse error at char 1: vector selector must contain at least one non-empty matcher"},
+		{input: "1 > 2", err: "parse error at char 3: comparisons between scalars must use bool modifier"},
+		{input: "x[5m] + 1", err: "parse error at char 7: binary expression must contain only scalar and instant vector types, got range vector"},
+		{input: `up{job="a}`, err: "parse error at char 8: unterminated quoted string"},
+		{input: "x offset 1h[5m]", err: "parse error at char 12: no offset or @ modifiers allowed before range"},
+	} {
+		t.Run(tc.input, func(t *testing.T) {
+			_, err := Parse(tc.input)
+			testutil.NotOk(t, err)
+			testutil.Equals(t, tc.err, err.Error())
+		})
+	}
+}
+
+func TestPretty(t *testing.T) {
+	e, err := Parse(`histogram_quantile(0.99, sum by (le, job) (rate(http_request_duration_seconds_bucket{job="api", handler="/query"}[5m]))) > on (job) group_left 0.5 * max by (job) (slo_latency_target_seconds)`)
+	testutil.Ok(t, err)
+
+	testutil.Equals(t, `histogram_quantile(
+  0.99,
+  sum by (le, job) (rate(http_request_duration_seconds_bucket{job="api", handler="/query"}[5m]))
+)
+> on (job) group_left
+0.5 * max by (job) (slo_latency_target_seconds)`, Pretty(e, 100))
+
+	testutil.Equals(t, e.String(), Pretty(e, 1000))
+
+	// A pretty-printed query parses to the same query.
+	pretty, err := Parse(Pretty(e, 40))
+	testutil.Ok(t, err)
+	testutil.Equals(t, e.String(), pretty.String())
+}
+
+func TestExplain(t *testing.T) {
+	e, err := Parse(`sum by (job) (rate(http_requests_total{code="500"}[5m])) / sum by (job) (rate(http_requests_total[5m])) and up offset 5m`)
+	testutil.Ok(t, err)
+
+	testutil.Equals(t, []string{`http_requests_total{code="500"}[5m]`, "http_requests_total[5m]", "up offset 5m"}, Selectors(e))
+	testutil.Equals(t, `BinaryExpr: and (instant vector)
+  BinaryExpr: / (instant vector)
+    AggregateExpr: sum by (job) (instant vector)
+      Call: rate (instant vector)
+        MatrixSelector: [5m] (range vector)
+          VectorSelector: http_requests_total{code="500"} (instant vector)
+    AggregateExpr: sum by (job) (instant vector)
+      Call: rate (instant vector)
+        MatrixSelector: [5m] (range vector)
+          VectorSelector: http_requests_total (instant vector)
+  VectorSelector: up offset 5m (instant vector)
+`, Tree(e))
+}
+
+func TestLint(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		step     time.Duration
+		warnings []string
+	}{
+		{input: "sum by (job) (rate(http_requests_total[5m]))", step: time.Minute},
+		{input: "rate(node_memory_available_bytes[5m])", warnings: []string{"looks like a gauge"}},
+		{input: `rate({__name__="process_cpu_seconds_total"}[5m])`},
+		{input: "histogram_quantile(0.9, sum by (le) (rate(x_bucket[5m])))"},
+		{input: "histogram_quantile(0.9, rate(x_bucket[5m]))"},
+		{input: "histogram_quantile(0.9, sum(rate(x_bucket[5m])))", warnings: []string{"has no by clause"}},
+		{input: "histogram_quantile(0.9, (sum by (job) (rate(x_bucket[5m]))))", warnings: []string{"add le to the by clause"}},
+		{input: "histogram_quantile(0.9, sum without (le) (rate(x_bucket[5m])))", warnings: []string{"remove le from the without clause"}},
+		{input: "rate(x_total[1m])", step: 30 * time.Second, warnings: []string{"range 1m is shorter than 4x the step 30s"}},
+		{input: "max_over_time(x[5m:1m])", step: 5 * time.Minute, warnings: []string{"subquery range 5m is shorter than 4x the step 5m"}},
+		{input: "rat(x_total[5m])", warnings: []string{"rat is unknown to obsctl"}},
+	} {
+		t.Run(tc.input, func(t *testing.T) {
+			e, err := Parse(tc.input)
+			testutil.Ok(t, err)
+
+			warnings := Lint(e, tc.step)
+			testutil.Equals(t, len(tc.warnings), len(warnings), "%v", warnings)
+			for i, w := range tc.warnings {
+				testutil.Assert(t, strings.Contains(warnings[i], w), "warning %q doesn't contain %q", warnings[i], w)
+			}
+		})
+	}
+}
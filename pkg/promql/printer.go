@@ -0,0 +1,234 @@
+package promql
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func (e *NumberLiteral) String() string { return e.Val }
+func (e *StringLiteral) String() string { return e.Val }
+func (e *ParenExpr) String() string     { return "(" + e.Expr.String() + ")" }
+func (e *UnaryExpr) String() string     { return e.Op + e.Expr.String() }
+
+func (m *LabelMatcher) String() string {
+	return m.Name + m.Op + m.Value
+}
+
+func (e *VectorSelector) String() string {
+	return e.Selector() + modifiers(e.Offset, e.At)
+}
+
+// Selector returns the vector selector without its offset and @ modifiers, as accepted by the series API.
+func (e *VectorSelector) Selector() string {
+	if len(e.Matchers) == 0 {
+		return e.Name
+	}
+
+	matchers := make([]string, 0, len(e.Matchers))
+	for _, m := range e.Matchers {
+		matchers = append(matchers, m.String())
+	}
+	return e.Name + "{" + strings.Join(matchers, ", ") + "}"
+}
+
+func (e *MatrixSelector) String() string {
+	return fmt.Sprintf("%s[%s]%s", e.VectorSelector.Selector(), formatDuration(e.Range), modifiers(e.VectorSelector.Offset, e.VectorSelector.At))
+}
+
+func (e *SubqueryExpr) String() string {
+	return e.Expr.String() + e.suffix()
+}
+
+// suffix returns the range, step and modifiers of a subquery.
+func (e *SubqueryExpr) suffix() string {
+	step := ""
+	if e.Step != 0 {
+		step = formatDuration(e.Step)
+	}
+	return fmt.Sprintf("[%s:%s]%s", formatDuration(e.Range), step, modifiers(e.Offset, e.At))
+}
+
+func (e *Call) String() string {
+	args := make([]string, 0, len(e.Args))
+	for _, a := range e.Args {
+		args = append(args, a.String())
+	}
+	return e.Func.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (e *AggregateExpr) String() string {
+	arg := e.Expr.String()
+	if e.Param != nil {
+		arg = e.Param.String() + ", " + arg
+	}
+	return e.prefix() + "(" + arg + ")"
+}
+
+// prefix returns the operator and grouping of an aggregation.
+func (e *AggregateExpr) prefix() string {
+	if !e.HasGrouping {
+		return e.Op
+	}
+
+	grouping := "by"
+	if e.Without {
+		grouping = "without"
+	}
+	return fmt.Sprintf("%s %s (%s) ", e.Op, grouping, strings.Join(e.Grouping, ", "))
+}
+
+func (e *BinaryExpr) String() string {
+	return e.LHS.String() + " " + e.operator() + " " + e.RHS.String()
+}
+
+// operator returns the operator of a binary expression with its modifiers.
+func (e *BinaryExpr) operator() string {
+	op := e.Op
+	if e.ReturnBool {
+		op += " bool"
+	}
+
+	if m := e.Matching; m != nil {
+		matching := "ignoring"
+		if m.On {
+			matching = "on"
+		}
+		op += fmt.Sprintf(" %s (%s)", matching, strings.Join(m.Labels, ", "))
+
+		if m.Card != "" {
+			op += " " + m.Card
+			if len(m.Include) > 0 {
+				op += fmt.Sprintf(" (%s)", strings.Join(m.Include, ", "))
+			}
+		}
+	}
+
+	return op
+}
+
+func modifiers(offset time.Duration, at string) string {
+	s := ""
+	if at != "" {
+		s += " @ " + at
+	}
+	if offset > 0 {
+		s += " offset " + formatDuration(offset)
+	} else if offset < 0 {
+		s += " offset -" + formatDuration(-offset)
+	}
+	return s
+}
+
+func formatDuration(d time.Duration) string {
+	return model.Duration(d).String()
+}
+
+// indent is the indentation of each level of a pretty-printed query.
+const indent = "  "
+
+// Pretty formats an expression over several lines, breaking up expressions which don't fit within the given width.
+func Pretty(e Expr, width int) string {
+	return pretty(e, 0, width)
+}
+
+func pretty(e Expr, level, width int) string {
+	pad := strings.Repeat(indent, level)
+	if s := e.String(); len(pad)+len(s) <= width {
+		return pad + s
+	}
+
+	switch n := e.(type) {
+	case *ParenExpr:
+		return pad + "(\n" + pretty(n.Expr, level+1, width) + "\n" + pad + ")"
+	case *UnaryExpr:
+		return pad + n.Op + strings.TrimLeft(pretty(n.Expr, level, width), " ")
+	case *SubqueryExpr:
+		return pretty(n.Expr, level, width) + n.suffix()
+	case *Call:
+		return pad + n.Func.Name + "(\n" + prettyList(n.Args, level+1, width) + "\n" + pad + ")"
+	case *AggregateExpr:
+		args := []Expr{n.Expr}
+		if n.Param != nil {
+			args = []Expr{n.Param, n.Expr}
+		}
+		return pad + n.prefix() + "(\n" + prettyList(args, level+1, width) + "\n" + pad + ")"
+	case *BinaryExpr:
+		return pretty(n.LHS, level, width) + "\n" + pad + n.operator() + "\n" + pretty(n.RHS, level, width)
+	}
+
+	// Literals and selectors can't be broken up.
+	return pad + e.String()
+}
+
+func prettyList(exprs []Expr, level, width int) string {
+	lines := make([]string, 0, len(exprs))
+	for _, e := range exprs {
+		lines = append(lines, pretty(e, level, width))
+	}
+	return strings.Join(lines, ",\n")
+}
+
+// Tree formats the syntax tree of an expression, with one node per line indented below its parent, along with
+// the type each node evaluates to.
+func Tree(e Expr) string {
+	var b strings.Builder
+	tree(&b, e, 0)
+	return b.String()
+}
+
+func tree(b *strings.Builder, e Expr, level int) {
+	fmt.Fprintf(b, "%s%s: %s (%s)\n", strings.Repeat(indent, level), nodeName(e), nodeLabel(e), e.Type())
+	for _, c := range Children(e) {
+		tree(b, c, level+1)
+	}
+}
+
+func nodeName(e Expr) string {
+	switch e.(type) {
+	case *NumberLiteral:
+		return "NumberLiteral"
+	case *StringLiteral:
+		return "StringLiteral"
+	case *VectorSelector:
+		return "VectorSelector"
+	case *MatrixSelector:
+		return "MatrixSelector"
+	case *SubqueryExpr:
+		return "SubqueryExpr"
+	case *Call:
+		return "Call"
+	case *AggregateExpr:
+		return "AggregateExpr"
+	case *BinaryExpr:
+		return "BinaryExpr"
+	case *ParenExpr:
+		return "ParenExpr"
+	case *UnaryExpr:
+		return "UnaryExpr"
+	}
+	return fmt.Sprintf("%T", e)
+}
+
+// nodeLabel describes a node of the syntax tree without its children.
+func nodeLabel(e Expr) string {
+	switch n := e.(type) {
+	case *MatrixSelector:
+		return "[" + formatDuration(n.Range) + "]"
+	case *SubqueryExpr:
+		return n.suffix()
+	case *Call:
+		return n.Func.Name
+	case *AggregateExpr:
+		return strings.TrimSpace(n.prefix())
+	case *BinaryExpr:
+		return n.operator()
+	case *ParenExpr:
+		return "()"
+	case *UnaryExpr:
+		return n.Op
+	}
+	return e.String()
+}
@@ -0,0 +1,80 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// fileExporter writes spans to a file as JSON lines, closing the file on shutdown.
+type fileExporter struct {
+	*stdouttrace.Exporter
+	f *os.File
+}
+
+func (e *fileExporter) Shutdown(ctx context.Context) error {
+	err := e.Exporter.Shutdown(ctx)
+	if cerr := e.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// newProcessor returns the span processor exporting spans as set in the options. Spans written to stdout, stderr or
+// a file are written as they end, while spans sent to an OTLP receiver are batched.
+func newProcessor(o Options) (sdktrace.SpanProcessor, error) {
+	switch o.Exporter {
+	case ExporterStdout, ExporterStderr:
+		w := os.Stdout
+		if o.Exporter == ExporterStderr {
+			w = os.Stderr
+		}
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(w))
+		if err != nil {
+			return nil, fmt.Errorf("creating %s exporter: %w", o.Exporter, err)
+		}
+		return sdktrace.NewSimpleSpanProcessor(exp), nil
+	case ExporterFile:
+		if o.File == "" {
+			return nil, fmt.Errorf("the %s exporter needs a file", ExporterFile)
+		}
+		f, err := os.OpenFile(o.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("opening traces file: %w", err)
+		}
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("creating %s exporter: %w", ExporterFile, err)
+		}
+		return sdktrace.NewSimpleSpanProcessor(&fileExporter{Exporter: exp, f: f}), nil
+	case ExporterOTLP:
+		if o.Endpoint == "" {
+			return nil, fmt.Errorf("the %s exporter needs an endpoint", ExporterOTLP)
+		}
+		u, err := url.Parse(o.Endpoint)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid %s endpoint %q, expected an http or https URL", ExporterOTLP, o.Endpoint)
+		}
+		opts := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(u.Host),
+			otlptracehttp.WithURLPath(strings.TrimSuffix(u.Path, "/") + "/v1/traces"),
+		}
+		if u.Scheme == "http" {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exp, err := otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("creating %s exporter: %w", ExporterOTLP, err)
+		}
+		return sdktrace.NewBatchSpanProcessor(exp), nil
+	default:
+		return nil, fmt.Errorf("unknown exporter %q, expected one of %s, %s, %s or %s", o.Exporter, ExporterStdout, ExporterStderr, ExporterFile, ExporterOTLP)
+	}
+}
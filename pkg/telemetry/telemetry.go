@@ -0,0 +1,147 @@
+// Package telemetry traces obsctl itself with OpenTelemetry: the commands it runs, the requests it sends and the
+// steps of authenticating them, so that the time spent by slow commands can be broken down.
+package telemetry
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The exporters spans can be exported with. ExporterStderr is the stdout exporter writing to stderr instead, so that
+// spans don't mix with the output of commands.
+const (
+	ExporterStdout = "stdout"
+	ExporterStderr = "stderr"
+	ExporterFile   = "file"
+	ExporterOTLP   = "otlp"
+)
+
+// instrumentationName is the name of the tracer of obsctl.
+const instrumentationName = "github.com/observatorium/obsctl"
+
+// Options are how spans are exported.
+type Options struct {
+	// Exporter is one of ExporterStdout, ExporterStderr, ExporterFile or ExporterOTLP, or empty to not trace at all.
+	Exporter string
+	// File is the file spans are appended to by the file exporter.
+	File string
+	// Endpoint is the URL of the OTLP/HTTP receiver spans are sent to by the OTLP exporter.
+	Endpoint string
+	// Version is the version of obsctl, recorded in the resource of spans.
+	Version string
+}
+
+var (
+	mtx      sync.Mutex
+	provider *sdktrace.TracerProvider
+)
+
+// Setup makes spans be exported as set in the options, and trace contexts be propagated with W3C traceparent
+// headers. It does nothing if no exporter is set.
+func Setup(o Options) error {
+	if o.Exporter == "" {
+		return nil
+	}
+
+	processor, err := newProcessor(o)
+	if err != nil {
+		return err
+	}
+
+	res := resource.NewSchemaless(attribute.String("service.name", "obsctl"), attribute.String("service.version", o.Version))
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	provider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(processor), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return nil
+}
+
+// Shutdown exports the spans which weren't yet and stops tracing.
+func Shutdown(ctx context.Context) error {
+	mtx.Lock()
+	p := provider
+	provider = nil
+	mtx.Unlock()
+
+	if p == nil {
+		return nil
+	}
+
+	otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	return p.Shutdown(ctx)
+}
+
+// Start starts a span, which is a child of the span of the context if it has one.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// StartCommand starts the span of a command, which lasts until the returned function is called with the error
+// the command returned. Spans started with the returned context are children of it.
+func StartCommand(ctx context.Context, name string) (context.Context, func(error)) {
+	ctx, span := Start(ctx, name)
+	return ctx, func(err error) { End(span, err) }
+}
+
+// End ends a span, recording the error it failed with if there is one.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// transport is a transport which sends requests in client spans, propagating their trace context.
+type transport struct {
+	next http.RoundTripper
+}
+
+// Transport returns a transport sending requests with next in spans, whose trace context is propagated to the
+// server with a traceparent header.
+func Transport(next http.RoundTripper) http.RoundTripper {
+	return &transport{next: next}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := Start(req.Context(), req.Method+" "+req.URL.Path,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", req.URL.String()),
+			attribute.String("net.peer.name", req.URL.Hostname()),
+		),
+	)
+	defer span.End()
+
+	// Transports must not modify requests, so the headers are injected into a copy.
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
+	}
+
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+
+	return resp, nil
+}
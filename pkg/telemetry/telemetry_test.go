@@ -0,0 +1,95 @@
+package telemetry
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/efficientgo/tools/core/pkg/testutil"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTransport(t *testing.T) {
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+
+	file := filepath.Join(t.TempDir(), "traces.json")
+	testutil.Ok(t, Setup(Options{Exporter: ExporterFile, File: file}))
+
+	// Spans get their parent from the context they are started with.
+	ctx, end := StartCommand(context.Background(), "obsctl metrics query")
+	c := &http.Client{Transport: Transport(http.DefaultTransport)}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/metrics/v1/test/api/v1/query?query=up", nil)
+	testutil.Ok(t, err)
+	resp, err := c.Do(req)
+	testutil.Ok(t, err)
+	resp.Body.Close()
+	end(errors.New("failed"))
+	testutil.Ok(t, Shutdown(context.Background()))
+
+	// The request wasn't modified.
+	testutil.Equals(t, "", req.Header.Get("traceparent"))
+
+	f, err := os.Open(file)
+	testutil.Ok(t, err)
+	defer f.Close()
+
+	// The spans as written by the stdouttrace exporter.
+	type jsonSpan struct {
+		Name        string
+		SpanContext struct{ TraceID, SpanID string }
+		Parent      struct{ SpanID string }
+		SpanKind    trace.SpanKind
+		Attributes  []struct {
+			Key   string
+			Value struct{ Value interface{} }
+		}
+		Status struct{ Code string }
+	}
+
+	var spans []jsonSpan
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var span jsonSpan
+		testutil.Ok(t, json.Unmarshal(s.Bytes(), &span))
+		spans = append(spans, span)
+	}
+	testutil.Ok(t, s.Err())
+	testutil.Equals(t, 2, len(spans))
+
+	request, command := spans[0], spans[1]
+	testutil.Equals(t, "GET /api/metrics/v1/test/api/v1/query", request.Name)
+	testutil.Equals(t, trace.SpanKindClient, request.SpanKind)
+	attrs := map[string]interface{}{}
+	for _, kv := range request.Attributes {
+		attrs[kv.Key] = kv.Value.Value
+	}
+	testutil.Equals(t, float64(http.StatusOK), attrs["http.status_code"])
+	testutil.Equals(t, command.SpanContext.SpanID, request.Parent.SpanID)
+	testutil.Equals(t, "Error", command.Status.Code)
+
+	// The trace context of the request is propagated to the server.
+	testutil.Equals(t, "00-"+request.SpanContext.TraceID+"-"+request.SpanContext.SpanID+"-01", traceparent)
+}
+
+func TestExporters(t *testing.T) {
+	for _, exporter := range []string{ExporterStdout, ExporterStderr, ExporterOTLP} {
+		p, err := newProcessor(Options{Exporter: exporter, Endpoint: "http://localhost:4318"})
+		testutil.Ok(t, err)
+		testutil.Ok(t, p.Shutdown(context.Background()))
+	}
+
+	_, err := newProcessor(Options{Exporter: "jaeger"})
+	testutil.NotOk(t, err)
+	_, err = newProcessor(Options{Exporter: ExporterOTLP, Endpoint: "localhost:4318"})
+	testutil.NotOk(t, err)
+}